@@ -3,12 +3,14 @@ package cmd
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/exaring/otelpgx"
 	pgxuuid "github.com/jackc/pgx-gofrs-uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/kroticw/freshman-server/infrastructure/storage"
+	"github.com/kroticw/freshman-server/internal/music"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -33,34 +35,30 @@ type configuration struct {
 		Endpoint  string  `mapstructure:"endpoint"`
 		TraceRate float64 `mapstructure:"traceRate"`
 	} `mapstructure:"openTelemetry"`
-	SourceStorage StorageDriverConfig `json:"sourceStorage" yaml:"sourceStorage" mapstructure:"sourceStorage"`
-}
-
-type StorageDriverConfig struct {
-	Type       string `json:"type" yaml:"type" mapstructure:"type"`
-	FileSystem *struct {
-		BaseDir string `json:"baseDir" yaml:"baseDir" mapstructure:"baseDir"`
-	} `json:"fileSystem" yaml:"fileSystem" mapstructure:"fileSystem"`
-	S3 *struct {
-		Endpoint        string `json:"endpoint" yaml:"endpoint" mapstructure:"endpoint"`
-		Region          string `json:"region" yaml:"region" mapstructure:"region"`
-		AccessKeyID     string `json:"accessKeyId" yaml:"accessKeyId" mapstructure:"accessKeyId"`
-		SecretAccessKey string `json:"secretAccessKey" yaml:"secretAccessKey" mapstructure:"secretAccessKey"`
-		ForcePathStyle  bool   `json:"forcePathStyle" yaml:"forcePathStyle" mapstructure:"forcePathStyle"`
-		Bucket          string `json:"bucket" yaml:"bucket" mapstructure:"bucket"`
-		BasePath        string `json:"basePath" yaml:"basePath" mapstructure:"basePath"`
-	} `json:"s3" yaml:"s3" mapstructure:"s3"`
-	// MaxSize актуален только для кэширующего хранилища (в байтах)
-	MaxSize            *uint64  `json:"maxSize" yaml:"maxSize" mapstructure:"maxSize"`
-	RetentionThreshold *float64 `json:"retentionThreshold" yaml:"retentionThreshold" mapstructure:"retentionThreshold"`
+	// SourceStorage - хранилище файлов. Параметры зависят от type, см. storage.Register
+	SourceStorage storage.DriverConfig `json:"sourceStorage" yaml:"sourceStorage" mapstructure:"sourceStorage"`
+	// StorageGC - сборка файлов sourceStorage, на которые не ссылается ни одна песня
+	StorageGC *struct {
+		// Interval включает периодическую сборку в serve
+		Interval         time.Duration `mapstructure:"interval"`
+		GracePeriod      time.Duration `mapstructure:"gracePeriod"`
+		QuarantinePrefix string        `mapstructure:"quarantinePrefix"`
+		DryRun           bool          `mapstructure:"dryRun"`
+	} `mapstructure:"storageGC"`
+	SongVersions struct {
+		// Retention - сколько прежних версий аудиофайла хранить для каждой песни, 0 - без ограничения
+		Retention int `mapstructure:"retention"`
+	} `mapstructure:"songVersions"`
 }
 
 var (
-	logger           *logrus.Logger
-	cfg              configuration
-	dbConn           *pgxpool.Pool
-	filesystemDriver *storage.FilesystemDriver = nil
-	s3Driver         *storage.S3Driver         = nil
+	logger *logrus.Logger
+	cfg    configuration
+	dbConn *pgxpool.Pool
+	// storageBuilder создает хранилища по конфигурации и помнит все созданные драйверы, включая обернутые
+	storageBuilder *storage.Builder
+	// sourceStorage - хранилище из sourceStorage со всеми обертками
+	sourceStorage music.Storage
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -143,43 +141,27 @@ func initDatabase() {
 }
 
 func initStorageDriver() {
-	switch cfg.SourceStorage.Type {
-	case "filesystem":
-		if cfg.SourceStorage.FileSystem == nil {
-			logger.Fatalln("filesystem driver selected but sourceStorage.fileSystem is not configured")
-		}
-		if cfg.SourceStorage.FileSystem.BaseDir == "" {
-			logger.Fatalln("filesystem driver selected but sourceStorage.fileSystem.baseDir is empty")
-		}
-		filesystemDriver = storage.NewFilesystemDriver(cfg.SourceStorage.FileSystem.BaseDir, logger)
-	case "s3":
-		if cfg.SourceStorage.S3 == nil {
-			logger.Fatalln("s3 driver selected but sourceStorage.s3 is not configured")
-		}
-		if cfg.SourceStorage.S3.Endpoint == "" ||
-			cfg.SourceStorage.S3.Region == "" ||
-			cfg.SourceStorage.S3.AccessKeyID == "" ||
-			cfg.SourceStorage.S3.SecretAccessKey == "" ||
-			cfg.SourceStorage.S3.Bucket == "" {
-			logger.Fatalln("s3 driver selected but required fields are empty " +
-				"(need endpoint, region, accessKeyId, secretAccessKey, bucket)")
-		}
-		s3Driver = storage.NewS3(
-			cfg.SourceStorage.S3.Region,
-			cfg.SourceStorage.S3.Endpoint,
-			cfg.SourceStorage.S3.AccessKeyID,
-			cfg.SourceStorage.S3.SecretAccessKey,
-			cfg.SourceStorage.S3.ForcePathStyle,
-			cfg.SourceStorage.S3.Bucket,
-			cfg.SourceStorage.S3.BasePath,
-			otel.GetTracerProvider().Tracer("S3"),
-			logger,
-		)
-	default:
-		if cfg.SourceStorage.Type == "" {
-			logger.Fatalln("storage driver type is not configured " +
-				"(set sourceStorage.type to filesystem|s3)")
-		}
-		logger.Fatalf("unknown storage driver %s", cfg.SourceStorage.Type)
+	storageBuilder = storage.NewBuilder(logger, otel.GetTracerProvider(), otel.GetMeterProvider())
+	var err error
+	sourceStorage, err = storageBuilder.Build(cfg.SourceStorage)
+	if err != nil {
+		logger.WithError(err).Fatalln("invalid sourceStorage configuration")
 	}
 }
+
+// buildStorage создает хранилище, описанное в блоке конфига key так же, как sourceStorage
+func buildStorage(key string) music.Storage {
+	if !viper.IsSet(key) {
+		logger.Fatalf("config block %s is not found", key)
+	}
+	var config storage.DriverConfig
+	if err := viper.UnmarshalKey(key, &config); err != nil {
+		logger.WithError(err).Fatalf("failed to parse config block %s", key)
+	}
+	driver, err := storageBuilder.Build(config)
+	if err != nil {
+		logger.WithError(err).Fatalf("invalid %s configuration", key)
+	}
+
+	return driver
+}
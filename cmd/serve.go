@@ -2,8 +2,11 @@ package cmd
 
 import (
 	"context"
+	"time"
 
+	"github.com/kroticw/freshman-server/infrastructure/auth"
 	"github.com/kroticw/freshman-server/infrastructure/sql"
+	"github.com/kroticw/freshman-server/infrastructure/storage"
 	"github.com/kroticw/freshman-server/infrastructure/transport/http"
 	"github.com/kroticw/freshman-server/internal/music"
 	"github.com/spf13/cobra"
@@ -27,24 +30,33 @@ func init() {
 }
 
 func runServe(_ *cobra.Command, _ []string) {
-	var driver music.Storage
-	switch cfg.SourceStorage.Type {
-	case "filesystem":
-		if filesystemDriver == nil {
-			logger.Fatalln("filesystem driver selected but driver is not initialized")
+	ctx := context.Background()
+	for _, driver := range storageBuilder.Drivers() {
+		if recoverer, ok := driver.(storage.Recoverer); ok {
+			recovered, err := recoverer.Recover(ctx)
+			if err != nil {
+				logger.WithError(err).Fatalln("failed to recover storage")
+			}
+			if recovered > 0 {
+				logger.Infof("Removed %d partially written files", recovered)
+			}
 		}
-		driver = filesystemDriver
-	case "s3":
-		if s3Driver == nil {
-			logger.Fatalln("s3 driver selected but driver is not initialized")
+		if maintainer, ok := driver.(storage.Maintainer); ok {
+			go maintainer.Maintain(ctx)
 		}
-		driver = s3Driver
-	default:
-		logger.Fatalf("unknown storage driver %s", cfg.SourceStorage.Type)
 	}
 	musicRepo := sql.NewMusicRepo(dbConn)
-	musSvc := music.NewMusicService(driver, musicRepo, logger)
-	router := http.SetupRouter(context.Background(), musSvc, logger)
+	musSvc := music.NewMusicService(sourceStorage, musicRepo, logger)
+	musSvc.SetVersionRetention(cfg.SongVersions.Retention)
+	// Ссылки выдает только само хранилище: через обертку вроде шифрования клиент получил бы не тот файл
+	if presigner, ok := sourceStorage.(music.Presigner); ok {
+		musSvc.SetPresigner(presigner)
+	}
+	if cfg.StorageGC != nil && cfg.StorageGC.Interval > 0 {
+		go runStorageGC(ctx, musSvc)
+	}
+	authSvc := auth.NewAuthService(sql.NewSessionRepo(dbConn), logger)
+	router := http.SetupRouter(ctx, musSvc, authSvc, logger)
 	if cfg.Web.Enable {
 		err := router.Run(cfg.Web.Listen)
 		if err != nil {
@@ -52,3 +64,24 @@ func runServe(_ *cobra.Command, _ []string) {
 		}
 	}
 }
+
+// runStorageGC периодически собирает файлы, на которые не ссылается ни одна песня
+func runStorageGC(ctx context.Context, musSvc *music.Service) {
+	ticker := time.NewTicker(cfg.StorageGC.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		report, err := musSvc.CollectGarbage(ctx, storageGCOptions())
+		if err != nil {
+			logger.WithError(err).Error("failed to collect orphaned storage files")
+			continue
+		}
+		logger.WithField("category", "gc").Infof(
+			"Storage GC: %d of %d files collected, %d bytes reclaimed, %d contents failed (dry run: %v)",
+			len(report.Collected), report.Objects, report.ReclaimedBytes, len(report.Failed), report.DryRun)
+	}
+}
@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// storageCmd объединяет команды обслуживания хранилища файлов
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Обслуживание хранилища файлов",
+	Long:  `Команды для проверки и обслуживания хранилища, выбранного в sourceStorage`,
+}
+
+func init() {
+	rootCmd.AddCommand(storageCmd)
+}
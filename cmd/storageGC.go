@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/kroticw/freshman-server/infrastructure/sql"
+	"github.com/kroticw/freshman-server/internal/music"
+	"github.com/spf13/cobra"
+)
+
+// storageGCCmd represents the storage gc command
+var storageGCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Сборка файлов, на которые не ссылается ни одна песня",
+	Long: `Обходит хранилище и удаляет файлы старше --grace-period, на которые не ссылается
+ни одна песня, вместе со слинкованными с ними. С --quarantine файлы не удаляются, а переносятся
+под ключ "<префикс>/<ключ>". Отчет в JSON со списком собранных файлов и освобожденным местом
+выводится в stdout. --dry-run только составляет отчет.
+
+Значения по умолчанию берутся из storageGC в конфигурации.`,
+	Run: runStorageGCOnce,
+}
+
+var storageGCGracePeriod time.Duration
+var storageGCDryRun bool
+var storageGCQuarantine string
+
+func init() {
+	storageCmd.AddCommand(storageGCCmd)
+	storageGCCmd.Flags().DurationVar(&storageGCGracePeriod,
+		"grace-period", music.DefaultGCGracePeriod, "Не собирать файлы моложе этого срока")
+	storageGCCmd.Flags().BoolVar(&storageGCDryRun,
+		"dry-run", false, "Только вывести отчет, ничего не удаляя")
+	storageGCCmd.Flags().StringVar(&storageGCQuarantine,
+		"quarantine", "", "Переносить файлы под этот префикс вместо удаления")
+}
+
+func runStorageGCOnce(cmd *cobra.Command, _ []string) {
+	opts := storageGCOptions()
+	if cmd.Flags().Changed("grace-period") {
+		opts.GracePeriod = storageGCGracePeriod
+	}
+	if cmd.Flags().Changed("dry-run") {
+		opts.DryRun = storageGCDryRun
+	}
+	if cmd.Flags().Changed("quarantine") {
+		opts.QuarantinePrefix = storageGCQuarantine
+	}
+	musSvc := music.NewMusicService(sourceStorage, sql.NewMusicRepo(dbConn), logger)
+	report, err := musSvc.CollectGarbage(context.Background(), opts)
+	if err != nil {
+		logger.WithError(err).Fatalln("storage garbage collection failed")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		logger.WithError(err).Fatalln("failed to write garbage collection report")
+	}
+}
+
+// storageGCOptions возвращает параметры сборки из конфигурации
+func storageGCOptions() music.GCOptions {
+	opts := music.GCOptions{GracePeriod: music.DefaultGCGracePeriod}
+	if cfg.StorageGC == nil {
+		return opts
+	}
+	if cfg.StorageGC.GracePeriod > 0 {
+		opts.GracePeriod = cfg.StorageGC.GracePeriod
+	}
+	opts.DryRun = cfg.StorageGC.DryRun
+	opts.QuarantinePrefix = cfg.StorageGC.QuarantinePrefix
+
+	return opts
+}
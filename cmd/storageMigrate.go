@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/kroticw/freshman-server/infrastructure/storage"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// storageMigrateCmd represents the storage migrate command
+var storageMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Перенос файлов между хранилищами",
+	Long: `Копирует все файлы, включая слинкованные, из хранилища, описанного в блоке конфига --from,
+в хранилище из блока --to. Блоки устроены так же, как sourceStorage.
+Файлы, которые уже есть в новом хранилище с тем же размером и SHA-256, пропускаются,
+а с другим содержимым - не перезаписываются и попадают в conflicts отчета.
+Перенесенные файлы записываются в --checkpoint, поэтому прерванный перенос продолжается с места остановки.
+
+С --switch-config после переноса без ошибок и конфликтов блок --to становится sourceStorage.
+Конфиг-файл при этом перезаписывается без комментариев, прежний сохраняется рядом с суффиксом .bak.`,
+	Run: runStorageMigrate,
+}
+
+var storageMigrateFrom string
+var storageMigrateTo string
+var storageMigrateConcurrency int
+var storageMigrateCheckpoint string
+var storageMigrateSwitchConfig bool
+
+func init() {
+	storageCmd.AddCommand(storageMigrateCmd)
+	storageMigrateCmd.Flags().StringVar(&storageMigrateFrom,
+		"from", "sourceStorage", "Блок конфига с хранилищем, из которого переносятся файлы")
+	storageMigrateCmd.Flags().StringVar(&storageMigrateTo,
+		"to", "targetStorage", "Блок конфига с хранилищем, в которое переносятся файлы")
+	storageMigrateCmd.Flags().IntVar(&storageMigrateConcurrency,
+		"concurrency", storage.DefaultMigrateConcurrency, "Количество файлов, копируемых параллельно")
+	storageMigrateCmd.Flags().StringVar(&storageMigrateCheckpoint,
+		"checkpoint", "./storage/migrate.checkpoint", "Файл с ключами уже перенесенных файлов")
+	storageMigrateCmd.Flags().BoolVar(&storageMigrateSwitchConfig,
+		"switch-config", false, "После успешного переноса сделать блок --to хранилищем sourceStorage")
+}
+
+func runStorageMigrate(_ *cobra.Command, _ []string) {
+	if storageMigrateFrom == storageMigrateTo {
+		logger.Fatalln("--from and --to must name different config blocks")
+	}
+	source := buildStorage(storageMigrateFrom)
+	destination := buildStorage(storageMigrateTo)
+	report, err := storage.Migrate(context.Background(), source, destination, storage.MigrateOptions{
+		Concurrency:    storageMigrateConcurrency,
+		CheckpointPath: storageMigrateCheckpoint,
+	}, logger)
+	if err != nil {
+		logger.WithError(err).Fatalln("storage migration failed")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		logger.WithError(err).Fatalln("failed to write migration report")
+	}
+	if len(report.Failed) > 0 || len(report.Conflicts) > 0 {
+		logger.Fatalf("migration finished with %d failed and %d conflicting files, run it again after fixing them",
+			len(report.Failed), len(report.Conflicts))
+	}
+	if storageMigrateSwitchConfig {
+		switchSourceStorage(storageMigrateTo)
+	}
+}
+
+// switchSourceStorage записывает блок key в sourceStorage конфиг-файла
+func switchSourceStorage(key string) {
+	configFile := viper.ConfigFileUsed()
+	if configFile == "" {
+		logger.Fatalln("cannot switch config: no config file is used")
+	}
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to read config file")
+	}
+	if err = os.WriteFile(configFile+".bak", content, 0600); err != nil {
+		logger.WithError(err).Fatalln("failed to back up config file")
+	}
+	viper.Set("sourceStorage", viper.Get(key))
+	if err = viper.WriteConfig(); err != nil {
+		logger.WithError(err).Fatalln("failed to write config file")
+	}
+	logger.WithField("filename", configFile).Infof("sourceStorage is switched to %s", key)
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/kroticw/freshman-server/infrastructure/storage"
+	"github.com/spf13/cobra"
+)
+
+// storageRewrapCmd represents the storage rewrap command
+var storageRewrapCmd = &cobra.Command{
+	Use:   "rewrap",
+	Short: "Перешифровка ключей данных текущим мастер-ключом",
+	Long: `Перешифровывает ключом masterKey драйвера encrypted ключи данных файлов,
+зашифрованные ключами из previousKeys. Сами файлы не перезаписываются.
+
+Порядок смены мастер-ключа: перенести текущий ключ в previousKeys, указать новый в masterKey,
+перезапустить сервер и выполнить storage rewrap. Когда команда сообщит, что перешифровывать
+больше нечего, старый ключ можно убрать из previousKeys.`,
+	Run: runStorageRewrap,
+}
+
+func init() {
+	storageCmd.AddCommand(storageRewrapCmd)
+}
+
+func runStorageRewrap(_ *cobra.Command, _ []string) {
+	found := false
+	for _, driver := range storageBuilder.Drivers() {
+		encrypting, ok := driver.(*storage.EncryptingDriver)
+		if !ok {
+			continue
+		}
+		found = true
+		rewrapped, err := encrypting.Rewrap(context.Background())
+		if err != nil {
+			logger.WithError(err).Fatalf("failed to rewrap data keys, %d rewrapped before the error", rewrapped)
+		}
+		logger.Infof("Rewrapped %d data keys", rewrapped)
+	}
+	if !found {
+		logger.Fatalln("sourceStorage has no encrypted driver")
+	}
+}
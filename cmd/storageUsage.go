@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/kroticw/freshman-server/infrastructure/sql"
+	"github.com/kroticw/freshman-server/internal/music"
+	"github.com/spf13/cobra"
+)
+
+// storageUsageCmd represents the storage usage command
+var storageUsageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Занятое место в хранилище по песням",
+	Long: `Выводит в stdout отчет в JSON: занятое место всего, по каждой песне (аудиофайл вместе
+с обложками и волновыми формами), место прошлых версий песен и файлов, на которые никто не ссылается.
+
+Хранилища, которые ведут учет места (s3), отвечают по нему, остальные обходятся целиком.`,
+	Run: runStorageUsage,
+}
+
+func init() {
+	storageCmd.AddCommand(storageUsageCmd)
+}
+
+func runStorageUsage(_ *cobra.Command, _ []string) {
+	musSvc := music.NewMusicService(sourceStorage, sql.NewMusicRepo(dbConn), logger)
+	report, err := musSvc.SpaceUsage(context.Background())
+	if err != nil {
+		logger.WithError(err).Fatalln("failed to calculate storage usage")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		logger.WithError(err).Fatalln("failed to write usage report")
+	}
+}
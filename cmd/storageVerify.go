@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/kroticw/freshman-server/infrastructure/sql"
+	"github.com/kroticw/freshman-server/internal/music"
+	"github.com/spf13/cobra"
+)
+
+const (
+	fixDeleteOrphans   = "delete-orphans"
+	fixMarkUnavailable = "mark-unavailable"
+)
+
+// storageVerifyCmd represents the storage verify command
+var storageVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Сверка песен в БД с файлами в хранилище",
+	Long: `Обходит хранилище и таблицу song и выводит в stdout отчет в JSON:
+песни, у которых нет аудиофайла или он не совпадает по размеру (и по SHA-256 с --checksum),
+и файлы, на которые не ссылается ни одна песня.
+
+--fix delete-orphans удаляет брошенные файлы, --fix mark-unavailable помечает песни
+с поврежденными файлами недоступными. Режимы можно передать вместе.`,
+	Run: runStorageVerify,
+}
+
+var storageVerifyChecksum bool
+var storageVerifyFix []string
+var storageVerifyOrphanMinAge time.Duration
+
+func init() {
+	storageCmd.AddCommand(storageVerifyCmd)
+	storageVerifyCmd.Flags().BoolVar(&storageVerifyChecksum,
+		"checksum", false, "Перечитать файлы и сверить SHA-256 с хешем песни")
+	storageVerifyCmd.Flags().StringSliceVar(&storageVerifyFix,
+		"fix", nil, "Исправить найденное: "+fixDeleteOrphans+", "+fixMarkUnavailable)
+	storageVerifyCmd.Flags().DurationVar(&storageVerifyOrphanMinAge,
+		"orphan-min-age", time.Hour, "Не считать брошенными файлы моложе этого срока")
+}
+
+func runStorageVerify(_ *cobra.Command, _ []string) {
+	for _, fix := range storageVerifyFix {
+		if fix != fixDeleteOrphans && fix != fixMarkUnavailable {
+			logger.Fatalf("unknown fix mode %s (use %s|%s)", fix, fixDeleteOrphans, fixMarkUnavailable)
+		}
+	}
+	musSvc := music.NewMusicService(sourceStorage, sql.NewMusicRepo(dbConn), logger)
+	report, err := musSvc.Verify(context.Background(), music.VerifyOptions{
+		Checksum:        storageVerifyChecksum,
+		OrphanMinAge:    storageVerifyOrphanMinAge,
+		DeleteOrphans:   slices.Contains(storageVerifyFix, fixDeleteOrphans),
+		MarkUnavailable: slices.Contains(storageVerifyFix, fixMarkUnavailable),
+	})
+	if err != nil {
+		logger.WithError(err).Fatalln("storage verification failed")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		logger.WithError(err).Fatalln("failed to write verification report")
+	}
+}
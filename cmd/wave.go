@@ -1,39 +1,17 @@
-/*
-Copyright © 2025 NAME HERE <EMAIL ADDRESS>
-*/
 package cmd
 
 import (
-	"fmt"
-
 	"github.com/spf13/cobra"
 )
 
-// waveCmd represents the wave command
+// waveCmd объединяет команды обслуживания пиков волны песен
 var waveCmd = &cobra.Command{
 	Use:   "wave",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("wave called")
-	},
+	Short: "Пики волны песен для плеера",
+	Long: `Команды для пиков волны, которые строятся по декодированному аудио (WAV, FLAC, MP3)
+и хранятся рядом с аудиофайлом песни`,
 }
 
 func init() {
 	rootCmd.AddCommand(waveCmd)
-
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// waveCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// waveCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/kroticw/freshman-server/infrastructure/sql"
+	"github.com/kroticw/freshman-server/internal/music"
+	"github.com/spf13/cobra"
+)
+
+// waveBackfillCmd represents the wave backfill command
+var waveBackfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "Построение пиков волны для уже загруженных песен",
+	Long: `Обходит таблицу song и строит недостающие пики волны: аудиофайл песни читается
+из хранилища и декодируется. Песни, пики которых уже есть, пропускаются, поэтому команду
+можно перезапускать. Отчет в JSON выводится в stdout.`,
+	Run: runWaveBackfill,
+}
+
+func init() {
+	waveCmd.AddCommand(waveBackfillCmd)
+}
+
+func runWaveBackfill(_ *cobra.Command, _ []string) {
+	musSvc := music.NewMusicService(sourceStorage, sql.NewMusicRepo(dbConn), logger)
+	report, err := musSvc.BackfillWaveforms(context.Background())
+	if err != nil {
+		logger.WithError(err).Fatalln("waveform backfill failed")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		logger.WithError(err).Fatalln("failed to write waveform backfill report")
+	}
+}
@@ -1 +1,45 @@
 package auth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kroticw/freshman-server/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrUnauthorized возвращается, если токен не передан или сессия не найдена либо истекла
+var ErrUnauthorized = errors.New("unauthorized")
+
+// SessionRepo возвращает common.ErrNotFound, если сессии с таким токеном нет или она истекла
+type SessionRepo interface {
+	GetUserIDByToken(ctx context.Context, token string) (int64, error)
+}
+
+type Service struct {
+	repo SessionRepo
+	log  *logrus.Logger
+}
+
+func NewAuthService(repo SessionRepo, log *logrus.Logger) *Service {
+	return &Service{
+		repo,
+		log,
+	}
+}
+
+// Authorize возвращает идентификатор пользователя, которому принадлежит токен сессии
+func (s *Service) Authorize(ctx context.Context, token string) (int64, error) {
+	if token == "" {
+		return 0, ErrUnauthorized
+	}
+	userID, err := s.repo.GetUserIDByToken(ctx, token)
+	if err != nil {
+		if errors.Is(err, common.ErrNotFound) {
+			return 0, ErrUnauthorized
+		}
+		return 0, err
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,2 @@
+DROP INDEX song_hash_idx;
+ALTER TABLE song DROP COLUMN hash;
@@ -0,0 +1,3 @@
+ALTER TABLE song ADD COLUMN hash CHAR(64);
+
+CREATE INDEX song_hash_idx ON song(hash);
@@ -0,0 +1,2 @@
+ALTER TABLE song DROP COLUMN available;
+ALTER TABLE song DROP COLUMN size;
@@ -0,0 +1,2 @@
+ALTER TABLE song ADD COLUMN size BIGINT;
+ALTER TABLE song ADD COLUMN available BOOLEAN NOT NULL DEFAULT TRUE;
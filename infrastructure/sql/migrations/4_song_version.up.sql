@@ -0,0 +1,10 @@
+CREATE TABLE song_version(
+    id BIGSERIAL PRIMARY KEY,
+    song_id BIGINT NOT NULL REFERENCES song(id) ON DELETE CASCADE,
+    hash CHAR(64) NOT NULL,
+    size BIGINT,
+    replaced_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX song_version_song_idx ON song_version(song_id, id);
+CREATE INDEX song_version_hash_idx ON song_version(hash);
@@ -0,0 +1,4 @@
+ALTER TABLE song DROP COLUMN genre;
+ALTER TABLE song DROP COLUMN year;
+ALTER TABLE song DROP COLUMN disc_number;
+ALTER TABLE song DROP COLUMN track_number;
@@ -0,0 +1,4 @@
+ALTER TABLE song ADD COLUMN track_number INTEGER;
+ALTER TABLE song ADD COLUMN disc_number INTEGER;
+ALTER TABLE song ADD COLUMN year INTEGER;
+ALTER TABLE song ADD COLUMN genre VARCHAR(255);
@@ -0,0 +1,11 @@
+ALTER TABLE song_version DROP COLUMN channels;
+ALTER TABLE song_version DROP COLUMN sample_rate;
+ALTER TABLE song_version DROP COLUMN bitrate;
+ALTER TABLE song_version DROP COLUMN duration_ms;
+ALTER TABLE song_version DROP COLUMN codec;
+
+ALTER TABLE song DROP COLUMN channels;
+ALTER TABLE song DROP COLUMN sample_rate;
+ALTER TABLE song DROP COLUMN bitrate;
+ALTER TABLE song DROP COLUMN duration_ms;
+ALTER TABLE song DROP COLUMN codec;
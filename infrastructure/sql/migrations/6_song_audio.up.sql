@@ -0,0 +1,11 @@
+ALTER TABLE song ADD COLUMN codec VARCHAR(32);
+ALTER TABLE song ADD COLUMN duration_ms BIGINT;
+ALTER TABLE song ADD COLUMN bitrate INTEGER;
+ALTER TABLE song ADD COLUMN sample_rate INTEGER;
+ALTER TABLE song ADD COLUMN channels SMALLINT;
+
+ALTER TABLE song_version ADD COLUMN codec VARCHAR(32);
+ALTER TABLE song_version ADD COLUMN duration_ms BIGINT;
+ALTER TABLE song_version ADD COLUMN bitrate INTEGER;
+ALTER TABLE song_version ADD COLUMN sample_rate INTEGER;
+ALTER TABLE song_version ADD COLUMN channels SMALLINT;
@@ -0,0 +1,8 @@
+DROP INDEX song_album_album_idx;
+DROP TABLE song_album;
+DROP INDEX album_name_idx;
+DROP TABLE album;
+DROP INDEX song_artist_artist_idx;
+ALTER TABLE song_artist DROP COLUMN position;
+DROP INDEX artist_name_idx;
+CREATE INDEX artist_name_idx ON artist(name);
@@ -0,0 +1,41 @@
+-- Одноименные исполнители сливаются в исполнителя с меньшим id, чтобы имя стало уникальным
+INSERT INTO song_artist (song_id, artist_id)
+SELECT song_artist.song_id, kept.id
+FROM song_artist
+JOIN artist ON artist.id = song_artist.artist_id
+JOIN (SELECT name, MIN(id) AS id FROM artist GROUP BY name) kept ON kept.name = artist.name
+WHERE artist.id <> kept.id
+ON CONFLICT DO NOTHING;
+
+INSERT INTO playlist_artist (playlist_id, artist_id)
+SELECT playlist_artist.playlist_id, kept.id
+FROM playlist_artist
+JOIN artist ON artist.id = playlist_artist.artist_id
+JOIN (SELECT name, MIN(id) AS id FROM artist GROUP BY name) kept ON kept.name = artist.name
+WHERE artist.id <> kept.id
+ON CONFLICT DO NOTHING;
+
+DELETE FROM artist merged USING artist kept WHERE merged.name = kept.name AND merged.id > kept.id;
+
+DROP INDEX artist_name_idx;
+CREATE UNIQUE INDEX artist_name_idx ON artist(name);
+
+-- position сохраняет порядок исполнителей песни: первым идет основной
+ALTER TABLE song_artist ADD COLUMN position SMALLINT NOT NULL DEFAULT 0;
+CREATE INDEX song_artist_artist_idx ON song_artist(artist_id);
+
+CREATE TABLE album(
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL
+);
+
+CREATE UNIQUE INDEX album_name_idx ON album(name);
+
+CREATE TABLE song_album(
+    song_id INTEGER REFERENCES song(id) ON DELETE CASCADE,
+    album_id INTEGER REFERENCES album(id) ON DELETE CASCADE,
+    position SMALLINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (song_id, album_id)
+);
+
+CREATE INDEX song_album_album_idx ON song_album(album_id);
@@ -0,0 +1,3 @@
+-- Сессия без срока действия оставалась бы рабочей вечно, если токен утечет.
+-- Уже выданные сессии истекают через 30 дней после миграции
+ALTER TABLE session ADD COLUMN expires_at TIMESTAMPTZ NOT NULL DEFAULT now() + INTERVAL '30 days';
@@ -2,8 +2,13 @@ package sql
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kroticw/freshman-server/internal/common"
 	"github.com/kroticw/freshman-server/internal/music"
 )
 
@@ -12,24 +17,635 @@ type MusicRepo struct {
 	tx   *pgxpool.Tx
 }
 
+// songColumns - столбцы song, которые читает scanSong
+const songColumns = "id, name, hash, size, available, track_number, disc_number, year, genre, " + audioColumns
+
 func (r *MusicRepo) GetSongByID(ctx context.Context, id int64) (*music.Song, error) {
-	//TODO implement me
-	panic("implement me")
+	query := "SELECT " + songColumns + " FROM song WHERE id = $1"
+	var row pgx.Row
+	if r.tx != nil {
+		row = r.tx.QueryRow(ctx, query, id)
+	} else {
+		row = r.pool.QueryRow(ctx, query, id)
+	}
+
+	return r.getSong(ctx, row)
 }
 
+// GetSongByName возвращает первую загруженную песню с названием name
 func (r *MusicRepo) GetSongByName(ctx context.Context, name string) (*music.Song, error) {
-	//TODO implement me
-	panic("implement me")
+	query := "SELECT " + songColumns + " FROM song WHERE name = $1 ORDER BY id LIMIT 1"
+	var row pgx.Row
+	if r.tx != nil {
+		row = r.tx.QueryRow(ctx, query, name)
+	} else {
+		row = r.pool.QueryRow(ctx, query, name)
+	}
+
+	return r.getSong(ctx, row)
 }
 
 func (r *MusicRepo) GetSongsByArtist(ctx context.Context, artist string) ([]*music.Song, error) {
-	//TODO implement me
-	panic("implement me")
+	return r.getSongsByLink(ctx, artistLink, artist)
 }
 
 func (r *MusicRepo) GetSongsByAlbum(ctx context.Context, album string) ([]*music.Song, error) {
-	//TODO implement me
-	panic("implement me")
+	return r.getSongsByLink(ctx, albumLink, album)
+}
+
+func (r *MusicRepo) CreateSong(ctx context.Context, song *music.Song) error {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err = lockContent(ctx, tx, song.Hash); err != nil {
+		return err
+	}
+	query := "INSERT INTO song (name, hash, size, track_number, disc_number, year, genre, " + audioColumns + ") " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id"
+	args := append([]any{song.Name, song.Hash, song.Size,
+		nullInt(song.TrackNumber), nullInt(song.DiscNumber), nullInt(song.Year), nullString(song.Genre)},
+		audioArgs(song.Audio)...)
+	var id int64
+	if err = tx.QueryRow(ctx, query, args...).Scan(&id); err != nil {
+		return err
+	}
+	if err = setSongLinks(ctx, tx, id, artistLink, song.Artists); err != nil {
+		return err
+	}
+	if err = setSongLinks(ctx, tx, id, albumLink, song.Albums); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	song.ID = id
+	song.Available = true
+
+	return nil
+}
+
+func (r *MusicRepo) UpdateSong(ctx context.Context, song *music.Song) error {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, "UPDATE song SET name = $1, track_number = $2, disc_number = $3, year = $4, genre = $5 "+
+		"WHERE id = $6", song.Name, nullInt(song.TrackNumber), nullInt(song.DiscNumber), nullInt(song.Year),
+		nullString(song.Genre), song.ID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound
+	}
+	if err = setSongLinks(ctx, tx, song.ID, artistLink, song.Artists); err != nil {
+		return err
+	}
+	if err = setSongLinks(ctx, tx, song.ID, albumLink, song.Albums); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *MusicRepo) DeleteSong(ctx context.Context, id int64) ([]string, error) {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	// Версии удаляются каскадно вместе с песней, поэтому их хеши читаются заранее
+	rows, err := tx.Query(ctx, "SELECT hash FROM song_version WHERE song_id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	var hash *string
+	if err = tx.QueryRow(ctx, "DELETE FROM song WHERE id = $1 RETURNING hash", id).Scan(&hash); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.ErrNotFound
+		}
+		return nil, err
+	}
+	if hash != nil {
+		hashes = append(hashes, *hash)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// InTransaction выполняет fn с репозиторием, запросы которого идут в одной транзакции. Транзакция
+// фиксируется, если fn вернула nil. Репозиторий, уже работающий в транзакции, передается как есть
+func (r *MusicRepo) InTransaction(ctx context.Context, fn func(repo music.Repo) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err = fn(&MusicRepo{pool: r.pool, tx: tx.(*pgxpool.Tx)}); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *MusicRepo) ListSongs(ctx context.Context) ([]*music.Song, error) {
+	var err error
+	var rows pgx.Rows
+	query := "SELECT id, name, hash, size, available FROM song ORDER BY id"
+	if r.tx != nil {
+		rows, err = r.tx.Query(ctx, query)
+	} else {
+		rows, err = r.pool.Query(ctx, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*music.Song, error) {
+		var song music.Song
+		// Песни, загруженные до хранения по хешу, не имеют ни хеша, ни размера
+		var hash *string
+		var size *int64
+		if err := row.Scan(&song.ID, &song.Name, &hash, &size, &song.Available); err != nil {
+			return nil, err
+		}
+		if hash != nil {
+			song.Hash = *hash
+			song.Path = music.ContentKey(*hash)
+		}
+		if size != nil {
+			song.Size = *size
+		}
+		return &song, nil
+	})
+}
+
+func (r *MusicRepo) SetSongAvailable(ctx context.Context, id int64, available bool) error {
+	var err error
+	var tag pgconn.CommandTag
+	query := "UPDATE song SET available = $1 WHERE id = $2"
+	if r.tx != nil {
+		tag, err = r.tx.Exec(ctx, query, available, id)
+	} else {
+		tag, err = r.pool.Exec(ctx, query, available, id)
+	}
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return common.ErrNotFound
+	}
+
+	return nil
+}
+
+func (r *MusicRepo) SongExistsByHash(ctx context.Context, hash string) (bool, error) {
+	var row pgx.Row
+	query := "SELECT EXISTS (SELECT 1 FROM song WHERE hash = $1) OR EXISTS (SELECT 1 FROM song_version WHERE hash = $1)"
+	if r.tx != nil {
+		row = r.tx.QueryRow(ctx, query, hash)
+	} else {
+		row = r.pool.QueryRow(ctx, query, hash)
+	}
+	var exists bool
+	if err := row.Scan(&exists); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func (r *MusicRepo) ReplaceSongContent(ctx context.Context, song *music.Song) error {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err = replaceSongContent(ctx, tx, song.ID, songContent{song.Hash, song.Size, song.Audio}); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *MusicRepo) ListSongVersions(ctx context.Context, songID int64) ([]*music.SongVersion, error) {
+	var err error
+	var rows pgx.Rows
+	query := "SELECT id, song_id, hash, size, replaced_at FROM song_version WHERE song_id = $1 ORDER BY id DESC"
+	if r.tx != nil {
+		rows, err = r.tx.Query(ctx, query, songID)
+	} else {
+		rows, err = r.pool.Query(ctx, query, songID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions, err := pgx.CollectRows(rows, scanSongVersion)
+	if err != nil || len(versions) > 0 {
+		return versions, err
+	}
+
+	// Отличаем песню без версий от отсутствующей песни
+	var row pgx.Row
+	query = "SELECT EXISTS (SELECT 1 FROM song WHERE id = $1)"
+	if r.tx != nil {
+		row = r.tx.QueryRow(ctx, query, songID)
+	} else {
+		row = r.pool.QueryRow(ctx, query, songID)
+	}
+	var exists bool
+	if err = row.Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, common.ErrNotFound
+	}
+
+	return []*music.SongVersion{}, nil
+}
+
+func (r *MusicRepo) ListVersionHashes(ctx context.Context) ([]string, error) {
+	var err error
+	var rows pgx.Rows
+	query := "SELECT DISTINCT hash FROM song_version"
+	if r.tx != nil {
+		rows, err = r.tx.Query(ctx, query)
+	} else {
+		rows, err = r.pool.Query(ctx, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (r *MusicRepo) RestoreSongVersion(ctx context.Context, songID int64, versionID int64) error {
+	tx, err := r.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var content songContent
+	var size *int64
+	var audio nullAudio
+	err = tx.QueryRow(ctx, "DELETE FROM song_version WHERE id = $1 AND song_id = $2 RETURNING hash, size, "+
+		audioColumns, versionID, songID).Scan(append([]any{&content.hash, &size}, audio.targets()...)...)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return common.ErrNotFound
+		}
+		return err
+	}
+	content.size = valueOf(size)
+	content.audio = audio.info()
+	if err = replaceSongContent(ctx, tx, songID, content); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (r *MusicRepo) DeleteSongVersions(ctx context.Context, songID int64, keep int) ([]*music.SongVersion, error) {
+	var err error
+	var rows pgx.Rows
+	query := `DELETE FROM song_version WHERE song_id = $1 AND id NOT IN (
+			SELECT id FROM song_version WHERE song_id = $1 ORDER BY id DESC LIMIT $2
+		) RETURNING id, song_id, hash, size, replaced_at`
+	if r.tx != nil {
+		rows, err = r.tx.Query(ctx, query, songID, keep)
+	} else {
+		rows, err = r.pool.Query(ctx, query, songID, keep)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, scanSongVersion)
+}
+
+func scanSongVersion(row pgx.CollectableRow) (*music.SongVersion, error) {
+	var version music.SongVersion
+	// Размер неизвестен у версий песен, загруженных до его появления
+	var size *int64
+	if err := row.Scan(&version.ID, &version.SongID, &version.Hash, &size, &version.ReplacedAt); err != nil {
+		return nil, err
+	}
+	if size != nil {
+		version.Size = *size
+	}
+
+	return &version, nil
+}
+
+// getSong читает строку songColumns вместе с исполнителями и альбомами песни
+func (r *MusicRepo) getSong(ctx context.Context, row pgx.Row) (*music.Song, error) {
+	song, err := scanSong(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, common.ErrNotFound
+		}
+		return nil, err
+	}
+	if err = r.fillLinks(ctx, []*music.Song{song}); err != nil {
+		return nil, err
+	}
+
+	return song, nil
+}
+
+// getSongsByLink возвращает песни исполнителя или альбома с названием name
+func (r *MusicRepo) getSongsByLink(ctx context.Context, link catalogueLink, name string) ([]*music.Song, error) {
+	var err error
+	var rows pgx.Rows
+	query := "SELECT " + songColumns + " FROM song WHERE id IN (SELECT " + link.join + ".song_id FROM " + link.join +
+		" JOIN " + link.table + " ON " + link.table + ".id = " + link.join + "." + link.column +
+		" WHERE " + link.table + ".name = $1) ORDER BY id"
+	if r.tx != nil {
+		rows, err = r.tx.Query(ctx, query, name)
+	} else {
+		rows, err = r.pool.Query(ctx, query, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	songs, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*music.Song, error) {
+		return scanSong(row)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = r.fillLinks(ctx, songs); err != nil {
+		return nil, err
+	}
+
+	return songs, nil
+}
+
+func scanSong(row pgx.Row) (*music.Song, error) {
+	var song music.Song
+	// Песни, загруженные до хранения по хешу, не имеют ни хеша, ни размера
+	var hash, genre *string
+	var size *int64
+	var track, disc, year *int
+	var audio nullAudio
+	targets := append([]any{&song.ID, &song.Name, &hash, &size, &song.Available, &track, &disc, &year, &genre},
+		audio.targets()...)
+	if err := row.Scan(targets...); err != nil {
+		return nil, err
+	}
+	if hash != nil {
+		song.Hash = *hash
+		song.Path = music.ContentKey(*hash)
+	}
+	song.Size = valueOf(size)
+	song.TrackNumber = valueOf(track)
+	song.DiscNumber = valueOf(disc)
+	song.Year = valueOf(year)
+	song.Genre = valueOf(genre)
+	song.Audio = audio.info()
+
+	return &song, nil
+}
+
+// catalogueLink описывает связь песни с исполнителями или альбомами: справочник table
+// и таблицу связей join, ссылающуюся на него через column
+type catalogueLink struct {
+	table  string
+	join   string
+	column string
+}
+
+var (
+	artistLink = catalogueLink{table: "artist", join: "song_artist", column: "artist_id"}
+	albumLink  = catalogueLink{table: "album", join: "song_album", column: "album_id"}
+)
+
+// setSongLinks заменяет связи песни с исполнителями или альбомами на names, сохраняя их порядок.
+// Отсутствующие в справочнике названия добавляются
+func setSongLinks(ctx context.Context, tx pgx.Tx, songID int64, link catalogueLink, names []string) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM "+link.join+" WHERE song_id = $1", songID); err != nil {
+		return err
+	}
+	for position, name := range names {
+		var id int64
+		// DO UPDATE вместо DO NOTHING, чтобы RETURNING вернул id и существующей записи
+		err := tx.QueryRow(ctx, "INSERT INTO "+link.table+" (name) VALUES ($1) "+
+			"ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name RETURNING id", name).Scan(&id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO "+link.join+" (song_id, "+link.column+", position) "+
+			"VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", songID, id, position)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fillLinks заполняет исполнителей и альбомы песен
+func (r *MusicRepo) fillLinks(ctx context.Context, songs []*music.Song) error {
+	if len(songs) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(songs))
+	for i, song := range songs {
+		ids[i] = song.ID
+	}
+	artists, err := r.songLinks(ctx, artistLink, ids)
+	if err != nil {
+		return err
+	}
+	albums, err := r.songLinks(ctx, albumLink, ids)
+	if err != nil {
+		return err
+	}
+	for _, song := range songs {
+		song.Artists = artists[song.ID]
+		song.Albums = albums[song.ID]
+	}
+
+	return nil
+}
+
+// songLinks возвращает названия исполнителей или альбомов песен ids в порядке добавления
+func (r *MusicRepo) songLinks(ctx context.Context, link catalogueLink, ids []int64) (map[int64][]string, error) {
+	var err error
+	var rows pgx.Rows
+	query := "SELECT " + link.join + ".song_id, " + link.table + ".name FROM " + link.join +
+		" JOIN " + link.table + " ON " + link.table + ".id = " + link.join + "." + link.column +
+		" WHERE " + link.join + ".song_id = ANY($1) ORDER BY " + link.join + ".song_id, " + link.join + ".position"
+	if r.tx != nil {
+		rows, err = r.tx.Query(ctx, query, ids)
+	} else {
+		rows, err = r.pool.Query(ctx, query, ids)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := make(map[int64][]string)
+	for rows.Next() {
+		var songID int64
+		var name string
+		if err = rows.Scan(&songID, &name); err != nil {
+			return nil, err
+		}
+		links[songID] = append(links[songID], name)
+	}
+
+	return links, rows.Err()
+}
+
+// songContent - аудиофайл песни или ее версии
+type songContent struct {
+	hash  string
+	size  int64
+	audio music.AudioInfo
+}
+
+// replaceSongContent сохраняет текущее содержимое песни как версию и записывает в песню новое.
+// Песня блокируется до конца транзакции, чтобы параллельная замена не потеряла версию
+func replaceSongContent(ctx context.Context, tx pgx.Tx, id int64, content songContent) error {
+	if err := lockContent(ctx, tx, content.hash); err != nil {
+		return err
+	}
+	var currentHash *string
+	var currentSize *int64
+	var currentAudio nullAudio
+	err := tx.QueryRow(ctx, "SELECT hash, size, "+audioColumns+" FROM song WHERE id = $1 FOR UPDATE", id).
+		Scan(append([]any{&currentHash, &currentSize}, currentAudio.targets()...)...)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return common.ErrNotFound
+		}
+		return err
+	}
+	// Песни, загруженные до хранения по хешу, не имеют файла, который можно сохранить как версию
+	if currentHash != nil && *currentHash != content.hash {
+		_, err = tx.Exec(ctx, "INSERT INTO song_version (song_id, hash, size, "+audioColumns+") "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			append([]any{id, *currentHash, currentSize}, currentAudio.args()...)...)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(ctx, "UPDATE song SET hash = $1, size = $2, available = TRUE, "+
+		"codec = $3, duration_ms = $4, bitrate = $5, sample_rate = $6, channels = $7 WHERE id = $8",
+		append(append([]any{content.hash, content.size}, audioArgs(content.audio)...), id)...)
+
+	return err
+}
+
+func (r *MusicRepo) LockContent(ctx context.Context, hash string) error {
+	if r.tx == nil {
+		// Вне транзакции блокировка снялась бы сразу после запроса
+		return errors.New("content lock requires a transaction")
+	}
+
+	return lockContent(ctx, r.tx, hash)
+}
+
+// lockContent берет транзакционную рекомендательную блокировку содержимого hash. Она снимается
+// при завершении внешней транзакции, даже если взята в точке сохранения
+func lockContent(ctx context.Context, tx pgx.Tx, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", hash)
+
+	return err
+}
+
+// begin начинает транзакцию. Внутри транзакции репозитория это точка сохранения
+func (r *MusicRepo) begin(ctx context.Context) (pgx.Tx, error) {
+	if r.tx != nil {
+		return r.tx.Begin(ctx)
+	}
+
+	return r.pool.Begin(ctx)
+}
+
+// audioColumns - столбцы music.AudioInfo в таблицах song и song_version
+const audioColumns = "codec, duration_ms, bitrate, sample_rate, channels"
+
+// nullAudio читает столбцы audioColumns, в которых NULL означает неизвестное значение
+type nullAudio struct {
+	codec      *string
+	durationMs *int64
+	bitrate    *int
+	sampleRate *int
+	channels   *int
+}
+
+func (a *nullAudio) targets() []any {
+	return []any{&a.codec, &a.durationMs, &a.bitrate, &a.sampleRate, &a.channels}
+}
+
+// args возвращает прочитанные значения как есть, чтобы перенести их в другую таблицу
+func (a *nullAudio) args() []any {
+	return []any{a.codec, a.durationMs, a.bitrate, a.sampleRate, a.channels}
+}
+
+func (a *nullAudio) info() music.AudioInfo {
+	return music.AudioInfo{
+		Codec:      valueOf(a.codec),
+		Duration:   time.Duration(valueOf(a.durationMs)) * time.Millisecond,
+		Bitrate:    valueOf(a.bitrate),
+		SampleRate: valueOf(a.sampleRate),
+		Channels:   valueOf(a.channels),
+	}
+}
+
+func audioArgs(audio music.AudioInfo) []any {
+	return []any{nullString(audio.Codec), nullInt64(audio.Duration.Milliseconds()), nullInt(audio.Bitrate),
+		nullInt(audio.SampleRate), nullInt(audio.Channels)}
+}
+
+// nullInt сохраняет неизвестное значение 0 как NULL
+func nullInt(n int) *int {
+	if n == 0 {
+		return nil
+	}
+	return &n
+}
+
+func nullInt64(n int64) *int64 {
+	if n == 0 {
+		return nil
+	}
+	return &n
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// valueOf возвращает значение столбца, прочитанного как NULL, или нулевое значение
+func valueOf[T any](value *T) T {
+	if value == nil {
+		var zero T
+		return zero
+	}
+	return *value
 }
 
 func NewMusicRepo(pool *pgxpool.Pool) *MusicRepo {
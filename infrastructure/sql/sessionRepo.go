@@ -0,0 +1,39 @@
+package sql
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kroticw/freshman-server/internal/common"
+)
+
+type SessionRepo struct {
+	pool *pgxpool.Pool
+	tx   *pgxpool.Tx
+}
+
+func NewSessionRepo(pool *pgxpool.Pool) *SessionRepo {
+	return &SessionRepo{pool: pool}
+}
+
+// GetUserIDByToken возвращает common.ErrNotFound и для истекшей сессии
+func (r *SessionRepo) GetUserIDByToken(ctx context.Context, token string) (int64, error) {
+	query := "SELECT user_id FROM session WHERE token = $1 AND expires_at > now()"
+	var row pgx.Row
+	if r.tx != nil {
+		row = r.tx.QueryRow(ctx, query, token)
+	} else {
+		row = r.pool.QueryRow(ctx, query, token)
+	}
+	var userID int64
+	if err := row.Scan(&userID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, common.ErrNotFound
+		}
+		return 0, err
+	}
+
+	return userID, nil
+}
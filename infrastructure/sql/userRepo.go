@@ -6,6 +6,7 @@ import (
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/kroticw/freshman-server/internal/common"
 	"github.com/kroticw/freshman-server/internal/users"
 )
 
@@ -117,5 +118,13 @@ WHERE id = $5
 }
 
 func (r *UserRepo) Delete(ctx context.Context, id int64) error {
+	query := "DELETE FROM users WHERE id = $1"
+	var err error
+	if r.tx != nil {
+		_, err = r.tx.Exec(ctx, query, id)
+	} else {
+		_, err = r.pool.Exec(ctx, query, id)
+	}
 
+	return err
 }
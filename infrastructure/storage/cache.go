@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kroticw/freshman-server/internal/music"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRetentionThreshold используется, если retentionThreshold не задан в конфиге
+const DefaultRetentionThreshold = 0.9
+
+// CachingDriver раздает файлы из origin через локальный кэш на FilesystemDriver.
+// Файл попадает в кэш при первом чтении. Когда кэш занимает больше чем
+// retentionThreshold * maxSize байт, вытесняются файлы, которые дольше всех не читались.
+// Запись идет сразу в origin, кэш при этом не заполняется.
+type CachingDriver struct {
+	origin             music.Storage
+	cache              *FilesystemDriver
+	maxSize            uint64
+	retentionThreshold float64
+	logger             *log.Logger
+
+	mu sync.Mutex
+	// usage - суммарный размер файлов в кэше
+	usage int64
+	// entries и recent индексируются путем файла в кэше. В начале recent самые свежие файлы
+	entries map[string]*list.Element
+	recent  *list.List
+	// fills - файлы, которые сейчас скачиваются из origin
+	fills map[string]chan struct{}
+}
+
+type cacheEntry struct {
+	path string
+	size int64
+}
+
+func NewCachingDriver(
+	origin music.Storage,
+	cache *FilesystemDriver,
+	maxSize uint64,
+	retentionThreshold float64,
+	logger *log.Logger,
+) (*CachingDriver, error) {
+	d := &CachingDriver{
+		origin:             origin,
+		cache:              cache,
+		maxSize:            maxSize,
+		retentionThreshold: retentionThreshold,
+		logger:             logger,
+		entries:            make(map[string]*list.Element),
+		recent:             list.New(),
+		fills:              make(map[string]chan struct{}),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+
+	return d, nil
+}
+
+// CacheConfig - параметры драйвера cache. Кэш должен быть драйвером filesystem
+type CacheConfig struct {
+	Origin DriverConfig `mapstructure:"origin"`
+	Cache  DriverConfig `mapstructure:"cache"`
+	// MaxSize - размер кэша в байтах
+	MaxSize uint64 `mapstructure:"maxSize"`
+	// RetentionThreshold - доля от MaxSize, после которой кэш начинает вытеснять файлы
+	RetentionThreshold float64 `mapstructure:"retentionThreshold"`
+}
+
+func init() {
+	Register("cache", func(b *Builder, config *CacheConfig) (music.Storage, error) {
+		if config.MaxSize == 0 {
+			return nil, errors.New("maxSize is required")
+		}
+		if config.RetentionThreshold == 0 {
+			config.RetentionThreshold = DefaultRetentionThreshold
+		}
+		if config.RetentionThreshold < 0 || config.RetentionThreshold > 1 {
+			return nil, errors.New("retentionThreshold must be in (0, 1]")
+		}
+		origin, err := b.BuildNested("origin", config.Origin)
+		if err != nil {
+			return nil, err
+		}
+		cache, err := b.BuildNested("cache", config.Cache)
+		if err != nil {
+			return nil, err
+		}
+		fsCache, ok := cache.(*FilesystemDriver)
+		if !ok {
+			return nil, fmt.Errorf("cache: must be a filesystem driver, got %s", config.Cache.Type)
+		}
+		return NewCachingDriver(origin, fsCache, config.MaxSize, config.RetentionThreshold, b.Logger)
+	})
+}
+
+// load восстанавливает индекс кэша после перезапуска. Время последнего чтения до
+// перезапуска неизвестно, поэтому порядок вытеснения берется по времени изменения файлов.
+func (d *CachingDriver) load() error {
+	type loaded struct {
+		cacheEntry
+		modTime int64
+	}
+	var files []loaded
+	err := filepath.WalkDir(d.cache.rootDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || isHiddenFileName(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, loaded{cacheEntry{filePath, info.Size()}, info.ModTime().UnixNano()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Сначала добавляем старые файлы, чтобы свежие оказались в начале списка
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime < files[j].modTime
+	})
+	for _, file := range files {
+		d.add(file.path, file.size)
+	}
+	d.logger.WithField("category", "cache").Infof("Loaded %d cached files, %d bytes", len(d.entries), d.usage)
+
+	return nil
+}
+
+func (d *CachingDriver) Exists(ctx context.Context, filename string) (bool, error) {
+	exists, err := d.cache.Exists(ctx, filename)
+	if err != nil || exists {
+		return exists, err
+	}
+
+	return d.origin.Exists(ctx, filename)
+}
+
+func (d *CachingDriver) IsLinkedExists(ctx context.Context, filename string, sourceFilename string) (bool, error) {
+	return d.origin.IsLinkedExists(ctx, filename, sourceFilename)
+}
+
+func (d *CachingDriver) ListLinked(ctx context.Context, sourceFilename string) ([]string, error) {
+	return d.origin.ListLinked(ctx, sourceFilename)
+}
+
+// Walk обходит файлы origin: кэш содержит только их копии
+func (d *CachingDriver) Walk(ctx context.Context, fn func(object music.ObjectInfo) error) error {
+	walker, ok := d.origin.(music.Walker)
+	if !ok {
+		return music.ErrWalkNotSupported
+	}
+
+	return walker.Walk(ctx, fn)
+}
+
+func (d *CachingDriver) Upload(ctx context.Context, filename string, file io.Reader, size int64) error {
+	return d.origin.Upload(ctx, filename, file, size)
+}
+
+func (d *CachingDriver) UploadWithMetadata(
+	ctx context.Context,
+	filename string,
+	file io.Reader,
+	size int64,
+	metadata music.ObjectMetadata,
+) error {
+	return d.origin.UploadWithMetadata(ctx, filename, file, size, metadata)
+}
+
+// Stat отвечает из кэша, если файл там есть, и не обращается к origin
+func (d *CachingDriver) Stat(ctx context.Context, filename string) (*music.ObjectInfo, error) {
+	d.mu.Lock()
+	_, cached := d.entries[getFilePath(filename, d.cache.rootDir)]
+	d.mu.Unlock()
+	if cached {
+		info, err := d.cache.Stat(ctx, filename)
+		if !errors.Is(err, os.ErrNotExist) {
+			return info, err
+		}
+	}
+
+	return d.origin.Stat(ctx, filename)
+}
+
+func (d *CachingDriver) UploadLinked(
+	ctx context.Context,
+	filename string,
+	sourceFilename string,
+	file io.Reader,
+	size int64,
+) error {
+	return d.origin.UploadLinked(ctx, filename, sourceFilename, file, size)
+}
+
+func (d *CachingDriver) Get(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	cached, err := d.fill(ctx, filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cached {
+		body, size, err := d.cache.Get(ctx, filename)
+		// Файл могли вытеснить между заполнением и чтением
+		if !errors.Is(err, os.ErrNotExist) {
+			return body, size, err
+		}
+	}
+
+	return d.origin.Get(ctx, filename)
+}
+
+func (d *CachingDriver) GetRange(
+	ctx context.Context,
+	filename string,
+	offset int64,
+	length int64,
+) (*music.ObjectRange, error) {
+	cached, err := d.fill(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if cached {
+		rng, err := d.cache.GetRange(ctx, filename, offset, length)
+		if !errors.Is(err, os.ErrNotExist) {
+			return rng, err
+		}
+	}
+
+	return d.origin.GetRange(ctx, filename, offset, length)
+}
+
+func (d *CachingDriver) Delete(ctx context.Context, filename string) error {
+	if err := d.origin.Delete(ctx, filename); err != nil {
+		return err
+	}
+
+	filePath := getFilePath(filename, d.cache.rootDir)
+	linkedDir := getLinkedDirPath(filename, d.cache.rootDir)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for entryPath := range d.entries {
+		if entryPath == filePath || strings.HasPrefix(entryPath, linkedDir+string(filepath.Separator)) {
+			d.remove(entryPath)
+		}
+	}
+
+	return nil
+}
+
+func (d *CachingDriver) GetSpaceUsage(_ context.Context) (usage int64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.usage, nil
+}
+
+// fill скачивает файл из origin в кэш, если его там нет, и отмечает чтение.
+// Возвращает false, если файл не помещается в кэш и читать его нужно напрямую из origin.
+func (d *CachingDriver) fill(ctx context.Context, filename string) (cached bool, err error) {
+	filePath := getFilePath(filename, d.cache.rootDir)
+	for {
+		d.mu.Lock()
+		if elem, ok := d.entries[filePath]; ok {
+			d.recent.MoveToFront(elem)
+			d.mu.Unlock()
+			return true, nil
+		}
+		wait, filling := d.fills[filePath]
+		if !filling {
+			done := make(chan struct{})
+			d.fills[filePath] = done
+			d.mu.Unlock()
+			cached, err = d.download(ctx, filename, filePath)
+			d.mu.Lock()
+			delete(d.fills, filePath)
+			close(done)
+			d.mu.Unlock()
+			return cached, err
+		}
+		d.mu.Unlock()
+		// Файл уже скачивается другим запросом, дожидаемся его и проверяем индекс еще раз
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+func (d *CachingDriver) download(ctx context.Context, filename string, filePath string) (bool, error) {
+	info, err := d.origin.Stat(ctx, filename)
+	if err != nil {
+		return false, err
+	}
+	if float64(info.Size) > d.limit() {
+		return false, nil
+	}
+	body, size, err := d.origin.Get(ctx, filename)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+	if err = d.cache.UploadWithMetadata(ctx, filename, body, size, info.ObjectMetadata); err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.add(filePath, size)
+	d.evict()
+
+	return true, nil
+}
+
+func (d *CachingDriver) limit() float64 {
+	return float64(d.maxSize) * d.retentionThreshold
+}
+
+// add и remove вызываются под d.mu
+func (d *CachingDriver) add(filePath string, size int64) {
+	d.entries[filePath] = d.recent.PushFront(&cacheEntry{filePath, size})
+	d.usage += size
+}
+
+func (d *CachingDriver) remove(filePath string) {
+	elem, ok := d.entries[filePath]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*cacheEntry)
+	if err := removeWithMetadata(filePath); err != nil {
+		d.logger.WithError(err).WithField("category", "cache").Errorf("failed to remove cached file %s", filePath)
+		return
+	}
+	d.recent.Remove(elem)
+	delete(d.entries, filePath)
+	d.usage -= entry.size
+}
+
+// evict вытесняет давно не читавшиеся файлы, пока кэш не уложится в лимит. Вызывается под d.mu
+func (d *CachingDriver) evict() {
+	for float64(d.usage) > d.limit() && d.recent.Len() > 0 {
+		oldest := d.recent.Back().Value.(*cacheEntry)
+		d.logger.WithField("category", "cache").Debugf("Evicting %s (%d bytes)", oldest.path, oldest.size)
+		before := d.recent.Len()
+		d.remove(oldest.path)
+		if d.recent.Len() == before {
+			// Файл не удалось удалить, не зацикливаемся на нем
+			return
+		}
+	}
+}
@@ -0,0 +1,715 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/kroticw/freshman-server/internal/music"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// encryptChunkSize - размер открытого текста в одном зашифрованном фрагменте
+	encryptChunkSize = 64 * 1024
+	// gcmOverhead - размер тега аутентификации AES-GCM, добавляемого к каждому фрагменту
+	gcmOverhead = 16
+	// dataKeySuffix отделяет ключ файла от идентификатора мастер-ключа в имени файла с ключом данных
+	dataKeySuffix = ".dek."
+	// staleDataKeyAge - через сколько файл с ключом данных без зашифрованного файла считается
+	// брошенным после сбоя загрузки, а не принадлежащим загрузке, которая идет прямо сейчас
+	staleDataKeyAge = time.Hour
+)
+
+var (
+	// ErrNoDataKey возвращается при чтении файла, для которого нет ключа данных,
+	// например загруженного до включения шифрования
+	ErrNoDataKey = errors.New("no data key for object")
+	// ErrCorrupted возвращается, если зашифрованный файл поврежден или подменен
+	ErrCorrupted = errors.New("encrypted object is corrupted")
+
+	masterKeyIDRegexp = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+	dataKeyRegexp     = regexp.MustCompile(`\.dek\.[A-Za-z0-9_-]+$`)
+)
+
+// MasterKey шифрует ключи данных файлов. Key - 32 байта для AES-256
+type MasterKey struct {
+	ID  string
+	Key []byte
+}
+
+// ParseMasterKey разбирает мастер-ключ, записанный в base64
+func ParseMasterKey(id string, encoded string) (MasterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return MasterKey{}, fmt.Errorf("master key %s is not valid base64: %w", id, err)
+	}
+
+	return MasterKey{ID: id, Key: key}, nil
+}
+
+// EncryptingDriver шифрует файлы перед записью в inner. У каждого файла свой ключ данных,
+// которым содержимое шифруется фрагментами AES-GCM, поэтому чтение диапазона расшифровывает
+// только нужные фрагменты. Ключ данных, зашифрованный мастер-ключом, хранится рядом с файлом
+// в "<файл>.dek.<идентификатор мастер-ключа>". При смене мастер-ключа старый переносится
+// в previous, а Rewrap перешифровывает ключи данных, не трогая сами файлы.
+type EncryptingDriver struct {
+	inner    music.Storage
+	current  MasterKey
+	masters  map[string]cipher.AEAD
+	keyOrder []string
+	logger   *log.Logger
+}
+
+// dataKeyFile - содержимое файла с ключом данных
+type dataKeyFile struct {
+	Version int    `json:"version"`
+	KeyID   string `json:"keyId"`
+	// Key - ключ данных, зашифрованный мастер-ключом: nonce и шифротекст
+	Key       []byte `json:"key"`
+	ChunkSize int64  `json:"chunkSize"`
+	// Size - размер открытого текста
+	Size int64 `json:"size"`
+	// Метаданные файла хранятся здесь, а не в inner: там они описывали бы шифротекст
+	ContentType string            `json:"contentType,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type dataKey struct {
+	aead      cipher.AEAD
+	chunkSize int64
+	size      int64
+	metadata  music.ObjectMetadata
+}
+
+func NewEncryptingDriver(
+	inner music.Storage,
+	current MasterKey,
+	previous []MasterKey,
+	logger *log.Logger,
+) (*EncryptingDriver, error) {
+	d := &EncryptingDriver{
+		inner:   inner,
+		current: current,
+		masters: make(map[string]cipher.AEAD),
+		logger:  logger,
+	}
+	for _, master := range append([]MasterKey{current}, previous...) {
+		if !masterKeyIDRegexp.MatchString(master.ID) {
+			return nil, fmt.Errorf("invalid master key id %q (use letters, digits, - and _)", master.ID)
+		}
+		if _, ok := d.masters[master.ID]; ok {
+			return nil, fmt.Errorf("duplicate master key id %s", master.ID)
+		}
+		if len(master.Key) != 32 {
+			return nil, fmt.Errorf("master key %s must be 32 bytes, got %d", master.ID, len(master.Key))
+		}
+		aead, err := newAEAD(master.Key)
+		if err != nil {
+			return nil, err
+		}
+		d.masters[master.ID] = aead
+		d.keyOrder = append(d.keyOrder, master.ID)
+	}
+
+	return d, nil
+}
+
+// EncryptionConfig - параметры драйвера encrypted
+type EncryptionConfig struct {
+	Inner     DriverConfig    `mapstructure:"inner"`
+	MasterKey MasterKeyConfig `mapstructure:"masterKey"`
+	// PreviousKeys - прежние мастер-ключи. Нужны, пока Rewrap не перешифрует ими ключи данных
+	PreviousKeys []MasterKeyConfig `mapstructure:"previousKeys"`
+}
+
+// MasterKeyConfig - мастер-ключ шифрования: 32 байта в base64 в Key или в файле KeyFile
+type MasterKeyConfig struct {
+	ID      string `mapstructure:"id"`
+	Key     string `mapstructure:"key"`
+	KeyFile string `mapstructure:"keyFile"`
+}
+
+func (c MasterKeyConfig) load() (MasterKey, error) {
+	encoded := c.Key
+	if c.KeyFile != "" {
+		if encoded != "" {
+			return MasterKey{}, fmt.Errorf("master key %s has both key and keyFile configured", c.ID)
+		}
+		content, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return MasterKey{}, fmt.Errorf("failed to read master key %s: %w", c.ID, err)
+		}
+		encoded = string(content)
+	}
+	if encoded == "" {
+		return MasterKey{}, fmt.Errorf("master key %s is not configured (set key or keyFile)", c.ID)
+	}
+
+	return ParseMasterKey(c.ID, encoded)
+}
+
+func init() {
+	Register("encrypted", func(b *Builder, config *EncryptionConfig) (music.Storage, error) {
+		current, err := config.MasterKey.load()
+		if err != nil {
+			return nil, fmt.Errorf("masterKey: %w", err)
+		}
+		previous := make([]MasterKey, 0, len(config.PreviousKeys))
+		for _, keyConfig := range config.PreviousKeys {
+			key, err := keyConfig.load()
+			if err != nil {
+				return nil, fmt.Errorf("previousKeys: %w", err)
+			}
+			previous = append(previous, key)
+		}
+		inner, err := b.BuildNested("inner", config.Inner)
+		if err != nil {
+			return nil, err
+		}
+		return NewEncryptingDriver(inner, current, previous, b.Logger)
+	})
+}
+
+func (d *EncryptingDriver) Exists(ctx context.Context, filename string) (bool, error) {
+	return d.inner.Exists(ctx, filename)
+}
+
+func (d *EncryptingDriver) IsLinkedExists(ctx context.Context, filename string, sourceFilename string) (bool, error) {
+	return d.inner.IsLinkedExists(ctx, filename, sourceFilename)
+}
+
+func (d *EncryptingDriver) Upload(ctx context.Context, filename string, file io.Reader, size int64) error {
+	return d.UploadWithMetadata(ctx, filename, file, size, music.ObjectMetadata{})
+}
+
+// UploadWithMetadata сверяет контрольную сумму открытого текста до того, как inner получит
+// последний фрагмент, поэтому при несовпадении зашифрованный файл не создается
+func (d *EncryptingDriver) UploadWithMetadata(
+	ctx context.Context,
+	filename string,
+	file io.Reader,
+	size int64,
+	metadata music.ObjectMetadata,
+) error {
+	exists, err := d.inner.Exists(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	// Ключ данных записывается первым: без него зашифрованный файл не прочитать
+	metadata.Metadata = lowerKeys(metadata.Metadata)
+	if err = d.putDataKey(ctx, filename, key, size, metadata); err != nil {
+		return err
+	}
+	err = d.inner.Upload(ctx, filename, &encryptReader{
+		src:       file,
+		aead:      aead,
+		chunkSize: encryptChunkSize,
+		remaining: size,
+		checksum:  metadata.Checksum,
+		hasher:    sha256.New(),
+	}, ciphertextSize(size, encryptChunkSize))
+	if err != nil {
+		if !errors.Is(err, os.ErrExist) {
+			if deleteErr := d.inner.Delete(ctx, d.dataKeyName(filename, d.current.ID)); deleteErr != nil {
+				d.logger.WithError(deleteErr).WithField("category", "encryption").
+					Errorf("failed to remove data key of failed upload %s", filename)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (d *EncryptingDriver) UploadLinked(
+	ctx context.Context,
+	filename string,
+	sourceFilename string,
+	file io.Reader,
+	size int64,
+) error {
+	return d.Upload(ctx, getFullFileName(filename, sourceFilename), file, size)
+}
+
+func (d *EncryptingDriver) Get(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	rng, err := d.GetRange(ctx, filename, 0, -1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rng.Body, rng.Size, nil
+}
+
+// Stat берет размер и метаданные из ключа данных, а время изменения и ETag - из inner
+func (d *EncryptingDriver) Stat(ctx context.Context, filename string) (*music.ObjectInfo, error) {
+	key, err := d.getDataKey(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := d.inner.Stat(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = key.size
+	info.ObjectMetadata = key.metadata
+
+	return info, nil
+}
+
+func (d *EncryptingDriver) GetRange(
+	ctx context.Context,
+	filename string,
+	offset int64,
+	length int64,
+) (*music.ObjectRange, error) {
+	key, err := d.getDataKey(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > key.size || (length >= 0 && offset+length > key.size) {
+		return nil, music.ErrInvalidRange
+	}
+	if length < 0 {
+		length = key.size - offset
+	}
+	if length == 0 {
+		rng, err := d.inner.GetRange(ctx, filename, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		rng.Offset, rng.Size = offset, key.size
+		return rng, nil
+	}
+
+	// Читаем фрагменты, в которые попадает диапазон, целиком
+	sealedChunkSize := key.chunkSize + gcmOverhead
+	firstChunk := offset / key.chunkSize
+	lastChunk := (offset + length - 1) / key.chunkSize
+	sealedSize := ciphertextSize(key.size, key.chunkSize)
+	sealedOffset := firstChunk * sealedChunkSize
+	sealedEnd := min((lastChunk+1)*sealedChunkSize, sealedSize)
+	rng, err := d.inner.GetRange(ctx, filename, sealedOffset, sealedEnd-sealedOffset)
+	if err != nil {
+		if errors.Is(err, music.ErrInvalidRange) {
+			// Файл короче, чем записано в ключе данных
+			return nil, ErrCorrupted
+		}
+		return nil, err
+	}
+	if rng.Size != sealedSize {
+		rng.Body.Close()
+		return nil, ErrCorrupted
+	}
+
+	return &music.ObjectRange{
+		Body: &decryptReader{
+			src:       rng.Body,
+			aead:      key.aead,
+			chunkSize: key.chunkSize,
+			index:     uint64(firstChunk),
+			final:     uint64(chunkCount(key.size, key.chunkSize) - 1),
+			lastSize:  sealedSize - (chunkCount(key.size, key.chunkSize)-1)*sealedChunkSize,
+			skip:      offset - firstChunk*key.chunkSize,
+			remaining: length,
+		},
+		Offset:       offset,
+		Length:       length,
+		Size:         key.size,
+		ETag:         rng.ETag,
+		LastModified: rng.LastModified,
+	}, nil
+}
+
+// Delete удаляет файл, слинкованные с ним файлы и ключи данных.
+// Ключи данных слинкованных файлов лежат рядом с ними и удаляются вместе с ними
+func (d *EncryptingDriver) Delete(ctx context.Context, filename string) error {
+	if err := d.inner.Delete(ctx, filename); err != nil {
+		return err
+	}
+	for _, keyID := range d.keyOrder {
+		if err := d.inner.Delete(ctx, d.dataKeyName(filename, keyID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *EncryptingDriver) ListLinked(ctx context.Context, sourceFilename string) ([]string, error) {
+	names, err := d.inner.ListLinked(ctx, sourceFilename)
+	if err != nil {
+		return nil, err
+	}
+	files := names[:0]
+	for _, name := range names {
+		if !isDataKeyName(name) {
+			files = append(files, name)
+		}
+	}
+
+	return files, nil
+}
+
+// Walk обходит зашифрованные файлы, пропуская ключи данных. Size - размер открытого текста
+func (d *EncryptingDriver) Walk(ctx context.Context, fn func(object music.ObjectInfo) error) error {
+	walker, ok := d.inner.(music.Walker)
+	if !ok {
+		return music.ErrWalkNotSupported
+	}
+
+	return walker.Walk(ctx, func(object music.ObjectInfo) error {
+		if isDataKeyName(object.Key) {
+			return nil
+		}
+		object.Size = plaintextSize(object.Size, encryptChunkSize)
+		return fn(object)
+	})
+}
+
+// Rewrap перешифровывает текущим мастер-ключом ключи данных, зашифрованные предыдущими.
+// Возвращает количество перешифрованных ключей. Когда он вернул 0, предыдущие мастер-ключи
+// можно убрать из конфигурации
+func (d *EncryptingDriver) Rewrap(ctx context.Context) (rewrapped int, err error) {
+	walker, ok := d.inner.(music.Walker)
+	if !ok {
+		return 0, music.ErrWalkNotSupported
+	}
+	var stale []string
+	err = walker.Walk(ctx, func(object music.ObjectInfo) error {
+		if !isDataKeyName(object.Key) {
+			return nil
+		}
+		if _, keyID := splitDataKeyName(object.Key); keyID != d.current.ID {
+			stale = append(stale, object.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range stale {
+		filename, keyID := splitDataKeyName(name)
+		if _, ok := d.masters[keyID]; !ok {
+			d.logger.WithField("category", "encryption").
+				Warnf("data key %s is encrypted with unknown master key %s, skipping", name, keyID)
+			continue
+		}
+		file, key, err := d.readDataKey(ctx, filename, keyID)
+		if err != nil {
+			return rewrapped, err
+		}
+		err = d.putDataKey(ctx, filename, key, file.Size, file.objectMetadata())
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return rewrapped, err
+		}
+		// Ключ, зашифрованный текущим мастер-ключом, уже есть, поэтому старый можно удалить
+		if err = d.inner.Delete(ctx, name); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+
+	return rewrapped, nil
+}
+
+func (d *EncryptingDriver) putDataKey(
+	ctx context.Context,
+	filename string,
+	key []byte,
+	size int64,
+	metadata music.ObjectMetadata,
+) error {
+	master := d.masters[d.current.ID]
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// Имя файла в дополнительных данных не дает подложить ключ данных от другого файла
+	wrapped := master.Seal(nonce, nonce, key, []byte(filename))
+	content, err := json.Marshal(dataKeyFile{
+		Version:     1,
+		KeyID:       d.current.ID,
+		Key:         wrapped,
+		ChunkSize:   encryptChunkSize,
+		Size:        size,
+		ContentType: metadata.ContentType,
+		Checksum:    metadata.Checksum,
+		Metadata:    metadata.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+	name := d.dataKeyName(filename, d.current.ID)
+	err = d.inner.Upload(ctx, name, bytes.NewReader(content), int64(len(content)))
+	if !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	// Ключ данных уже есть: либо файл загружается параллельно, либо прошлая загрузка оборвалась
+	existing, err := d.inner.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	exists, err := d.inner.Exists(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if exists || time.Since(existing.ModTime) < staleDataKeyAge {
+		return os.ErrExist
+	}
+	d.logger.WithField("category", "encryption").Warnf("Replacing stale data key %s", name)
+	if err = d.inner.Delete(ctx, name); err != nil {
+		return err
+	}
+
+	return d.inner.Upload(ctx, name, bytes.NewReader(content), int64(len(content)))
+}
+
+// getDataKey ищет ключ данных файла, начиная с текущего мастер-ключа
+func (d *EncryptingDriver) getDataKey(ctx context.Context, filename string) (*dataKey, error) {
+	for _, keyID := range d.keyOrder {
+		file, key, err := d.readDataKey(ctx, filename, keyID)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		return &dataKey{aead: aead, chunkSize: file.ChunkSize, size: file.Size, metadata: file.objectMetadata()}, nil
+	}
+	exists, err := d.inner.Exists(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%w %s", ErrNoDataKey, filename)
+	}
+
+	return nil, os.ErrNotExist
+}
+
+func (d *EncryptingDriver) readDataKey(ctx context.Context, filename string, keyID string) (*dataKeyFile, []byte, error) {
+	body, _, err := d.inner.Get(ctx, d.dataKeyName(filename, keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	var file dataKeyFile
+	if err = json.NewDecoder(body).Decode(&file); err != nil {
+		return nil, nil, fmt.Errorf("invalid data key of %s: %w", filename, err)
+	}
+	if file.Version != 1 || file.KeyID != keyID || file.ChunkSize <= 0 || file.Size < 0 {
+		return nil, nil, fmt.Errorf("invalid data key of %s", filename)
+	}
+	master := d.masters[keyID]
+	if len(file.Key) < master.NonceSize() {
+		return nil, nil, fmt.Errorf("invalid data key of %s", filename)
+	}
+	key, err := master.Open(nil, file.Key[:master.NonceSize()], file.Key[master.NonceSize():], []byte(filename))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt data key of %s with master key %s: %w", filename, keyID, err)
+	}
+
+	return &file, key, nil
+}
+
+func (f *dataKeyFile) objectMetadata() music.ObjectMetadata {
+	return music.ObjectMetadata{ContentType: f.ContentType, Checksum: f.Checksum, Metadata: f.Metadata}
+}
+
+func (d *EncryptingDriver) dataKeyName(filename string, keyID string) string {
+	return filename + dataKeySuffix + keyID
+}
+
+func isDataKeyName(filename string) bool {
+	return dataKeyRegexp.MatchString(filename)
+}
+
+func splitDataKeyName(name string) (filename string, keyID string) {
+	i := strings.LastIndex(name, dataKeySuffix)
+	return name[:i], name[i+len(dataKeySuffix):]
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkCount - количество фрагментов. Пустой файл тоже состоит из одного (пустого) фрагмента,
+// чтобы усечение файла до нуля было заметно
+func chunkCount(size int64, chunkSize int64) int64 {
+	return max(1, (size+chunkSize-1)/chunkSize)
+}
+
+func ciphertextSize(size int64, chunkSize int64) int64 {
+	return size + chunkCount(size, chunkSize)*gcmOverhead
+}
+
+func plaintextSize(sealedSize int64, chunkSize int64) int64 {
+	sealedChunkSize := chunkSize + gcmOverhead
+	size := sealedSize / sealedChunkSize * chunkSize
+	if rest := sealedSize % sealedChunkSize; rest > gcmOverhead {
+		size += rest - gcmOverhead
+	}
+
+	return size
+}
+
+// chunkNonce - номер фрагмента. Ключ данных у каждого файла свой, поэтому nonce не повторяются
+func chunkNonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], index)
+
+	return nonce
+}
+
+// chunkAdditionalData отмечает последний фрагмент, чтобы обрезанный файл не расшифровался как целый
+func chunkAdditionalData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+// encryptReader шифрует ровно remaining байт из src. Если задан checksum, последний фрагмент
+// отдается, только если SHA-256 прочитанного совпал с ним
+type encryptReader struct {
+	src       io.Reader
+	aead      cipher.AEAD
+	chunkSize int64
+	remaining int64
+	checksum  string
+	hasher    hash.Hash
+	index     uint64
+	done      bool
+	plain     []byte
+	sealed    []byte
+	out       []byte
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.plain == nil {
+			r.plain = make([]byte, r.chunkSize)
+			r.sealed = make([]byte, 0, r.chunkSize+int64(r.aead.Overhead()))
+		}
+		plain := r.plain[:min(r.chunkSize, r.remaining)]
+		if _, err := io.ReadFull(r.src, plain); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.remaining -= int64(len(plain))
+		r.done = r.remaining == 0
+		if r.checksum != "" {
+			r.hasher.Write(plain)
+			if r.done && hex.EncodeToString(r.hasher.Sum(nil)) != r.checksum {
+				return 0, music.ErrChecksumMismatch
+			}
+		}
+		r.out = r.aead.Seal(r.sealed[:0], chunkNonce(r.index), plain, chunkAdditionalData(r.done))
+		r.index++
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+
+	return n, nil
+}
+
+// decryptReader расшифровывает фрагменты начиная с index и отдает remaining байт, пропустив первые skip
+type decryptReader struct {
+	src       io.ReadCloser
+	aead      cipher.AEAD
+	chunkSize int64
+	index     uint64
+	// final - номер последнего фрагмента файла, lastSize - его размер в зашифрованном виде
+	final     uint64
+	lastSize  int64
+	skip      int64
+	remaining int64
+	sealed    []byte
+	out       []byte
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		if r.sealed == nil {
+			r.sealed = make([]byte, r.chunkSize+int64(r.aead.Overhead()))
+		}
+		sealed := r.sealed
+		final := r.index == r.final
+		if final {
+			sealed = sealed[:r.lastSize]
+		}
+		if _, err := io.ReadFull(r.src, sealed); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, ErrCorrupted
+			}
+			return 0, err
+		}
+		plain, err := r.aead.Open(sealed[:0], chunkNonce(r.index), sealed, chunkAdditionalData(final))
+		if err != nil {
+			return 0, ErrCorrupted
+		}
+		r.index++
+		plain = plain[r.skip:]
+		r.skip = 0
+		if int64(len(plain)) > r.remaining {
+			plain = plain[:r.remaining]
+		}
+		r.out = plain
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	r.remaining -= int64(n)
+
+	return n, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,485 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kroticw/freshman-server/internal/music"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	// filerChecksumHeader и filerMetadataHeaderPrefix - заголовки, которые filer сохраняет в расширенных
+	// атрибутах файла (все заголовки с префиксом Seaweed-) и возвращает при чтении
+	filerChecksumHeader       = "Seaweed-Sha256"
+	filerMetadataHeaderPrefix = "Seaweed-Meta-"
+	// filerListLimit - количество записей каталога в одном запросе
+	filerListLimit = 1000
+)
+
+// FilerDriver хранит файлы в SeaweedFS через HTTP API filer, минуя S3-шлюз.
+// Файлы раскладываются по каталогам так же, как в FilesystemDriver. Файлам можно задать TTL,
+// по истечении которого filer удаляет их сам, например для кэша или производных файлов.
+type FilerDriver struct {
+	baseURL  *url.URL
+	basePath string
+	// ttl и linkedTTL - TTL исходных и слинкованных файлов в формате filer, пустой - без TTL
+	ttl       string
+	linkedTTL string
+	client    *http.Client
+	logger    *log.Logger
+}
+
+// NewFilerDriver создает драйвер для filer по адресу filerURL, например http://localhost:8888.
+// basePath - каталог filer, в котором хранятся файлы
+func NewFilerDriver(filerURL string, basePath string, logger *log.Logger) (*FilerDriver, error) {
+	baseURL, err := url.Parse(filerURL)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("filer url must be http or https, got %q", filerURL)
+	}
+
+	return &FilerDriver{
+		baseURL:  baseURL,
+		basePath: strings.Trim(basePath, "/"),
+		client:   &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		logger:   logger,
+	}, nil
+}
+
+// SetTTL задает время жизни загружаемых файлов: ttl - исходных, linkedTTL - слинкованных.
+// filer хранит TTL с точностью до минуты, поэтому значения округляются вверх. 0 - без TTL
+func (d *FilerDriver) SetTTL(ttl time.Duration, linkedTTL time.Duration) error {
+	var err error
+	if d.ttl, err = filerTTL(ttl); err != nil {
+		return err
+	}
+	d.linkedTTL, err = filerTTL(linkedTTL)
+
+	return err
+}
+
+// FilerConfig - параметры драйвера filer
+type FilerConfig struct {
+	URL      string `mapstructure:"url"`
+	BasePath string `mapstructure:"basePath"`
+	// TTL - время жизни исходных файлов, LinkedTTL - слинкованных
+	TTL       time.Duration `mapstructure:"ttl"`
+	LinkedTTL time.Duration `mapstructure:"linkedTTL"`
+}
+
+func init() {
+	Register("filer", func(b *Builder, config *FilerConfig) (music.Storage, error) {
+		if config.URL == "" {
+			return nil, errors.New("url is required")
+		}
+		driver, err := NewFilerDriver(config.URL, config.BasePath, b.Logger)
+		if err != nil {
+			return nil, err
+		}
+		if err = driver.SetTTL(config.TTL, config.LinkedTTL); err != nil {
+			return nil, err
+		}
+		return driver, nil
+	})
+}
+
+func (d *FilerDriver) Exists(ctx context.Context, filename string) (bool, error) {
+	_, err := d.Stat(ctx, filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (d *FilerDriver) IsLinkedExists(ctx context.Context, filename string, sourceFilename string) (bool, error) {
+	return d.Exists(ctx, getFullFileName(filename, sourceFilename))
+}
+
+func (d *FilerDriver) Upload(ctx context.Context, filename string, file io.Reader, size int64) error {
+	return d.UploadWithMetadata(ctx, filename, file, size, music.ObjectMetadata{})
+}
+
+// UploadWithMetadata сверяет контрольную сумму по мере отправки и удаляет файл, если она не совпала
+func (d *FilerDriver) UploadWithMetadata(
+	ctx context.Context,
+	filename string,
+	file io.Reader,
+	size int64,
+	metadata music.ObjectMetadata,
+) error {
+	exists, err := d.Exists(ctx, filename)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	filePath := getFilePath(filename, d.basePath)
+	hasher := sha256.New()
+	var body io.Reader = http.NoBody
+	if size > 0 {
+		body = io.TeeReader(file, hasher)
+	}
+	query := url.Values{}
+	ttl := d.ttl
+	if path.Base(filename) != filename {
+		ttl = d.linkedTTL
+	}
+	if ttl != "" {
+		query.Set("ttl", ttl)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, d.url(filePath, query), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if metadata.ContentType != "" {
+		req.Header.Set("Content-Type", metadata.ContentType)
+	}
+	if metadata.Checksum != "" {
+		req.Header.Set(filerChecksumHeader, metadata.Checksum)
+	}
+	for name, value := range lowerKeys(metadata.Metadata) {
+		req.Header.Set(filerMetadataHeaderPrefix+name, value)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		// filer мог сохранить часть файла, если поток оборвался
+		d.cleanup(filePath)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return filerError(resp)
+	}
+	if metadata.Checksum != "" && hex.EncodeToString(hasher.Sum(nil)) != metadata.Checksum {
+		d.cleanup(filePath)
+		return music.ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+func (d *FilerDriver) UploadLinked(
+	ctx context.Context,
+	filename string,
+	sourceFilename string,
+	file io.Reader,
+	size int64,
+) error {
+	return d.Upload(ctx, getFullFileName(filename, sourceFilename), file, size)
+}
+
+func (d *FilerDriver) Get(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	resp, err := d.do(ctx, http.MethodGet, getFilePath(filename, d.basePath), nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, 0, filerError(resp)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (d *FilerDriver) Stat(ctx context.Context, filename string) (*music.ObjectInfo, error) {
+	resp, err := d.do(ctx, http.MethodHead, getFilePath(filename, d.basePath), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, filerError(resp)
+	}
+
+	info := &music.ObjectInfo{
+		Key:  filename,
+		Size: resp.ContentLength,
+		ETag: resp.Header.Get("ETag"),
+		ObjectMetadata: music.ObjectMetadata{
+			ContentType: resp.Header.Get("Content-Type"),
+			Checksum:    resp.Header.Get(filerChecksumHeader),
+		},
+	}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for name, values := range resp.Header {
+		name, ok := strings.CutPrefix(name, filerMetadataHeaderPrefix)
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if info.Metadata == nil {
+			info.Metadata = make(map[string]string)
+		}
+		info.Metadata[strings.ToLower(name)] = values[0]
+	}
+
+	return info, nil
+}
+
+// GetRange сначала узнает размер файла: filer, как и S3, молча обрезает диапазон по концу файла
+func (d *FilerDriver) GetRange(
+	ctx context.Context,
+	filename string,
+	offset int64,
+	length int64,
+) (*music.ObjectRange, error) {
+	info, err := d.Stat(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > info.Size || (length >= 0 && offset+length > info.Size) {
+		return nil, music.ErrInvalidRange
+	}
+	if length < 0 {
+		length = info.Size - offset
+	}
+	rng := &music.ObjectRange{
+		Body:         io.NopCloser(strings.NewReader("")),
+		Offset:       offset,
+		Length:       length,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		LastModified: info.ModTime,
+	}
+	if length == 0 {
+		return rng, nil
+	}
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := d.do(ctx, http.MethodGet, getFilePath(filename, d.basePath), nil, header)
+	if err != nil {
+		return nil, err
+	}
+	whole := resp.StatusCode == http.StatusOK && offset == 0 && length == info.Size
+	if (resp.StatusCode != http.StatusPartialContent && !whole) || resp.ContentLength != length {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// Файл изменился между запросами
+			return nil, music.ErrInvalidRange
+		}
+		if resp.StatusCode >= http.StatusBadRequest {
+			return nil, filerError(resp)
+		}
+		return nil, fmt.Errorf("filer returned %d bytes with status %s for range %s",
+			resp.ContentLength, resp.Status, header.Get("Range"))
+	}
+	rng.Body = resp.Body
+
+	return rng, nil
+}
+
+// Delete удаляет файл и каталог слинкованных с ним файлов целиком
+func (d *FilerDriver) Delete(ctx context.Context, filename string) error {
+	if err := d.remove(ctx, getLinkedDirPath(filename, d.basePath), true); err != nil {
+		return err
+	}
+
+	return d.remove(ctx, getFilePath(filename, d.basePath), false)
+}
+
+func (d *FilerDriver) ListLinked(ctx context.Context, sourceFilename string) ([]string, error) {
+	linkedDir := getLinkedDirPath(sourceFilename, d.basePath)
+	names := make([]string, 0)
+	err := d.walkDir(ctx, linkedDir, func(entry filerEntry) error {
+		names = append(names, strings.TrimPrefix(entry.FullPath, "/"+linkedDir+"/"))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (d *FilerDriver) Walk(ctx context.Context, fn func(object music.ObjectInfo) error) error {
+	prefix := "/"
+	if d.basePath != "" {
+		prefix += d.basePath + "/"
+	}
+
+	return d.walkDir(ctx, d.basePath, func(entry filerEntry) error {
+		name := path.Base(entry.FullPath)
+		if isHiddenFileName(name) {
+			return nil
+		}
+		filename, ok := parseFilePath(strings.TrimPrefix(entry.FullPath, prefix))
+		if !ok {
+			return nil
+		}
+		return fn(music.ObjectInfo{Key: filename, Size: entry.FileSize, ModTime: entry.Mtime})
+	})
+}
+
+// filerEntry - запись в ответе filer на запрос содержимого каталога
+type filerEntry struct {
+	FullPath string      `json:"FullPath"`
+	Mtime    time.Time   `json:"Mtime"`
+	Mode     os.FileMode `json:"Mode"`
+	FileSize int64       `json:"FileSize"`
+}
+
+type filerListing struct {
+	Entries               []filerEntry `json:"Entries"`
+	LastFileName          string       `json:"LastFileName"`
+	ShouldDisplayLoadMore bool         `json:"ShouldDisplayLoadMore"`
+}
+
+// walkDir вызывает fn для каждого файла в каталоге dir и его подкаталогах. Отсутствующий каталог пуст
+func (d *FilerDriver) walkDir(ctx context.Context, dir string, fn func(entry filerEntry) error) error {
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	lastFileName := ""
+	for {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(filerListLimit))
+		if lastFileName != "" {
+			query.Set("lastFileName", lastFileName)
+		}
+		resp, err := d.do(ctx, http.MethodGet, dir+"/", query, header)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return filerError(resp)
+		}
+		var listing filerListing
+		err = json.NewDecoder(resp.Body).Decode(&listing)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("invalid filer listing of %s: %w", dir, err)
+		}
+
+		for _, entry := range listing.Entries {
+			if entry.Mode.IsDir() {
+				err = d.walkDir(ctx, strings.TrimPrefix(entry.FullPath, "/"), fn)
+			} else {
+				err = fn(entry)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if !listing.ShouldDisplayLoadMore || len(listing.Entries) == 0 {
+			return nil
+		}
+		lastFileName = listing.LastFileName
+	}
+}
+
+// remove удаляет файл или, с recursive, каталог. Отсутствие файла не ошибка
+func (d *FilerDriver) remove(ctx context.Context, filePath string, recursive bool) error {
+	query := url.Values{}
+	if recursive {
+		query.Set("recursive", "true")
+	}
+	resp, err := d.do(ctx, http.MethodDelete, filePath, query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return filerError(resp)
+	}
+}
+
+// cleanup удаляет файл неудавшейся загрузки, даже если ее контекст уже отменен
+func (d *FilerDriver) cleanup(filePath string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := d.remove(ctx, filePath, false); err != nil {
+		d.logger.WithError(err).WithField("category", "filer").
+			Errorf("failed to remove %s after failed upload", filePath)
+	}
+}
+
+func (d *FilerDriver) do(
+	ctx context.Context,
+	method string,
+	filePath string,
+	query url.Values,
+	header http.Header,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, d.url(filePath, query), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	return d.client.Do(req)
+}
+
+func (d *FilerDriver) url(filePath string, query url.Values) string {
+	u := *d.baseURL
+	u.Path = path.Join("/", u.Path, filePath)
+	if strings.HasSuffix(filePath, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// filerError превращает ответ с ошибкой в error, 404 - в os.ErrNotExist
+func filerError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return os.ErrNotExist
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	return fmt.Errorf("filer %s %s: %s: %s",
+		resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// filerTTL переводит ttl в формат filer: число до 255 и единица m, h, d или w.
+// Выбирается самая мелкая единица, в которую ttl укладывается, с округлением вверх
+func filerTTL(ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", nil
+	}
+	units := []struct {
+		unit   time.Duration
+		suffix string
+	}{
+		{time.Minute, "m"},
+		{time.Hour, "h"},
+		{24 * time.Hour, "d"},
+		{7 * 24 * time.Hour, "w"},
+	}
+	for _, u := range units {
+		if count := (ttl + u.unit - 1) / u.unit; count <= 255 {
+			return strconv.FormatInt(int64(count), 10) + u.suffix, nil
+		}
+	}
+
+	return "", fmt.Errorf("ttl %s is too long for filer (max 255 weeks)", ttl)
+}
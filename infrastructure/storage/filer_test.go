@@ -0,0 +1,252 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kroticw/freshman-server/infrastructure/storage"
+	"github.com/kroticw/freshman-server/infrastructure/storage/storagetest"
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+// filerStandIn повторяет ту часть HTTP API filer SeaweedFS, которой пользуется FilerDriver:
+// PUT, GET с Range, HEAD, DELETE с recursive, JSON-листинг каталога постранично
+// и сохранение заголовков Seaweed-* и параметра ttl
+type filerStandIn struct {
+	mu    sync.Mutex
+	files map[string]*filerStandInFile
+}
+
+type filerStandInFile struct {
+	data     []byte
+	mime     string
+	mtime    time.Time
+	ttl      string
+	extended http.Header
+}
+
+func newFilerStandIn(t *testing.T) (*filerStandIn, *httptest.Server) {
+	standIn := &filerStandIn{files: make(map[string]*filerStandInFile)}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	return standIn, server
+}
+
+func (f *filerStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := path.Clean(r.URL.Path)
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file := &filerStandInFile{
+			data:     data,
+			mime:     r.Header.Get("Content-Type"),
+			mtime:    time.Now().Truncate(time.Second),
+			ttl:      r.URL.Query().Get("ttl"),
+			extended: http.Header{},
+		}
+		for header, values := range r.Header {
+			if strings.HasPrefix(header, "Seaweed-") {
+				file.extended[header] = values
+			}
+		}
+		f.files[name] = file
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]any{"name": path.Base(name), "size": len(data)})
+	case http.MethodGet, http.MethodHead:
+		if file, ok := f.files[name]; ok {
+			sum := md5.Sum(file.data)
+			w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+			if file.mime != "" {
+				w.Header().Set("Content-Type", file.mime)
+			}
+			for header, values := range file.extended {
+				w.Header()[header] = values
+			}
+			http.ServeContent(w, r, "", file.mtime, bytes.NewReader(file.data))
+			return
+		}
+		if r.Header.Get("Accept") == "application/json" && f.isDir(name) {
+			f.list(w, r, name)
+			return
+		}
+		http.NotFound(w, r)
+	case http.MethodDelete:
+		if _, ok := f.files[name]; ok {
+			delete(f.files, name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !f.isDir(name) {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("recursive") != "true" {
+			http.Error(w, "directory is not empty", http.StatusInternalServerError)
+			return
+		}
+		for fileName := range f.files {
+			if strings.HasPrefix(fileName, name+"/") {
+				delete(f.files, fileName)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// isDir - каталоги filer создает неявно при записи файлов
+func (f *filerStandIn) isDir(name string) bool {
+	if name == "/" {
+		return true
+	}
+	for fileName := range f.files {
+		if strings.HasPrefix(fileName, name+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *filerStandIn) list(w http.ResponseWriter, r *http.Request, dir string) {
+	type entry struct {
+		FullPath string
+		Mtime    time.Time
+		Mode     os.FileMode
+		FileSize int64
+	}
+	children := make(map[string]entry)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for fileName, file := range f.files {
+		rest, ok := strings.CutPrefix(fileName, prefix)
+		if !ok {
+			continue
+		}
+		child, _, isDir := strings.Cut(rest, "/")
+		if isDir {
+			children[child] = entry{FullPath: prefix + child, Mode: os.ModeDir | 0o755}
+		} else {
+			children[child] = entry{FullPath: fileName, Mtime: file.mtime, Mode: 0o644, FileSize: int64(len(file.data))}
+		}
+	}
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lastFileName := r.URL.Query().Get("lastFileName")
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	start := sort.SearchStrings(names, lastFileName)
+	if start < len(names) && names[start] == lastFileName {
+		start++
+	}
+	end := min(start+limit, len(names))
+	entries := make([]entry, 0, end-start)
+	for _, name := range names[start:end] {
+		entries = append(entries, children[name])
+	}
+	listing := map[string]any{
+		"Path":                  dir,
+		"Entries":               entries,
+		"Limit":                 limit,
+		"LastFileName":          "",
+		"ShouldDisplayLoadMore": end < len(names),
+	}
+	if end > start {
+		listing["LastFileName"] = names[end-1]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(listing)
+}
+
+func (f *filerStandIn) file(name string) (*filerStandInFile, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, ok := f.files[name]
+
+	return file, ok
+}
+
+func TestFilerDriver(t *testing.T) {
+	storagetest.RunConformanceTests(t, func(t *testing.T) music.Storage {
+		_, server := newFilerStandIn(t)
+		driver, err := storage.NewFilerDriver(server.URL, "/music/", newTestLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return driver
+	})
+}
+
+func TestFilerDriverTTL(t *testing.T) {
+	standIn, server := newFilerStandIn(t)
+	driver, err := storage.NewFilerDriver(server.URL, "music", newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = driver.SetTTL(0, 90*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = driver.Upload(ctx, "0123456789.audio", strings.NewReader("audio"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err = driver.UploadLinked(ctx, "cover.jpg", "0123456789.audio", strings.NewReader("cover"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	source, ok := standIn.file("/music/01/23/45/0123456789.audio")
+	if !ok {
+		t.Fatal("source file is not stored in its shard directory")
+	}
+	if source.ttl != "" {
+		t.Errorf("source ttl = %q, want none", source.ttl)
+	}
+	linked, ok := standIn.file("/music/01/23/45/0123456789/cover.jpg")
+	if !ok {
+		t.Fatal("linked file is not stored in the source directory")
+	}
+	if linked.ttl != "90m" {
+		t.Errorf("linked ttl = %q, want 90m", linked.ttl)
+	}
+
+	if err = driver.SetTTL(400*24*time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = driver.Upload(ctx, "abcdef.audio", strings.NewReader("audio"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if file, _ := standIn.file("/music/ab/cd/ef/abcdef.audio"); file == nil || file.ttl != "58w" {
+		t.Errorf("ttl of 400 days is not rounded up to weeks: %+v", file)
+	}
+	if err = driver.SetTTL(256*7*24*time.Hour, 0); err == nil {
+		t.Error("SetTTL accepted ttl longer than 255 weeks")
+	}
+}
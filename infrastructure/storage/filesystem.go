@@ -1,18 +1,27 @@
 package storage
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
 
+	"github.com/kroticw/freshman-server/internal/music"
 	log "github.com/sirupsen/logrus"
 )
 
+// tempFileMarker отличает временные файлы незавершенных загрузок. Имена временных файлов
+// начинаются с точки: скрытые файлы - служебные, ключи файлов с точки не начинаются
+const tempFileMarker = ".tmp-"
+
 // FilesystemDriver реализует Driver в виде файлов в операционной системе
 type FilesystemDriver struct {
 	rootDir string
@@ -26,6 +35,20 @@ func NewFilesystemDriver(rootDir string, logger *log.Logger) *FilesystemDriver {
 	}
 }
 
+// FilesystemConfig - параметры драйвера filesystem
+type FilesystemConfig struct {
+	BaseDir string `mapstructure:"baseDir"`
+}
+
+func init() {
+	Register("filesystem", func(b *Builder, config *FilesystemConfig) (music.Storage, error) {
+		if config.BaseDir == "" {
+			return nil, errors.New("baseDir is required")
+		}
+		return NewFilesystemDriver(config.BaseDir, b.Logger), nil
+	})
+}
+
 func (s *FilesystemDriver) IsLinkedExists(
 	ctx context.Context,
 	filename string,
@@ -51,105 +74,389 @@ func (s *FilesystemDriver) UploadLinked(
 	ctx context.Context,
 	filename string,
 	sourceFilename string,
-	file []byte,
+	file io.Reader,
+	size int64,
 ) error {
-	fullFileName := getFullFileName(filename, sourceFilename)
-	if exists, err := s.Exists(ctx, fullFileName); exists || err != nil {
+	return s.Upload(ctx, getFullFileName(filename, sourceFilename), file, size)
+}
+
+func (s *FilesystemDriver) Upload(ctx context.Context, filename string, file io.Reader, size int64) error {
+	return s.UploadWithMetadata(ctx, filename, file, size, music.ObjectMetadata{})
+}
+
+// UploadWithMetadata пишет во временный файл в том же каталоге и только после fsync связывает его
+// с итоговым путем, поэтому при сбое итоговый путь либо не существует, либо указывает на полностью
+// записанный файл. Метаданные хранятся рядом в скрытом файле ".<имя>.meta"
+func (s *FilesystemDriver) UploadWithMetadata(
+	ctx context.Context,
+	filename string,
+	file io.Reader,
+	size int64,
+	metadata music.ObjectMetadata,
+) error {
+	if exists, err := s.Exists(ctx, filename); exists || err != nil {
 		if err != nil {
 			return err
 		}
 
 		return os.ErrExist
 	}
-	filePath := getFilePath(fullFileName, s.rootDir)
-	err := os.MkdirAll(path.Dir(filePath), 0755)
+	filePath := getFilePath(filename, s.rootDir)
+	dir := path.Dir(filePath)
+	err := os.MkdirAll(dir, 0755)
 	if err != nil {
 		return err
 	}
 
-	// Записываем файл
-	fstream, err := os.OpenFile(filePath, os.O_WRONLY|os.O_EXCL|os.O_CREATE, 0644)
+	tmp, err := os.CreateTemp(dir, "."+path.Base(filePath)+tempFileMarker+"*")
+	if err != nil {
+		return err
+	}
+	// После успешной записи временный файл тоже удаляется: итоговый путь - жесткая ссылка на него
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(tmp, hash), file, size)
+	if err == nil && metadata.Checksum != "" && hex.EncodeToString(hash.Sum(nil)) != metadata.Checksum {
+		err = music.ErrChecksumMismatch
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
-	defer fstream.Close()
-	_, err = io.Copy(fstream, bytes.NewReader(file))
+
+	metaTmp, err := writeMetadataTemp(dir, filePath, metadata)
 	if err != nil {
 		return err
 	}
+	if metaTmp != "" {
+		defer os.Remove(metaTmp)
+	}
+	if err = commitTempFile(tmp.Name(), filePath); err != nil {
+		return err
+	}
+	if metaTmp != "" {
+		// Сбой между двумя переименованиями оставит файл без метаданных, но не наоборот
+		if err = os.Rename(metaTmp, getMetadataPath(filePath)); err != nil {
+			return err
+		}
+	}
 
-	return nil
+	return syncDir(dir)
 }
 
-func (s *FilesystemDriver) Upload(ctx context.Context, filename string, file []byte) error {
-	if exists, err := s.Exists(ctx, filename); exists || err != nil {
-		if err != nil {
-			return err
-		}
+// fileMetadata - содержимое файла метаданных
+type fileMetadata struct {
+	ContentType string            `json:"contentType,omitempty"`
+	Checksum    string            `json:"checksum,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
 
-		return os.ErrExist
+func getMetadataPath(filePath string) string {
+	return path.Join(path.Dir(filePath), "."+path.Base(filePath)+".meta")
+}
+
+// writeMetadataTemp записывает метаданные во временный файл и возвращает его путь.
+// Если метаданных нет, файл не создается и возвращается пустая строка
+func writeMetadataTemp(dir string, filePath string, metadata music.ObjectMetadata) (string, error) {
+	if metadata.ContentType == "" && metadata.Checksum == "" && len(metadata.Metadata) == 0 {
+		return "", nil
 	}
-	filePath := getFilePath(filename, s.rootDir)
-	err := os.MkdirAll(path.Dir(filePath), 0755)
+	content, err := json.Marshal(fileMetadata{
+		ContentType: metadata.ContentType,
+		Checksum:    metadata.Checksum,
+		Metadata:    lowerKeys(metadata.Metadata),
+	})
 	if err != nil {
-		return err
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, "."+path.Base(filePath)+".meta"+tempFileMarker+"*")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
 	}
-
-	// Записываем файл
-	fstream, err := os.OpenFile(filePath, os.O_WRONLY|os.O_EXCL|os.O_CREATE, 0644)
 	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// lowerKeys приводит ключи метаданных к нижнему регистру, как их возвращает S3
+func lowerKeys(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	lowered := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		lowered[strings.ToLower(key)] = value
+	}
+
+	return lowered
+}
+
+// commitTempFile делает записанный временный файл видимым по итоговому пути, не перезаписывая
+// существующий файл. Если файловая система не поддерживает жесткие ссылки, файл переименовывается
+func commitTempFile(tmpPath string, filePath string) error {
+	err := os.Link(tmpPath, filePath)
+	if err == nil || errors.Is(err, os.ErrExist) {
 		return err
 	}
-	defer fstream.Close()
-	_, err = io.Copy(fstream, bytes.NewReader(file))
+	if _, statErr := os.Stat(filePath); statErr == nil {
+		return os.ErrExist
+	}
+
+	return os.Rename(tmpPath, filePath)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
+	defer d.Close()
 
-	return nil
+	return d.Sync()
 }
 
-func (s *FilesystemDriver) Get(ctx context.Context, filename string) ([]byte, error) {
+// Recover удаляет временные файлы, оставшиеся от загрузок, прерванных сбоем.
+// Вызывается при запуске, пока в хранилище никто не пишет
+func (s *FilesystemDriver) Recover(ctx context.Context) (removed int, err error) {
+	err = filepath.WalkDir(s.rootDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == s.rootDir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || !isTempFileName(entry.Name()) {
+			return nil
+		}
+		if err = os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.logger.WithField("category", "filesystem").Infof("Removed partially written file %s", filePath)
+		removed++
+		return nil
+	})
+
+	return removed, err
+}
+
+func (s *FilesystemDriver) Get(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
 	if exists, err := s.Exists(ctx, filename); !exists || err != nil {
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
-		return nil, os.ErrNotExist
+		return nil, 0, os.ErrNotExist
 	}
 	filePath := getFilePath(filename, s.rootDir)
-	contents, err := os.ReadFile(filePath)
+	fstream, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := fstream.Stat()
 	if err != nil {
+		fstream.Close()
+		return nil, 0, err
+	}
+
+	return fstream, info.Size(), nil
+}
+
+func (s *FilesystemDriver) GetRange(
+	ctx context.Context,
+	filename string,
+	offset int64,
+	length int64,
+) (*music.ObjectRange, error) {
+	body, size, err := s.Get(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	fstream := body.(*os.File)
+	if offset < 0 || offset > size || (length >= 0 && offset+length > size) {
+		fstream.Close()
+		return nil, music.ErrInvalidRange
+	}
+	if length < 0 {
+		length = size - offset
+	}
+	info, err := fstream.Stat()
+	if err != nil {
+		fstream.Close()
+		return nil, err
+	}
+
+	return &music.ObjectRange{
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(fstream, offset, length), fstream},
+		Offset:       offset,
+		Length:       length,
+		Size:         size,
+		ETag:         fileETag(info),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+func (s *FilesystemDriver) Stat(_ context.Context, filename string) (*music.ObjectInfo, error) {
+	filePath := getFilePath(filename, s.rootDir)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	object := &music.ObjectInfo{
+		Key:     filename,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		ETag:    fileETag(info),
+	}
+	content, err := os.ReadFile(getMetadataPath(filePath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return object, nil
+		}
 		return nil, err
 	}
+	var metadata fileMetadata
+	if err = json.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata of %s: %w", filename, err)
+	}
+	object.ContentType = metadata.ContentType
+	object.Checksum = metadata.Checksum
+	object.Metadata = metadata.Metadata
+
+	return object, nil
+}
 
-	return contents, nil
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
 }
 
-func (s *FilesystemDriver) GetLinked(ctx context.Context, filename string, sourceFilename string) ([]byte, error) {
+func (s *FilesystemDriver) GetLinked(
+	ctx context.Context,
+	filename string,
+	sourceFilename string,
+) (io.ReadCloser, int64, error) {
 	return s.Get(ctx, getFullFileName(filename, sourceFilename))
 }
 
+// Delete удаляет файл вместе со всеми слинкованными с ним файлами
 func (s *FilesystemDriver) Delete(_ context.Context, filename string) error {
-	// удаляем все связанные картинки
-	sourceFilename := strings.Replace(path.Base(filename), path.Ext(filename), "", -1)
-	err := os.RemoveAll(getFilePath(path.Join(s.rootDir, sourceFilename), s.rootDir))
+	err := os.RemoveAll(getLinkedDirPath(filename, s.rootDir))
 	if err != nil {
 		return err
 	}
-	// удаляем исходный файл
-	return os.Remove(getFilePath(filename, s.rootDir))
+	return removeWithMetadata(getFilePath(filename, s.rootDir))
+}
+
+// removeWithMetadata удаляет файл и его метаданные. Метаданные удаляются первыми:
+// при сбое файл останется без них, но метаданные не достанутся следующему файлу с тем же именем
+func removeWithMetadata(filePath string) error {
+	err := os.Remove(getMetadataPath(filePath))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.Remove(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *FilesystemDriver) ListLinked(_ context.Context, sourceFilename string) ([]string, error) {
+	linkedDir := getLinkedDirPath(sourceFilename, s.rootDir)
+	names := make([]string, 0)
+	err := filepath.WalkDir(linkedDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == linkedDir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || isHiddenFileName(entry.Name()) {
+			return nil
+		}
+		name, err := filepath.Rel(linkedDir, filePath)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// Walk обходит все файлы под rootDir. Файлы, которые не мог создать драйвер, и служебные
+// скрытые файлы пропускаются
+func (s *FilesystemDriver) Walk(ctx context.Context, fn func(object music.ObjectInfo) error) error {
+	return filepath.WalkDir(s.rootDir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == s.rootDir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || isHiddenFileName(entry.Name()) {
+			return nil
+		}
+		relPath, err := filepath.Rel(s.rootDir, filePath)
+		if err != nil {
+			return err
+		}
+		filename, ok := parseFilePath(filepath.ToSlash(relPath))
+		if !ok {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return fn(music.ObjectInfo{Key: filename, Size: info.Size(), ModTime: info.ModTime()})
+	})
 }
 
 func (s *FilesystemDriver) DeleteCache(_ context.Context, filename string, sourceFilename string) error {
 	fillFileName := getFullFileName(filename, sourceFilename)
 	fillPath := getFilePath(fillFileName, s.rootDir)
-	return os.Remove(fillPath)
+	return removeWithMetadata(fillPath)
 }
 
 func (s *FilesystemDriver) GetSpaceUsage(_ context.Context) (usage int64, err error) {
 	usage = int64(0)
 	err = filepath.Walk(s.rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Каталог еще не создан: в хранилище ничего не загружали
+			if path == s.rootDir && errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
 		if !info.IsDir() {
 			usage += info.Size()
 		}
@@ -158,3 +465,11 @@ func (s *FilesystemDriver) GetSpaceUsage(_ context.Context) (usage int64, err er
 
 	return usage, err
 }
+
+func isHiddenFileName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+func isTempFileName(name string) bool {
+	return isHiddenFileName(name) && strings.Contains(name, tempFileMarker)
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+// MemoryDriver хранит файлы в памяти. Предназначен для тестов: загрузка держит файл в памяти целиком
+type MemoryDriver struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	modTime  time.Time
+	metadata music.ObjectMetadata
+}
+
+func NewMemoryDriver() *MemoryDriver {
+	return &MemoryDriver{objects: make(map[string]*memoryObject)}
+}
+
+func init() {
+	// Содержимое пропадает при перезапуске, драйвер нужен для тестов и локальной отладки
+	Register("memory", func(*Builder, *struct{}) (music.Storage, error) {
+		return NewMemoryDriver(), nil
+	})
+}
+
+func (d *MemoryDriver) Exists(_ context.Context, filename string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.objects[filename]
+
+	return ok, nil
+}
+
+func (d *MemoryDriver) IsLinkedExists(ctx context.Context, filename string, sourceFilename string) (bool, error) {
+	return d.Exists(ctx, getFullFileName(filename, sourceFilename))
+}
+
+func (d *MemoryDriver) Upload(ctx context.Context, filename string, file io.Reader, size int64) error {
+	return d.UploadWithMetadata(ctx, filename, file, size, music.ObjectMetadata{})
+}
+
+func (d *MemoryDriver) UploadWithMetadata(
+	ctx context.Context,
+	filename string,
+	file io.Reader,
+	size int64,
+	metadata music.ObjectMetadata,
+) error {
+	if exists, _ := d.Exists(ctx, filename); exists {
+		return os.ErrExist
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return err
+	}
+	if metadata.Checksum != "" {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != metadata.Checksum {
+			return music.ErrChecksumMismatch
+		}
+	}
+	metadata.Metadata = lowerKeys(metadata.Metadata)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Файл могли загрузить, пока читался поток
+	if _, ok := d.objects[filename]; ok {
+		return os.ErrExist
+	}
+	d.objects[filename] = &memoryObject{data: data, modTime: time.Now(), metadata: metadata}
+
+	return nil
+}
+
+func (d *MemoryDriver) UploadLinked(
+	ctx context.Context,
+	filename string,
+	sourceFilename string,
+	file io.Reader,
+	size int64,
+) error {
+	return d.Upload(ctx, getFullFileName(filename, sourceFilename), file, size)
+}
+
+func (d *MemoryDriver) Get(_ context.Context, filename string) (io.ReadCloser, int64, error) {
+	object, err := d.get(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return io.NopCloser(bytes.NewReader(object.data)), int64(len(object.data)), nil
+}
+
+func (d *MemoryDriver) GetRange(
+	_ context.Context,
+	filename string,
+	offset int64,
+	length int64,
+) (*music.ObjectRange, error) {
+	object, err := d.get(filename)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(object.data))
+	if offset < 0 || offset > size || (length >= 0 && offset+length > size) {
+		return nil, music.ErrInvalidRange
+	}
+	if length < 0 {
+		length = size - offset
+	}
+
+	return &music.ObjectRange{
+		Body:         io.NopCloser(bytes.NewReader(object.data[offset : offset+length])),
+		Offset:       offset,
+		Length:       length,
+		Size:         size,
+		ETag:         object.etag(),
+		LastModified: object.modTime,
+	}, nil
+}
+
+func (d *MemoryDriver) Stat(_ context.Context, filename string) (*music.ObjectInfo, error) {
+	object, err := d.get(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &music.ObjectInfo{
+		Key:            filename,
+		Size:           int64(len(object.data)),
+		ModTime:        object.modTime,
+		ETag:           object.etag(),
+		ObjectMetadata: object.metadata,
+	}, nil
+}
+
+func (o *memoryObject) etag() string {
+	return fmt.Sprintf(`"%x-%x"`, o.modTime.UnixNano(), len(o.data))
+}
+
+// Delete удаляет файл вместе со всеми слинкованными с ним файлами
+func (d *MemoryDriver) Delete(_ context.Context, filename string) error {
+	linkedPrefix := getSourceName(filename) + "/"
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.objects, filename)
+	for key := range d.objects {
+		if strings.HasPrefix(key, linkedPrefix) {
+			delete(d.objects, key)
+		}
+	}
+
+	return nil
+}
+
+func (d *MemoryDriver) ListLinked(_ context.Context, sourceFilename string) ([]string, error) {
+	linkedPrefix := getSourceName(sourceFilename) + "/"
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	names := make([]string, 0)
+	for key := range d.objects {
+		if name, ok := strings.CutPrefix(key, linkedPrefix); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Walk обходит файлы в порядке ключей. Файлы, загруженные во время обхода, могут не попасть в него
+func (d *MemoryDriver) Walk(ctx context.Context, fn func(object music.ObjectInfo) error) error {
+	d.mu.RLock()
+	objects := make([]music.ObjectInfo, 0, len(d.objects))
+	for key, object := range d.objects {
+		objects = append(objects, music.ObjectInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime})
+	}
+	d.mu.RUnlock()
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	for _, object := range objects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *MemoryDriver) GetSpaceUsage(_ context.Context) (usage int64, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, object := range d.objects {
+		usage += int64(len(object.data))
+	}
+
+	return usage, nil
+}
+
+func (d *MemoryDriver) get(filename string) (*memoryObject, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	object, ok := d.objects[filename]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return object, nil
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kroticw/freshman-server/internal/music"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultMigrateConcurrency используется, если количество параллельных копирований не задано
+const DefaultMigrateConcurrency = 4
+
+type MigrateOptions struct {
+	Concurrency int
+	// CheckpointPath - файл, в который дописываются ключи перенесенных файлов.
+	// При повторном запуске эти файлы пропускаются без обращения к хранилищам
+	CheckpointPath string
+}
+
+type MigrateReport struct {
+	Objects int `json:"objects"`
+	// Copied - перенесено сейчас, Checkpointed - перенесено при прошлых запусках,
+	// Identical - уже было в новом хранилище с тем же размером и SHA-256
+	Copied       int      `json:"copied"`
+	CopiedBytes  int64    `json:"copiedBytes"`
+	Checkpointed int      `json:"checkpointed"`
+	Identical    int      `json:"identical"`
+	Conflicts    []string `json:"conflicts"`
+	Failed       []string `json:"failed"`
+}
+
+// Migrate копирует все файлы из source в destination, включая слинкованные.
+// Файл, который уже есть в destination с другим содержимым, не перезаписывается, а попадает в Conflicts.
+// Ошибки копирования отдельных файлов не прерывают перенос и попадают в Failed.
+func Migrate(
+	ctx context.Context,
+	source music.Storage,
+	destination music.Storage,
+	opts MigrateOptions,
+	logger *log.Logger,
+) (*MigrateReport, error) {
+	walker, ok := source.(music.Walker)
+	if !ok {
+		return nil, music.ErrWalkNotSupported
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultMigrateConcurrency
+	}
+	checkpoint, err := openCheckpoint(opts.CheckpointPath)
+	if err != nil {
+		return nil, err
+	}
+	defer checkpoint.close()
+
+	report := &MigrateReport{Conflicts: []string{}, Failed: []string{}}
+	var mu sync.Mutex
+	var copiedBytes atomic.Int64
+	objects := make(chan music.ObjectInfo)
+	var wg sync.WaitGroup
+	for range opts.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range objects {
+				result, err := migrateObject(ctx, source, destination, object)
+				if err == nil && result != migrateConflict {
+					err = checkpoint.add(object.Key)
+				}
+				mu.Lock()
+				switch {
+				case err != nil:
+					logger.WithError(err).WithField("category", "migrate").Errorf("failed to copy %s", object.Key)
+					report.Failed = append(report.Failed, object.Key)
+				case result == migrateCopied:
+					report.Copied++
+					copiedBytes.Add(object.Size)
+				case result == migrateIdentical:
+					report.Identical++
+				case result == migrateConflict:
+					logger.WithField("category", "migrate").
+						Warnf("%s already exists in destination with different content", object.Key)
+					report.Conflicts = append(report.Conflicts, object.Key)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err = walker.Walk(ctx, func(object music.ObjectInfo) error {
+		mu.Lock()
+		report.Objects++
+		mu.Unlock()
+		if checkpoint.contains(object.Key) {
+			mu.Lock()
+			report.Checkpointed++
+			mu.Unlock()
+			return nil
+		}
+		select {
+		case objects <- object:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(objects)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	report.CopiedBytes = copiedBytes.Load()
+	sort.Strings(report.Conflicts)
+	sort.Strings(report.Failed)
+
+	return report, nil
+}
+
+type migrateResult int
+
+const (
+	migrateCopied migrateResult = iota
+	migrateIdentical
+	migrateConflict
+)
+
+func migrateObject(
+	ctx context.Context,
+	source music.Storage,
+	destination music.Storage,
+	object music.ObjectInfo,
+) (migrateResult, error) {
+	existing, err := destination.Stat(ctx, object.Key)
+	if err == nil {
+		return compareObjects(ctx, source, destination, object, existing.Size)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	info, err := source.Stat(ctx, object.Key)
+	if err != nil {
+		return 0, err
+	}
+	body, size, err := source.Get(ctx, object.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	err = destination.UploadWithMetadata(ctx, object.Key, body, size, info.ObjectMetadata)
+	if errors.Is(err, os.ErrExist) {
+		// Файл появился в destination, пока мы его читали
+		return compareObjects(ctx, source, destination, object, -1)
+	}
+
+	return migrateCopied, err
+}
+
+// compareObjects сравнивает размер и SHA-256 файла в обоих хранилищах.
+// Отрицательный destinationSize означает, что размер в destination еще неизвестен
+func compareObjects(
+	ctx context.Context,
+	source music.Storage,
+	destination music.Storage,
+	object music.ObjectInfo,
+	destinationSize int64,
+) (migrateResult, error) {
+	if destinationSize >= 0 && destinationSize != object.Size {
+		return migrateConflict, nil
+	}
+	sourceHash, sourceSize, err := hashObject(ctx, source, object.Key)
+	if err != nil {
+		return 0, err
+	}
+	destinationHash, destinationSize, err := hashObject(ctx, destination, object.Key)
+	if err != nil {
+		return 0, err
+	}
+	if sourceSize != destinationSize || sourceHash != destinationHash {
+		return migrateConflict, nil
+	}
+
+	return migrateIdentical, nil
+}
+
+func hashObject(ctx context.Context, storage music.Storage, filename string) (sum [sha256.Size]byte, size int64, err error) {
+	body, _, err := storage.Get(ctx, filename)
+	if err != nil {
+		return sum, 0, err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	size, err = io.Copy(hash, body)
+	if err != nil {
+		return sum, 0, err
+	}
+	copy(sum[:], hash.Sum(nil))
+
+	return sum, size, nil
+}
+
+// migrateCheckpoint - множество перенесенных ключей, сохраняемое в файл по одному ключу в строке
+type migrateCheckpoint struct {
+	mu   sync.Mutex
+	done map[string]bool
+	file *os.File
+}
+
+func openCheckpoint(filePath string) (*migrateCheckpoint, error) {
+	checkpoint := &migrateCheckpoint{done: make(map[string]bool)}
+	if filePath == "" {
+		return checkpoint, nil
+	}
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if key := scanner.Text(); key != "" {
+			checkpoint.done[key] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	checkpoint.file = file
+
+	return checkpoint, nil
+}
+
+func (c *migrateCheckpoint) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.done[key]
+}
+
+func (c *migrateCheckpoint) add(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done[key] = true
+	if c.file == nil {
+		return nil
+	}
+	_, err := c.file.WriteString(key + "\n")
+
+	return err
+}
+
+func (c *migrateCheckpoint) close() {
+	if c.file != nil {
+		c.file.Close()
+	}
+}
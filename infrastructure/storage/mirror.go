@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kroticw/freshman-server/internal/music"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sidePrimary   = "primary"
+	sideSecondary = "secondary"
+)
+
+// errSideDone закрывает поток стороны, которая завершила запись раньше, чем прочитала его целиком
+var errSideDone = errors.New("mirror side finished writing")
+
+// MirroringDriver пишет в оба хранилища, а читает из primary, переключаясь на secondary при ошибке.
+// Если запись удалась только на одной стороне, операция считается успешной, а в журнал
+// восстановления добавляется запись, по которой Repair потом догоняет отставшую сторону.
+type MirroringDriver struct {
+	primary   music.Storage
+	secondary music.Storage
+	repairLog *repairLog
+	// repairInterval - период Repair в Maintain
+	repairInterval time.Duration
+	logger         *log.Logger
+}
+
+// NewMirroringDriver создает зеркало. repairLogPath - файл журнала операций, не выполненных на одной из сторон
+func NewMirroringDriver(
+	primary music.Storage,
+	secondary music.Storage,
+	repairLogPath string,
+	logger *log.Logger,
+) *MirroringDriver {
+	return &MirroringDriver{
+		primary:        primary,
+		secondary:      secondary,
+		repairLog:      &repairLog{path: repairLogPath},
+		repairInterval: DefaultRepairInterval,
+		logger:         logger,
+	}
+}
+
+// DefaultRepairInterval используется, если repairInterval не задан в конфиге
+const DefaultRepairInterval = 10 * time.Minute
+
+// MirrorConfig - параметры драйвера mirror
+type MirrorConfig struct {
+	Primary   DriverConfig `mapstructure:"primary"`
+	Secondary DriverConfig `mapstructure:"secondary"`
+	// RepairLog - файл журнала операций, не выполненных на одной из сторон
+	RepairLog      string        `mapstructure:"repairLog"`
+	RepairInterval time.Duration `mapstructure:"repairInterval"`
+}
+
+func init() {
+	Register("mirror", func(b *Builder, config *MirrorConfig) (music.Storage, error) {
+		if config.RepairLog == "" {
+			return nil, errors.New("repairLog is required")
+		}
+		primary, err := b.BuildNested("primary", config.Primary)
+		if err != nil {
+			return nil, err
+		}
+		secondary, err := b.BuildNested("secondary", config.Secondary)
+		if err != nil {
+			return nil, err
+		}
+		driver := NewMirroringDriver(primary, secondary, config.RepairLog, b.Logger)
+		if config.RepairInterval > 0 {
+			driver.repairInterval = config.RepairInterval
+		}
+		return driver, nil
+	})
+}
+
+func (d *MirroringDriver) Exists(ctx context.Context, filename string) (bool, error) {
+	exists, err := d.primary.Exists(ctx, filename)
+	if err == nil && exists {
+		return true, nil
+	}
+	// Отсутствие файла на вторичном хранилище не значит, что его нет на недоступном основном
+	secondaryExists, secondaryErr := d.secondary.Exists(ctx, filename)
+	if secondaryErr == nil && secondaryExists {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return false, secondaryErr
+}
+
+func (d *MirroringDriver) IsLinkedExists(ctx context.Context, filename string, sourceFilename string) (bool, error) {
+	return d.Exists(ctx, getFullFileName(filename, sourceFilename))
+}
+
+func (d *MirroringDriver) Upload(ctx context.Context, filename string, file io.Reader, size int64) error {
+	return d.mirrorWrite(filename, file, size, func(side music.Storage, r io.Reader) error {
+		return side.Upload(ctx, filename, r, size)
+	})
+}
+
+func (d *MirroringDriver) UploadWithMetadata(
+	ctx context.Context,
+	filename string,
+	file io.Reader,
+	size int64,
+	metadata music.ObjectMetadata,
+) error {
+	return d.mirrorWrite(filename, file, size, func(side music.Storage, r io.Reader) error {
+		return side.UploadWithMetadata(ctx, filename, r, size, metadata)
+	})
+}
+
+func (d *MirroringDriver) UploadLinked(
+	ctx context.Context,
+	filename string,
+	sourceFilename string,
+	file io.Reader,
+	size int64,
+) error {
+	return d.mirrorWrite(getFullFileName(filename, sourceFilename), file, size,
+		func(side music.Storage, r io.Reader) error {
+			return side.UploadLinked(ctx, filename, sourceFilename, r, size)
+		})
+}
+
+func (d *MirroringDriver) Get(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	body, size, err := d.primary.Get(ctx, filename)
+	if err == nil {
+		return body, size, nil
+	}
+	d.logReadFailover(filename, err)
+
+	return d.secondary.Get(ctx, filename)
+}
+
+func (d *MirroringDriver) Stat(ctx context.Context, filename string) (*music.ObjectInfo, error) {
+	info, err := d.primary.Stat(ctx, filename)
+	if err == nil {
+		return info, nil
+	}
+	d.logReadFailover(filename, err)
+
+	return d.secondary.Stat(ctx, filename)
+}
+
+func (d *MirroringDriver) GetRange(
+	ctx context.Context,
+	filename string,
+	offset int64,
+	length int64,
+) (*music.ObjectRange, error) {
+	rng, err := d.primary.GetRange(ctx, filename, offset, length)
+	if err == nil || errors.Is(err, music.ErrInvalidRange) {
+		return rng, err
+	}
+	d.logReadFailover(filename, err)
+
+	return d.secondary.GetRange(ctx, filename, offset, length)
+}
+
+func (d *MirroringDriver) ListLinked(ctx context.Context, sourceFilename string) ([]string, error) {
+	names, err := d.primary.ListLinked(ctx, sourceFilename)
+	if err == nil {
+		return names, nil
+	}
+	d.logReadFailover(sourceFilename, err)
+
+	return d.secondary.ListLinked(ctx, sourceFilename)
+}
+
+// Walk обходит файлы primary. Файлы, которых на нем нет, ожидают восстановления по журналу
+func (d *MirroringDriver) Walk(ctx context.Context, fn func(object music.ObjectInfo) error) error {
+	walker, ok := d.primary.(music.Walker)
+	if !ok {
+		return music.ErrWalkNotSupported
+	}
+
+	return walker.Walk(ctx, fn)
+}
+
+// Delete удаляет файл на обеих сторонах. Ошибка возвращается, только если удалить не удалось нигде
+func (d *MirroringDriver) Delete(ctx context.Context, filename string) error {
+	var wg sync.WaitGroup
+	var primaryErr, secondaryErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		primaryErr = ignoreNotExist(d.primary.Delete(ctx, filename))
+	}()
+	go func() {
+		defer wg.Done()
+		secondaryErr = ignoreNotExist(d.secondary.Delete(ctx, filename))
+	}()
+	wg.Wait()
+
+	return d.settle(repairDelete, filename, primaryErr, secondaryErr)
+}
+
+// mirrorWrite раздает поток file обеим сторонам одновременно, не буферизуя его целиком.
+// Сторона, запись на которую завершилась ошибкой, отключается, а другая продолжает получать данные.
+func (d *MirroringDriver) mirrorWrite(
+	filename string,
+	file io.Reader,
+	size int64,
+	write func(side music.Storage, r io.Reader) error,
+) error {
+	sides := []music.Storage{d.primary, d.secondary}
+	readers := make([]*io.PipeReader, len(sides))
+	writers := make([]*io.PipeWriter, len(sides))
+	errs := make([]error, len(sides))
+	var wg sync.WaitGroup
+	for i, side := range sides {
+		readers[i], writers[i] = io.Pipe()
+		wg.Add(1)
+		go func(i int, side music.Storage) {
+			defer wg.Done()
+			errs[i] = write(side, readers[i])
+			readers[i].CloseWithError(errSideDone)
+		}(i, side)
+	}
+
+	buf := make([]byte, 32*1024)
+	src := io.LimitReader(file, size)
+	alive := len(sides)
+	for alive > 0 {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			for i, w := range writers {
+				if w == nil {
+					continue
+				}
+				if _, err := w.Write(buf[:n]); err != nil {
+					writers[i] = nil
+					alive--
+				}
+			}
+		}
+		if readErr != nil {
+			for _, w := range writers {
+				if w == nil {
+					continue
+				}
+				if readErr == io.EOF {
+					w.Close()
+				} else {
+					w.CloseWithError(readErr)
+				}
+			}
+			break
+		}
+	}
+	wg.Wait()
+
+	existed := false
+	for i := range errs {
+		// Файл уже есть на этой стороне: восстанавливать ее не нужно
+		if errors.Is(errs[i], os.ErrExist) {
+			errs[i] = nil
+			existed = true
+		}
+	}
+	err := d.settle(repairUpload, filename, errs[0], errs[1])
+	if err == nil && existed {
+		return os.ErrExist
+	}
+
+	return err
+}
+
+// settle записывает в журнал сторону, на которой операция не выполнилась
+func (d *MirroringDriver) settle(op string, filename string, primaryErr error, secondaryErr error) error {
+	if primaryErr != nil && secondaryErr != nil {
+		return primaryErr
+	}
+	failedSide, err := sidePrimary, primaryErr
+	if secondaryErr != nil {
+		failedSide, err = sideSecondary, secondaryErr
+	}
+	if err == nil {
+		return nil
+	}
+
+	d.logger.WithError(err).WithField("category", "mirror").
+		Warnf("%s of %s failed on %s storage, scheduled for repair", op, filename, failedSide)
+	if logErr := d.repairLog.append(repairEntry{Op: op, Key: filename, Side: failedSide, Error: err.Error()}); logErr != nil {
+		// Без записи в журнал стороны разойдутся незаметно, поэтому это ошибка всей операции
+		return logErr
+	}
+
+	return nil
+}
+
+func (d *MirroringDriver) logReadFailover(filename string, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	d.logger.WithError(err).WithField("category", "mirror").
+		Warnf("failed to read %s from primary storage, falling back to secondary", filename)
+}
+
+func ignoreNotExist(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+const (
+	repairUpload = "upload"
+	repairDelete = "delete"
+)
+
+// repairEntry - операция, которая не выполнилась на стороне Side
+type repairEntry struct {
+	Op    string    `json:"op"`
+	Key   string    `json:"key"`
+	Side  string    `json:"side"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// repairLog - журнал в формате JSON Lines, переживающий перезапуск сервера
+type repairLog struct {
+	path string
+	mu   sync.Mutex
+	// pass не дает двум проходам Repair одновременно переписать журнал
+	pass sync.Mutex
+}
+
+func (l *repairLog) append(entries ...repairEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = writeRepairEntries(file, entries); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+func writeRepairEntries(w io.Writer, entries []repairEntry) error {
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if entry.Time.IsZero() {
+			entry.Time = time.Now()
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// take читает все записи журнала, не удаляя их: если проход восстановления прервется, записи
+// выполнятся при следующем. offset - размер прочитанной части журнала, его нужно передать в finish
+func (l *repairLog) take() (entries []repairEntry, offset int64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var entry repairEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Оборванная при сбое последняя строка
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return entries, int64(len(data)), nil
+}
+
+// finish заменяет записи, прочитанные take, записями failed. Записи, добавленные в журнал после take,
+// сохраняются. Журнал подменяется переименованием временного файла, поэтому при сбое остается
+// либо прежний журнал, либо новый
+func (l *repairLog) finish(offset int64, failed []repairEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data, err := os.ReadFile(l.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	tail := data[min(offset, int64(len(data))):]
+	if len(failed) == 0 && len(tail) == 0 {
+		return ignoreNotExist(os.Remove(l.path))
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err = writeRepairEntries(file, failed); err != nil {
+		return err
+	}
+	if _, err = file.Write(tail); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), l.path)
+}
+
+// Maintain раз в repairInterval догоняет отставшую сторону зеркала по журналу восстановления
+func (d *MirroringDriver) Maintain(ctx context.Context) {
+	ticker := time.NewTicker(d.repairInterval)
+	defer ticker.Stop()
+	for {
+		repaired, err := d.Repair(ctx)
+		if err != nil {
+			d.logger.WithError(err).WithField("category", "mirror").Error("failed to repair storage mirror")
+		} else if repaired > 0 {
+			d.logger.WithField("category", "mirror").Infof("Repaired %d mirrored files", repaired)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Repair догоняет стороны по журналу восстановления: копирует недостающие файлы с другой стороны
+// и повторяет неудавшиеся удаления. Возвращает количество выполненных операций;
+// невыполненные остаются в журнале до следующего вызова.
+func (d *MirroringDriver) Repair(ctx context.Context) (repaired int, err error) {
+	d.repairLog.pass.Lock()
+	defer d.repairLog.pass.Unlock()
+	entries, offset, err := d.repairLog.take()
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	// Для каждого ключа и стороны важна только последняя операция
+	type target struct{ key, side string }
+	latest := make(map[target]repairEntry, len(entries))
+	order := make([]target, 0, len(entries))
+	for _, entry := range entries {
+		t := target{entry.Key, entry.Side}
+		if _, ok := latest[t]; !ok {
+			order = append(order, t)
+		}
+		latest[t] = entry
+	}
+
+	var failed []repairEntry
+	for _, t := range order {
+		entry := latest[t]
+		if ctx.Err() != nil {
+			failed = append(failed, entry)
+			continue
+		}
+		if repairErr := d.repair(ctx, entry); repairErr != nil {
+			d.logger.WithError(repairErr).WithField("category", "mirror").
+				Warnf("failed to repair %s of %s on %s storage", entry.Op, entry.Key, entry.Side)
+			entry.Error = repairErr.Error()
+			failed = append(failed, entry)
+			continue
+		}
+		repaired++
+	}
+	if err = d.repairLog.finish(offset, failed); err != nil {
+		return repaired, err
+	}
+
+	return repaired, ctx.Err()
+}
+
+func (d *MirroringDriver) repair(ctx context.Context, entry repairEntry) error {
+	target, source := d.primary, d.secondary
+	if entry.Side == sideSecondary {
+		target, source = d.secondary, d.primary
+	}
+
+	switch entry.Op {
+	case repairDelete:
+		return ignoreNotExist(target.Delete(ctx, entry.Key))
+	case repairUpload:
+		return copyObject(ctx, source, target, entry.Key)
+	default:
+		return errors.New("unknown repair operation " + entry.Op)
+	}
+}
+
+// copyObject копирует файл key из source в target, если в target его еще нет.
+// Если файла нет и в source, его успели удалить, и копировать нечего.
+func copyObject(ctx context.Context, source music.Storage, target music.Storage, key string) error {
+	exists, err := target.Exists(ctx, key)
+	if err != nil || exists {
+		return err
+	}
+	info, err := source.Stat(ctx, key)
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	body, size, err := source.Get(ctx, key)
+	if err != nil {
+		return ignoreNotExist(err)
+	}
+	defer body.Close()
+
+	err = target.UploadWithMetadata(ctx, key, body, size, info.ObjectMetadata)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,215 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kroticw/freshman-server/infrastructure/storage"
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+var errSideDown = errors.New("storage is down")
+
+// flakyStorage - сторона зеркала, которую тест может отключить. onUpload вызывается перед каждой
+// загрузкой на включенную сторону
+type flakyStorage struct {
+	music.Storage
+	mu       sync.Mutex
+	down     bool
+	onUpload func(filename string)
+}
+
+func (f *flakyStorage) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flakyStorage) check(filename string) error {
+	f.mu.Lock()
+	down, onUpload := f.down, f.onUpload
+	f.mu.Unlock()
+	if down {
+		return errSideDown
+	}
+	if onUpload != nil && filename != "" {
+		onUpload(filename)
+	}
+
+	return nil
+}
+
+func (f *flakyStorage) Exists(ctx context.Context, filename string) (bool, error) {
+	if err := f.check(""); err != nil {
+		return false, err
+	}
+	return f.Storage.Exists(ctx, filename)
+}
+
+func (f *flakyStorage) Upload(ctx context.Context, filename string, file io.Reader, size int64) error {
+	if err := f.check(filename); err != nil {
+		io.Copy(io.Discard, file)
+		return err
+	}
+	return f.Storage.Upload(ctx, filename, file, size)
+}
+
+func (f *flakyStorage) UploadWithMetadata(
+	ctx context.Context,
+	filename string,
+	file io.Reader,
+	size int64,
+	metadata music.ObjectMetadata,
+) error {
+	if err := f.check(filename); err != nil {
+		io.Copy(io.Discard, file)
+		return err
+	}
+	return f.Storage.UploadWithMetadata(ctx, filename, file, size, metadata)
+}
+
+func (f *flakyStorage) Delete(ctx context.Context, filename string) error {
+	if err := f.check(""); err != nil {
+		return err
+	}
+	return f.Storage.Delete(ctx, filename)
+}
+
+func upload(t *testing.T, driver music.Storage, key string, content string) {
+	t.Helper()
+	if err := driver.Upload(context.Background(), key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Upload(%s): %v", key, err)
+	}
+}
+
+func exists(t *testing.T, driver music.Storage, key string) bool {
+	t.Helper()
+	ok, err := driver.Exists(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Exists(%s): %v", key, err)
+	}
+
+	return ok
+}
+
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestMirroringDriverRepair(t *testing.T) {
+	ctx := context.Background()
+	primary := storage.NewMemoryDriver()
+	secondary := &flakyStorage{Storage: storage.NewMemoryDriver()}
+	logPath := filepath.Join(t.TempDir(), "repair.jsonl")
+	driver := storage.NewMirroringDriver(primary, secondary, logPath, newTestLogger())
+
+	upload(t, driver, "deleted.audio", "old")
+	secondary.setDown(true)
+	upload(t, driver, "a.audio", "aaa")
+	upload(t, driver, "b.audio", "bbb")
+	if err := driver.Delete(ctx, "deleted.audio"); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(readLog(t, logPath), "\n"); lines != 3 {
+		t.Fatalf("repair log has %d entries, want 3", lines)
+	}
+
+	// Пока сторона недоступна, записи остаются в журнале
+	repaired, err := driver.Repair(ctx)
+	if err != nil || repaired != 0 {
+		t.Fatalf("Repair() with secondary down = %d, %v, want 0", repaired, err)
+	}
+	if lines := strings.Count(readLog(t, logPath), "\n"); lines != 3 {
+		t.Fatalf("repair log has %d entries after failed repair, want 3", lines)
+	}
+
+	secondary.setDown(false)
+	secondary.onUpload = func(filename string) {
+		if filename != "a.audio" {
+			return
+		}
+		// Во время прохода журнал цел: сбой процесса сейчас не потеряет записи
+		if !strings.Contains(readLog(t, logPath), `"b.audio"`) {
+			t.Error("repair log was emptied before the repair pass finished")
+		}
+		// Запись, добавленная во время прохода, переживает его
+		secondary.onUpload = nil
+		secondary.setDown(true)
+		upload(t, driver, "late.audio", "late")
+		secondary.setDown(false)
+	}
+	repaired, err = driver.Repair(ctx)
+	if err != nil || repaired != 3 {
+		t.Fatalf("Repair() = %d, %v, want 3", repaired, err)
+	}
+	for _, key := range []string{"a.audio", "b.audio"} {
+		if !exists(t, secondary.Storage, key) {
+			t.Errorf("%s is not copied to secondary", key)
+		}
+	}
+	if exists(t, secondary.Storage, "deleted.audio") {
+		t.Error("deleted.audio is not deleted from secondary")
+	}
+	if entries := readLog(t, logPath); strings.Count(entries, "\n") != 1 || !strings.Contains(entries, `"late.audio"`) {
+		t.Fatalf("repair log = %q, want only the entry added during repair", entries)
+	}
+
+	repaired, err = driver.Repair(ctx)
+	if err != nil || repaired != 1 || !exists(t, secondary.Storage, "late.audio") {
+		t.Fatalf("Repair() of late entry = %d, %v", repaired, err)
+	}
+	if _, err = os.Stat(logPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("repair log is left after full repair: %v", err)
+	}
+}
+
+func TestMirroringDriverRepairCorruptLine(t *testing.T) {
+	ctx := context.Background()
+	primary := storage.NewMemoryDriver()
+	secondary := storage.NewMemoryDriver()
+	logPath := filepath.Join(t.TempDir(), "repair.jsonl")
+	driver := storage.NewMirroringDriver(primary, secondary, logPath, newTestLogger())
+	upload(t, primary, "a.audio", "aaa")
+	// Последняя строка оборвана сбоем при записи
+	entries := `{"op":"upload","key":"a.audio","side":"secondary"}` + "\n" + `{"op":"upl`
+	if err := os.WriteFile(logPath, []byte(entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired, err := driver.Repair(ctx)
+	if err != nil || repaired != 1 || !exists(t, secondary, "a.audio") {
+		t.Fatalf("Repair() = %d, %v", repaired, err)
+	}
+	if _, err = os.Stat(logPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("repair log is left after full repair: %v", err)
+	}
+}
+
+func TestMirroringDriverExistsPrimaryDown(t *testing.T) {
+	primary := &flakyStorage{Storage: storage.NewMemoryDriver()}
+	secondary := &flakyStorage{Storage: storage.NewMemoryDriver()}
+	driver := storage.NewMirroringDriver(primary, secondary, filepath.Join(t.TempDir(), "repair.jsonl"), newTestLogger())
+	upload(t, primary, "primary.audio", "audio")
+	upload(t, secondary, "secondary.audio", "audio")
+	primary.setDown(true)
+
+	// Вторичное хранилище может подтвердить наличие файла, но не его отсутствие
+	if ok, err := driver.Exists(context.Background(), "secondary.audio"); err != nil || !ok {
+		t.Errorf("Exists(secondary.audio) = %t, %v, want true", ok, err)
+	}
+	if ok, err := driver.Exists(context.Background(), "primary.audio"); !errors.Is(err, errSideDown) {
+		t.Errorf("Exists(primary.audio) = %t, %v, want %v", ok, err, errSideDown)
+	}
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/kroticw/freshman-server/internal/music"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// DriverConfig описывает хранилище в конфигурации: тип драйвера и его параметры рядом с ним.
+// Драйверы-обертки (кэш, зеркало, шифрование) описывают обернутые хранилища вложенными DriverConfig.
+type DriverConfig struct {
+	Type    string         `json:"type" yaml:"type" mapstructure:"type"`
+	Options map[string]any `mapstructure:",remain"`
+}
+
+// Recoverer - драйвер, которому нужно привести хранилище в порядок перед началом работы
+type Recoverer interface {
+	// Recover возвращает количество исправленных файлов
+	Recover(ctx context.Context) (int, error)
+}
+
+// Maintainer - драйвер с периодическим обслуживанием. Maintain работает, пока не отменен ctx
+type Maintainer interface {
+	Maintain(ctx context.Context)
+}
+
+type driverFactory struct {
+	newConfig func() any
+	build     func(b *Builder, config any) (music.Storage, error)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]driverFactory)
+)
+
+// Register добавляет драйвер типа driverType. Параметры из DriverConfig.Options декодируются
+// в C по тегам mapstructure, и неизвестный параметр считается ошибкой конфигурации.
+// Вызывается из init файла драйвера
+func Register[C any](driverType string, factory func(b *Builder, config *C) (music.Storage, error)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[driverType]; ok {
+		panic("storage driver " + driverType + " is already registered")
+	}
+	registry[driverType] = driverFactory{
+		newConfig: func() any { return new(C) },
+		build: func(b *Builder, config any) (music.Storage, error) {
+			return factory(b, config.(*C))
+		},
+	}
+}
+
+// DriverTypes возвращает зарегистрированные типы драйверов по алфавиту
+func DriverTypes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	types := make([]string, 0, len(registry))
+	for driverType := range registry {
+		types = append(types, driverType)
+	}
+	sort.Strings(types)
+
+	return types
+}
+
+// Builder создает хранилища по DriverConfig и запоминает все созданные драйверы,
+// включая обернутые, чтобы их можно было восстановить и обслуживать
+type Builder struct {
+	Logger         *log.Logger
+	TracerProvider trace.TracerProvider
+	MeterProvider  metric.MeterProvider
+	drivers        []music.Storage
+}
+
+func NewBuilder(logger *log.Logger, tracerProvider trace.TracerProvider, meterProvider metric.MeterProvider) *Builder {
+	return &Builder{Logger: logger, TracerProvider: tracerProvider, MeterProvider: meterProvider}
+}
+
+// Build проверяет параметры и создает хранилище. Ошибка содержит путь до неверного параметра
+func (b *Builder) Build(config DriverConfig) (music.Storage, error) {
+	if config.Type == "" {
+		return nil, fmt.Errorf("storage driver type is not set (available: %v)", DriverTypes())
+	}
+	registryMu.RLock()
+	factory, ok := registry[config.Type]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver %s (available: %v)", config.Type, DriverTypes())
+	}
+
+	options := factory.newConfig()
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           options,
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = decoder.Decode(config.Options); err != nil {
+		return nil, fmt.Errorf("%s driver: %w", config.Type, err)
+	}
+	driver, err := factory.build(b, options)
+	if err != nil {
+		return nil, fmt.Errorf("%s driver: %w", config.Type, err)
+	}
+	b.drivers = append(b.drivers, driver)
+
+	return driver, nil
+}
+
+// BuildNested создает хранилище, обернутое драйвером. field - имя параметра для сообщения об ошибке
+func (b *Builder) BuildNested(field string, config DriverConfig) (music.Storage, error) {
+	driver, err := b.Build(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+
+	return driver, nil
+}
+
+// Drivers возвращает все созданные драйверы в порядке создания: обернутые раньше оберток
+func (b *Builder) Drivers() []music.Storage {
+	return slices.Clone(b.drivers)
+}
+
+// tracer возвращает трассировщик для драйвера name
+func (b *Builder) tracer(name string) trace.Tracer {
+	if b.TracerProvider == nil {
+		return noop.NewTracerProvider().Tracer(name)
+	}
+
+	return b.TracerProvider.Tracer(name)
+}
+
+// meter возвращает измеритель для метрик драйвера name
+func (b *Builder) meter(name string) metric.Meter {
+	if b.MeterProvider == nil {
+		return metricnoop.NewMeterProvider().Meter(name)
+	}
+
+	return b.MeterProvider.Meter(name)
+}
@@ -1,21 +1,29 @@
 package storage
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/aws/smithy-go/logging"
+	"github.com/kroticw/freshman-server/internal/music"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/attribute"
@@ -23,11 +31,24 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
+// maxDeleteObjects - максимальное количество ключей в одном запросе DeleteObjects
+const maxDeleteObjects = 1000
+
 type S3Driver struct {
-	bucket   string
-	basePath string
-	svc      *s3.Client
-	tracer   trace.Tracer
+	bucket    string
+	basePath  string
+	svc       *s3.Client
+	tracer    trace.Tracer
+	multipart *MultipartConfig
+	presign   *PresignConfig
+	// policy - таймауты, повторы и circuit breaker, nil - не заданы
+	policy *s3Policy
+	logger *logrus.Logger
+
+	usageMu sync.Mutex
+	// usage - nil, пока занятое место не подсчитано
+	usage                *spaceUsage
+	usageRefreshInterval time.Duration
 }
 
 func NewS3(
@@ -68,13 +89,70 @@ func NewS3(
 	})
 
 	return &S3Driver{
-		bucket:   bucket,
-		basePath: basePath,
-		tracer:   tracer,
-		svc:      client,
+		bucket:               bucket,
+		basePath:             basePath,
+		tracer:               tracer,
+		svc:                  client,
+		logger:               logger,
+		usageRefreshInterval: DefaultS3UsageRefreshInterval,
 	}
 }
 
+// S3Config - параметры драйвера s3
+type S3Config struct {
+	Endpoint        string `mapstructure:"endpoint"`
+	Region          string `mapstructure:"region"`
+	AccessKeyID     string `mapstructure:"accessKeyId"`
+	SecretAccessKey string `mapstructure:"secretAccessKey"`
+	ForcePathStyle  bool   `mapstructure:"forcePathStyle"`
+	Bucket          string `mapstructure:"bucket"`
+	BasePath        string `mapstructure:"basePath"`
+	// Multipart включает загрузку крупных файлов по частям
+	Multipart *MultipartConfig `mapstructure:"multipart"`
+	// Presign включает прямую загрузку и воспроизведение через временные ссылки на объекты
+	Presign *PresignConfig `mapstructure:"presign"`
+	// UsageRefreshInterval - срок, после которого занятое место пересчитывается обходом бакета,
+	// по умолчанию DefaultS3UsageRefreshInterval
+	UsageRefreshInterval time.Duration `mapstructure:"usageRefreshInterval"`
+	// Таймауты, повторы и circuit breaker действуют всегда, незаданные параметры берутся по умолчанию
+	S3ResilienceConfig `mapstructure:",squash"`
+}
+
+func init() {
+	Register("s3", func(b *Builder, config *S3Config) (music.Storage, error) {
+		if config.Endpoint == "" || config.Region == "" || config.AccessKeyID == "" ||
+			config.SecretAccessKey == "" || config.Bucket == "" {
+			return nil, errors.New("required fields are empty (need endpoint, region, accessKeyId, secretAccessKey, bucket)")
+		}
+		driver := NewS3(
+			config.Region,
+			config.Endpoint,
+			config.AccessKeyID,
+			config.SecretAccessKey,
+			config.ForcePathStyle,
+			config.Bucket,
+			config.BasePath,
+			b.tracer("S3"),
+			b.Logger,
+		)
+		if err := driver.SetResilience(config.S3ResilienceConfig, b.meter("S3")); err != nil {
+			return nil, err
+		}
+		if config.Multipart != nil {
+			if err := driver.SetMultipart(*config.Multipart); err != nil {
+				return nil, fmt.Errorf("multipart: %w", err)
+			}
+		}
+		if config.Presign != nil {
+			driver.SetPresign(*config.Presign)
+		}
+		if config.UsageRefreshInterval != 0 {
+			driver.SetUsageRefreshInterval(config.UsageRefreshInterval)
+		}
+		return driver, nil
+	})
+}
+
 func (s *S3Driver) Exists(ctx context.Context, filename string) (exists bool, err error) {
 	ctx, span := s.tracer.Start(ctx, "Exists")
 	defer span.End()
@@ -100,7 +178,23 @@ func (s *S3Driver) IsLinkedExists(ctx context.Context, filename string, sourceFi
 	return s.Exists(ctx, path.Join(sourceFilename, filename))
 }
 
-func (s *S3Driver) Upload(ctx context.Context, filename string, file []byte) error {
+// metadataChecksumKey - ключ пользовательских метаданных объекта, под которым хранится SHA-256 содержимого
+const metadataChecksumKey = "sha256"
+
+func (s *S3Driver) Upload(ctx context.Context, filename string, file io.Reader, size int64) error {
+	return s.UploadWithMetadata(ctx, filename, file, size, music.ObjectMetadata{})
+}
+
+// UploadWithMetadata сверяет контрольную сумму по мере отправки. Объект, загружаемый одним запросом,
+// при несовпадении отклоняет S3, а если хранилище не сверяет контрольные суммы - объект удаляется
+// после загрузки. Загрузка по частям при несовпадении прерывается до завершения.
+func (s *S3Driver) UploadWithMetadata(
+	ctx context.Context,
+	filename string,
+	file io.Reader,
+	size int64,
+	metadata music.ObjectMetadata,
+) error {
 	ctx, span := s.tracer.Start(ctx, "Upload")
 	defer span.End()
 	span.SetAttributes(attribute.String("aws.s3.key", filename), attribute.String("aws.s3.bucket", s.bucket))
@@ -111,29 +205,71 @@ func (s *S3Driver) Upload(ctx context.Context, filename string, file []byte) err
 	if exists {
 		return os.ErrExist
 	}
-	reader := bytes.NewReader(file)
-	defer reader.Reset([]byte("")) //memory leak fixer
-	filename = getFilePath(filename, s.basePath)
-	_, err = s.svc.PutObject(ctx, &s3.PutObjectInput{
-		Bucket:             &s.bucket,
-		Key:                &filename,
-		ACL:                types.ObjectCannedACLPrivate,
-		Body:               reader,
-		ContentDisposition: aws.String("attachment"),
-	})
+	key := getFilePath(filename, s.basePath)
+	hasher := sha256.New()
+	if metadata.Checksum != "" {
+		file = io.TeeReader(file, hasher)
+	}
+	verify := func() error {
+		if metadata.Checksum != "" && hex.EncodeToString(hasher.Sum(nil)) != metadata.Checksum {
+			return music.ErrChecksumMismatch
+		}
+		return nil
+	}
+	if s.useMultipart(size) {
+		err = s.uploadMultipart(ctx, key, file, size, metadata, verify)
+	} else {
+		input := &s3.PutObjectInput{
+			Bucket:        &s.bucket,
+			Key:           &key,
+			ACL:           types.ObjectCannedACLPrivate,
+			Body:          file,
+			ContentLength: aws.Int64(size),
+			ContentType:   contentTypeOrNil(metadata.ContentType),
+			Metadata:      objectMetadata(metadata),
+		}
+		if metadata.Checksum != "" {
+			// Контрольную сумму проверяет и сам S3: объект с другим содержимым не будет создан
+			checksum, err := hex.DecodeString(metadata.Checksum)
+			if err != nil {
+				return fmt.Errorf("invalid checksum %q: %w", metadata.Checksum, err)
+			}
+			input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(checksum))
+		}
+		// Тело не перематывается, поэтому подписываем запрос без хэша содержимого
+		_, err = s.svc.PutObject(ctx, input, s3.WithAPIOptions(v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware))
+		if isBadDigest(err) {
+			err = music.ErrChecksumMismatch
+		} else if err == nil {
+			if err = verify(); err != nil {
+				// S3 без проверки контрольных сумм принял объект с другим содержимым
+				_, deleteErr := s.svc.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &s.bucket, Key: &key})
+				if deleteErr != nil {
+					s.logger.WithError(deleteErr).Errorf("failed to delete object %s with mismatching checksum", key)
+				}
+			}
+		}
+	}
 	if err != nil {
 		span.SetStatus(codes.Error, err.Error())
+		return err
 	}
+	s.trackUpload(filename, size)
 
-	return err
+	return nil
 }
 
-func (s *S3Driver) UploadLinked(ctx context.Context, filename string, sourceFilename string, file []byte) error {
-	fullFileName := getFullFileName(filename, sourceFilename)
-	return s.Upload(ctx, getFilePath(fullFileName, s.basePath), file)
+func (s *S3Driver) UploadLinked(
+	ctx context.Context,
+	filename string,
+	sourceFilename string,
+	file io.Reader,
+	size int64,
+) error {
+	return s.Upload(ctx, getFullFileName(filename, sourceFilename), file, size)
 }
 
-func (s *S3Driver) Get(ctx context.Context, filename string) ([]byte, error) {
+func (s *S3Driver) Get(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
 	ctx, span := s.tracer.Start(ctx, "Get")
 	defer span.End()
 	filename = getFilePath(filename, s.basePath)
@@ -144,35 +280,172 @@ func (s *S3Driver) Get(ctx context.Context, filename string) ([]byte, error) {
 	})
 	if err != nil {
 		span.SetStatus(codes.Error, err.Error())
-		var opErr *smithy.OperationError
-		if errors.As(err, &opErr) {
-			var nf *types.NotFound
-			if errors.As(err, &nf) {
-				return nil, os.ErrNotExist
+		if isNotFound(err) {
+			return nil, 0, os.ErrNotExist
+		}
+		return nil, 0, err
+	}
+
+	return results.Body, aws.ToInt64(results.ContentLength), nil
+}
+
+func (s *S3Driver) Stat(ctx context.Context, filename string) (*music.ObjectInfo, error) {
+	ctx, span := s.tracer.Start(ctx, "Stat")
+	defer span.End()
+	key := getFilePath(filename, s.basePath)
+	span.SetAttributes(attribute.String("aws.s3.key", key), attribute.String("aws.s3.bucket", s.bucket))
+	head, err := s.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	info := &music.ObjectInfo{
+		Key:     filename,
+		Size:    aws.ToInt64(head.ContentLength),
+		ModTime: aws.ToTime(head.LastModified),
+		ETag:    aws.ToString(head.ETag),
+		ObjectMetadata: music.ObjectMetadata{
+			ContentType: aws.ToString(head.ContentType),
+		},
+	}
+	for name, value := range head.Metadata {
+		name = strings.ToLower(name)
+		if name == metadataChecksumKey {
+			info.Checksum = value
+			continue
+		}
+		if info.Metadata == nil {
+			info.Metadata = make(map[string]string)
+		}
+		info.Metadata[name] = value
+	}
+
+	return info, nil
+}
+
+func (s *S3Driver) GetRange(
+	ctx context.Context,
+	filename string,
+	offset int64,
+	length int64,
+) (*music.ObjectRange, error) {
+	ctx, span := s.tracer.Start(ctx, "GetRange")
+	defer span.End()
+	filename = getFilePath(filename, s.basePath)
+	span.SetAttributes(
+		attribute.String("aws.s3.key", filename),
+		attribute.String("aws.s3.bucket", s.bucket),
+		attribute.Int64("offset", offset),
+		attribute.Int64("length", length),
+	)
+	if offset < 0 || length == 0 {
+		// Пустой диапазон не выражается заголовком Range
+		return s.getEmptyRange(ctx, filename, offset)
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(filename),
+	}
+	if offset > 0 || length > 0 {
+		rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+		if length > 0 {
+			rangeHeader += strconv.FormatInt(offset+length-1, 10)
+		}
+		input.Range = aws.String(rangeHeader)
+	}
+	results, err := s.svc.GetObject(ctx, input)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+			if length < 0 {
+				// Диапазон от конца файла до конца пуст, но S3 считает его некорректным
+				return s.getEmptyRange(ctx, filename, offset)
+			}
+			return nil, music.ErrInvalidRange
+		}
+		return nil, err
+	}
+	contentLength := aws.ToInt64(results.ContentLength)
+	size := contentLength
+	if results.ContentRange != nil {
+		// Content-Range: bytes 0-99/1234
+		rangeParts := strings.SplitN(*results.ContentRange, "/", 2)
+		if len(rangeParts) == 2 {
+			size, err = strconv.ParseInt(rangeParts[1], 10, 64)
+			if err != nil {
+				results.Body.Close()
+				return nil, fmt.Errorf("unexpected content range %q: %w", *results.ContentRange, err)
 			}
 		}
+	}
+	if length > 0 && contentLength != length {
+		// S3 молча обрезает диапазон по концу объекта
+		results.Body.Close()
+		return nil, music.ErrInvalidRange
+	}
+
+	return &music.ObjectRange{
+		Body:         results.Body,
+		Offset:       offset,
+		Length:       contentLength,
+		Size:         size,
+		ETag:         aws.ToString(results.ETag),
+		LastModified: aws.ToTime(results.LastModified),
+	}, nil
+}
+
+func (s *S3Driver) getEmptyRange(ctx context.Context, filename string, offset int64) (*music.ObjectRange, error) {
+	head, err := s.svc.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &filename,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, os.ErrNotExist
+		}
 		return nil, err
 	}
-	defer results.Body.Close()
+	size := aws.ToInt64(head.ContentLength)
+	if offset < 0 || offset > size {
+		return nil, music.ErrInvalidRange
+	}
 
-	return io.ReadAll(results.Body)
+	return &music.ObjectRange{
+		Body:         io.NopCloser(strings.NewReader("")),
+		Offset:       offset,
+		Size:         size,
+		ETag:         aws.ToString(head.ETag),
+		LastModified: aws.ToTime(head.LastModified),
+	}, nil
 }
 
-func (s *S3Driver) GetLinked(ctx context.Context, filename string, sourceFilename string) ([]byte, error) {
+func (s *S3Driver) GetLinked(
+	ctx context.Context,
+	filename string,
+	sourceFilename string,
+) (io.ReadCloser, int64, error) {
 	return s.Get(ctx, getFullFileName(filename, sourceFilename))
 }
 
+// Delete удаляет файл вместе со всеми слинкованными с ним файлами
 func (s *S3Driver) Delete(ctx context.Context, filename string) error {
 	ctx, span := s.tracer.Start(ctx, "Delete")
 	defer span.End()
 
 	// Сначала удаляем слинкованные файлы
 	linkedFilesDeleteCtx, linkedFilesDeleteSpan := s.tracer.Start(ctx, "Delete linked files")
-	sourceFilename := getFilePath(strings.Replace(path.Base(filename), path.Ext(filename), "", -1), s.basePath)
-	_, err := s.svc.DeleteObject(linkedFilesDeleteCtx, &s3.DeleteObjectInput{
-		Bucket: &s.bucket,
-		Key:    &sourceFilename,
-	})
+	err := s.deleteLinked(linkedFilesDeleteCtx, filename)
 	if err != nil {
 		linkedFilesDeleteSpan.SetStatus(codes.Error, err.Error())
 		linkedFilesDeleteSpan.End()
@@ -181,36 +454,185 @@ func (s *S3Driver) Delete(ctx context.Context, filename string) error {
 	linkedFilesDeleteSpan.End()
 	// Удаляем оригинал
 	sourceFileDeleteCtx, sourceFileDeleteSpan := s.tracer.Start(ctx, "Delete source file")
-	filename = getFilePath(filename, s.basePath)
+	defer sourceFileDeleteSpan.End()
+	key := getFilePath(filename, s.basePath)
 	_, err = s.svc.DeleteObject(sourceFileDeleteCtx, &s3.DeleteObjectInput{
 		Bucket: &s.bucket,
-		Key:    &filename,
+		Key:    &key,
 	})
 	if err != nil {
 		sourceFileDeleteSpan.SetStatus(codes.Error, err.Error())
-		sourceFileDeleteSpan.End()
 		return err
 	}
+	s.trackDelete(filename)
+
+	return nil
+}
+
+// deleteLinked удаляет слинкованные файлы пачками по maxDeleteObjects ключей
+func (s *S3Driver) deleteLinked(ctx context.Context, sourceFilename string) error {
+	prefix := getLinkedDirPath(sourceFilename, s.basePath) + "/"
+	paginator := s3.NewListObjectsV2Paginator(s.svc, &s3.ListObjectsV2Input{
+		Bucket:  &s.bucket,
+		Prefix:  &prefix,
+		MaxKeys: aws.Int32(maxDeleteObjects),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+		objects := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			objects = append(objects, types.ObjectIdentifier{Key: object.Key})
+		}
+		result, err := s.svc.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &s.bucket,
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(result.Errors) > 0 {
+			failed := result.Errors[0]
+			return fmt.Errorf("failed to delete %d linked objects, first %s: %s",
+				len(result.Errors), aws.ToString(failed.Key), aws.ToString(failed.Message))
+		}
+	}
+
+	return nil
+}
+
+func (s *S3Driver) ListLinked(ctx context.Context, sourceFilename string) ([]string, error) {
+	ctx, span := s.tracer.Start(ctx, "ListLinked")
+	defer span.End()
+	prefix := getLinkedDirPath(sourceFilename, s.basePath) + "/"
+	span.SetAttributes(attribute.String("aws.s3.prefix", prefix), attribute.String("aws.s3.bucket", s.bucket))
+	names := make([]string, 0)
+	paginator := s3.NewListObjectsV2Paginator(s.svc, &s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			names = append(names, strings.TrimPrefix(aws.ToString(object.Key), prefix))
+		}
+	}
+
+	return names, nil
+}
+
+// Walk обходит все объекты под basePath. Объекты, которые не мог создать драйвер, пропускаются
+func (s *S3Driver) Walk(ctx context.Context, fn func(object music.ObjectInfo) error) error {
+	ctx, span := s.tracer.Start(ctx, "Walk")
+	defer span.End()
+	prefix := s.basePrefix()
+	span.SetAttributes(attribute.String("aws.s3.prefix", prefix), attribute.String("aws.s3.bucket", s.bucket))
+	input := &s3.ListObjectsV2Input{Bucket: &s.bucket}
+	if prefix != "" {
+		input.Prefix = &prefix
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.svc, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+		for _, object := range page.Contents {
+			filename, ok := parseFilePath(strings.TrimPrefix(aws.ToString(object.Key), prefix))
+			if !ok {
+				continue
+			}
+			err = fn(music.ObjectInfo{
+				Key:     filename,
+				Size:    aws.ToInt64(object.Size),
+				ModTime: aws.ToTime(object.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
 
 func (s *S3Driver) DeleteCache(ctx context.Context, filename string, sourceFilename string) error {
 	sourceFileDeleteCtx, sourceFileDeleteSpan := s.tracer.Start(ctx, "Delete cache file")
-	fillPath := getFilePath(getFullFileName(filename, sourceFilename), s.basePath)
-	_, err := s.svc.DeleteObject(sourceFileDeleteCtx, &s3.DeleteObjectInput{
+	defer sourceFileDeleteSpan.End()
+	fullFileName := getFullFileName(filename, sourceFilename)
+	fillPath := getFilePath(fullFileName, s.basePath)
+	// Размер нужен только для учета занятого места
+	head, err := s.svc.HeadObject(sourceFileDeleteCtx, &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &fillPath,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		sourceFileDeleteSpan.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	_, err = s.svc.DeleteObject(sourceFileDeleteCtx, &s3.DeleteObjectInput{
 		Bucket: &s.bucket,
 		Key:    &fillPath,
 	})
 	if err != nil {
 		sourceFileDeleteSpan.SetStatus(codes.Error, err.Error())
-		sourceFileDeleteSpan.End()
 		return err
 	}
+	s.trackDeleteOne(fullFileName, aws.ToInt64(head.ContentLength))
 
 	return nil
 }
 
-func (s *S3Driver) GetSpaceUsage(_ context.Context) (usage int64, err error) {
-	return -1, nil
+// objectMetadata собирает пользовательские метаданные объекта вместе с контрольной суммой
+func objectMetadata(metadata music.ObjectMetadata) map[string]string {
+	if metadata.Checksum == "" && len(metadata.Metadata) == 0 {
+		return nil
+	}
+	result := lowerKeys(metadata.Metadata)
+	if result == nil {
+		result = make(map[string]string)
+	}
+	if metadata.Checksum != "" {
+		result[metadataChecksumKey] = metadata.Checksum
+	}
+
+	return result
+}
+
+func contentTypeOrNil(contentType string) *string {
+	if contentType == "" {
+		return nil
+	}
+
+	return aws.String(contentType)
+}
+
+// isNotFound распознает отсутствие объекта: HeadObject отвечает NotFound, а GetObject - NoSuchKey
+func isNotFound(err error) bool {
+	var opErr *smithy.OperationError
+	if !errors.As(err, &opErr) {
+		return false
+	}
+	var nf *types.NotFound
+	var nsk *types.NoSuchKey
+	return errors.As(err, &nf) || errors.As(err, &nsk)
+}
+
+// isBadDigest - S3 отклонил объект, содержимое которого не совпало с переданной контрольной суммой
+func isBadDigest(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "BadDigest"
 }
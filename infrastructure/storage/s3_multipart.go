@@ -0,0 +1,471 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/kroticw/freshman-server/internal/music"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+const (
+	// minPartSize - минимальный размер части, который принимает S3 (кроме последней)
+	minPartSize = 5 << 20
+	// maxParts - максимальное количество частей в одной загрузке
+	maxParts = 10000
+
+	DefaultMultipartThreshold   = 64 << 20
+	DefaultMultipartPartSize    = 8 << 20
+	DefaultMultipartConcurrency = 4
+)
+
+// MultipartConfig настраивает загрузку крупных файлов в S3 по частям
+type MultipartConfig struct {
+	// Threshold - файлы от этого размера загружаются по частям
+	Threshold int64 `mapstructure:"threshold"`
+	PartSize  int64 `mapstructure:"partSize"`
+	// Concurrency - сколько частей загружается параллельно. В памяти одновременно
+	// находится не больше Concurrency частей
+	Concurrency int `mapstructure:"concurrency"`
+	// StateDir - каталог, где сохраняются идентификаторы незавершенных загрузок,
+	// чтобы повторная загрузка того же файла продолжилась с места обрыва.
+	// Если не задан, загрузки не возобновляются
+	StateDir string `mapstructure:"stateDir"`
+	// StaleAfter - Maintain прерывает незавершенные загрузки старше этого срока. 0 отключает очистку
+	StaleAfter      time.Duration `mapstructure:"staleAfter"`
+	CleanupInterval time.Duration `mapstructure:"cleanupInterval"`
+}
+
+// multipartState - сохраненное состояние незавершенной загрузки
+type multipartState struct {
+	Key       string    `json:"key"`
+	UploadID  string    `json:"uploadId"`
+	Size      int64     `json:"size"`
+	PartSize  int64     `json:"partSize"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type uploadedPart struct {
+	etag string
+	size int64
+}
+
+// SetMultipart включает загрузку по частям для файлов от config.Threshold байт
+func (s *S3Driver) SetMultipart(config MultipartConfig) error {
+	if config.Threshold <= 0 {
+		config.Threshold = DefaultMultipartThreshold
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = DefaultMultipartPartSize
+	}
+	if config.PartSize < minPartSize {
+		return fmt.Errorf("multipart part size must be at least %d bytes", minPartSize)
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = DefaultMultipartConcurrency
+	}
+	if config.StateDir != "" {
+		if err := os.MkdirAll(config.StateDir, 0755); err != nil {
+			return err
+		}
+	}
+	if config.CleanupInterval <= 0 {
+		config.CleanupInterval = time.Hour
+	}
+	s.multipart = &config
+
+	return nil
+}
+
+func (s *S3Driver) useMultipart(size int64) bool {
+	return s.multipart != nil && size >= s.multipart.Threshold
+}
+
+// partSizeFor увеличивает размер части, если иначе файл не уложится в лимит частей S3
+func (s *S3Driver) partSizeFor(size int64) int64 {
+	partSize := s.multipart.PartSize
+	for (size+partSize-1)/partSize > maxParts {
+		partSize *= 2
+	}
+
+	return partSize
+}
+
+// uploadMultipart загружает файл по частям. key - полный ключ объекта в бакете.
+// Если загрузка прервалась, идентификатор остается в StateDir, и при следующей загрузке
+// того же ключа уже принятые S3 части пропускаются (их MD5 сверяется с ETag).
+// verify вызывается, когда все части отправлены, и его ошибка прерывает загрузку.
+func (s *S3Driver) uploadMultipart(
+	ctx context.Context,
+	key string,
+	file io.Reader,
+	size int64,
+	metadata music.ObjectMetadata,
+	verify func() error,
+) error {
+	ctx, span := s.tracer.Start(ctx, "UploadMultipart")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("aws.s3.key", key),
+		attribute.String("aws.s3.bucket", s.bucket),
+		attribute.Int64("size", size),
+	)
+
+	state, uploaded, err := s.resumeMultipart(ctx, key, size)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	if state == nil {
+		state, err = s.createMultipart(ctx, key, size, metadata)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+	} else {
+		span.SetAttributes(attribute.Int("resumedParts", len(uploaded)))
+	}
+
+	parts, err := s.uploadParts(ctx, state, file, uploaded)
+	if err != nil {
+		// Загрузку не прерываем: она будет продолжена при повторе или прервана при очистке
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	if err = verify(); err != nil {
+		s.abortMultipart(ctx, state)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	_, err = s.svc.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		UploadId:        &state.UploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	s.forgetMultipart(key)
+
+	return nil
+}
+
+func (s *S3Driver) createMultipart(
+	ctx context.Context,
+	key string,
+	size int64,
+	metadata music.ObjectMetadata,
+) (*multipartState, error) {
+	created, err := s.svc.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		ACL:         types.ObjectCannedACLPrivate,
+		ContentType: contentTypeOrNil(metadata.ContentType),
+		Metadata:    objectMetadata(metadata),
+	})
+	if err != nil {
+		return nil, err
+	}
+	state := &multipartState{
+		Key:       key,
+		UploadID:  aws.ToString(created.UploadId),
+		Size:      size,
+		PartSize:  s.partSizeFor(size),
+		CreatedAt: time.Now(),
+	}
+	if err = s.saveMultipart(state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// resumeMultipart находит сохраненную загрузку ключа и список уже принятых частей
+func (s *S3Driver) resumeMultipart(
+	ctx context.Context,
+	key string,
+	size int64,
+) (*multipartState, map[int32]uploadedPart, error) {
+	state, err := s.loadMultipart(key)
+	if err != nil || state == nil {
+		return nil, nil, err
+	}
+	if state.Size != size {
+		// Под тем же ключом загружается другой файл, старую загрузку бросаем
+		s.abortMultipart(ctx, state)
+		return nil, nil, nil
+	}
+
+	uploaded := make(map[int32]uploadedPart)
+	paginator := s3.NewListPartsPaginator(s.svc, &s3.ListPartsInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		UploadId: &state.UploadID,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			var nsu *types.NoSuchUpload
+			if errors.As(err, &nsu) {
+				s.forgetMultipart(key)
+				return nil, nil, nil
+			}
+			return nil, nil, err
+		}
+		for _, part := range page.Parts {
+			uploaded[aws.ToInt32(part.PartNumber)] = uploadedPart{
+				etag: aws.ToString(part.ETag),
+				size: aws.ToInt64(part.Size),
+			}
+		}
+	}
+
+	return state, uploaded, nil
+}
+
+// uploadParts читает file последовательно и отправляет части параллельно
+func (s *S3Driver) uploadParts(
+	ctx context.Context,
+	state *multipartState,
+	file io.Reader,
+	uploaded map[int32]uploadedPart,
+) ([]types.CompletedPart, error) {
+	buffers := make(chan []byte, s.multipart.Concurrency)
+	for i := 0; i < s.multipart.Concurrency; i++ {
+		buffers <- make([]byte, state.PartSize)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		parts    []types.CompletedPart
+	)
+	// После ошибки новые части не читаются, но уже отправленные догружаются:
+	// они пригодятся при возобновлении
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	complete := func(number int32, etag string) {
+		mu.Lock()
+		defer mu.Unlock()
+		parts = append(parts, types.CompletedPart{PartNumber: aws.Int32(number), ETag: aws.String(etag)})
+	}
+
+	remaining := state.Size
+	for number := int32(1); remaining > 0; number++ {
+		var buf []byte
+		select {
+		case buf = <-buffers:
+		case <-ctx.Done():
+			fail(ctx.Err())
+		}
+		if buf == nil || failed() {
+			break
+		}
+		partSize := min(state.PartSize, remaining)
+		if _, err := io.ReadFull(file, buf[:partSize]); err != nil {
+			buffers <- buf
+			fail(err)
+			break
+		}
+		remaining -= partSize
+
+		sum := md5.Sum(buf[:partSize])
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		if part, ok := uploaded[number]; ok && part.size == partSize && part.etag == etag {
+			complete(number, etag)
+			buffers <- buf
+			continue
+		}
+
+		wg.Add(1)
+		go func(number int32, body []byte) {
+			defer wg.Done()
+			defer func() { buffers <- body[:cap(body)] }()
+			result, err := s.svc.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:        &s.bucket,
+				Key:           &state.Key,
+				UploadId:      &state.UploadID,
+				PartNumber:    aws.Int32(number),
+				Body:          bytes.NewReader(body),
+				ContentLength: aws.Int64(int64(len(body))),
+			}, withoutDefaultChecksums)
+			if err != nil {
+				fail(fmt.Errorf("upload part %d: %w", number, err))
+				return
+			}
+			complete(number, aws.ToString(result.ETag))
+		}(number, buf[:partSize])
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+
+	return parts, nil
+}
+
+// Maintain периодически прерывает брошенные загрузки по частям, если задан multipart.staleAfter
+func (s *S3Driver) Maintain(ctx context.Context) {
+	if s.multipart == nil || s.multipart.StaleAfter <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.multipart.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		aborted, err := s.AbortStaleMultipartUploads(ctx, s.multipart.StaleAfter)
+		if err != nil {
+			s.logger.WithError(err).WithField("category", "s3").Error("failed to abort stale multipart uploads")
+		} else if aborted > 0 {
+			s.logger.WithField("category", "s3").Infof("Aborted %d stale multipart uploads", aborted)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// withoutDefaultChecksums отключает контрольные суммы, которые SDK добавляет к частям по умолчанию:
+// загрузка создается без алгоритма контрольной суммы, и S3-совместимые хранилища отклоняют такие части
+func withoutDefaultChecksums(o *s3.Options) {
+	o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+}
+
+// AbortStaleMultipartUploads прерывает незавершенные загрузки под basePath старше olderThan,
+// чтобы брошенные части не занимали место в бакете. Возвращает количество прерванных загрузок.
+func (s *S3Driver) AbortStaleMultipartUploads(ctx context.Context, olderThan time.Duration) (int, error) {
+	ctx, span := s.tracer.Start(ctx, "AbortStaleMultipartUploads")
+	defer span.End()
+
+	deadline := time.Now().Add(-olderThan)
+	aborted := 0
+	input := &s3.ListMultipartUploadsInput{Bucket: &s.bucket}
+	if prefix := s.basePrefix(); prefix != "" {
+		input.Prefix = &prefix
+	}
+	for {
+		page, err := s.svc.ListMultipartUploads(ctx, input)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return aborted, err
+		}
+		for _, upload := range page.Uploads {
+			if upload.Initiated == nil || upload.Initiated.After(deadline) {
+				continue
+			}
+			state := &multipartState{Key: aws.ToString(upload.Key), UploadID: aws.ToString(upload.UploadId)}
+			if err = s.abortMultipart(ctx, state); err != nil {
+				span.SetStatus(codes.Error, err.Error())
+				return aborted, err
+			}
+			aborted++
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			break
+		}
+		input.KeyMarker = page.NextKeyMarker
+		input.UploadIdMarker = page.NextUploadIdMarker
+	}
+	span.SetAttributes(attribute.Int("aborted", aborted))
+
+	return aborted, nil
+}
+
+func (s *S3Driver) abortMultipart(ctx context.Context, state *multipartState) error {
+	_, err := s.svc.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &state.Key,
+		UploadId: &state.UploadID,
+	})
+	var apiErr smithy.APIError
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload") {
+		return err
+	}
+	if saved, _ := s.loadMultipart(state.Key); saved != nil && saved.UploadID == state.UploadID {
+		s.forgetMultipart(state.Key)
+	}
+
+	return nil
+}
+
+func (s *S3Driver) multipartStatePath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.multipart.StateDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *S3Driver) loadMultipart(key string) (*multipartState, error) {
+	if s.multipart == nil || s.multipart.StateDir == "" {
+		return nil, nil
+	}
+	contents, err := os.ReadFile(s.multipartStatePath(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state multipartState
+	if err = json.Unmarshal(contents, &state); err != nil {
+		return nil, err
+	}
+	if state.Key != key {
+		return nil, nil
+	}
+
+	return &state, nil
+}
+
+func (s *S3Driver) saveMultipart(state *multipartState) error {
+	if s.multipart.StateDir == "" {
+		return nil
+	}
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.multipartStatePath(state.Key), contents, 0644)
+}
+
+func (s *S3Driver) forgetMultipart(key string) {
+	if s.multipart == nil || s.multipart.StateDir == "" {
+		return
+	}
+	_ = os.Remove(s.multipartStatePath(key))
+}
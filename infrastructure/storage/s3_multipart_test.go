@@ -0,0 +1,408 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kroticw/freshman-server/infrastructure/storage"
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+const testPartSize = 5 << 20
+
+// multipartUpload - незавершенная загрузка по частям в multipartS3
+type multipartUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+// multipartS3 отвечает как бакет S3 на запросы загрузки по частям (создание, отправка и список частей,
+// завершение, прерывание и список незавершенных загрузок) и на HEAD, PUT, DELETE и список объектов
+type multipartS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]*multipartUpload
+	lastID  int
+	// scans - сколько раз запрашивался список всех объектов бакета
+	scans int
+	// partRequests - сколько раз отправлялась каждая часть, creates - сколько загрузок создано
+	partRequests map[int]int
+	creates      int
+	// failPart - номер части, отправка которой завершается ошибкой 503
+	failPart int
+	// ignoreChecksums - бакет принимает объект, не сверяя его с x-amz-checksum-sha256,
+	// как S3-совместимые хранилища без поддержки контрольных сумм
+	ignoreChecksums bool
+	// putChecksum - x-amz-checksum-sha256 последнего PUT объекта
+	putChecksum string
+}
+
+func newBucketS3(t *testing.T) (*multipartS3, *storage.S3Driver) {
+	fake := &multipartS3{
+		objects:      make(map[string][]byte),
+		uploads:      make(map[string]*multipartUpload),
+		partRequests: make(map[int]int),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	// Повторы отключены, чтобы внедренный сбой сразу прерывал запрос
+	driver := newResilientS3(t, server.URL, storage.S3ResilienceConfig{
+		Retry: storage.S3RetryConfig{MaxAttempts: 1},
+	})
+
+	return fake, driver
+}
+
+func newMultipartS3(t *testing.T) (*multipartS3, *storage.S3Driver, string) {
+	fake, driver := newBucketS3(t)
+	stateDir := t.TempDir()
+	err := driver.SetMultipart(storage.MultipartConfig{
+		Threshold:   testPartSize,
+		PartSize:    testPartSize,
+		Concurrency: 1,
+		StateDir:    stateDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, driver, stateDir
+}
+
+func (f *multipartS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/music/")
+	query := r.URL.Query()
+	uploadID := query.Get("uploadId")
+	upload := f.uploads[uploadID]
+	if uploadID != "" && upload == nil {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	case r.Method == http.MethodPut && uploadID == "":
+		data, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(data)
+		checksum := r.Header.Get("X-Amz-Checksum-Sha256")
+		f.putChecksum = checksum
+		if !f.ignoreChecksums && checksum != "" && checksum != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeS3Error(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+		f.objects[key] = data
+		w.Header().Set("ETag", partETag(data))
+	case r.Method == http.MethodDelete && uploadID == "":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && query.Has("delete"):
+		var request struct {
+			Object []struct{ Key string }
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		for _, object := range request.Object {
+			delete(f.objects, object.Key)
+		}
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+		}{})
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		if query.Get("prefix") == "" {
+			f.scans++
+		}
+		type content struct {
+			Key  string
+			Size int
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			IsTruncated bool
+			Contents    []content
+		}{}
+		for key, data := range f.objects {
+			if strings.HasPrefix(key, query.Get("prefix")) {
+				result.Contents = append(result.Contents, content{key, len(data)})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		writeXML(w, result)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.lastID++
+		f.creates++
+		uploadID = strconv.Itoa(f.lastID)
+		f.uploads[uploadID] = &multipartUpload{key: key, initiated: time.Now(), parts: make(map[int][]byte)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Key      string
+			UploadId string
+		}{Key: key, UploadId: uploadID})
+	case r.Method == http.MethodPut && uploadID != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.partRequests[number]++
+		data, _ := io.ReadAll(r.Body)
+		if number == f.failPart {
+			writeS3Error(w, http.StatusServiceUnavailable, "ServiceUnavailable")
+			return
+		}
+		upload.parts[number] = data
+		w.Header().Set("ETag", partETag(data))
+	case r.Method == http.MethodGet && uploadID != "":
+		type part struct {
+			PartNumber int
+			ETag       string
+			Size       int
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListPartsResult"`
+			IsTruncated bool
+			Part        []part
+		}{}
+		for number, data := range upload.parts {
+			result.Part = append(result.Part, part{number, partETag(data), len(data)})
+		}
+		sort.Slice(result.Part, func(i, j int) bool { return result.Part[i].PartNumber < result.Part[j].PartNumber })
+		writeXML(w, result)
+	case r.Method == http.MethodPost && uploadID != "":
+		var completed struct {
+			Part []struct{ PartNumber int }
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&completed); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object []byte
+		for _, part := range completed.Part {
+			object = append(object, upload.parts[part.PartNumber]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, uploadID)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string
+			ETag    string
+		}{Key: key, ETag: `"object"`})
+	case r.Method == http.MethodDelete && uploadID != "":
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && query.Has("uploads"):
+		type pending struct {
+			Key       string
+			UploadId  string
+			Initiated string
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+			IsTruncated bool
+			Upload      []pending
+		}{}
+		for id, upload := range f.uploads {
+			if strings.HasPrefix(upload.key, query.Get("prefix")) {
+				result.Upload = append(result.Upload, pending{upload.key, id, upload.initiated.UTC().Format(time.RFC3339)})
+			}
+		}
+		writeXML(w, result)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *multipartS3) set(fn func(f *multipartS3)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(f)
+}
+
+// object возвращает содержимое файла filename. Ключ объекта в бакете строит драйвер, см. getFilePath
+func (f *multipartS3) object(filename string) []byte {
+	for key, data := range f.objects {
+		if path.Base(key) == filename {
+			return data
+		}
+	}
+
+	return nil
+}
+
+func partETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(body)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>injected fault</Message></Error>", code)
+}
+
+func stateFiles(t *testing.T, stateDir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(entries)
+}
+
+func TestS3DriverMultipartResume(t *testing.T) {
+	fake, driver, stateDir := newMultipartS3(t)
+	ctx := context.Background()
+	content := make([]byte, 2*testPartSize+1024)
+	rand.Read(content)
+
+	// Вторая часть не принята: загрузка обрывается, ее идентификатор остается в StateDir
+	fake.set(func(f *multipartS3) { f.failPart = 2 })
+	if err := driver.Upload(ctx, "song.audio", bytes.NewReader(content), int64(len(content))); err == nil {
+		t.Fatal("Upload succeeded despite the failed part")
+	}
+	if stateFiles(t, stateDir) != 1 {
+		t.Fatal("interrupted upload is not saved in state dir")
+	}
+
+	fake.set(func(f *multipartS3) { f.failPart = 0 })
+	if err := driver.Upload(ctx, "song.audio", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("resumed Upload: %v", err)
+	}
+	fake.set(func(f *multipartS3) {
+		if f.creates != 1 {
+			t.Errorf("created %d multipart uploads, want 1 resumed", f.creates)
+		}
+		// Уже принятая первая часть повторно не отправляется
+		if f.partRequests[1] != 1 || f.partRequests[2] != 2 || f.partRequests[3] != 1 {
+			t.Errorf("part requests = %v, want 1: 1, 2: 2, 3: 1", f.partRequests)
+		}
+		if !bytes.Equal(f.object("song.audio"), content) {
+			t.Error("completed object differs from uploaded content")
+		}
+		if len(f.uploads) != 0 {
+			t.Errorf("%d multipart uploads left after completion", len(f.uploads))
+		}
+	})
+	if stateFiles(t, stateDir) != 0 {
+		t.Error("state of completed upload is left in state dir")
+	}
+}
+
+func TestS3DriverMultipartResumeChangedContent(t *testing.T) {
+	fake, driver, _ := newMultipartS3(t)
+	ctx := context.Background()
+	content := make([]byte, 2*testPartSize)
+	rand.Read(content)
+	fake.set(func(f *multipartS3) { f.failPart = 2 })
+	_ = driver.Upload(ctx, "song.audio", bytes.NewReader(content), int64(len(content)))
+
+	// Под тем же ключом загружается файл с другой первой частью: принятая часть не подходит
+	fake.set(func(f *multipartS3) { f.failPart = 0 })
+	rand.Read(content[:testPartSize])
+	if err := driver.Upload(ctx, "song.audio", bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	fake.set(func(f *multipartS3) {
+		if f.partRequests[1] != 2 || !bytes.Equal(f.object("song.audio"), content) {
+			t.Errorf("part requests = %v, object matches content: %t", f.partRequests, bytes.Equal(f.object("song.audio"), content))
+		}
+	})
+}
+
+func TestS3DriverAbortStaleMultipartUploads(t *testing.T) {
+	fake, driver, stateDir := newMultipartS3(t)
+	ctx := context.Background()
+	content := make([]byte, 2*testPartSize)
+	fake.set(func(f *multipartS3) { f.failPart = 1 })
+	_ = driver.Upload(ctx, "stale.audio", bytes.NewReader(content), int64(len(content)))
+	fake.set(func(f *multipartS3) {
+		f.uploads["1"].initiated = time.Now().Add(-2 * time.Hour)
+		f.uploads["recent"] = &multipartUpload{key: "recent.audio", initiated: time.Now(), parts: make(map[int][]byte)}
+	})
+
+	aborted, err := driver.AbortStaleMultipartUploads(ctx, time.Hour)
+	if err != nil || aborted != 1 {
+		t.Fatalf("AbortStaleMultipartUploads() = %d, %v, want 1", aborted, err)
+	}
+	fake.set(func(f *multipartS3) {
+		if _, ok := f.uploads["1"]; ok {
+			t.Error("stale upload is not aborted")
+		}
+		if _, ok := f.uploads["recent"]; !ok {
+			t.Error("recent upload is aborted")
+		}
+	})
+	if stateFiles(t, stateDir) != 0 {
+		t.Error("state of aborted upload is left in state dir")
+	}
+}
+
+func TestS3DriverUploadChecksum(t *testing.T) {
+	content := "audio content"
+	sum := sha256.Sum256([]byte(content))
+	checksum := hex.EncodeToString(sum[:])
+	wrongSum := sha256.Sum256([]byte("other content"))
+	for _, ignoreChecksums := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ignoreChecksums=%t", ignoreChecksums), func(t *testing.T) {
+			fake, driver := newBucketS3(t)
+			fake.set(func(f *multipartS3) { f.ignoreChecksums = ignoreChecksums })
+			ctx := context.Background()
+			upload := func(filename string, checksum string) error {
+				return driver.UploadWithMetadata(ctx, filename, strings.NewReader(content), int64(len(content)),
+					music.ObjectMetadata{Checksum: checksum})
+			}
+
+			// Объект с другим содержимым отклоняет S3, а если он не сверяет контрольные суммы - удаляет драйвер
+			if err := upload("wrong.audio", hex.EncodeToString(wrongSum[:])); !errors.Is(err, music.ErrChecksumMismatch) {
+				t.Fatalf("UploadWithMetadata() with wrong checksum error = %v, want %v", err, music.ErrChecksumMismatch)
+			}
+			fake.set(func(f *multipartS3) {
+				if f.object("wrong.audio") != nil {
+					t.Error("object with wrong checksum left in the bucket")
+				}
+			})
+
+			if err := upload("right.audio", checksum); err != nil {
+				t.Fatal(err)
+			}
+			fake.set(func(f *multipartS3) {
+				if data := f.object("right.audio"); string(data) != content {
+					t.Errorf("object = %q, want %q", data, content)
+				}
+				if want := base64.StdEncoding.EncodeToString(sum[:]); f.putChecksum != want {
+					t.Errorf("PutObject sent checksum %q, want %q", f.putChecksum, want)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,562 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	DefaultS3Timeout                  = 30 * time.Second
+	DefaultS3StallTimeout             = time.Minute
+	DefaultS3RetryMaxAttempts         = 3
+	DefaultS3RetryBaseDelay           = 100 * time.Millisecond
+	DefaultS3RetryMaxDelay            = 5 * time.Second
+	DefaultCircuitBreakerThreshold    = 5
+	DefaultCircuitBreakerOpenDuration = 30 * time.Second
+)
+
+// DefaultS3OperationTimeouts - таймауты операций, для которых не подходит DefaultS3Timeout.
+// PutObject передает файл целиком, и его длительность зависит от размера файла, поэтому
+// зависшую загрузку прерывает не общий таймаут, а таймаут простоя S3TimeoutConfig.Stall
+var DefaultS3OperationTimeouts = map[string]time.Duration{
+	"PutObject":  0,
+	"UploadPart": 5 * time.Minute,
+}
+
+// s3NonIdempotentOperations не повторяются: тело PutObject - поток, который нельзя перечитать,
+// а повтор CreateMultipartUpload и CompleteMultipartUpload создает лишнюю загрузку или ошибку NoSuchUpload
+var s3NonIdempotentOperations = map[string]bool{
+	"PutObject":               true,
+	"CreateMultipartUpload":   true,
+	"CompleteMultipartUpload": true,
+}
+
+// ErrCircuitOpen возвращается без обращения к S3, пока circuit breaker разомкнут
+var ErrCircuitOpen = errors.New("s3 circuit breaker is open")
+
+// S3TimeoutConfig задает таймауты одной попытки запроса. Для GetObject таймаут ограничивает
+// ожидание ответа, но не чтение содержимого, которое может длиться сколько угодно
+type S3TimeoutConfig struct {
+	// Default - таймаут операций, не указанных в Operations
+	Default time.Duration `mapstructure:"default"`
+	// Operations - таймауты по имени операции S3 API (HeadObject, GetObject, PutObject, UploadPart...).
+	// 0 - без таймаута
+	Operations map[string]time.Duration `mapstructure:"operations"`
+	// Stall - таймаут простоя для операций с телом запроса, у которых нет таймаута: попытка прерывается,
+	// если тело не читается дольше Stall, в том числе в ожидании ответа после отправки всего тела
+	Stall time.Duration `mapstructure:"stall"`
+}
+
+// S3RetryConfig задает повтор идемпотентных операций с экспоненциальной задержкой со случайным разбросом
+type S3RetryConfig struct {
+	// MaxAttempts - число попыток, включая первую. 1 отключает повторы
+	MaxAttempts int           `mapstructure:"maxAttempts"`
+	BaseDelay   time.Duration `mapstructure:"baseDelay"`
+	MaxDelay    time.Duration `mapstructure:"maxDelay"`
+}
+
+// CircuitBreakerConfig задает circuit breaker: после FailureThreshold неудачных операций подряд
+// запросы к S3 сразу завершаются ErrCircuitOpen, а через OpenDuration одна пробная операция проверяет,
+// восстановился ли S3
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `mapstructure:"failureThreshold"`
+	OpenDuration     time.Duration `mapstructure:"openDuration"`
+}
+
+// S3ResilienceConfig - таймауты, повторы и circuit breaker запросов к S3. Незаданные значения
+// берутся по умолчанию
+type S3ResilienceConfig struct {
+	Timeouts       S3TimeoutConfig      `mapstructure:"timeouts"`
+	Retry          S3RetryConfig        `mapstructure:"retry"`
+	CircuitBreaker CircuitBreakerConfig `mapstructure:"circuitBreaker"`
+}
+
+func (config *S3ResilienceConfig) setDefaults() {
+	if config.Timeouts.Default <= 0 {
+		config.Timeouts.Default = DefaultS3Timeout
+	}
+	if config.Timeouts.Stall <= 0 {
+		config.Timeouts.Stall = DefaultS3StallTimeout
+	}
+	// viper приводит ключи к нижнему регистру, поэтому имена операций сравниваются без учета регистра
+	operations := make(map[string]time.Duration, len(DefaultS3OperationTimeouts)+len(config.Timeouts.Operations))
+	for name, timeout := range DefaultS3OperationTimeouts {
+		operations[strings.ToLower(name)] = timeout
+	}
+	for name, timeout := range config.Timeouts.Operations {
+		operations[strings.ToLower(name)] = timeout
+	}
+	config.Timeouts.Operations = operations
+	if config.Retry.MaxAttempts <= 0 {
+		config.Retry.MaxAttempts = DefaultS3RetryMaxAttempts
+	}
+	if config.Retry.BaseDelay <= 0 {
+		config.Retry.BaseDelay = DefaultS3RetryBaseDelay
+	}
+	if config.Retry.MaxDelay <= 0 {
+		config.Retry.MaxDelay = DefaultS3RetryMaxDelay
+	}
+	if config.CircuitBreaker.FailureThreshold <= 0 {
+		config.CircuitBreaker.FailureThreshold = DefaultCircuitBreakerThreshold
+	}
+	if config.CircuitBreaker.OpenDuration <= 0 {
+		config.CircuitBreaker.OpenDuration = DefaultCircuitBreakerOpenDuration
+	}
+}
+
+// timeout возвращает таймаут попытки операции, 0 - без таймаута
+func (config *S3TimeoutConfig) timeout(operation string) time.Duration {
+	if timeout, ok := config.Operations[strings.ToLower(operation)]; ok {
+		return timeout
+	}
+
+	return config.Default
+}
+
+// SetResilience включает таймауты, повторы и circuit breaker для всех запросов драйвера.
+// Состояние circuit breaker и число повторов и таймаутов публикуются в метриках meter
+func (s *S3Driver) SetResilience(config S3ResilienceConfig, meter metric.Meter) error {
+	config.setDefaults()
+	policy := &s3Policy{
+		config: config,
+		breaker: &circuitBreaker{
+			threshold:    config.CircuitBreaker.FailureThreshold,
+			openDuration: config.CircuitBreaker.OpenDuration,
+			logger:       s.logger.WithField("category", "s3").WithField("bucket", s.bucket),
+		},
+		bucket: attribute.String("aws.s3.bucket", s.bucket),
+	}
+	if err := policy.initMetrics(meter); err != nil {
+		return err
+	}
+
+	retryer := retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = config.Retry.MaxAttempts
+		o.MaxBackoff = config.Retry.MaxDelay
+		o.Backoff = jitterBackoff{base: config.Retry.BaseDelay, max: config.Retry.MaxDelay}
+		o.Retryables = append([]retry.IsErrorRetryable{retry.IsErrorRetryableFunc(policy.isRetryable)}, o.Retryables...)
+		// Квота повторов SDK отключена: при отказе S3 повторы ограничивает circuit breaker
+		o.RateLimiter = ratelimit.None
+	})
+	s.policy = policy
+	s.svc = s3.New(s.svc.Options(), func(o *s3.Options) {
+		o.Retryer = retryer
+		o.APIOptions = append(o.APIOptions, policy.addMiddlewares)
+	})
+
+	return nil
+}
+
+// s3Policy подключается к стеку middleware клиента S3: circuit breaker оборачивает операцию целиком
+// вместе с повторами, а таймаут ограничивает каждую попытку отдельно
+type s3Policy struct {
+	config  S3ResilienceConfig
+	breaker *circuitBreaker
+
+	bucket   attribute.KeyValue
+	retries  metric.Int64Counter
+	timeouts metric.Int64Counter
+	rejected metric.Int64Counter
+}
+
+const (
+	circuitBreakerMiddlewareID = "FreshmanCircuitBreaker"
+	attemptTimeoutMiddlewareID = "FreshmanAttemptTimeout"
+)
+
+func (p *s3Policy) initMetrics(meter metric.Meter) error {
+	var err error
+	if p.retries, err = meter.Int64Counter("storage.s3.retries",
+		metric.WithDescription("Repeated attempts of S3 operations")); err != nil {
+		return err
+	}
+	if p.timeouts, err = meter.Int64Counter("storage.s3.timeouts",
+		metric.WithDescription("S3 operation attempts cancelled by timeout")); err != nil {
+		return err
+	}
+	if p.rejected, err = meter.Int64Counter("storage.s3.circuit_breaker.rejected",
+		metric.WithDescription("S3 operations rejected by the open circuit breaker")); err != nil {
+		return err
+	}
+	_, err = meter.Int64ObservableGauge("storage.s3.circuit_breaker.state",
+		metric.WithDescription("Circuit breaker state: 0 - closed, 1 - half-open, 2 - open"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(p.breaker.currentState()), metric.WithAttributes(p.bucket))
+			return nil
+		}))
+
+	return err
+}
+
+func (p *s3Policy) operationAttrs(operation string) metric.MeasurementOption {
+	return metric.WithAttributes(p.bucket, attribute.String("operation", operation))
+}
+
+func (p *s3Policy) addMiddlewares(stack *middleware.Stack) error {
+	err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc(circuitBreakerMiddlewareID, p.handleOperation),
+		middleware.After)
+	if err != nil {
+		return err
+	}
+	if _, ok := stack.Finalize.Get("Retry"); !ok {
+		return nil
+	}
+
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc(attemptTimeoutMiddlewareID, p.handleAttempt),
+		"Retry", middleware.After)
+}
+
+// removeMiddlewares отключает политику для подписи ссылок: она не обращается к S3
+func (p *s3Policy) removeMiddlewares(stack *middleware.Stack) error {
+	if _, ok := stack.Initialize.Get(circuitBreakerMiddlewareID); ok {
+		if _, err := stack.Initialize.Remove(circuitBreakerMiddlewareID); err != nil {
+			return err
+		}
+	}
+	if _, ok := stack.Finalize.Get(attemptTimeoutMiddlewareID); ok {
+		if _, err := stack.Finalize.Remove(attemptTimeoutMiddlewareID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attemptCounterKey - ключ контекста со счетчиком попыток операции
+type attemptCounterKey struct{}
+
+func (p *s3Policy) handleOperation(
+	ctx context.Context,
+	in middleware.InitializeInput,
+	next middleware.InitializeHandler,
+) (middleware.InitializeOutput, middleware.Metadata, error) {
+	operation := awsmiddleware.GetOperationName(ctx)
+	if err := p.breaker.allow(); err != nil {
+		p.rejected.Add(ctx, 1, p.operationAttrs(operation))
+		return middleware.InitializeOutput{}, middleware.Metadata{}, fmt.Errorf("%s: %w", operation, err)
+	}
+	attempts := 0
+	out, metadata, err := next.HandleInitialize(context.WithValue(ctx, attemptCounterKey{}, &attempts), in)
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		// Запрос отменил вызывающий, о состоянии S3 это ничего не говорит
+		p.breaker.release()
+		return out, metadata, err
+	}
+	p.breaker.record(!isS3Failure(err))
+
+	return out, metadata, err
+}
+
+func (p *s3Policy) handleAttempt(
+	ctx context.Context,
+	in middleware.FinalizeInput,
+	next middleware.FinalizeHandler,
+) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	operation := awsmiddleware.GetOperationName(ctx)
+	if attempts, ok := ctx.Value(attemptCounterKey{}).(*int); ok {
+		*attempts++
+		if *attempts > 1 {
+			p.retries.Add(ctx, 1, p.operationAttrs(operation))
+		}
+	}
+
+	timeout := p.config.Timeouts.timeout(operation)
+	var stall *stallTimer
+	var out middleware.FinalizeOutput
+	var metadata middleware.Metadata
+	var err error
+	request, hasBody := in.Request.(*smithyhttp.Request)
+	hasBody = hasBody && request.GetStream() != nil
+	if timeout <= 0 && !hasBody {
+		out, metadata, err = next.HandleFinalize(ctx, in)
+	} else {
+		// Отмена по таймеру, а не context.WithTimeout: после получения ответа GetObject
+		// таймер останавливается, и содержимое можно читать дольше таймаута
+		attemptCtx, cancel := context.WithCancel(ctx)
+		var timer *time.Timer
+		if timeout > 0 {
+			timer = time.AfterFunc(timeout, cancel)
+		} else {
+			stall = newStallTimer(p.config.Timeouts.Stall, cancel)
+			if in.Request, err = request.SetStream(stall.wrap(request.GetStream())); err != nil {
+				stall.stop()
+				cancel()
+				return out, metadata, err
+			}
+		}
+		out, metadata, err = next.HandleFinalize(attemptCtx, in)
+		expired := timer != nil && !timer.Stop()
+		stalled := stall != nil && stall.stop()
+		switch {
+		case err != nil && (expired || stalled) && ctx.Err() == nil:
+			cancel()
+			p.timeouts.Add(ctx, 1, p.operationAttrs(operation))
+			if stalled {
+				err = &attemptTimeoutError{operation: operation, timeout: p.config.Timeouts.Stall, stalled: true, err: err}
+			} else {
+				err = &attemptTimeoutError{operation: operation, timeout: timeout, err: err}
+			}
+		case err == nil:
+			if result, ok := out.Result.(*s3.GetObjectOutput); ok && result.Body != nil {
+				result.Body = &cancelOnClose{ReadCloser: result.Body, cancel: cancel}
+			} else {
+				cancel()
+			}
+		default:
+			cancel()
+		}
+	}
+	if err != nil && s3NonIdempotentOperations[operation] {
+		err = &nonIdempotentError{err: err}
+	}
+
+	return out, metadata, err
+}
+
+// isRetryable дополняет проверки SDK: попытка, прерванная таймаутом, повторяется,
+// а неидемпотентные операции не повторяются никогда
+func (p *s3Policy) isRetryable(err error) aws.Ternary {
+	var nonIdempotent *nonIdempotentError
+	if errors.As(err, &nonIdempotent) {
+		return aws.FalseTernary
+	}
+	var timeout *attemptTimeoutError
+	if errors.As(err, &timeout) {
+		return aws.TrueTernary
+	}
+
+	return aws.UnknownTernary
+}
+
+// isS3Failure сообщает, говорит ли ошибка о неисправности S3. Ответы 4xx, кроме 429,
+// означают, что S3 работает: например, объекта нет или запрос неверен
+func isS3Failure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var response interface{ HTTPStatusCode() int }
+	if errors.As(err, &response) {
+		status := response.HTTPStatusCode()
+		return status >= 500 || status == 429
+	}
+
+	return true
+}
+
+type attemptTimeoutError struct {
+	operation string
+	timeout   time.Duration
+	// stalled - попытка прервана таймаутом простоя
+	stalled bool
+	err     error
+}
+
+func (e *attemptTimeoutError) Error() string {
+	if e.stalled {
+		return fmt.Sprintf("%s attempt stalled for %s: %v", e.operation, e.timeout, e.err)
+	}
+	return fmt.Sprintf("%s attempt timed out after %s: %v", e.operation, e.timeout, e.err)
+}
+
+func (e *attemptTimeoutError) Unwrap() error { return e.err }
+
+func (e *attemptTimeoutError) Timeout() bool { return true }
+
+type nonIdempotentError struct {
+	err error
+}
+
+func (e *nonIdempotentError) Error() string { return e.err.Error() }
+
+func (e *nonIdempotentError) Unwrap() error { return e.err }
+
+// cancelOnClose освобождает контекст попытки, когда вызывающий дочитал содержимое
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// stallTimer отменяет попытку, если тело запроса не читается дольше timeout
+type stallTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+}
+
+func newStallTimer(timeout time.Duration, cancel context.CancelFunc) *stallTimer {
+	t := &stallTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.fired.Store(true)
+		cancel()
+	})
+
+	return t
+}
+
+// wrap возвращает тело, чтение которого откладывает отмену. Перематываемое тело остается
+// перематываемым: по этому признаку SDK выбирает способ подписи и подсчета контрольной суммы
+func (t *stallTimer) wrap(body io.Reader) io.Reader {
+	reader := &stallReader{Reader: body, timer: t}
+	if seeker, ok := body.(io.Seeker); ok {
+		return &stallReadSeeker{stallReader: reader, Seeker: seeker}
+	}
+
+	return reader
+}
+
+// stop останавливает таймер и сообщает, успел ли он отменить попытку
+func (t *stallTimer) stop() bool {
+	t.timer.Stop()
+	return t.fired.Load()
+}
+
+type stallReader struct {
+	io.Reader
+	timer *stallTimer
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.timer.timer.Reset(r.timer.timeout)
+	}
+
+	return n, err
+}
+
+type stallReadSeeker struct {
+	*stallReader
+	io.Seeker
+}
+
+// jitterBackoff - экспоненциальная задержка с полным случайным разбросом:
+// перед попыткой n ждет случайное время от 0 до min(max, base * 2^(n-1))
+type jitterBackoff struct {
+	base time.Duration
+	max  time.Duration
+}
+
+func (b jitterBackoff) BackoffDelay(attempt int, _ error) (time.Duration, error) {
+	ceiling := b.max
+	if shift := attempt - 1; shift < 32 && b.base<<shift < b.max && b.base<<shift > 0 {
+		ceiling = b.base << shift
+	}
+
+	return rand.N(ceiling + 1), nil
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+	logger       *logrus.Entry
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	// probing - в полуоткрытом состоянии уже выполняется пробная операция
+	probing bool
+}
+
+// allow пропускает операцию или возвращает ErrCircuitOpen
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.openDuration {
+			return ErrCircuitOpen
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		b.logger.Infof("S3 circuit breaker is half-open, probing S3")
+		return nil
+	case circuitHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// record учитывает результат пропущенной операции
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitHalfOpen:
+		b.probing = false
+		if success {
+			b.failures = 0
+			b.state = circuitClosed
+			b.logger.Infof("S3 circuit breaker closed, S3 is available again")
+		} else {
+			b.openedAt = time.Now()
+			b.state = circuitOpen
+			b.logger.Warnf("S3 circuit breaker probe failed, retrying in %s", b.openDuration)
+		}
+	case circuitClosed:
+		if success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openedAt = time.Now()
+			b.state = circuitOpen
+			b.logger.Warnf("S3 circuit breaker opened after %d failed operations, retrying in %s",
+				b.failures, b.openDuration)
+		}
+	}
+	// В разомкнутом состоянии результаты операций, начатых до размыкания, не учитываются
+}
+
+// release освобождает пропущенную операцию, не учитывая ее результат
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *circuitBreaker) currentState() circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
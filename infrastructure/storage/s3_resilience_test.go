@@ -0,0 +1,269 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kroticw/freshman-server/infrastructure/storage"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// faultyS3 отвечает на HEAD, GET и PUT объектов как S3 и по команде теста внедряет сбои:
+// ошибки 503 и задержки ответа или содержимого
+type faultyS3 struct {
+	mu       sync.Mutex
+	objects  map[string]string
+	requests map[string]int
+	// failures - сколько следующих запросов метода завершить ошибкой 503, -1 - все
+	failures map[string]int
+	// delay - задержка перед ответом, bodyDelay - перед отправкой содержимого после заголовков,
+	// putDelay - перед чтением тела PUT
+	delay     time.Duration
+	bodyDelay time.Duration
+	putDelay  time.Duration
+}
+
+func newFaultyS3(t *testing.T) (*faultyS3, *httptest.Server) {
+	fake := &faultyS3{
+		objects:  make(map[string]string),
+		requests: make(map[string]int),
+		failures: make(map[string]int),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	return fake, server
+}
+
+func (f *faultyS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests[r.Method]++
+	fail := f.failures[r.Method] != 0
+	if f.failures[r.Method] > 0 {
+		f.failures[r.Method]--
+	}
+	delay, bodyDelay := f.delay, f.bodyDelay
+	if r.Method == http.MethodPut {
+		delay += f.putDelay
+	}
+	f.mu.Unlock()
+
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		return
+	}
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "<Error><Code>ServiceUnavailable</Code><Message>injected fault</Message></Error>")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.objects[r.URL.Path] = string(data)
+		f.mu.Unlock()
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodHead, http.MethodGet:
+		f.mu.Lock()
+		content, ok := f.objects[r.URL.Path]
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.(http.Flusher).Flush()
+		time.Sleep(bodyDelay)
+		_, _ = io.WriteString(w, content)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *faultyS3) set(fn func(f *faultyS3)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(f)
+}
+
+func (f *faultyS3) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests[method]
+}
+
+func newResilientS3(t *testing.T, url string, config storage.S3ResilienceConfig) *storage.S3Driver {
+	driver := storage.NewS3("us-east-1", url, "key", "secret", true, "music", "",
+		tracenoop.NewTracerProvider().Tracer("S3"), newTestLogger())
+	if err := driver.SetResilience(config, metricnoop.NewMeterProvider().Meter("S3")); err != nil {
+		t.Fatal(err)
+	}
+
+	return driver
+}
+
+func TestS3DriverRetry(t *testing.T) {
+	fake, server := newFaultyS3(t)
+	driver := newResilientS3(t, server.URL, storage.S3ResilienceConfig{
+		Retry: storage.S3RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+	})
+	ctx := context.Background()
+
+	fake.set(func(f *faultyS3) { f.failures[http.MethodHead] = 2 })
+	if _, err := driver.Exists(ctx, "0123456789.audio"); err != nil {
+		t.Fatalf("Exists after 2 transient failures: %v", err)
+	}
+	if got := fake.count(http.MethodHead); got != 3 {
+		t.Errorf("HEAD requests = %d, want 3", got)
+	}
+
+	// Тело PutObject - поток, который нельзя перечитать, поэтому загрузка не повторяется
+	fake.set(func(f *faultyS3) { f.failures[http.MethodPut] = 1 })
+	if err := driver.Upload(ctx, "0123456789.audio", strings.NewReader("audio"), 5); err == nil {
+		t.Fatal("Upload succeeded despite the injected fault")
+	}
+	if got := fake.count(http.MethodPut); got != 1 {
+		t.Errorf("PUT requests = %d, want 1", got)
+	}
+}
+
+func TestS3DriverTimeout(t *testing.T) {
+	fake, server := newFaultyS3(t)
+	driver := newResilientS3(t, server.URL, storage.S3ResilienceConfig{
+		Timeouts: storage.S3TimeoutConfig{Default: 50 * time.Millisecond},
+		Retry:    storage.S3RetryConfig{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	ctx := context.Background()
+	if err := driver.Upload(ctx, "0123456789.audio", strings.NewReader("audio"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// Зависший S3 не задерживает запрос дольше таймаута попыток
+	fake.set(func(f *faultyS3) { f.delay = time.Second })
+	headBefore := fake.count(http.MethodHead)
+	start := time.Now()
+	if _, err := driver.Exists(ctx, "0123456789.audio"); err == nil {
+		t.Fatal("Exists succeeded although S3 hangs")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Exists took %s, want about 2 attempts of 50ms", elapsed)
+	}
+	if got := fake.count(http.MethodHead) - headBefore; got != 2 {
+		t.Errorf("HEAD requests = %d, want 2 attempts", got)
+	}
+
+	// Таймаут GetObject ограничивает ожидание ответа, а не чтение содержимого
+	fake.set(func(f *faultyS3) {
+		f.delay = 0
+		f.bodyDelay = 150 * time.Millisecond
+	})
+	body, _, err := driver.Get(ctx, "0123456789.audio")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil || string(data) != "audio" {
+		t.Fatalf("slow body was cut by the attempt timeout: %q, %v", data, err)
+	}
+}
+
+// tricklingReader отдает содержимое по байту с задержкой delay
+type tricklingReader struct {
+	data  string
+	delay time.Duration
+}
+
+func (r *tricklingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	n := copy(p[:1], r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+func TestS3DriverStallTimeout(t *testing.T) {
+	fake, server := newFaultyS3(t)
+	driver := newResilientS3(t, server.URL, storage.S3ResilienceConfig{
+		Timeouts: storage.S3TimeoutConfig{Stall: 100 * time.Millisecond},
+	})
+	ctx := context.Background()
+
+	// У PutObject нет общего таймаута: медленная загрузка идет дольше таймаута простоя, пока тело читается
+	content := "slow upload"
+	slow := &tricklingReader{data: content, delay: 20 * time.Millisecond}
+	if err := driver.Upload(ctx, "0123456789.audio", slow, int64(len(content))); err != nil {
+		t.Fatalf("slow upload: %v", err)
+	}
+
+	// Загрузка в зависший S3 прерывается через таймаут простоя
+	fake.set(func(f *faultyS3) { f.putDelay = time.Second })
+	start := time.Now()
+	err := driver.Upload(ctx, "abcdefghij.audio", strings.NewReader(content), int64(len(content)))
+	if err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Fatalf("upload to hung S3 error = %v, want stall timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("upload to hung S3 took %s, want about 100ms", elapsed)
+	}
+}
+
+func TestS3DriverCircuitBreaker(t *testing.T) {
+	fake, server := newFaultyS3(t)
+	driver := newResilientS3(t, server.URL, storage.S3ResilienceConfig{
+		Retry:          storage.S3RetryConfig{MaxAttempts: 1},
+		CircuitBreaker: storage.CircuitBreakerConfig{FailureThreshold: 2, OpenDuration: 100 * time.Millisecond},
+	})
+	ctx := context.Background()
+
+	// Отсутствующий объект - нормальный ответ S3, а не сбой
+	for range 3 {
+		if _, err := driver.Exists(ctx, "missing.audio"); err != nil {
+			t.Fatalf("Exists of missing object: %v", err)
+		}
+	}
+
+	fake.set(func(f *faultyS3) { f.failures[http.MethodHead] = -1 })
+	for range 2 {
+		if _, err := driver.Exists(ctx, "missing.audio"); err == nil || errors.Is(err, storage.ErrCircuitOpen) {
+			t.Fatalf("Exists with failing S3 = %v, want S3 error", err)
+		}
+	}
+	before := fake.count(http.MethodHead)
+	if _, err := driver.Exists(ctx, "missing.audio"); !errors.Is(err, storage.ErrCircuitOpen) {
+		t.Fatalf("Exists after %d failures = %v, want ErrCircuitOpen", 2, err)
+	}
+	if fake.count(http.MethodHead) != before {
+		t.Fatal("open circuit breaker let the request through to S3")
+	}
+
+	// После OpenDuration пробный запрос замыкает цепь, если S3 восстановился
+	fake.set(func(f *faultyS3) { f.failures[http.MethodHead] = 0 })
+	time.Sleep(150 * time.Millisecond)
+	for range 2 {
+		if _, err := driver.Exists(ctx, "missing.audio"); err != nil {
+			t.Fatalf("Exists after S3 recovered: %v", err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// DefaultS3UsageRefreshInterval - срок, после которого подсчитанное занятое место пересчитывается
+// обходом бакета. Между пересчетами учитываются только загрузки и удаления через этот драйвер,
+// поэтому изменения, сделанные другими экземплярами сервера или в обход драйвера, видны не сразу
+const DefaultS3UsageRefreshInterval = 15 * time.Minute
+
+// spaceUsage - занятое место под basePath: всего и по исходным файлам (исходный файл вместе
+// со слинкованными с ним файлами). По исходным файлам место считается, чтобы при удалении
+// исходного файла вычесть и удаленные вместе с ним слинкованные. Место по пользователям
+// не считается: у песен нет владельца
+type spaceUsage struct {
+	total    int64
+	bySource map[string]int64
+	// scannedAt - время обхода бакета, по которому подсчитано место
+	scannedAt time.Time
+}
+
+func (u *spaceUsage) add(filename string, size int64) {
+	u.total += size
+	u.bySource[getSourceNameOfKey(filename)] += size
+}
+
+// SetUsageRefreshInterval задает срок, после которого занятое место пересчитывается обходом бакета.
+// 0 - пересчитывать только при первом запросе
+func (s *S3Driver) SetUsageRefreshInterval(interval time.Duration) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	s.usageRefreshInterval = interval
+}
+
+// GetSpaceUsage возвращает место, занятое объектами под basePath. При первом вызове и по истечении
+// usageRefreshInterval объекты пересчитываются постранично, в промежутках результат поддерживается
+// при загрузке и удалении. Объекты, загруженные в бакет в обход драйвера (например, по временной ссылке
+// или другим экземпляром сервера), учитываются после следующего пересчета.
+func (s *S3Driver) GetSpaceUsage(ctx context.Context) (usage int64, err error) {
+	u, err := s.getSpaceUsage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+
+	return u.total, nil
+}
+
+// GetSpaceUsageBySource возвращает место по исходным файлам: ключ - имя исходного файла без расширения,
+// значение - размер исходного файла вместе со слинкованными с ним. Объекты под basePath,
+// хранящиеся не по getFilePath, сюда не входят и учитываются только в GetSpaceUsage
+func (s *S3Driver) GetSpaceUsageBySource(ctx context.Context) (map[string]int64, error) {
+	u, err := s.getSpaceUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+
+	return maps.Clone(u.bySource), nil
+}
+
+// refreshSpaceUsage пересчитывает занятое место заново
+func (s *S3Driver) refreshSpaceUsage(ctx context.Context) error {
+	u, err := s.scanSpaceUsage(ctx)
+	if err != nil {
+		return err
+	}
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	s.usage = u
+
+	return nil
+}
+
+func (s *S3Driver) getSpaceUsage(ctx context.Context) (*spaceUsage, error) {
+	s.usageMu.Lock()
+	u := s.usage
+	fresh := u != nil && (s.usageRefreshInterval == 0 || time.Since(u.scannedAt) < s.usageRefreshInterval)
+	s.usageMu.Unlock()
+	if fresh {
+		return u, nil
+	}
+	if err := s.refreshSpaceUsage(ctx); err != nil {
+		return nil, err
+	}
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+
+	return s.usage, nil
+}
+
+func (s *S3Driver) scanSpaceUsage(ctx context.Context) (*spaceUsage, error) {
+	ctx, span := s.tracer.Start(ctx, "ScanSpaceUsage")
+	defer span.End()
+	prefix := s.basePrefix()
+	span.SetAttributes(attribute.String("aws.s3.prefix", prefix), attribute.String("aws.s3.bucket", s.bucket))
+
+	u := &spaceUsage{bySource: make(map[string]int64), scannedAt: time.Now()}
+	input := &s3.ListObjectsV2Input{Bucket: &s.bucket}
+	if prefix != "" {
+		input.Prefix = &prefix
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.svc, input)
+	objects := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			objects++
+			filename, ok := parseFilePath(strings.TrimPrefix(aws.ToString(object.Key), prefix))
+			if !ok {
+				// Чужой объект под basePath учитываем только в общем объеме
+				u.total += aws.ToInt64(object.Size)
+				continue
+			}
+			u.add(filename, aws.ToInt64(object.Size))
+		}
+	}
+	span.SetAttributes(attribute.Int("objects", objects), attribute.Int64("usage", u.total))
+
+	return u, nil
+}
+
+// basePrefix - префикс ключей всех объектов драйвера
+func (s *S3Driver) basePrefix() string {
+	if s.basePath == "" {
+		return ""
+	}
+
+	return strings.TrimSuffix(s.basePath, "/") + "/"
+}
+
+func (s *S3Driver) trackUpload(filename string, size int64) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	if s.usage != nil {
+		s.usage.add(filename, size)
+	}
+}
+
+// trackDelete вызывается после удаления исходного файла: вместе с ним удалены и все слинкованные
+func (s *S3Driver) trackDelete(filename string) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	if s.usage != nil {
+		source := getSourceNameOfKey(filename)
+		s.usage.total -= s.usage.bySource[source]
+		delete(s.usage.bySource, source)
+	}
+}
+
+// trackDeleteOne вызывается после удаления одного слинкованного файла известного размера
+func (s *S3Driver) trackDeleteOne(filename string, size int64) {
+	s.trackUpload(filename, -size)
+}
@@ -0,0 +1,79 @@
+package storage_test
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+func TestS3DriverSpaceUsage(t *testing.T) {
+	fake, driver := newBucketS3(t)
+	ctx := context.Background()
+	upload := func(filename string, content string) {
+		t.Helper()
+		if err := driver.Upload(ctx, filename, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage := func(want int64) {
+		t.Helper()
+		got, err := driver.GetSpaceUsage(ctx)
+		if err != nil || got != want {
+			t.Fatalf("GetSpaceUsage() = %d, %v, want %d", got, err, want)
+		}
+	}
+
+	upload("0123456789.audio", "audio")
+	// Объект, загруженный в обход драйвера, учитывается только в общем объеме
+	fake.set(func(f *multipartS3) { f.objects["foreign.txt"] = []byte("foreign") })
+	usage(12)
+
+	// Дальше занятое место поддерживается без повторного обхода бакета
+	upload("abcdefghij.audio", "second")
+	err := driver.UploadLinked(ctx, "cover-256.jpg", "0123456789.audio", strings.NewReader("jpeg"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage(22)
+	// Исходный файл удаляется вместе со слинкованными
+	if err = driver.Delete(ctx, "0123456789.audio"); err != nil {
+		t.Fatal(err)
+	}
+	usage(13)
+	// Сервис музыки получает место по песням через music.SpaceUsageReporter
+	var reporter music.SpaceUsageReporter = driver
+	bySource, err := reporter.GetSpaceUsageBySource(ctx)
+	if want := map[string]int64{"abcdefghij": 6}; err != nil || !maps.Equal(bySource, want) {
+		t.Errorf("GetSpaceUsageBySource() = %v, %v, want %v", bySource, err, want)
+	}
+	fake.set(func(f *multipartS3) {
+		if f.scans != 1 {
+			t.Errorf("bucket scanned %d times, want 1", f.scans)
+		}
+	})
+}
+
+func TestS3DriverSpaceUsageRefresh(t *testing.T) {
+	fake, driver := newBucketS3(t)
+	ctx := context.Background()
+	driver.SetUsageRefreshInterval(time.Millisecond)
+	if usage, err := driver.GetSpaceUsage(ctx); err != nil || usage != 0 {
+		t.Fatalf("GetSpaceUsage() = %d, %v, want 0", usage, err)
+	}
+
+	// Объект загрузил другой экземпляр сервера: он учитывается после пересчета
+	fake.set(func(f *multipartS3) { f.objects["0123456789.audio"] = []byte("audio") })
+	time.Sleep(2 * time.Millisecond)
+	if usage, err := driver.GetSpaceUsage(ctx); err != nil || usage != 5 {
+		t.Fatalf("GetSpaceUsage() after refresh interval = %d, %v, want 5", usage, err)
+	}
+	fake.set(func(f *multipartS3) {
+		if f.scans != 2 {
+			t.Errorf("bucket scanned %d times, want 2", f.scans)
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kroticw/freshman-server/infrastructure/storage"
+	"github.com/kroticw/freshman-server/infrastructure/storage/storagetest"
+	"github.com/kroticw/freshman-server/internal/music"
+	log "github.com/sirupsen/logrus"
+)
+
+func newTestLogger() *log.Logger {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	return logger
+}
+
+func TestFilesystemDriver(t *testing.T) {
+	storagetest.RunConformanceTests(t, func(t *testing.T) music.Storage {
+		return storage.NewFilesystemDriver(t.TempDir(), newTestLogger())
+	})
+}
+
+func TestMemoryDriver(t *testing.T) {
+	storagetest.RunConformanceTests(t, func(t *testing.T) music.Storage {
+		return storage.NewMemoryDriver()
+	})
+}
+
+func TestCachingDriver(t *testing.T) {
+	storagetest.RunConformanceTests(t, func(t *testing.T) music.Storage {
+		cache := storage.NewFilesystemDriver(t.TempDir(), newTestLogger())
+		driver, err := storage.NewCachingDriver(storage.NewMemoryDriver(), cache, 1<<20,
+			storage.DefaultRetentionThreshold, newTestLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return driver
+	})
+}
+
+func TestMirroringDriver(t *testing.T) {
+	storagetest.RunConformanceTests(t, func(t *testing.T) music.Storage {
+		return storage.NewMirroringDriver(
+			storage.NewMemoryDriver(),
+			storage.NewFilesystemDriver(t.TempDir(), newTestLogger()),
+			filepath.Join(t.TempDir(), "repair.jsonl"),
+			newTestLogger(),
+		)
+	})
+}
+
+func newTestMasterKey(t *testing.T, id string) storage.MasterKey {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return storage.MasterKey{ID: id, Key: key}
+}
+
+func TestEncryptingDriver(t *testing.T) {
+	storagetest.RunConformanceTests(t, func(t *testing.T) music.Storage {
+		driver, err := storage.NewEncryptingDriver(
+			storage.NewFilesystemDriver(t.TempDir(), newTestLogger()),
+			newTestMasterKey(t, "k1"),
+			nil,
+			newTestLogger(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return driver
+	})
+}
+
+func TestEncryptingDriverRewrap(t *testing.T) {
+	ctx := context.Background()
+	inner := storage.NewMemoryDriver()
+	oldKey, newKey := newTestMasterKey(t, "old"), newTestMasterKey(t, "new")
+	content := bytes.Repeat([]byte("licensed audio "), 10000)
+	const filename = "0123456789abcdef.audio"
+
+	driver, err := storage.NewEncryptingDriver(inner, oldKey, nil, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = driver.Upload(ctx, filename, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := inner.Get(ctx, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := io.ReadAll(body)
+	if bytes.Contains(stored, []byte("licensed audio")) {
+		t.Fatal("stored object contains plaintext")
+	}
+
+	rotated, err := storage.NewEncryptingDriver(inner, newKey, []storage.MasterKey{oldKey}, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, err := rotated.Rewrap(ctx)
+	if err != nil || rewrapped != 1 {
+		t.Fatalf("Rewrap = %d, %v, want 1", rewrapped, err)
+	}
+	if rewrapped, err = rotated.Rewrap(ctx); err != nil || rewrapped != 0 {
+		t.Fatalf("second Rewrap = %d, %v, want 0", rewrapped, err)
+	}
+
+	// После перешифровки старый мастер-ключ больше не нужен
+	newOnly, err := storage.NewEncryptingDriver(inner, newKey, nil, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng, err := newOnly.GetRange(ctx, filename, 70000, 60000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rng.Body)
+	rng.Body.Close()
+	if err != nil || !bytes.Equal(got, content[70000:130000]) {
+		t.Fatalf("GetRange after rewrap returned wrong content: %v", err)
+	}
+
+	// Ключ данных, зашифрованный только старым мастер-ключом, без него не прочитать
+	oldOnly, err := storage.NewEncryptingDriver(inner, oldKey, nil, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = oldOnly.Get(ctx, filename); !errors.Is(err, storage.ErrNoDataKey) {
+		t.Fatalf("Get with retired master key: got %v, want ErrNoDataKey", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	source, destination := storage.NewMemoryDriver(), storage.NewMemoryDriver()
+	files := map[string]string{
+		"0123456789abcdef.audio":         "song",
+		"0123456789abcdef/cover.jpg":     "cover",
+		"fedcba9876543210.audio":         "identical",
+		"aaaaaaaaaaaaaaaa.audio":         "conflicting",
+		"0123456789abcdef/thumbs/64.jpg": "thumb",
+	}
+	for key, content := range files {
+		if err := source.Upload(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, content := range map[string]string{"fedcba9876543210.audio": "identical", "aaaaaaaaaaaaaaaa.audio": "different!!"} {
+		if err := destination.Upload(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := storage.MigrateOptions{Concurrency: 2, CheckpointPath: filepath.Join(t.TempDir(), "checkpoint")}
+	report, err := storage.Migrate(ctx, source, destination, opts, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 5 || report.Copied != 3 || report.Identical != 1 ||
+		len(report.Conflicts) != 1 || report.Conflicts[0] != "aaaaaaaaaaaaaaaa.audio" || len(report.Failed) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for key, content := range files {
+		if key == "aaaaaaaaaaaaaaaa.audio" {
+			continue
+		}
+		body, _, err := destination.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+		got, _ := io.ReadAll(body)
+		if string(got) != content {
+			t.Fatalf("Get(%s) = %q, want %q", key, got, content)
+		}
+	}
+
+	// Повторный запуск пропускает перенесенные файлы по контрольной точке
+	report, err = storage.Migrate(ctx, source, destination, opts, newTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checkpointed != 4 || report.Copied != 0 || len(report.Conflicts) != 1 {
+		t.Fatalf("unexpected report after resume %+v", report)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	builder := storage.NewBuilder(newTestLogger(), nil, nil)
+	driver, err := builder.Build(storage.DriverConfig{
+		Type: "mirror",
+		Options: map[string]any{
+			"repairLog":      filepath.Join(t.TempDir(), "repair.jsonl"),
+			"repairInterval": "5m",
+			"primary":        map[string]any{"type": "memory"},
+			"secondary": map[string]any{
+				"type":    "cache",
+				"maxSize": 1 << 20,
+				"origin":  map[string]any{"type": "memory"},
+				"cache":   map[string]any{"type": "filesystem", "baseDir": t.TempDir()},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if _, ok := driver.(*storage.MirroringDriver); !ok {
+		t.Fatalf("Build returned %T, want *storage.MirroringDriver", driver)
+	}
+	// Обернутые драйверы создаются раньше оберток
+	if drivers := builder.Drivers(); len(drivers) != 5 || drivers[4] != driver {
+		t.Fatalf("Drivers returned %d drivers, want 5 ending with the mirror", len(drivers))
+	}
+
+	for name, config := range map[string]storage.DriverConfig{
+		"unknown option": {Type: "filesystem", Options: map[string]any{"baseDir": "x", "fileSystem": "x"}},
+		"missing option": {Type: "filesystem"},
+		"unknown type":   {Type: "ftp"},
+		"bad nested":     {Type: "cache", Options: map[string]any{"maxSize": 1, "origin": map[string]any{}}},
+	} {
+		if _, err = storage.NewBuilder(newTestLogger(), nil, nil).Build(config); err == nil {
+			t.Errorf("Build with %s: got nil error", name)
+		}
+	}
+}
+
+func TestFilesystemDriverSpaceUsage(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "music")
+	driver := storage.NewFilesystemDriver(dir, newTestLogger())
+	// Каталог создается при первой загрузке
+	if usage, err := driver.GetSpaceUsage(ctx); err != nil || usage != 0 {
+		t.Fatalf("GetSpaceUsage() without root dir = %d, %v, want 0", usage, err)
+	}
+
+	if err := driver.Upload(ctx, "song.audio", strings.NewReader("audio"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := driver.GetSpaceUsage(ctx); err != nil || usage != 5 {
+		t.Errorf("GetSpaceUsage() = %d, %v, want 5", usage, err)
+	}
+}
@@ -0,0 +1,357 @@
+// Package storagetest содержит общие тесты реализаций music.Storage. Пакет подключается только из тестов,
+// чтобы testing не попадал в сборку сервера
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+// RunConformanceTests проверяет поведение, которого music.Service ждет от любого music.Storage:
+// ошибки os.ErrExist и os.ErrNotExist, границы диапазонов, ключи слинкованных файлов, удаление,
+// метаданные и проверку контрольной суммы при загрузке.
+// newDriver вызывается в каждом подтесте и должен возвращать пустое хранилище.
+// Если драйвер реализует music.Walker, проверяется и обход.
+func RunConformanceTests(t *testing.T, newDriver func(t *testing.T) music.Storage) {
+	const source = "0123456789abcdef.audio"
+	const sourceName = "0123456789abcdef"
+	content := []byte("conformance test content")
+	size := int64(len(content))
+	contentSum := sha256.Sum256(content)
+	contentChecksum := hex.EncodeToString(contentSum[:])
+
+	upload := func(t *testing.T, driver music.Storage, filename string, data []byte) {
+		t.Helper()
+		if err := driver.Upload(context.Background(), filename, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Upload(%s): %v", filename, err)
+		}
+	}
+	uploadLinked := func(t *testing.T, driver music.Storage, filename string, data []byte) {
+		t.Helper()
+		err := driver.UploadLinked(context.Background(), filename, source, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("UploadLinked(%s): %v", filename, err)
+		}
+	}
+	assertContent := func(t *testing.T, driver music.Storage, filename string, want []byte) {
+		t.Helper()
+		body, gotSize, err := driver.Get(context.Background(), filename)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", filename, err)
+		}
+		defer body.Close()
+		got, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("Get(%s): read: %v", filename, err)
+		}
+		if gotSize != int64(len(want)) || !bytes.Equal(got, want) {
+			t.Fatalf("Get(%s) = %q (size %d), want %q", filename, got, gotSize, want)
+		}
+	}
+	assertExists := func(t *testing.T, driver music.Storage, filename string, want bool) {
+		t.Helper()
+		exists, err := driver.Exists(context.Background(), filename)
+		if err != nil {
+			t.Fatalf("Exists(%s): %v", filename, err)
+		}
+		if exists != want {
+			t.Fatalf("Exists(%s) = %v, want %v", filename, exists, want)
+		}
+	}
+	assertLinked := func(t *testing.T, driver music.Storage, want ...string) {
+		t.Helper()
+		names, err := driver.ListLinked(context.Background(), source)
+		if err != nil {
+			t.Fatalf("ListLinked: %v", err)
+		}
+		if names == nil {
+			t.Fatalf("ListLinked returned nil slice")
+		}
+		sort.Strings(names)
+		if !slices.Equal(names, want) {
+			t.Fatalf("ListLinked = %v, want %v", names, want)
+		}
+	}
+
+	t.Run("UploadAndGet", func(t *testing.T) {
+		driver := newDriver(t)
+		assertExists(t, driver, source, false)
+		upload(t, driver, source, content)
+		assertExists(t, driver, source, true)
+		assertContent(t, driver, source, content)
+	})
+
+	t.Run("UploadExisting", func(t *testing.T) {
+		driver := newDriver(t)
+		upload(t, driver, source, content)
+		other := []byte("other")
+		err := driver.Upload(context.Background(), source, bytes.NewReader(other), int64(len(other)))
+		if !errors.Is(err, os.ErrExist) {
+			t.Fatalf("Upload of existing file: got %v, want os.ErrExist", err)
+		}
+		assertContent(t, driver, source, content)
+	})
+
+	t.Run("UploadShortReader", func(t *testing.T) {
+		driver := newDriver(t)
+		err := driver.Upload(context.Background(), source, bytes.NewReader(content), size+10)
+		if err == nil {
+			t.Fatalf("Upload of short reader succeeded")
+		}
+		assertExists(t, driver, source, false)
+	})
+
+	t.Run("GetMissing", func(t *testing.T) {
+		driver := newDriver(t)
+		if _, _, err := driver.Get(context.Background(), source); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Get of missing file: got %v, want os.ErrNotExist", err)
+		}
+		if _, err := driver.GetRange(context.Background(), source, 0, -1); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("GetRange of missing file: got %v, want os.ErrNotExist", err)
+		}
+		if _, err := driver.GetRange(context.Background(), source, 0, 0); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("empty GetRange of missing file: got %v, want os.ErrNotExist", err)
+		}
+	})
+
+	t.Run("GetRange", func(t *testing.T) {
+		driver := newDriver(t)
+		upload(t, driver, source, content)
+		cases := []struct {
+			offset, length int64
+			want           []byte
+			invalid        bool
+		}{
+			{offset: 0, length: -1, want: content},
+			{offset: 3, length: 5, want: content[3:8]},
+			{offset: 5, length: -1, want: content[5:]},
+			{offset: size - 1, length: 1, want: content[size-1:]},
+			{offset: 0, length: 0, want: []byte{}},
+			{offset: size, length: 0, want: []byte{}},
+			{offset: size, length: -1, want: []byte{}},
+			{offset: size + 1, length: 0, invalid: true},
+			{offset: size + 1, length: -1, invalid: true},
+			{offset: size - 1, length: 2, invalid: true},
+			{offset: -1, length: 0, invalid: true},
+		}
+		for _, c := range cases {
+			rng, err := driver.GetRange(context.Background(), source, c.offset, c.length)
+			if c.invalid {
+				if !errors.Is(err, music.ErrInvalidRange) {
+					t.Errorf("GetRange(%d, %d): got %v, want music.ErrInvalidRange", c.offset, c.length, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("GetRange(%d, %d): %v", c.offset, c.length, err)
+				continue
+			}
+			got, err := io.ReadAll(rng.Body)
+			rng.Body.Close()
+			if err != nil {
+				t.Errorf("GetRange(%d, %d): read: %v", c.offset, c.length, err)
+				continue
+			}
+			if !bytes.Equal(got, c.want) || rng.Offset != c.offset ||
+				rng.Length != int64(len(c.want)) || rng.Size != size {
+				t.Errorf("GetRange(%d, %d) = %q (offset %d, length %d, size %d), want %q (size %d)",
+					c.offset, c.length, got, rng.Offset, rng.Length, rng.Size, c.want, size)
+			}
+		}
+	})
+
+	t.Run("Linked", func(t *testing.T) {
+		driver := newDriver(t)
+		upload(t, driver, source, content)
+		assertLinked(t, driver)
+		uploadLinked(t, driver, "cover.jpg", []byte("cover"))
+		uploadLinked(t, driver, "thumbs/64.jpg", []byte("thumb"))
+
+		exists, err := driver.IsLinkedExists(context.Background(), "cover.jpg", source)
+		if err != nil || !exists {
+			t.Fatalf("IsLinkedExists(cover.jpg) = %v, %v, want true", exists, err)
+		}
+		exists, err = driver.IsLinkedExists(context.Background(), "missing.jpg", source)
+		if err != nil || exists {
+			t.Fatalf("IsLinkedExists(missing.jpg) = %v, %v, want false", exists, err)
+		}
+		assertLinked(t, driver, "cover.jpg", "thumbs/64.jpg")
+		// Слинкованный файл доступен как обычный по ключу "<исходный файл без расширения>/<имя>"
+		assertContent(t, driver, sourceName+"/cover.jpg", []byte("cover"))
+		assertContent(t, driver, sourceName+"/thumbs/64.jpg", []byte("thumb"))
+		// Слинкованные файлы не задевают исходный
+		assertContent(t, driver, source, content)
+
+		err = driver.UploadLinked(context.Background(), "cover.jpg", source, strings.NewReader("new"), 3)
+		if !errors.Is(err, os.ErrExist) {
+			t.Fatalf("UploadLinked of existing file: got %v, want os.ErrExist", err)
+		}
+	})
+
+	t.Run("DeleteRemovesLinked", func(t *testing.T) {
+		driver := newDriver(t)
+		upload(t, driver, source, content)
+		uploadLinked(t, driver, "cover.jpg", []byte("cover"))
+		uploadLinked(t, driver, "thumbs/64.jpg", []byte("thumb"))
+		// Файл с похожим именем не слинкован с исходным и должен остаться
+		upload(t, driver, sourceName+"0.audio", content)
+
+		if err := driver.Delete(context.Background(), source); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		assertExists(t, driver, source, false)
+		assertExists(t, driver, sourceName+"/cover.jpg", false)
+		assertLinked(t, driver)
+		assertContent(t, driver, sourceName+"0.audio", content)
+		if _, _, err := driver.Get(context.Background(), source); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Get after Delete: got %v, want os.ErrNotExist", err)
+		}
+	})
+
+	t.Run("DeleteMissing", func(t *testing.T) {
+		driver := newDriver(t)
+		if err := driver.Delete(context.Background(), source); err != nil {
+			t.Fatalf("Delete of missing file: %v", err)
+		}
+	})
+
+	t.Run("DeleteOnlyLinked", func(t *testing.T) {
+		driver := newDriver(t)
+		uploadLinked(t, driver, "cover.jpg", []byte("cover"))
+		if err := driver.Delete(context.Background(), source); err != nil {
+			t.Fatalf("Delete of file with only linked files: %v", err)
+		}
+		assertLinked(t, driver)
+	})
+
+	t.Run("UploadAfterDelete", func(t *testing.T) {
+		driver := newDriver(t)
+		upload(t, driver, source, []byte("old"))
+		if err := driver.Delete(context.Background(), source); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		upload(t, driver, source, content)
+		assertContent(t, driver, source, content)
+	})
+
+	t.Run("StatMissing", func(t *testing.T) {
+		driver := newDriver(t)
+		if _, err := driver.Stat(context.Background(), source); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Stat of missing file: got %v, want os.ErrNotExist", err)
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		driver := newDriver(t)
+		upload(t, driver, source, content)
+		uploadLinked(t, driver, "cover.jpg", []byte("cover"))
+		for filename, wantSize := range map[string]int64{source: size, sourceName + "/cover.jpg": 5} {
+			info, err := driver.Stat(context.Background(), filename)
+			if err != nil {
+				t.Fatalf("Stat(%s): %v", filename, err)
+			}
+			if info.Size != wantSize || info.ModTime.IsZero() {
+				t.Fatalf("Stat(%s) = size %d, modified %v, want size %d", filename, info.Size, info.ModTime, wantSize)
+			}
+			if info.Checksum != "" || len(info.Metadata) != 0 {
+				t.Fatalf("Stat(%s) returned metadata of plain upload: %+v", filename, info.ObjectMetadata)
+			}
+		}
+	})
+
+	t.Run("UploadWithMetadata", func(t *testing.T) {
+		driver := newDriver(t)
+		metadata := music.ObjectMetadata{
+			ContentType: "audio/mpeg",
+			Checksum:    contentChecksum,
+			Metadata:    map[string]string{"Uploaded-By": "conformance"},
+		}
+		err := driver.UploadWithMetadata(context.Background(), source, bytes.NewReader(content), size, metadata)
+		if err != nil {
+			t.Fatalf("UploadWithMetadata: %v", err)
+		}
+		assertContent(t, driver, source, content)
+		info, err := driver.Stat(context.Background(), source)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if info.Size != size || info.ContentType != metadata.ContentType || info.Checksum != metadata.Checksum {
+			t.Fatalf("Stat = %+v, want size %d and %+v", info, size, metadata)
+		}
+		// Имена пользовательских метаданных приводятся к нижнему регистру, как в HTTP-заголовках S3
+		if len(info.Metadata) != 1 || info.Metadata["uploaded-by"] != "conformance" {
+			t.Fatalf("Stat metadata = %v, want map[uploaded-by:conformance]", info.Metadata)
+		}
+	})
+
+	t.Run("UploadChecksumMismatch", func(t *testing.T) {
+		driver := newDriver(t)
+		metadata := music.ObjectMetadata{Checksum: strings.Repeat("0", 64)}
+		err := driver.UploadWithMetadata(context.Background(), source, bytes.NewReader(content), size, metadata)
+		if !errors.Is(err, music.ErrChecksumMismatch) {
+			t.Fatalf("UploadWithMetadata with wrong checksum: got %v, want music.ErrChecksumMismatch", err)
+		}
+		assertExists(t, driver, source, false)
+		upload(t, driver, source, content)
+	})
+
+	t.Run("Walk", func(t *testing.T) {
+		driver := newDriver(t)
+		walker, ok := driver.(music.Walker)
+		if !ok {
+			t.Skip("driver does not implement music.Walker")
+		}
+		upload(t, driver, source, content)
+		uploadLinked(t, driver, "cover.jpg", []byte("cover"))
+		uploadLinked(t, driver, "thumbs/64.jpg", []byte("thumb"))
+
+		sizes := make(map[string]int64)
+		err := walker.Walk(context.Background(), func(object music.ObjectInfo) error {
+			if _, ok := sizes[object.Key]; ok {
+				t.Errorf("Walk returned %s twice", object.Key)
+			}
+			if object.ModTime.IsZero() {
+				t.Errorf("Walk returned %s without modification time", object.Key)
+			}
+			sizes[object.Key] = object.Size
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Walk: %v", err)
+		}
+		want := map[string]int64{
+			source:                        size,
+			sourceName + "/cover.jpg":     5,
+			sourceName + "/thumbs/64.jpg": 5,
+		}
+		if len(sizes) != len(want) {
+			t.Fatalf("Walk returned %v, want %v", sizes, want)
+		}
+		for key, wantSize := range want {
+			if gotSize, ok := sizes[key]; !ok || gotSize != wantSize {
+				t.Fatalf("Walk returned %v, want %v", sizes, want)
+			}
+		}
+
+		stop := errors.New("stop")
+		calls := 0
+		err = walker.Walk(context.Background(), func(music.ObjectInfo) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Fatalf("Walk did not stop on callback error: got %v after %d calls", err, calls)
+		}
+	})
+}
@@ -13,21 +13,62 @@ func getFilePath(filename string, basePath string) string {
 		baseName = path.Dir(filename)
 	}
 
+	return path.Join(getShardDir(baseName, basePath), filename)
+}
+
+// getShardDir возвращает каталог, в который попадают файлы с именем baseName
+func getShardDir(baseName string, basePath string) string {
 	// Если длина названия меньше 6 символов, не получится разделить их на 3 уровня вложенности корректно.
 	if len(baseName) < 3 {
-		return path.Join(basePath, baseName, filename)
+		return path.Join(basePath, baseName)
 	}
 	if len(baseName) < 4 {
-		return path.Join(basePath, baseName[0:2], filename)
+		return path.Join(basePath, baseName[0:2])
 	}
 	if len(baseName) < 6 {
-		return path.Join(basePath, baseName[0:2], baseName[2:4], filename)
+		return path.Join(basePath, baseName[0:2], baseName[2:4])
 	}
 
-	return path.Join(basePath, baseName[0:2], baseName[2:4], baseName[4:6], filename)
+	return path.Join(basePath, baseName[0:2], baseName[2:4], baseName[4:6])
+}
+
+// getLinkedDirPath возвращает каталог, в котором лежат файлы, слинкованные с sourceFilename
+func getLinkedDirPath(sourceFilename string, basePath string) string {
+	sourceName := getSourceName(sourceFilename)
+	return path.Join(getShardDir(sourceName, basePath), sourceName)
 }
 
 func getFullFileName(filename string, sourceFilename string) string {
-	sourceFilename = strings.Replace(path.Base(sourceFilename), path.Ext(sourceFilename), "", -1)
-	return path.Join(sourceFilename, filename)
+	return path.Join(getSourceName(sourceFilename), filename)
+}
+
+func getSourceName(sourceFilename string) string {
+	return strings.Replace(path.Base(sourceFilename), path.Ext(sourceFilename), "", -1)
+}
+
+// getSourceNameOfKey возвращает имя исходного файла, к которому относится ключ:
+// для самого исходного файла это имя без расширения, для слинкованного - каталог
+func getSourceNameOfKey(filename string) string {
+	if path.Base(filename) == filename {
+		return getSourceName(filename)
+	}
+
+	return strings.SplitN(filename, "/", 2)[0]
+}
+
+// parseFilePath - обратное преобразование к getFilePath: по пути относительно basePath
+// восстанавливает ключ файла. ok = false, если путь не мог быть получен из getFilePath
+func parseFilePath(relPath string) (filename string, ok bool) {
+	parts := strings.Split(relPath, "/")
+	for depth := 3; depth >= 1; depth-- {
+		if len(parts) <= depth {
+			continue
+		}
+		filename = path.Join(parts[depth:]...)
+		if getFilePath(filename, "") == relPath {
+			return filename, true
+		}
+	}
+
+	return "", false
 }
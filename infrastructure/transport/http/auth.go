@@ -0,0 +1,35 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kroticw/freshman-server/infrastructure/auth"
+	"github.com/sirupsen/logrus"
+)
+
+const userIDKey = "userID"
+
+// authorize пропускает только запросы с токеном действующей сессии в заголовке
+// "Authorization: Bearer <token>" и сохраняет идентификатор пользователя в контексте
+func authorize(authSvc *auth.Service, logger *logrus.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		userID, err := authSvc.Authorize(c.Request.Context(), strings.TrimSpace(token))
+		if err != nil {
+			if errors.Is(err, auth.ErrUnauthorized) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+					"error": "unauthorized",
+				})
+				return
+			}
+			logger.WithError(err).Error("failed to authorize request")
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Set(userIDKey, userID)
+		c.Next()
+	}
+}
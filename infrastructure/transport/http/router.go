@@ -1,21 +1,37 @@
 package http
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/kroticw/freshman-server/infrastructure/auth"
+	"github.com/kroticw/freshman-server/internal/common"
 	"github.com/kroticw/freshman-server/internal/music"
+	"github.com/kroticw/freshman-server/internal/music/cover"
+	"github.com/kroticw/freshman-server/internal/music/waveform"
 	"github.com/sirupsen/logrus"
 )
 
 func SetupRouter(
 	ctx context.Context,
 	musSvc *music.Service,
+	authSvc *auth.Service,
 	logger *logrus.Logger,
 ) *gin.Engine {
 	r := gin.Default()
+	// Файлы крупнее этого лимита multipart-парсер сразу пишет во временный файл,
+	// а не держит в памяти
+	r.MaxMultipartMemory = 1 << 20
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "pong",
@@ -24,35 +40,309 @@ func SetupRouter(
 
 	r.PUT("/api/add", func(c *gin.Context) {
 		params := c.Request.URL.Query()
-		fh, err := c.FormFile("song")
+		fh, mime, ok := readAudioFile(c, logger)
+		if !ok {
+			return
+		}
+
+		src, err := fh.Open()
 		if err != nil {
-			logger.WithError(err).Error("failed to get file")
+			logger.WithError(err).Error("failed to open file")
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		defer src.Close()
+		var song music.Song
+		if err = song.Unmarshal(params, src, fh.Size); err != nil {
+			logger.WithError(err).Error("failed to unmarshal song")
 			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
+		song.ContentType = mime
+		err = musSvc.UploadSong(ctx, &song)
+		if err != nil {
+			// Обязательного поля нет ни в параметрах, ни в тегах файла
+			var invalidParam music.ErrorInvalidParam
+			if errors.As(err, &invalidParam) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": invalidParam.Error(),
+				})
+				return
+			}
+			logger.WithError(err).Error("failed to upload song")
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
 
-		// Дополнительный (быстрый) фильтр по расширению.
-		if !isAllowedAudioExtension(fh.Filename) {
+		c.JSON(http.StatusOK, gin.H{
+			"status":      "ok",
+			"id":          song.ID,
+			"contentType": mime,
+			"hash":        song.Hash,
+			"metadata":    songMetadata(&song),
+			"sources":     song.MetadataSources,
+			"audio":       audioResponse(song.Audio),
+		})
+	})
+
+	r.GET("/api/songs/:id/cover", func(c *gin.Context) {
+		song, ok := loadSong(c, musSvc, logger)
+		if !ok {
+			return
+		}
+		size := defaultCoverSize
+		if value := c.Query("size"); value != "" {
+			var err error
+			if size, err = strconv.Atoi(value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "invalid size",
+				})
+				return
+			}
+		}
+		format, ok := coverFormat(c)
+		if !ok {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "invalid file extension",
+				"error": "invalid format",
 			})
 			return
 		}
 
-		mime, err := sniffContentType(fh)
+		body, _, err := musSvc.GetCover(c.Request.Context(), song, size, format)
 		if err != nil {
-			logger.WithError(err).Error("failed to sniff content type")
-			c.AbortWithError(http.StatusBadRequest, err)
+			var invalidParam music.ErrorInvalidParam
+			switch {
+			case errors.As(err, &invalidParam):
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": invalidParam.Error(),
+				})
+			case errors.Is(err, music.ErrNoCover), errors.Is(err, cover.ErrUnsupportedImage):
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song has no cover",
+				})
+			default:
+				logger.WithError(err).Error("failed to get song cover")
+				c.AbortWithError(http.StatusInternalServerError, err)
+			}
+			return
+		}
+		defer body.Close()
+		// Миниатюры небольшие, а ServeContent нужен перематываемый поток для If-None-Match и Range
+		data, err := io.ReadAll(body)
+		if err != nil {
+			logger.WithError(err).Error("failed to read song cover")
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		// Обложка определяется содержимым песни, которое может смениться, поэтому кэш короткий
+		c.Header("ETag", fmt.Sprintf(`"%s-%d.%s"`, song.Hash, size, format.Ext()))
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.Header("Content-Type", format.ContentType())
+		c.Header("Vary", "Accept")
+		http.ServeContent(c.Writer, c.Request, "", time.Time{}, bytes.NewReader(data))
+	})
+
+	// Пики волны в формате audiowaveform для отрисовки в плеере
+	r.GET("/api/songs/:id/waveform", func(c *gin.Context) {
+		song, ok := loadSong(c, musSvc, logger)
+		if !ok {
+			return
+		}
+		resolution, err := strconv.Atoi(c.DefaultQuery("resolution", strconv.Itoa(defaultWaveformResolution)))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid resolution",
+			})
+			return
+		}
+		format, ok := waveform.ParseFormat(c.DefaultQuery("format", string(waveform.JSON)))
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid format",
+			})
+			return
+		}
+
+		body, _, err := musSvc.GetWaveform(c.Request.Context(), song, resolution, format)
+		if err != nil {
+			var invalidParam music.ErrorInvalidParam
+			switch {
+			case errors.As(err, &invalidParam):
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": invalidParam.Error(),
+				})
+			case errors.Is(err, music.ErrNoWaveform):
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song has no waveform",
+				})
+			default:
+				logger.WithError(err).Error("failed to get song waveform")
+				c.AbortWithError(http.StatusInternalServerError, err)
+			}
+			return
+		}
+		defer body.Close()
+		data, err := io.ReadAll(body)
+		if err != nil {
+			logger.WithError(err).Error("failed to read song waveform")
+			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
-		if !isAllowedAudioMIME(mime) {
+
+		// Как и обложка, пики определяются содержимым песни, которое может смениться
+		c.Header("ETag", fmt.Sprintf(`"%s-waveform-%d.%s"`, song.Hash, resolution, format.Ext()))
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.Header("Content-Type", format.ContentType())
+		http.ServeContent(c.Writer, c.Request, "", time.Time{}, bytes.NewReader(data))
+	})
+
+	authorized := r.Group("/api", authorize(authSvc, logger))
+
+	authorized.GET("/songs/:id/stream", func(c *gin.Context) {
+		reqCtx := c.Request.Context()
+		song, ok := loadSong(c, musSvc, logger)
+		if !ok {
+			return
+		}
+
+		info, err := musSvc.StatSong(reqCtx, song)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song file not found",
+				})
+				return
+			}
+			logger.WithError(err).Error("failed to open song")
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		open := func(ctx context.Context, offset int64, length int64) (*music.ObjectRange, error) {
+			return musSvc.GetSongRange(ctx, song, offset, length)
+		}
+		content := newStorageReadSeeker(reqCtx, open, info.Size)
+		defer content.Close()
+
+		if info.ETag != "" {
+			c.Header("ETag", info.ETag)
+		}
+		// Без Content-Type ServeContent прочитал бы начало файла, чтобы определить его
+		if contentType := info.ContentType; contentType != "" {
+			c.Header("Content-Type", contentType)
+		} else if song.ContentType != "" {
+			c.Header("Content-Type", song.ContentType)
+		}
+		c.Header("Accept-Ranges", "bytes")
+		// ServeContent сам обрабатывает Range, If-Range, If-None-Match и If-Modified-Since
+		http.ServeContent(c.Writer, c.Request, "", info.ModTime, content)
+	})
+
+	authorized.GET("/songs/:id/play", func(c *gin.Context) {
+		song, ok := loadSong(c, musSvc, logger)
+		if !ok {
+			return
+		}
+		request, err := musSvc.GetSongPlaybackURL(c.Request.Context(), song)
+		if err != nil {
+			if errors.Is(err, music.ErrDirectAccessDisabled) {
+				// Хранилище не отдает файлы напрямую, воспроизводим через сервер
+				c.Redirect(http.StatusTemporaryRedirect, "/api/songs/"+c.Param("id")+"/stream")
+				return
+			}
+			logger.WithError(err).Error("failed to presign song url")
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Redirect(http.StatusTemporaryRedirect, request.URL)
+	})
+
+	authorized.POST("/songs/direct-upload", func(c *gin.Context) {
+		size, err := strconv.ParseInt(c.Query("size"), 10, 64)
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"error":       "invalid file content type",
-				"contentType": mime,
+				"error": "invalid size",
 			})
 			return
 		}
+		request, err := musSvc.PrepareDirectUpload(c.Request.Context(), c.Query("sha256"), size)
+		if err != nil {
+			var invalidParam music.ErrorInvalidParam
+			switch {
+			case errors.As(err, &invalidParam):
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": invalidParam.Error(),
+				})
+			case errors.Is(err, music.ErrDirectAccessDisabled):
+				c.JSON(http.StatusNotImplemented, gin.H{
+					"error": err.Error(),
+				})
+			default:
+				logger.WithError(err).Error("failed to presign upload")
+				c.AbortWithError(http.StatusInternalServerError, err)
+			}
+			return
+		}
+		if request == nil {
+			// Файл уже есть в хранилище, достаточно зарегистрировать песню
+			c.JSON(http.StatusOK, gin.H{
+				"exists": true,
+			})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"exists": false,
+			"upload": request,
+		})
+	})
+
+	authorized.POST("/songs/direct-upload/complete", func(c *gin.Context) {
+		params := c.Request.URL.Query()
+		var song music.Song
+		if err := song.UnmarshalParams(params); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		song.Hash = c.Query("sha256")
+		err := musSvc.CompleteDirectUpload(c.Request.Context(), &song)
+		if err != nil {
+			var invalidParam music.ErrorInvalidParam
+			var getSong music.ErrorGetSong
+			switch {
+			case errors.As(err, &invalidParam):
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": invalidParam.Error(),
+				})
+			case errors.As(err, &getSong):
+				c.JSON(http.StatusConflict, gin.H{
+					"error": "song file is not uploaded",
+				})
+			default:
+				logger.WithError(err).Error("failed to register uploaded song")
+				c.AbortWithError(http.StatusInternalServerError, err)
+			}
+			return
+		}
 
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+			"id":     song.ID,
+			"hash":   song.Hash,
+		})
+	})
+
+	authorized.PUT("/songs/:id/content", func(c *gin.Context) {
+		id, ok := parseID(c, "id", "song id")
+		if !ok {
+			return
+		}
+		fh, mime, ok := readAudioFile(c, logger)
+		if !ok {
+			return
+		}
 		src, err := fh.Open()
 		if err != nil {
 			logger.WithError(err).Error("failed to open file")
@@ -60,30 +350,314 @@ func SetupRouter(
 			return
 		}
 		defer src.Close()
-		content, err := io.ReadAll(src)
+		song := music.Song{ID: id, Content: src, Size: fh.Size, ContentType: mime}
+		if err = musSvc.ReplaceSongContent(c.Request.Context(), &song); err != nil {
+			if errors.Is(err, common.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song not found",
+				})
+				return
+			}
+			logger.WithError(err).Error("failed to replace song content")
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":      "ok",
+			"contentType": mime,
+			"hash":        song.Hash,
+			"audio":       audioResponse(song.Audio),
+		})
+	})
+
+	authorized.GET("/songs/:id", func(c *gin.Context) {
+		id, ok := parseID(c, "id", "song id")
+		if !ok {
+			return
+		}
+		// В отличие от loadSong, недоступная песня тоже описывается: клиент увидит available = false
+		song, err := musSvc.GetSongByID(c.Request.Context(), id)
 		if err != nil {
-			logger.WithError(err).Error("failed to read file")
-			c.AbortWithError(http.StatusBadRequest, err)
+			if errors.Is(err, common.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song not found",
+				})
+				return
+			}
+			logger.WithError(err).Error("failed to get song")
+			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
-		var song music.Song
-		if err = song.Unmarshal(params, content); err != nil {
-			logger.WithError(err).Error("failed to unmarshal song")
-			c.AbortWithError(http.StatusBadRequest, err)
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":        song.ID,
+			"hash":      song.Hash,
+			"size":      song.Size,
+			"available": song.Available,
+			"metadata":  songMetadata(song),
+			"audio":     audioResponse(song.Audio),
+		})
+	})
+
+	// Заменяет описание песни. Параметры те же, что при прямой загрузке
+	authorized.PUT("/songs/:id", func(c *gin.Context) {
+		id, ok := parseID(c, "id", "song id")
+		if !ok {
 			return
 		}
-		err = musSvc.UploadSong(ctx, &song)
+		song := music.Song{ID: id}
+		if err := song.UnmarshalParams(c.Request.URL.Query()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		if err := musSvc.UpdateSong(c.Request.Context(), &song); err != nil {
+			if errors.Is(err, common.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song not found",
+				})
+				return
+			}
+			logger.WithError(err).Error("failed to update song")
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status":   "ok",
+			"id":       song.ID,
+			"metadata": songMetadata(&song),
+		})
+	})
+
+	authorized.DELETE("/songs/:id", func(c *gin.Context) {
+		id, ok := parseID(c, "id", "song id")
+		if !ok {
+			return
+		}
+		if err := musSvc.DeleteSong(c.Request.Context(), id); err != nil {
+			if errors.Is(err, common.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song not found",
+				})
+				return
+			}
+			logger.WithError(err).Error("failed to delete song")
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+		})
+	})
+
+	authorized.GET("/songs/:id/versions", func(c *gin.Context) {
+		id, ok := parseID(c, "id", "song id")
+		if !ok {
+			return
+		}
+		versions, err := musSvc.ListSongVersions(c.Request.Context(), id)
 		if err != nil {
-			logger.WithError(err).Error("failed to upload song")
+			if errors.Is(err, common.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song not found",
+				})
+				return
+			}
+			logger.WithError(err).Error("failed to list song versions")
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"status":      "ok",
-			"contentType": mime,
+			"versions": versions,
+		})
+	})
+
+	authorized.POST("/songs/:id/versions/:version/restore", func(c *gin.Context) {
+		id, ok := parseID(c, "id", "song id")
+		if !ok {
+			return
+		}
+		versionID, ok := parseID(c, "version", "version id")
+		if !ok {
+			return
+		}
+		err := musSvc.RestoreSongVersion(c.Request.Context(), id, versionID)
+		if err != nil {
+			switch {
+			case errors.Is(err, common.ErrNotFound):
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song version not found",
+				})
+			case errors.Is(err, os.ErrNotExist):
+				c.JSON(http.StatusConflict, gin.H{
+					"error": "song version file not found",
+				})
+			default:
+				logger.WithError(err).Error("failed to restore song version")
+				c.AbortWithError(http.StatusInternalServerError, err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"status": "ok",
+		})
+	})
+
+	// Удаляет версии песни, кроме keep последних
+	authorized.DELETE("/songs/:id/versions", func(c *gin.Context) {
+		id, ok := parseID(c, "id", "song id")
+		if !ok {
+			return
+		}
+		keep, err := strconv.Atoi(c.DefaultQuery("keep", "0"))
+		if err != nil || keep < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid keep",
+			})
+			return
+		}
+		pruned, err := musSvc.PruneSongVersions(c.Request.Context(), id, keep)
+		if err != nil {
+			if errors.Is(err, common.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": "song not found",
+				})
+				return
+			}
+			logger.WithError(err).Error("failed to prune song versions")
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"pruned": pruned,
 		})
 	})
 
 	return r
 }
+
+// loadSong находит песню по параметру пути :id. Если песни нет, сам отвечает клиенту и возвращает false
+func loadSong(c *gin.Context, musSvc *music.Service, logger *logrus.Logger) (*music.Song, bool) {
+	id, ok := parseID(c, "id", "song id")
+	if !ok {
+		return nil, false
+	}
+	song, err := musSvc.GetSongByID(c.Request.Context(), id)
+	if err != nil {
+		if errors.Is(err, common.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "song not found",
+			})
+			return nil, false
+		}
+		logger.WithError(err).Error("failed to get song")
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if !song.Available {
+		// Проверка хранилища не нашла аудиофайл песни или нашла его поврежденным
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "song is unavailable",
+		})
+		return nil, false
+	}
+
+	return song, true
+}
+
+// defaultCoverSize - размер обложки, если он не указан в запросе
+const defaultCoverSize = 300
+
+// defaultWaveformResolution - число пар пиков, если оно не указано в запросе
+const defaultWaveformResolution = 1024
+
+// coverFormat берет формат обложки из параметра format, а без него выбирает WebP,
+// если клиент его принимает
+func coverFormat(c *gin.Context) (cover.Format, bool) {
+	if value := c.Query("format"); value != "" {
+		return cover.ParseFormat(value)
+	}
+	if strings.Contains(c.GetHeader("Accept"), cover.WebP.ContentType()) {
+		return cover.WebP, true
+	}
+
+	return cover.JPEG, true
+}
+
+func songMetadata(song *music.Song) gin.H {
+	return gin.H{
+		"name":    song.Name,
+		"artists": song.Artists,
+		"albums":  song.Albums,
+		"track":   song.TrackNumber,
+		"disc":    song.DiscNumber,
+		"year":    song.Year,
+		"genre":   song.Genre,
+	}
+}
+
+// audioResponse описывает технические параметры песни. Длительность в миллисекундах
+func audioResponse(audio music.AudioInfo) gin.H {
+	return gin.H{
+		"codec":      audio.Codec,
+		"durationMs": audio.Duration.Milliseconds(),
+		"bitrate":    audio.Bitrate,
+		"sampleRate": audio.SampleRate,
+		"channels":   audio.Channels,
+	}
+}
+
+// parseID читает числовой параметр пути. Если он некорректен, сам отвечает клиенту и возвращает false
+func parseID(c *gin.Context, param string, name string) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param(param), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid " + name,
+		})
+		return 0, false
+	}
+
+	return id, true
+}
+
+// readAudioFile достает аудиофайл из поля формы song и определяет его MIME-тип по содержимому.
+// Если файла нет или это не аудио, сам отвечает клиенту и возвращает false
+func readAudioFile(c *gin.Context, logger *logrus.Logger) (*multipart.FileHeader, string, bool) {
+	fh, err := c.FormFile("song")
+	if err != nil {
+		logger.WithError(err).Error("failed to get file")
+		c.AbortWithError(http.StatusBadRequest, err)
+		return nil, "", false
+	}
+
+	// Дополнительный (быстрый) фильтр по расширению.
+	if !isAllowedAudioExtension(fh.Filename) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid file extension",
+		})
+		return nil, "", false
+	}
+
+	mime, err := sniffContentType(fh)
+	if err != nil {
+		logger.WithError(err).Error("failed to sniff content type")
+		c.AbortWithError(http.StatusBadRequest, err)
+		return nil, "", false
+	}
+	if !isAllowedAudioMIME(mime) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":       "invalid file content type",
+			"contentType": mime,
+		})
+		return nil, "", false
+	}
+
+	return fh, mime, true
+}
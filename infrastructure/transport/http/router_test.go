@@ -0,0 +1,95 @@
+package http_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kroticw/freshman-server/infrastructure/auth"
+	"github.com/kroticw/freshman-server/infrastructure/storage"
+	transport "github.com/kroticw/freshman-server/infrastructure/transport/http"
+	"github.com/kroticw/freshman-server/internal/common"
+	"github.com/kroticw/freshman-server/internal/music"
+	"github.com/sirupsen/logrus"
+)
+
+const testToken = "token"
+
+type sessionRepo struct{}
+
+func (sessionRepo) GetUserIDByToken(_ context.Context, token string) (int64, error) {
+	if token != testToken {
+		return 0, common.ErrNotFound
+	}
+	return 1, nil
+}
+
+// songRepo знает одну песню. Остальные методы тестам не нужны
+type songRepo struct {
+	music.Repo
+	song *music.Song
+}
+
+func (r songRepo) GetSongByID(_ context.Context, id int64) (*music.Song, error) {
+	if id != r.song.ID {
+		return nil, common.ErrNotFound
+	}
+	song := *r.song
+	return &song, nil
+}
+
+func newTestRouter(t *testing.T, content string) http.Handler {
+	gin.SetMode(gin.TestMode)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	driver := storage.NewMemoryDriver()
+	hash := strings.Repeat("ab", 32)
+	err := driver.Upload(context.Background(), music.ContentKey(hash), strings.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	song := &music.Song{ID: 1, Name: "song", Hash: hash, Path: music.ContentKey(hash), Available: true}
+	musSvc := music.NewMusicService(driver, songRepo{song: song}, logger)
+	authSvc := auth.NewAuthService(sessionRepo{}, logger)
+
+	return transport.SetupRouter(context.Background(), musSvc, authSvc, logger)
+}
+
+func TestSongStream(t *testing.T) {
+	router := newTestRouter(t, "0123456789")
+	request := func(path string, token string, rangeHeader string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if w := request("/api/songs/1/stream", token, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("stream with token %q: status %d, want 401", token, w.Code)
+		}
+	}
+	if w := request("/api/songs/2/stream", testToken, ""); w.Code != http.StatusNotFound {
+		t.Errorf("stream of missing song: status %d, want 404", w.Code)
+	}
+	w := request("/api/songs/1/stream", testToken, "")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("stream: status %d, body %q", w.Code, w.Body.String())
+	}
+	w = request("/api/songs/1/stream", testToken, "bytes=2-5")
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" ||
+		w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("ranged stream: status %d, body %q, Content-Range %q",
+			w.Code, w.Body.String(), w.Header().Get("Content-Range"))
+	}
+}
@@ -0,0 +1,82 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+type rangeOpener func(ctx context.Context, offset int64, length int64) (*music.ObjectRange, error)
+
+// storageReadSeeker представляет файл в хранилище как io.ReadSeeker для http.ServeContent.
+// Seek ничего не читает: поток открывается заново с нужного смещения только при следующем Read,
+// поэтому перемотка по диапазонам не требует загрузки файла в память.
+type storageReadSeeker struct {
+	ctx     context.Context
+	open    rangeOpener
+	size    int64
+	pos     int64
+	body    io.ReadCloser
+	bodyPos int64
+}
+
+// newStorageReadSeeker не открывает файл: поток открывается при первом Read.
+// size - размер файла, известный заранее, например из Storage.Stat
+func newStorageReadSeeker(ctx context.Context, open rangeOpener, size int64) *storageReadSeeker {
+	return &storageReadSeeker{
+		ctx:  ctx,
+		open: open,
+		size: size,
+	}
+}
+
+func (r *storageReadSeeker) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil || r.bodyPos != r.pos {
+		if r.body != nil {
+			_ = r.body.Close()
+		}
+		rng, err := r.open(r.ctx, r.pos, -1)
+		if err != nil {
+			r.body = nil
+			return 0, err
+		}
+		r.body = rng.Body
+		r.bodyPos = r.pos
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	r.bodyPos += int64(n)
+
+	return n, err
+}
+
+func (r *storageReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+
+	return offset, nil
+}
+
+func (r *storageReadSeeker) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	return r.body.Close()
+}
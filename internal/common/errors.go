@@ -0,0 +1,6 @@
+package common
+
+import "errors"
+
+// ErrNotFound возвращается репозиториями, когда запись не найдена
+var ErrNotFound = errors.New("not found")
@@ -0,0 +1,112 @@
+package music
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+// errContentNotRewindable возвращается readContent, если content нельзя прочитать с начала файла песни
+var errContentNotRewindable = errors.New("song content can't be read from the beginning")
+
+// contentKeyExt отделяет файл песни от каталога со слинкованными с ним файлами,
+// который в хранилище называется по имени файла без расширения
+const contentKeyExt = ".audio"
+
+// ContentKey возвращает ключ в хранилище для аудиофайла с SHA-256 hash
+func ContentKey(hash string) string {
+	return hash + contentKeyExt
+}
+
+// hashContent считает SHA-256 содержимого песни за один проход. Если content не умеет
+// перематываться, он по пути копируется во временный файл, чтобы после хэширования его
+// можно было прочитать повторно. cleanup удаляет временный файл и должен быть вызван всегда.
+func hashContent(content io.Reader, size int64) (hash string, body io.ReadSeeker, cleanup func(), err error) {
+	hasher := sha256.New()
+	if seeker, ok := content.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		if _, err = io.CopyN(hasher, seeker, size); err != nil {
+			return "", nil, nil, err
+		}
+		if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+			return "", nil, nil, err
+		}
+		return hex.EncodeToString(hasher.Sum(nil)), seeker, func() {}, nil
+	}
+
+	spool, err := os.CreateTemp("", "song-*")
+	if err != nil {
+		return "", nil, nil, err
+	}
+	cleanup = func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	if _, err = io.CopyN(io.MultiWriter(spool, hasher), content, size); err != nil {
+		cleanup()
+		return "", nil, nil, err
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return "", nil, nil, err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), spool, cleanup, nil
+}
+
+// readContent передает read содержимое песни размером size, начинающееся с текущей позиции content,
+// и возвращает позицию content на место
+func readContent[T any](content io.ReadSeeker, size int64, read func(r io.ReadSeeker) (T, error)) (T, error) {
+	var zero T
+	start, err := content.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return zero, err
+	}
+	if readerAt, ok := content.(io.ReaderAt); ok {
+		return read(io.NewSectionReader(readerAt, start, size))
+	}
+	if start != 0 {
+		// Без ReaderAt read увидел бы и то, что лежит в content до песни
+		return zero, errContentNotRewindable
+	}
+	result, err := read(content)
+	if _, seekErr := content.Seek(start, io.SeekStart); seekErr != nil {
+		return zero, seekErr
+	}
+
+	return result, err
+}
+
+// spoolContent копирует аудиофайл песни из хранилища во временный файл: разбор форматов
+// требует перемотки. cleanup удаляет временный файл и должен быть вызван, если нет ошибки
+func (s *Service) spoolContent(ctx context.Context, song *Song) (spool *os.File, cleanup func(), err error) {
+	body, size, err := s.storage.Get(ctx, song.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	spool, err = os.CreateTemp("", "song-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup = func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	if _, err = io.CopyN(spool, body, size); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	return spool, cleanup, nil
+}
@@ -0,0 +1,109 @@
+// Package cover уменьшает встроенные в аудиофайлы обложки до миниатюр JPEG и WebP
+package cover
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	// Форматы обложек, которые встречаются в тегах
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// ErrUnsupportedImage возвращается, если обложку не удалось декодировать
+var ErrUnsupportedImage = errors.New("unsupported cover image")
+
+// maxPixels защищает от обложек, которые при декодировании займут слишком много памяти
+const maxPixels = 40_000_000
+
+const jpegQuality = 85
+
+type Format string
+
+const (
+	JPEG Format = "jpeg"
+	// WebP кодируется без потерь: чистого Go-кодировщика WebP с потерями нет
+	WebP Format = "webp"
+)
+
+// ParseFormat возвращает формат по имени. ok = false для неизвестного формата
+func ParseFormat(name string) (format Format, ok bool) {
+	switch Format(name) {
+	case JPEG, "jpg":
+		return JPEG, true
+	case WebP:
+		return WebP, true
+	default:
+		return "", false
+	}
+}
+
+// Ext возвращает расширение файла без точки
+func (f Format) Ext() string {
+	if f == JPEG {
+		return "jpg"
+	}
+	return string(f)
+}
+
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Decode декодирует обложку в форматах JPEG, PNG, GIF или WebP
+func Decode(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("%w: %dx%d", ErrUnsupportedImage, config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedImage, err)
+	}
+
+	return img, nil
+}
+
+// Thumbnail вписывает изображение в квадрат size x size с сохранением пропорций и кодирует его.
+// Изображения меньше квадрата не увеличиваются. Прозрачные области заливаются белым
+func Thumbnail(img image.Image, size int, format Format) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+	thumbnail := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(thumbnail, thumbnail.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumbnail, thumbnail.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case JPEG:
+		err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: jpegQuality})
+	case WebP:
+		err = nativewebp.Encode(&buf, thumbnail, nil)
+	default:
+		err = fmt.Errorf("unknown cover format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
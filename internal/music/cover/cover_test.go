@@ -0,0 +1,64 @@
+package cover_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/kroticw/freshman-server/internal/music/cover"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestThumbnail(t *testing.T) {
+	img, err := cover.Decode(encodePNG(t, 800, 400))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		size          int
+		format        cover.Format
+		width, height int
+	}{
+		{300, cover.JPEG, 300, 150},
+		{100, cover.WebP, 100, 50},
+		// Изображение меньше квадрата не увеличивается
+		{1000, cover.JPEG, 800, 400},
+	}
+	for _, tt := range tests {
+		data, err := cover.Thumbnail(img, tt.size, tt.format)
+		if err != nil {
+			t.Fatalf("Thumbnail(%d, %s): %v", tt.size, tt.format, err)
+		}
+		config, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("decode %s thumbnail: %v", tt.format, err)
+		}
+		if format != string(tt.format) || config.Width != tt.width || config.Height != tt.height {
+			t.Errorf("Thumbnail(%d, %s) = %s %dx%d, want %dx%d",
+				tt.size, tt.format, format, config.Width, config.Height, tt.width, tt.height)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	if _, err := cover.Decode([]byte("not an image")); !errors.Is(err, cover.ErrUnsupportedImage) {
+		t.Errorf("Decode() error = %v, want ErrUnsupportedImage", err)
+	}
+}
@@ -0,0 +1,195 @@
+package music
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/kroticw/freshman-server/internal/music/cover"
+	"github.com/kroticw/freshman-server/internal/music/tags"
+)
+
+// CoverSizes - стороны миниатюр обложки в пикселях
+var CoverSizes = []int{100, 300, 600}
+
+// CoverFormats - форматы миниатюр, которые создаются при загрузке
+var CoverFormats = []cover.Format{cover.JPEG, cover.WebP}
+
+// coverSourceName - имя исходного изображения обложки, слинкованного с аудиофайлом.
+// Пустой файл означает, что обложки в аудиофайле нет
+const coverSourceName = "cover"
+
+// ErrNoCover возвращается, если в аудиофайле песни нет обложки
+var ErrNoCover = errors.New("song has no cover")
+
+// LinkedKey возвращает ключ в хранилище файла name, слинкованного с sourceFilename
+func LinkedKey(sourceFilename string, name string) string {
+	return path.Join(strings.TrimSuffix(path.Base(sourceFilename), path.Ext(sourceFilename)), name)
+}
+
+func coverName(size int, format cover.Format) string {
+	return fmt.Sprintf("cover-%d.%s", size, format.Ext())
+}
+
+// storeCovers сохраняет встроенную обложку рядом с аудиофайлом и создает все миниатюры.
+// Ошибки не прерывают загрузку песни: недостающие миниатюры GetCover создаст при запросе
+func (s *Service) storeCovers(ctx context.Context, song *Song, picture *tags.Picture) {
+	// Песня с уже загруженным содержимым: обложки сохранены при первой загрузке
+	if exists, err := s.storage.IsLinkedExists(ctx, coverSourceName, song.Path); err != nil || exists {
+		if err != nil {
+			s.log.WithError(err).Warnf("failed to check cover of song %s", song.Name)
+		}
+		return
+	}
+	var data []byte
+	if picture != nil {
+		data = picture.Data
+	}
+	if err := s.uploadLinked(ctx, song, coverSourceName, data); err != nil {
+		s.log.WithError(err).Warnf("failed to store cover of song %s", song.Name)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	img, err := cover.Decode(data)
+	if err != nil {
+		s.log.WithError(err).Warnf("failed to decode cover of song %s", song.Name)
+		return
+	}
+	for _, size := range CoverSizes {
+		for _, format := range CoverFormats {
+			if _, err = s.storeThumbnail(ctx, song, img, size, format); err != nil {
+				s.log.WithError(err).Warnf("failed to store %dpx %s cover of song %s", size, format, song.Name)
+			}
+		}
+	}
+}
+
+// GetCover возвращает миниатюру обложки песни со стороной size. Отсутствующая миниатюра создается
+// из исходного изображения, а если его нет, то из аудиофайла. Возвращает ErrorInvalidParam для
+// размера не из CoverSizes и ErrNoCover, если в аудиофайле нет обложки
+func (s *Service) GetCover(
+	ctx context.Context,
+	song *Song,
+	size int,
+	format cover.Format,
+) (io.ReadCloser, int64, error) {
+	if !slices.Contains(CoverSizes, size) {
+		return nil, 0, ErrorInvalidParam{"size"}
+	}
+	name := coverName(size, format)
+	exists, err := s.storage.IsLinkedExists(ctx, name, song.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if exists {
+		return s.storage.Get(ctx, LinkedKey(song.Path, name))
+	}
+
+	data, err := s.coverSource(ctx, song)
+	if err != nil {
+		return nil, 0, err
+	}
+	img, err := cover.Decode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	thumbnail, err := s.storeThumbnail(ctx, song, img, size, format)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return io.NopCloser(bytes.NewReader(thumbnail)), int64(len(thumbnail)), nil
+}
+
+func (s *Service) storeThumbnail(
+	ctx context.Context,
+	song *Song,
+	img image.Image,
+	size int,
+	format cover.Format,
+) ([]byte, error) {
+	thumbnail, err := cover.Thumbnail(img, size, format)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.uploadLinked(ctx, song, coverName(size, format), thumbnail); err != nil {
+		return nil, err
+	}
+
+	return thumbnail, nil
+}
+
+// coverSource читает исходное изображение обложки. Для песен, загруженных до появления обложек,
+// оно извлекается из аудиофайла и сохраняется, чтобы не читать аудиофайл повторно
+func (s *Service) coverSource(ctx context.Context, song *Song) ([]byte, error) {
+	body, _, err := s.storage.Get(ctx, LinkedKey(song.Path, coverSourceName))
+	if err == nil {
+		defer body.Close()
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return nil, ErrNoCover
+		}
+		return data, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	picture, err := s.readStoredCover(ctx, song)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if picture != nil {
+		data = picture.Data
+	}
+	if err = s.uploadLinked(ctx, song, coverSourceName, data); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNoCover
+	}
+
+	return data, nil
+}
+
+// readStoredCover читает обложку из аудиофайла песни в хранилище
+func (s *Service) readStoredCover(ctx context.Context, song *Song) (*tags.Picture, error) {
+	spool, cleanup, err := s.spoolContent(ctx, song)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	found, err := tags.Read(spool)
+	if err != nil {
+		if errors.Is(err, tags.ErrUnsupportedFormat) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return found.Picture, nil
+}
+
+// uploadLinked сохраняет data рядом с аудиофайлом песни. Уже сохраненный файл не ошибка:
+// его создал параллельный запрос из того же содержимого
+func (s *Service) uploadLinked(ctx context.Context, song *Song, name string, data []byte) error {
+	err := s.storage.UploadLinked(ctx, name, song.Path, bytes.NewReader(data), int64(len(data)))
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,143 @@
+package music
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"time"
+)
+
+// DefaultGCGracePeriod - срок, в течение которого загрузка успевает зарегистрировать песню для своего файла
+const DefaultGCGracePeriod = 24 * time.Hour
+
+type GCOptions struct {
+	// GracePeriod - файлы моложе этого срока не собираются, даже если на них не ссылается ни одна песня
+	GracePeriod time.Duration
+	// DryRun только составляет отчет, ничего не удаляя
+	DryRun bool
+	// QuarantinePrefix, если задан, включает перенос брошенных файлов под ключ "<префикс>/<ключ>"
+	// вместо удаления. Такие ключи не хранятся по хешу содержимого, поэтому GC их больше не трогает
+	QuarantinePrefix string
+}
+
+type GCReport struct {
+	DryRun  bool `json:"dryRun"`
+	Objects int  `json:"objects"`
+	// Collected - брошенные файлы, которые удалены или перенесены (в DryRun - были бы)
+	Collected   []OrphanObject `json:"collected"`
+	Deleted     int            `json:"deleted"`
+	Quarantined int            `json:"quarantined"`
+	// ReclaimedBytes - суммарный размер собранных файлов. При переносе в карантин место освобождается,
+	// только когда префикс карантина очищают вручную
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+	// Failed - хеши содержимого, файлы которых не удалось собрать. Они будут собраны при следующем запуске
+	Failed []string `json:"failed"`
+}
+
+// CollectGarbage удаляет файлы, на которые не ссылается ни одна песня или версия песни: например, аудиофайл,
+// загруженный запросом, который затем не смог создать песню. Файлы, слинкованные с брошенным,
+// собираются вместе с ним. Перед удалением ссылка на содержимое перепроверяется в БД,
+// поскольку за время обхода хранилища его могла переиспользовать новая песня.
+func (s *Service) CollectGarbage(ctx context.Context, opts GCOptions) (*GCReport, error) {
+	index, err := s.indexStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	songs, err := s.repo.ListSongs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := s.referencedContent(ctx, songs)
+	if err != nil {
+		return nil, err
+	}
+	report := &GCReport{DryRun: opts.DryRun, Objects: index.total, Collected: []OrphanObject{}, Failed: []string{}}
+
+	for _, source := range index.orphans(referenced, time.Now().Add(-opts.GracePeriod)) {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		sourceObjects := index.bySource[source]
+		if !opts.DryRun {
+			if err = s.collectSource(ctx, source, sourceObjects, opts.QuarantinePrefix); err != nil {
+				if errors.Is(err, errContentReferenced) {
+					continue
+				}
+				s.log.WithError(err).Errorf("failed to collect orphaned content %s", source)
+				report.Failed = append(report.Failed, source)
+				continue
+			}
+		}
+		for _, object := range sourceObjects {
+			report.Collected = append(report.Collected, newOrphanObject(object))
+			report.ReclaimedBytes += object.Size
+		}
+		if opts.QuarantinePrefix != "" {
+			report.Quarantined += len(sourceObjects)
+		} else {
+			report.Deleted += len(sourceObjects)
+		}
+	}
+	sortOrphans(report.Collected)
+
+	return report, nil
+}
+
+// errContentReferenced - содержимое стало нужно песне, созданной во время сборки
+var errContentReferenced = errors.New("content is referenced by a song")
+
+// collectSource собирает файлы содержимого source. Перепроверка ссылок и удаление идут под блокировкой
+// содержимого, чтобы новая песня не сослалась на него между ними. Копирование в карантин идет до блокировки:
+// оно читает файлы целиком, а блокировка задерживает загрузки того же содержимого. Если за время
+// копирования на содержимое сослалась песня, копии остаются в карантине до его ручной очистки
+func (s *Service) collectSource(ctx context.Context, source string, objects []ObjectInfo, quarantinePrefix string) error {
+	if quarantinePrefix != "" {
+		for _, object := range objects {
+			if err := s.quarantine(ctx, object.Key, path.Join(quarantinePrefix, object.Key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.repo.InTransaction(ctx, func(repo Repo) error {
+		if err := repo.LockContent(ctx, source); err != nil {
+			return err
+		}
+		referenced, err := repo.SongExistsByHash(ctx, source)
+		if err != nil {
+			return err
+		}
+		if referenced {
+			return errContentReferenced
+		}
+		// Удаление исходного файла удаляет и все слинкованные с ним
+		err = s.storage.Delete(ctx, ContentKey(source))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.log.Infof("Collected %d orphaned files of content %s", len(objects), source)
+
+		return nil
+	})
+}
+
+// quarantine копирует файл под ключ target вместе с метаданными. Исходный файл удаляет вызывающая сторона
+func (s *Service) quarantine(ctx context.Context, key string, target string) error {
+	info, err := s.storage.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	body, size, err := s.storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	err = s.storage.UploadWithMetadata(ctx, target, body, size, info.ObjectMetadata)
+	if errors.Is(err, os.ErrExist) {
+		// Прошлая сборка успела перенести файл, но не удалила оригинал
+		return nil
+	}
+
+	return err
+}
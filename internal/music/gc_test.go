@@ -0,0 +1,173 @@
+package music_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+// gcFixture - песня со своим содержимым и брошенное содержимое со слинкованной обложкой
+func gcFixture(t *testing.T) (repo *fakeRepo, driver music.Storage, service *music.Service, orphan string, kept string) {
+	t.Helper()
+	repo = &fakeRepo{}
+	service, memory := newTestService(repo)
+	kept = storeContent(t, memory, "song")
+	repo.songs = []*music.Song{{ID: 1, Name: "song", Hash: kept}}
+	orphan = storeContent(t, memory, "orphan")
+	err := memory.UploadLinked(context.Background(), "cover-256.jpg", music.ContentKey(orphan), strings.NewReader("jpeg"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return repo, memory, service, orphan, kept
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	_, driver, service, orphan, kept := gcFixture(t)
+	orphanFiles := []string{music.ContentKey(orphan), music.LinkedKey(music.ContentKey(orphan), "cover-256.jpg")}
+
+	// Файлы моложе срока ожидания не трогаются
+	report, err := service.CollectGarbage(ctx, music.GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collected) != 0 || report.Objects != 3 {
+		t.Fatalf("CollectGarbage() within grace period = %+v", report)
+	}
+
+	report, err = service.CollectGarbage(ctx, music.GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collected) != 2 || report.Deleted != 2 || report.ReclaimedBytes != int64(len("orphan")+4) {
+		t.Fatalf("CollectGarbage(DryRun) = %+v", report)
+	}
+	for _, key := range orphanFiles {
+		if !exists(t, driver, key) {
+			t.Fatalf("CollectGarbage(DryRun) deleted %s", key)
+		}
+	}
+
+	report, err = service.CollectGarbage(ctx, music.GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collected) != 2 || report.Deleted != 2 || len(report.Failed) != 0 {
+		t.Fatalf("CollectGarbage() = %+v", report)
+	}
+	for _, key := range orphanFiles {
+		if exists(t, driver, key) {
+			t.Errorf("CollectGarbage() left orphaned %s", key)
+		}
+	}
+	if !exists(t, driver, music.ContentKey(kept)) {
+		t.Error("CollectGarbage() deleted referenced content")
+	}
+}
+
+func TestCollectGarbageQuarantine(t *testing.T) {
+	ctx := context.Background()
+	_, driver, service, orphan, _ := gcFixture(t)
+
+	report, err := service.CollectGarbage(ctx, music.GCOptions{QuarantinePrefix: "quarantine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Quarantined != 2 || report.Deleted != 0 {
+		t.Fatalf("CollectGarbage(QuarantinePrefix) = %+v", report)
+	}
+	for key, content := range map[string]string{
+		music.ContentKey(orphan):                                   "orphan",
+		music.LinkedKey(music.ContentKey(orphan), "cover-256.jpg"): "jpeg",
+	} {
+		if exists(t, driver, key) {
+			t.Errorf("%s is left after quarantine", key)
+		}
+		body, _, err := driver.Get(ctx, "quarantine/"+key)
+		if err != nil {
+			t.Fatalf("quarantined %s: %v", key, err)
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil || string(data) != content {
+			t.Errorf("quarantined %s = %q, %v, want %q", key, data, err, content)
+		}
+	}
+
+	// Перенесенные файлы хранятся не по хешу, и повторная сборка их не трогает
+	report, err = service.CollectGarbage(ctx, music.GCOptions{QuarantinePrefix: "quarantine"})
+	if err != nil || len(report.Collected) != 0 {
+		t.Fatalf("second CollectGarbage() = %+v, %v", report, err)
+	}
+}
+
+func TestCollectGarbageReferencedDuringCollection(t *testing.T) {
+	repo, driver, service, orphan, _ := gcFixture(t)
+	// Песня на брошенное содержимое создана после того, как GC прочитал список песен
+	repo.lateRefs = map[string]bool{orphan: true}
+
+	report, err := service.CollectGarbage(context.Background(), music.GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collected) != 0 || report.Deleted != 0 || len(report.Failed) != 0 {
+		t.Fatalf("CollectGarbage() = %+v", report)
+	}
+	if !exists(t, driver, music.ContentKey(orphan)) {
+		t.Error("CollectGarbage() deleted content referenced by a new song")
+	}
+}
+
+func TestVerifyDeleteOrphans(t *testing.T) {
+	ctx := context.Background()
+	repo, driver, service, orphan, kept := gcFixture(t)
+	// Песня на брошенное содержимое создана после того, как Verify прочитал список песен
+	repo.lateRefs = map[string]bool{orphan: true}
+
+	report, err := service.Verify(ctx, music.VerifyOptions{DeleteOrphans: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 2 || report.DeletedOrphans != 0 || !exists(t, driver, music.ContentKey(orphan)) {
+		t.Fatalf("Verify() deleted content referenced by a new song: %+v", report)
+	}
+
+	repo.lateRefs = nil
+	if report, err = service.Verify(ctx, music.VerifyOptions{DeleteOrphans: true}); err != nil {
+		t.Fatal(err)
+	}
+	if report.DeletedOrphans != 2 || exists(t, driver, music.ContentKey(orphan)) || !exists(t, driver, music.ContentKey(kept)) {
+		t.Errorf("Verify() = %+v, want orphaned content deleted", report)
+	}
+}
+
+func TestCollectGarbageQuarantineReferencedDuringCopy(t *testing.T) {
+	ctx := context.Background()
+	repo, driver, service, orphan, _ := gcFixture(t)
+	quarantined := "quarantine/" + music.ContentKey(orphan)
+	repo.onLock = func(hash string) {
+		// Файлы копируются в карантин до блокировки содержимого, и за это время на него сослалась песня
+		if !exists(t, driver, quarantined) {
+			t.Error("content lock taken before the quarantine copy")
+		}
+		repo.lateRefs = map[string]bool{hash: true}
+	}
+
+	report, err := service.CollectGarbage(ctx, music.GCOptions{QuarantinePrefix: "quarantine"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collected) != 0 || report.Quarantined != 0 || len(report.Failed) != 0 {
+		t.Fatalf("CollectGarbage(QuarantinePrefix) = %+v", report)
+	}
+	for _, key := range []string{music.ContentKey(orphan), music.LinkedKey(music.ContentKey(orphan), "cover-256.jpg")} {
+		if !exists(t, driver, key) {
+			t.Errorf("CollectGarbage() deleted %s referenced by a new song", key)
+		}
+	}
+}
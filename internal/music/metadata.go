@@ -0,0 +1,105 @@
+package music
+
+import (
+	"errors"
+	"io"
+
+	"github.com/kroticw/freshman-server/internal/music/probe"
+	"github.com/kroticw/freshman-server/internal/music/tags"
+)
+
+// metadataField связывает поле описания песни с его значением в тегах аудиофайла
+type metadataField struct {
+	name    string
+	present func() bool
+	// fromTags заполняет поле из тегов и сообщает, нашлось ли в них значение
+	fromTags func(t *tags.Tags) bool
+}
+
+func (s *Song) metadataFields() []metadataField {
+	return []metadataField{
+		{"name", func() bool { return s.Name != "" }, func(t *tags.Tags) bool {
+			s.Name = t.Title
+			return t.Title != ""
+		}},
+		{"artists", func() bool { return len(s.Artists) > 0 }, func(t *tags.Tags) bool {
+			s.Artists = t.Artists
+			return len(t.Artists) > 0
+		}},
+		{"albums", func() bool { return len(s.Albums) > 0 }, func(t *tags.Tags) bool {
+			if t.Album == "" {
+				return false
+			}
+			s.Albums = []string{t.Album}
+			return true
+		}},
+		{"track", func() bool { return s.TrackNumber != 0 }, func(t *tags.Tags) bool {
+			s.TrackNumber = t.TrackNumber
+			return t.TrackNumber != 0
+		}},
+		{"disc", func() bool { return s.DiscNumber != 0 }, func(t *tags.Tags) bool {
+			s.DiscNumber = t.DiscNumber
+			return t.DiscNumber != 0
+		}},
+		{"year", func() bool { return s.Year != 0 }, func(t *tags.Tags) bool {
+			s.Year = t.Year
+			return t.Year != 0
+		}},
+		{"genre", func() bool { return s.Genre != "" }, func(t *tags.Tags) bool {
+			s.Genre = t.Genre
+			return t.Genre != ""
+		}},
+	}
+}
+
+// applyTags заполняет из тегов поля, не переданные в параметрах, и отмечает их источник
+func (s *Song) applyTags(t *tags.Tags) {
+	if s.MetadataSources == nil {
+		s.MetadataSources = make(map[string]string)
+	}
+	for _, field := range s.metadataFields() {
+		if field.present() {
+			continue
+		}
+		if field.fromTags(t) {
+			s.MetadataSources[field.name] = MetadataSourceTags
+		}
+	}
+}
+
+// readTags читает теги из содержимого песни. Нечитаемые теги не ошибка: песню можно загрузить,
+// если все обязательные поля переданы в параметрах. В этом случае возвращаются пустые Tags
+func (s *Service) readTags(song *Song, content io.ReadSeeker) *tags.Tags {
+	found, err := readContent(content, song.Size, tags.Read)
+	if err != nil {
+		if errors.Is(err, tags.ErrUnsupportedFormat) {
+			s.log.Debugf("No tags read from song %s: %v", song.Name, err)
+		} else {
+			s.log.WithError(err).Warnf("failed to read tags of song %s", song.Name)
+		}
+		return &tags.Tags{}
+	}
+
+	return found
+}
+
+// fillAudioInfo определяет технические параметры аудиофайла. Неизвестный формат не ошибка:
+// параметры песни остаются пустыми
+func (s *Service) fillAudioInfo(song *Song, content io.ReadSeeker) {
+	info, err := readContent(content, song.Size, probe.Probe)
+	if err != nil {
+		if errors.Is(err, probe.ErrUnsupportedFormat) {
+			s.log.Debugf("Audio format of song %s is not recognized", song.Name)
+		} else {
+			s.log.WithError(err).Warnf("failed to probe audio of song %s", song.Name)
+		}
+		return
+	}
+	song.Audio = AudioInfo{
+		Codec:      info.Codec,
+		Duration:   info.Duration,
+		Bitrate:    info.Bitrate,
+		SampleRate: info.SampleRate,
+		Channels:   info.Channels,
+	}
+}
@@ -0,0 +1,69 @@
+package probe
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// streamInfo - поля блока STREAMINFO, общего для FLAC и Ogg FLAC
+type streamInfo struct {
+	sampleRate   int
+	channels     int
+	totalSamples int64
+}
+
+// parseStreamInfo разбирает 34 байта STREAMINFO: после размеров блоков и кадров идут
+// 20 бит частоты, 3 бита числа каналов - 1, 5 бит разрядности - 1 и 36 бит числа отсчетов
+func parseStreamInfo(data []byte) (streamInfo, error) {
+	if len(data) < 18 {
+		return streamInfo{}, ErrInvalidHeader
+	}
+	packed := binary.BigEndian.Uint64(data[10:18])
+	info := streamInfo{
+		sampleRate:   int(packed >> 44),
+		channels:     int(packed>>41&7) + 1,
+		totalSamples: int64(packed & (1<<36 - 1)),
+	}
+	if info.sampleRate == 0 {
+		return streamInfo{}, ErrInvalidHeader
+	}
+
+	return info, nil
+}
+
+// probeFLAC читает STREAMINFO и пропускает остальные блоки метаданных, чтобы найти начало аудиоданных
+func probeFLAC(r io.ReadSeeker, offset int64, size int64) (*Info, error) {
+	pos := offset + 4
+	header := make([]byte, 4)
+	var stream *streamInfo
+	for {
+		if err := readAt(r, header, pos); err != nil {
+			return nil, err
+		}
+		blockSize := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		if header[0]&0x7F == 0 {
+			data := make([]byte, min(blockSize, 34))
+			if err := readAt(r, data, pos+4); err != nil {
+				return nil, err
+			}
+			info, err := parseStreamInfo(data)
+			if err != nil {
+				return nil, err
+			}
+			stream = &info
+		}
+		pos += 4 + blockSize
+		if header[0]&0x80 != 0 {
+			break
+		}
+	}
+	// STREAMINFO обязан быть первым блоком
+	if stream == nil {
+		return nil, ErrInvalidHeader
+	}
+	info := &Info{Codec: "flac", SampleRate: stream.sampleRate, Channels: stream.channels}
+	info.Duration = durationOf(stream.totalSamples, int64(stream.sampleRate))
+	info.Bitrate = averageBitrate(size-pos, info.Duration)
+
+	return info, nil
+}
@@ -0,0 +1,138 @@
+package probe
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// mp4Codecs - кодеки по формату записи stsd. Записи других форматов, например видео, пропускаются
+var mp4Codecs = map[string]string{
+	"mp4a": "aac",
+	"alac": "alac",
+	"Opus": "opus",
+	"fLaC": "flac",
+	".mp3": "mp3",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+}
+
+// mp4Containers - атомы, внутри которых лежат mvhd и stsd
+var mp4Containers = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"mdia": true,
+	"minf": true,
+	"stbl": true,
+}
+
+type mp4Probe struct {
+	r         io.ReadSeeker
+	info      Info
+	timescale int64
+	duration  int64
+	// mdatSize - объем аудиоданных для среднего битрейта
+	mdatSize int64
+}
+
+// probeMP4 читает длительность из mvhd и параметры первой звуковой дорожки из stsd
+func probeMP4(r io.ReadSeeker, size int64) (*Info, error) {
+	probe := &mp4Probe{r: r}
+	if err := probe.walk(0, size); err != nil {
+		return nil, err
+	}
+	if probe.info.Codec == "" {
+		return nil, ErrUnsupportedFormat
+	}
+	info := probe.info
+	info.Duration = durationOf(probe.duration, probe.timescale)
+	info.Bitrate = averageBitrate(probe.mdatSize, info.Duration)
+
+	return &info, nil
+}
+
+// walk обходит атомы в диапазоне [start, end), спускаясь в контейнеры
+func (p *mp4Probe) walk(start int64, end int64) error {
+	header := make([]byte, 16)
+	for pos := start; pos+8 <= end; {
+		if err := readAt(p.r, header[:8], pos); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			size = end - pos
+		case 1:
+			if err := readAt(p.r, header[8:16], pos+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize || pos+size > end {
+			return ErrInvalidHeader
+		}
+		body, bodySize := pos+headerSize, size-headerSize
+
+		var err error
+		switch {
+		case mp4Containers[kind]:
+			err = p.walk(body, body+bodySize)
+		case kind == "mvhd":
+			err = p.readMovieHeader(body, bodySize)
+		case kind == "stsd" && p.info.Codec == "":
+			err = p.readSampleDescription(body, bodySize)
+		case kind == "mdat":
+			p.mdatSize += bodySize
+		}
+		if err != nil {
+			return err
+		}
+		pos += size
+	}
+
+	return nil
+}
+
+// readMovieHeader читает timescale и duration. В версии 1 время и длительность 64-битные
+func (p *mp4Probe) readMovieHeader(offset int64, size int64) error {
+	data := make([]byte, min(size, 32))
+	if err := readAt(p.r, data, offset); err != nil {
+		return err
+	}
+	switch {
+	case data[0] == 1 && len(data) >= 32:
+		p.timescale = int64(binary.BigEndian.Uint32(data[20:24]))
+		p.duration = int64(binary.BigEndian.Uint64(data[24:32]))
+	case data[0] == 0 && len(data) >= 20:
+		p.timescale = int64(binary.BigEndian.Uint32(data[12:16]))
+		p.duration = int64(binary.BigEndian.Uint32(data[16:20]))
+	default:
+		return ErrInvalidHeader
+	}
+
+	return nil
+}
+
+// readSampleDescription читает первую запись stsd. Запись звуковой дорожки после заголовка
+// содержит число каналов, разрядность и частоту в формате 16.16
+func (p *mp4Probe) readSampleDescription(offset int64, size int64) error {
+	data := make([]byte, min(size, 8+36))
+	if err := readAt(p.r, data, offset); err != nil {
+		return err
+	}
+	if len(data) < 8+36 || binary.BigEndian.Uint32(data[4:8]) == 0 {
+		return nil
+	}
+	entry := data[8:]
+	codec, ok := mp4Codecs[string(entry[4:8])]
+	if !ok {
+		return nil
+	}
+	p.info.Codec = codec
+	p.info.Channels = int(binary.BigEndian.Uint16(entry[24:26]))
+	p.info.SampleRate = int(binary.BigEndian.Uint32(entry[32:36]) >> 16)
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package probe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// maxSyncSearch ограничивает поиск первого кадра MPEG после тега ID3v2
+const maxSyncSearch = 64 << 10
+
+// mpegBitrates - битрейты в кбит/с по индексу из заголовка кадра
+var mpegBitrates = map[[2]int][15]int{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mpegSampleRates = map[int][3]int{
+	1: {44100, 48000, 32000},
+	2: {22050, 24000, 16000},
+	// MPEG 2.5
+	3: {11025, 12000, 8000},
+}
+
+// mpegFrame - разобранный заголовок кадра MPEG audio. version 3 означает MPEG 2.5
+type mpegFrame struct {
+	version    int
+	layer      int
+	bitrate    int
+	sampleRate int
+	channels   int
+	size       int
+	samples    int
+}
+
+// parseMPEGHeader разбирает 4 байта заголовка кадра. Возвращает nil, если это не заголовок
+func parseMPEGHeader(h []byte) *mpegFrame {
+	if len(h) < 4 || h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return nil
+	}
+	frame := &mpegFrame{}
+	switch h[1] >> 3 & 3 {
+	case 0:
+		frame.version = 3
+	case 2:
+		frame.version = 2
+	case 3:
+		frame.version = 1
+	default:
+		return nil
+	}
+	frame.layer = 4 - int(h[1]>>1&3)
+	bitrateIndex, rateIndex := int(h[2]>>4), int(h[2]>>2&3)
+	// Layer 0, свободный битрейт и зарезервированные значения не поддерживаются
+	if frame.layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return nil
+	}
+	frame.bitrate = mpegBitrates[[2]int{min(frame.version, 2), frame.layer}][bitrateIndex] * 1000
+	frame.sampleRate = mpegSampleRates[frame.version][rateIndex]
+	frame.channels = 2
+	if h[3]>>6 == 3 {
+		frame.channels = 1
+	}
+	padding := int(h[2] >> 1 & 1)
+	switch {
+	case frame.layer == 1:
+		frame.samples = 384
+		frame.size = (12*frame.bitrate/frame.sampleRate + padding) * 4
+	case frame.layer == 3 && frame.version != 1:
+		frame.samples = 576
+		frame.size = 72*frame.bitrate/frame.sampleRate + padding
+	default:
+		frame.samples = 1152
+		frame.size = 144*frame.bitrate/frame.sampleRate + padding
+	}
+
+	return frame
+}
+
+func (f *mpegFrame) codec() string {
+	switch f.layer {
+	case 1:
+		return "mp1"
+	case 2:
+		return "mp2"
+	default:
+		return "mp3"
+	}
+}
+
+// xingOffset возвращает смещение заголовка Xing от начала кадра: он лежит после side information
+func (f *mpegFrame) xingOffset() int {
+	switch {
+	case f.version == 1 && f.channels == 2:
+		return 4 + 32
+	case f.version == 1 || f.channels == 2:
+		return 4 + 17
+	default:
+		return 4 + 9
+	}
+}
+
+// probeID3 пропускает тег ID3v2. За ним следуют кадры MPEG или, в редких файлах, FLAC
+func probeID3(r io.ReadSeeker, size int64) (*Info, error) {
+	header := make([]byte, 10)
+	if err := readAt(r, header, 0); err != nil {
+		return nil, err
+	}
+	start := int64(10 + syncsafe(header[6:10]))
+	if header[5]&0x10 != 0 {
+		// Футер тега
+		start += 10
+	}
+	if start >= size {
+		// Оборванный файл: тег длиннее самого файла
+		return nil, ErrInvalidHeader
+	}
+	magic := make([]byte, 4)
+	if err := readAt(r, magic, start); err == nil && string(magic) == "fLaC" {
+		return probeFLAC(r, start, size)
+	}
+
+	return probeMPEG(r, start, size)
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0])<<21 | uint32(b[1])<<14 | uint32(b[2])<<7 | uint32(b[3])
+}
+
+// probeMPEG ищет первый кадр начиная с offset. Длительность берется из заголовка Xing или VBRI,
+// а без них считается по всем кадрам файла
+func probeMPEG(r io.ReadSeeker, offset int64, size int64) (*Info, error) {
+	start, first, err := findMPEGFrame(r, offset, size)
+	if err != nil {
+		return nil, err
+	}
+	end := size
+	tag := make([]byte, 3)
+	if size-start >= 128 && readAt(r, tag, size-128) == nil && string(tag) == "TAG" {
+		end -= 128
+	}
+	info := &Info{Codec: first.codec(), SampleRate: first.sampleRate, Channels: first.channels}
+
+	data := make([]byte, min(first.size, int(end-start)))
+	if err = readAt(r, data, start); err != nil {
+		return nil, err
+	}
+	if frames, audioBytes, ok := parseVBRHeader(first, data); ok {
+		if audioBytes <= 0 {
+			audioBytes = end - start
+		}
+		info.Duration = durationOf(frames*int64(first.samples), int64(first.sampleRate))
+		info.Bitrate = averageBitrate(audioBytes, info.Duration)
+		return info, nil
+	}
+
+	frames, audioBytes, err := countMPEGFrames(r, start, end)
+	if err != nil {
+		return nil, err
+	}
+	info.Duration = durationOf(frames*int64(first.samples), int64(first.sampleRate))
+	info.Bitrate = averageBitrate(audioBytes, info.Duration)
+
+	return info, nil
+}
+
+// findMPEGFrame ищет заголовок кадра, за которым следует еще один кадр или конец файла.
+// Проверка второго кадра отсекает случайные совпадения в данных тега
+func findMPEGFrame(r io.ReadSeeker, offset int64, size int64) (int64, *mpegFrame, error) {
+	if offset >= size {
+		return 0, nil, ErrInvalidHeader
+	}
+	window := make([]byte, min(int64(maxSyncSearch), size-offset))
+	if len(window) < 4 {
+		return 0, nil, ErrInvalidHeader
+	}
+	if err := readAt(r, window, offset); err != nil {
+		return 0, nil, err
+	}
+	next := make([]byte, 4)
+	for i := 0; i+4 <= len(window); i++ {
+		frame := parseMPEGHeader(window[i:])
+		if frame == nil {
+			continue
+		}
+		pos := offset + int64(i)
+		if pos+int64(frame.size)+4 > size {
+			return pos, frame, nil
+		}
+		if readAt(r, next, pos+int64(frame.size)) == nil && parseMPEGHeader(next) != nil {
+			return pos, frame, nil
+		}
+	}
+
+	return 0, nil, ErrInvalidHeader
+}
+
+// parseVBRHeader читает число кадров и байт из заголовка Xing (Info для CBR) или VBRI в первом кадре
+func parseVBRHeader(frame *mpegFrame, data []byte) (frames int64, audioBytes int64, ok bool) {
+	if offset := frame.xingOffset(); len(data) >= offset+16 {
+		tag := string(data[offset : offset+4])
+		if tag == "Xing" || tag == "Info" {
+			flags := binary.BigEndian.Uint32(data[offset+4:])
+			fields := data[offset+8:]
+			// Без числа кадров заголовок бесполезен для длительности
+			if flags&1 == 0 {
+				return 0, 0, false
+			}
+			frames = int64(binary.BigEndian.Uint32(fields))
+			if flags&2 != 0 {
+				audioBytes = int64(binary.BigEndian.Uint32(fields[4:]))
+			}
+			return frames, audioBytes, frames > 0
+		}
+	}
+	// Заголовок VBRI всегда лежит в 32 байтах после заголовка кадра
+	if len(data) >= 36+18 && string(data[36:40]) == "VBRI" {
+		audioBytes = int64(binary.BigEndian.Uint32(data[46:]))
+		frames = int64(binary.BigEndian.Uint32(data[50:]))
+		return frames, audioBytes, frames > 0
+	}
+
+	return 0, 0, false
+}
+
+// countMPEGFrames проходит по заголовкам кадров от start до первого не-кадра или end
+func countMPEGFrames(r io.ReadSeeker, start int64, end int64) (frames int64, audioBytes int64, err error) {
+	if _, err = r.Seek(start, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	reader := bufio.NewReader(io.LimitReader(r, end-start))
+	for {
+		header, err := reader.Peek(4)
+		if err != nil {
+			break
+		}
+		frame := parseMPEGHeader(header)
+		if frame == nil {
+			break
+		}
+		discarded, err := reader.Discard(frame.size)
+		audioBytes += int64(discarded)
+		if err != nil {
+			// Оборванный последний кадр не считается
+			break
+		}
+		frames++
+	}
+
+	return frames, audioBytes, nil
+}
@@ -0,0 +1,101 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// maxOggPage - максимальный размер страницы Ogg: заголовок, 255 сегментов и их содержимое
+const maxOggPage = 27 + 255 + 255*255
+
+// opusSampleRate - Opus всегда декодируется с частотой 48 кГц, от нее же считается гранула
+const opusSampleRate = 48000
+
+// probeOgg читает заголовок первого логического потока. Длительность - гранула последней
+// страницы этого потока: число отсчетов от начала
+func probeOgg(r io.ReadSeeker, size int64) (*Info, error) {
+	page := make([]byte, 27)
+	if err := readAt(r, page, 0); err != nil {
+		return nil, err
+	}
+	serial := binary.LittleEndian.Uint32(page[14:18])
+	segments := make([]byte, page[26])
+	if _, err := io.ReadFull(r, segments); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	// Первый пакет потока по спецификации занимает первую страницу целиком
+	var packetSize int
+	for _, segment := range segments {
+		packetSize += int(segment)
+		if segment < 255 {
+			break
+		}
+	}
+	packet := make([]byte, packetSize)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	info := &Info{}
+	var preSkip, rate int64
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+		info.Codec = "vorbis"
+		info.Channels = int(packet[11])
+		info.SampleRate = int(binary.LittleEndian.Uint32(packet[12:16]))
+		rate = int64(info.SampleRate)
+	case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 12:
+		info.Codec = "opus"
+		info.Channels = int(packet[9])
+		info.SampleRate = opusSampleRate
+		preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+		rate = opusSampleRate
+	case bytes.HasPrefix(packet, []byte("\x7fFLAC")) && len(packet) >= 17+18:
+		// Заголовок Ogg FLAC: версия, число заголовков, сигнатура fLaC и заголовок блока STREAMINFO
+		stream, err := parseStreamInfo(packet[17:])
+		if err != nil {
+			return nil, err
+		}
+		info.Codec = "flac"
+		info.Channels = stream.channels
+		info.SampleRate = stream.sampleRate
+		rate = int64(stream.sampleRate)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	if rate == 0 {
+		return nil, ErrInvalidHeader
+	}
+
+	granule, err := lastOggGranule(r, size, serial)
+	if err != nil {
+		return nil, err
+	}
+	info.Duration = durationOf(granule-preSkip, rate)
+	info.Bitrate = averageBitrate(size, info.Duration)
+
+	return info, nil
+}
+
+// lastOggGranule ищет последнюю страницу потока serial в хвосте файла, в который помещается целая страница
+func lastOggGranule(r io.ReadSeeker, size int64, serial uint32) (int64, error) {
+	tailSize := min(size, 2*maxOggPage)
+	tail := make([]byte, tailSize)
+	if err := readAt(r, tail, size-tailSize); err != nil {
+		return 0, err
+	}
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		page := tail[i:]
+		if len(page) < 27 || binary.LittleEndian.Uint32(page[14:18]) != serial {
+			continue
+		}
+		granule := int64(binary.LittleEndian.Uint64(page[6:14]))
+		// -1 - на странице не заканчивается ни один пакет
+		if granule >= 0 {
+			return granule, nil
+		}
+	}
+
+	return 0, ErrInvalidHeader
+}
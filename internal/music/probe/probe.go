@@ -0,0 +1,94 @@
+// Package probe определяет технические параметры аудиофайла по заголовкам контейнера и кадров:
+// MP3 (Xing, VBRI или подсчет кадров), FLAC, Ogg (Vorbis, Opus, FLAC), MP4 и WAV. Аудио не декодируется.
+package probe
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrUnsupportedFormat возвращается, если формат файла не распознан
+var ErrUnsupportedFormat = errors.New("unsupported audio format")
+
+// ErrInvalidHeader возвращается, если формат распознан, но его заголовки повреждены
+var ErrInvalidHeader = errors.New("invalid audio header")
+
+// Info - технические параметры аудио. Нулевое значение поля означает, что его не удалось определить
+type Info struct {
+	Codec    string
+	Duration time.Duration
+	// Bitrate - средний битрейт в бит/с
+	Bitrate    int
+	SampleRate int
+	Channels   int
+}
+
+// Probe определяет формат по содержимому r и читает его параметры. Позиция r после чтения не определена
+func Probe(r io.ReadSeeker) (*Info, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 12)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return probeID3(r, size)
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return probeFLAC(r, 0, size)
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return probeOgg(r, size)
+	case len(header) >= 8 && string(header[4:8]) == "ftyp":
+		return probeMP4(r, size)
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return probeWAV(r, size)
+	case parseMPEGHeader(header) != nil:
+		return probeMPEG(r, 0, size)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// readAt читает len(p) байт с позиции offset. Короткое чтение в конце файла - ошибка
+func readAt(r io.ReadSeeker, p []byte, offset int64) error {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, p); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrInvalidHeader
+		}
+		return err
+	}
+
+	return nil
+}
+
+// durationOf переводит units отсчетов с частотой rate в длительность без переполнения
+func durationOf(units int64, rate int64) time.Duration {
+	if units <= 0 || rate <= 0 {
+		return 0
+	}
+	seconds, rest := units/rate, units%rate
+
+	return time.Duration(seconds)*time.Second + time.Duration(rest)*time.Second/time.Duration(rate)
+}
+
+// averageBitrate считает средний битрейт по объему аудиоданных и длительности
+func averageBitrate(bytes int64, duration time.Duration) int {
+	if bytes <= 0 || duration <= 0 {
+		return 0
+	}
+
+	return int(float64(bytes) * 8 / duration.Seconds())
+}
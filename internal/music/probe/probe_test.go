@@ -0,0 +1,215 @@
+package probe_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kroticw/freshman-server/internal/music/probe"
+)
+
+// mp3Header - MPEG-1 Layer III, 128 кбит/с, 44100 Гц, стерео: кадр 417 байт на 1152 отсчета
+var mp3Header = []byte{0xFF, 0xFB, 0x90, 0x00}
+
+const mp3FrameSize = 417
+
+func mp3Frames(count int) []byte {
+	frame := make([]byte, mp3FrameSize)
+	copy(frame, mp3Header)
+
+	return bytes.Repeat(frame, count)
+}
+
+func xingFrame(frames, size uint32) []byte {
+	frame := make([]byte, mp3FrameSize)
+	copy(frame, mp3Header)
+	copy(frame[36:], "Xing")
+	binary.BigEndian.PutUint32(frame[40:], 3)
+	binary.BigEndian.PutUint32(frame[44:], frames)
+	binary.BigEndian.PutUint32(frame[48:], size)
+
+	return frame
+}
+
+func id3v2(size int) []byte {
+	return append([]byte{'I', 'D', '3', 3, 0, 0, 0, 0, byte(size >> 7), byte(size & 0x7F)}, make([]byte, size)...)
+}
+
+func streamInfo(sampleRate, channels int, samples int64) []byte {
+	data := make([]byte, 34)
+	packed := uint64(sampleRate)<<44 | uint64(channels-1)<<41 | 15<<36 | uint64(samples)
+	binary.BigEndian.PutUint64(data[10:], packed)
+
+	return data
+}
+
+func oggPage(serial uint32, granule int64, packet []byte) []byte {
+	var segments []byte
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			segments = append(segments, byte(n))
+			break
+		}
+		segments = append(segments, 255)
+	}
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	binary.LittleEndian.PutUint64(header[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(header[14:], serial)
+	header[26] = byte(len(segments))
+
+	return append(append(header, segments...), packet...)
+}
+
+func mp4Atom(kind string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+
+	return append(append(binary.BigEndian.AppendUint32(nil, uint32(len(body)+8)), kind...), body...)
+}
+
+func mp4File(format string, channels, sampleRate int, timescale, duration uint32, mdat int) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+	entry := make([]byte, 28)
+	binary.BigEndian.PutUint16(entry[16:], uint16(channels))
+	binary.BigEndian.PutUint16(entry[18:], 16)
+	binary.BigEndian.PutUint32(entry[24:], uint32(sampleRate)<<16)
+	stsd := append([]byte{0, 0, 0, 0, 0, 0, 0, 1}, mp4Atom(format, entry)...)
+
+	return bytes.Join([][]byte{
+		mp4Atom("ftyp", []byte("M4A \x00\x00\x00\x00")),
+		mp4Atom("moov",
+			mp4Atom("mvhd", mvhd),
+			mp4Atom("trak", mp4Atom("mdia", mp4Atom("minf", mp4Atom("stbl", mp4Atom("stsd", stsd))))),
+		),
+		mp4Atom("mdat", make([]byte, mdat)),
+	}, nil)
+}
+
+func wavFile(format uint16, channels, sampleRate, bits int, frames int) []byte {
+	blockAlign := channels * bits / 8
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], format)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], uint16(channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:], uint32(sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[12:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[14:], uint16(bits))
+	chunk := func(id string, body []byte) []byte {
+		return append(append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+	}
+	body := bytes.Join([][]byte{
+		[]byte("WAVE"),
+		// Неизвестный чанк нечетной длины с выравниванием
+		chunk("LIST", []byte("odd")), {0},
+		chunk("fmt ", fmtChunk),
+		chunk("data", make([]byte, frames*blockAlign)),
+	}, nil)
+
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func samples(n int64, rate int64) time.Duration {
+	return time.Duration(n) * time.Second / time.Duration(rate)
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want probe.Info
+	}{
+		{
+			name: "MP3 CBR counted frames",
+			data: append(append(id3v2(300), mp3Frames(100)...), append([]byte("TAG"), make([]byte, 125)...)...),
+			want: probe.Info{Codec: "mp3", Duration: samples(100*1152, 44100), Bitrate: 127706,
+				SampleRate: 44100, Channels: 2},
+		},
+		{
+			name: "MP3 Xing",
+			data: append(xingFrame(1000, 1000*mp3FrameSize), mp3Frames(3)...),
+			want: probe.Info{Codec: "mp3", Duration: samples(1000*1152, 44100), Bitrate: 127706,
+				SampleRate: 44100, Channels: 2},
+		},
+		{
+			name: "FLAC",
+			data: bytes.Join([][]byte{
+				[]byte("fLaC"), {0, 0, 0, 34}, streamInfo(48000, 2, 48000*90+24000),
+				{0x80 | 4, 0, 0, 4}, make([]byte, 4),
+				make([]byte, 100000),
+			}, nil),
+			want: probe.Info{Codec: "flac", Duration: 90*time.Second + 500*time.Millisecond, Bitrate: 8839,
+				SampleRate: 48000, Channels: 2},
+		},
+		{
+			name: "Ogg Vorbis",
+			data: bytes.Join([][]byte{
+				oggPage(7, 0, append([]byte("\x01vorbis\x00\x00\x00\x00\x02"),
+					binary.LittleEndian.AppendUint32(nil, 44100)...)),
+				oggPage(7, 44100*10, make([]byte, 1000)),
+				// Страница другого потока после последней страницы нужного
+				oggPage(8, 99999999, make([]byte, 10)),
+			}, nil),
+			want: probe.Info{Codec: "vorbis", Duration: 10 * time.Second, Bitrate: 890,
+				SampleRate: 44100, Channels: 2},
+		},
+		{
+			name: "Opus",
+			data: bytes.Join([][]byte{
+				oggPage(1, 0, []byte("OpusHead\x01\x01\x38\x01\x80\xbb\x00\x00")),
+				oggPage(1, 48000*3+312, make([]byte, 300)),
+			}, nil),
+			want: probe.Info{Codec: "opus", Duration: 3 * time.Second, Bitrate: 994,
+				SampleRate: 48000, Channels: 1},
+		},
+		{
+			name: "MP4 AAC",
+			data: mp4File("mp4a", 2, 44100, 1000, 4500, 72000),
+			want: probe.Info{Codec: "aac", Duration: 4500 * time.Millisecond, Bitrate: 128000,
+				SampleRate: 44100, Channels: 2},
+		},
+		{
+			name: "WAV",
+			data: wavFile(1, 2, 8000, 16, 12000),
+			want: probe.Info{Codec: "pcm", Duration: 1500 * time.Millisecond, Bitrate: 256000,
+				SampleRate: 8000, Channels: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := probe.Probe(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("Probe() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeInvalid(t *testing.T) {
+	if _, err := probe.Probe(bytes.NewReader([]byte("plain text file"))); !errors.Is(err, probe.ErrUnsupportedFormat) {
+		t.Errorf("Probe(text) error = %v, want ErrUnsupportedFormat", err)
+	}
+	// Оборванные заголовки - ошибка, а не паника
+	files := [][]byte{
+		append([]byte("fLaC"), 0, 0, 0, 34),
+		wavFile(1, 2, 8000, 16, 10)[:30],
+		mp4File("mp4a", 2, 44100, 1000, 4500, 10)[:60],
+		oggPage(1, 0, []byte("OpusHead"))[:20],
+	}
+	for _, data := range files {
+		if _, err := probe.Probe(bytes.NewReader(data)); err == nil {
+			t.Errorf("Probe(%q) succeeded on a truncated file", data)
+		}
+	}
+	// Тег ID3v2 длиннее оборванного MP3
+	truncated := append(id3v2(4096), mp3Frames(2)...)[:200]
+	if _, err := probe.Probe(bytes.NewReader(truncated)); !errors.Is(err, probe.ErrInvalidHeader) {
+		t.Errorf("Probe(truncated mp3) error = %v, want ErrInvalidHeader", err)
+	}
+}
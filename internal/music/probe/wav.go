@@ -0,0 +1,68 @@
+package probe
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// wavCodecs - кодеки по полю формата чанка fmt
+var wavCodecs = map[uint16]string{
+	1: "pcm",
+	3: "pcm_float",
+	6: "alaw",
+	7: "mulaw",
+}
+
+// wavFormatExtensible - формат, реальный тип которого лежит в первых байтах GUID подформата
+const wavFormatExtensible = 0xFFFE
+
+// probeWAV читает чанк fmt и размер чанка data
+func probeWAV(r io.ReadSeeker, size int64) (*Info, error) {
+	var format []byte
+	var dataSize int64 = -1
+	header := make([]byte, 8)
+	for pos := int64(12); pos+8 <= size && (format == nil || dataSize < 0); {
+		if err := readAt(r, header, pos); err != nil {
+			return nil, err
+		}
+		chunkSize := int64(binary.LittleEndian.Uint32(header[4:8]))
+		body := pos + 8
+		switch string(header[:4]) {
+		case "fmt ":
+			format = make([]byte, min(chunkSize, 26))
+			if err := readAt(r, format, body); err != nil {
+				return nil, err
+			}
+		case "data":
+			// Потоковая запись оставляет размер незаполненным
+			dataSize = min(chunkSize, size-body)
+		}
+		// Чанки выравниваются по четной границе
+		pos = body + chunkSize + chunkSize&1
+	}
+	if len(format) < 16 || dataSize < 0 {
+		return nil, ErrInvalidHeader
+	}
+
+	tag := binary.LittleEndian.Uint16(format[0:2])
+	if tag == wavFormatExtensible && len(format) >= 26 {
+		tag = binary.LittleEndian.Uint16(format[24:26])
+	}
+	codec, ok := wavCodecs[tag]
+	if !ok {
+		codec = "wav"
+	}
+	info := &Info{
+		Codec:      codec,
+		Channels:   int(binary.LittleEndian.Uint16(format[2:4])),
+		SampleRate: int(binary.LittleEndian.Uint32(format[4:8])),
+	}
+	byteRate := int64(binary.LittleEndian.Uint32(format[8:12]))
+	blockAlign := int64(binary.LittleEndian.Uint16(format[12:14]))
+	if blockAlign > 0 && info.SampleRate > 0 {
+		info.Duration = durationOf(dataSize/blockAlign, int64(info.SampleRate))
+	}
+	info.Bitrate = int(byteRate * 8)
+
+	return info, nil
+}
@@ -2,46 +2,324 @@ package music
 
 import (
 	"context"
+	"errors"
+	"io"
+	"os"
+	"regexp"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Storage хранит файлы потоково: ни загрузка, ни чтение не держат файл в памяти целиком.
+// Файл, слинкованный с исходным, доступен по ключу "<исходный файл без расширения>/<имя>".
+// Поведение, общее для всех реализаций, проверяет storagetest.RunConformanceTests.
 type Storage interface {
 	Exists(ctx context.Context, filename string) (exists bool, err error)
-	Upload(ctx context.Context, filename string, file []byte) error
-	UploadLinked(ctx context.Context, filename string, sourceFilename string, file []byte) error
-	Get(ctx context.Context, filename string) ([]byte, error)
+	// Upload записывает ровно size байт из file. Если файл уже есть, возвращает os.ErrExist
+	// и не меняет его. Если file закончился раньше, файл не создается
+	Upload(ctx context.Context, filename string, file io.Reader, size int64) error
+	// UploadWithMetadata работает как Upload и сохраняет metadata вместе с файлом.
+	// Если задан metadata.Checksum, а содержимое с ним не совпало, файл не создается
+	UploadWithMetadata(ctx context.Context, filename string, file io.Reader, size int64, metadata ObjectMetadata) error
+	UploadLinked(ctx context.Context, filename string, sourceFilename string, file io.Reader, size int64) error
+	// Get возвращает поток с содержимым файла и его размер. Поток закрывает вызывающая сторона.
+	// Если файла нет, возвращает os.ErrNotExist
+	Get(ctx context.Context, filename string) (io.ReadCloser, int64, error)
+	// Stat возвращает описание файла, не читая его содержимое. Если файла нет, возвращает os.ErrNotExist
+	Stat(ctx context.Context, filename string) (*ObjectInfo, error)
+	// GetRange читает length байт начиная с offset. Отрицательный length означает "до конца файла".
+	// Если диапазон выходит за пределы файла, возвращает ErrInvalidRange
+	GetRange(ctx context.Context, filename string, offset int64, length int64) (*ObjectRange, error)
+	// Delete удаляет файл вместе со всеми слинкованными с ним. Удаление отсутствующего файла не ошибка
 	Delete(ctx context.Context, filename string) error
 	IsLinkedExists(ctx context.Context, filename string, sourceFilename string) (exists bool, err error)
+	// ListLinked возвращает имена всех файлов, слинкованных с sourceFilename
+	ListLinked(ctx context.Context, sourceFilename string) ([]string, error)
 }
 
+// Walker перечисляет все файлы хранилища
+type Walker interface {
+	// Walk вызывает fn для каждого файла, включая слинкованные. Ошибка из fn прерывает обход и возвращается
+	Walk(ctx context.Context, fn func(object ObjectInfo) error) error
+}
+
+// Repo возвращает common.ErrNotFound, если песня не найдена
 type Repo interface {
 	GetSongByID(ctx context.Context, id int64) (*Song, error)
 	GetSongByName(ctx context.Context, name string) (*Song, error)
 	GetSongsByArtist(ctx context.Context, artist string) ([]*Song, error)
 	GetSongsByAlbum(ctx context.Context, album string) ([]*Song, error)
+	// CreateSong сохраняет новую песню с исполнителями и альбомами и заполняет song.ID
+	CreateSong(ctx context.Context, song *Song) error
+	// UpdateSong сохраняет описание песни song.ID, включая исполнителей и альбомы. Содержимое не меняется
+	UpdateSong(ctx context.Context, song *Song) error
+	// DeleteSong удаляет песню с ее версиями и возвращает хеши содержимого, на которое они ссылались
+	DeleteSong(ctx context.Context, id int64) ([]string, error)
+	// InTransaction выполняет fn с репозиторием, все изменения которого фиксируются, только если fn вернула nil
+	InTransaction(ctx context.Context, fn func(repo Repo) error) error
+	// LockContent блокирует содержимое с SHA-256 hash до конца транзакции InTransaction. CreateSong,
+	// ReplaceSongContent и RestoreSongVersion берут ту же блокировку, поэтому, пока она удерживается,
+	// новая ссылка на содержимое не появится
+	LockContent(ctx context.Context, hash string) error
+	// ListSongs возвращает все песни без исполнителей и альбомов
+	ListSongs(ctx context.Context) ([]*Song, error)
+	SetSongAvailable(ctx context.Context, id int64, available bool) error
+	// SongExistsByHash сообщает, ссылается ли на содержимое с SHA-256 hash хотя бы одна песня или версия песни
+	SongExistsByHash(ctx context.Context, hash string) (bool, error)
+	// ReplaceSongContent переводит песню song.ID на содержимое song.Hash, song.Size и song.Audio,
+	// сохраняя прежнее как версию
+	ReplaceSongContent(ctx context.Context, song *Song) error
+	// ListSongVersions возвращает прежние версии песни, начиная с последней
+	ListSongVersions(ctx context.Context, songID int64) ([]*SongVersion, error)
+	// ListVersionHashes возвращает хеши содержимого всех версий всех песен
+	ListVersionHashes(ctx context.Context) ([]string, error)
+	// RestoreSongVersion делает версию текущим содержимым песни, а текущее - версией
+	RestoreSongVersion(ctx context.Context, songID int64, versionID int64) error
+	// DeleteSongVersions удаляет версии песни, кроме keep последних, и возвращает удаленные
+	DeleteSongVersions(ctx context.Context, songID int64, keep int) ([]*SongVersion, error)
+}
+
+// Presigner выдает клиентам временные ссылки для прямого доступа к хранилищу
+type Presigner interface {
+	PresignGet(ctx context.Context, filename string) (*PresignedRequest, error)
+	// PresignPut подписывает загрузку файла с заданными размером и SHA-256 в hex
+	PresignPut(ctx context.Context, filename string, size int64, sha256Hex string) (*PresignedRequest, error)
 }
 
+// ErrDirectAccessDisabled возвращается, если хранилище не выдает временные ссылки
+var ErrDirectAccessDisabled = errors.New("direct storage access is not configured")
+
+var sha256HexRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
 type Service struct {
-	storage Storage
-	repo    Repo
-	log     *logrus.Logger
+	storage   Storage
+	repo      Repo
+	log       *logrus.Logger
+	presigner Presigner
+	// versionRetention - сколько прежних версий песни хранить, 0 - без ограничения
+	versionRetention int
 }
 
 func NewMusicService(storage Storage, repo Repo, log *logrus.Logger) *Service {
 	return &Service{
-		storage,
-		repo,
-		log,
+		storage: storage,
+		repo:    repo,
+		log:     log,
 	}
 }
 
+// SetPresigner включает прямую загрузку и воспроизведение через временные ссылки хранилища
+func (s *Service) SetPresigner(presigner Presigner) {
+	s.presigner = presigner
+}
+
+// UploadSong сохраняет аудиофайл под ключом, равным SHA-256 его содержимого, и создает песню в БД.
+// Если такой файл уже загружен, песня ссылается на него, и повторно он не сохраняется.
+// Поля, не переданные в параметрах, заполняются из тегов файла, song.Audio - по его заголовкам.
+// Если после этого не хватает обязательного поля, возвращает ErrorInvalidParam и файл не сохраняет.
+// Встроенная обложка сохраняется рядом с файлом вместе с миниатюрами, см. GetCover.
+// Рядом же сохраняются пики волны, построенные по декодированному аудио, см. GetWaveform.
 func (s *Service) UploadSong(ctx context.Context, song *Song) error {
+	content, cleanup, err := s.openContent(song)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	found := s.readTags(song, content)
+	song.applyTags(found)
+	s.fillAudioInfo(song, content)
+	if err = song.Validate(); err != nil {
+		return err
+	}
 	s.log.Infof("Uploading song %s", song.Name)
-	return s.storage.Upload(ctx, song.Name, song.Content)
+	// Декодирование долгое, поэтому идет до начала транзакции
+	peaks := s.decodeWaveform(ctx, song, content)
+
+	var created bool
+	// Песня вставляется до записи файла: если запись не удалась, транзакция откатывается.
+	// CreateSong блокирует содержимое до конца транзакции, поэтому удаление брошенных файлов
+	// не удалит уже загруженный файл, на который ссылается новая песня
+	err = s.repo.InTransaction(ctx, func(repo Repo) error {
+		if err := repo.CreateSong(ctx, song); err != nil {
+			return err
+		}
+		created, err = s.uploadContent(ctx, song)
+		return err
+	})
+	if err != nil {
+		if created {
+			// Файл записан, а транзакция не зафиксирована
+			s.removeStoredContent(ctx, song.Hash)
+		}
+		song.ID = 0
+		return err
+	}
+	s.storeCovers(ctx, song, found.Picture)
+	if peaks != nil {
+		if err = s.storeWaveforms(ctx, song, peaks); err != nil {
+			s.log.WithError(err).Warnf("failed to store waveform of song %s", song.Name)
+		}
+	}
+
+	return nil
+}
+
+// openContent хеширует song.Content, заполняет song.Hash и song.Path и заменяет song.Content
+// перематываемым содержимым. cleanup удаляет временный файл и должен быть вызван, если нет ошибки
+func (s *Service) openContent(song *Song) (content io.ReadSeeker, cleanup func(), err error) {
+	hash, content, cleanup, err := hashContent(song.Content, song.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	song.Hash = hash
+	song.Path = ContentKey(hash)
+	song.Content = content
+
+	return content, cleanup, nil
+}
+
+// uploadContent сохраняет содержимое, открытое openContent, в хранилище по хешу. created сообщает,
+// что файл записан этим вызовом, а не был загружен раньше
+func (s *Service) uploadContent(ctx context.Context, song *Song) (created bool, err error) {
+	exists, err := s.storage.Exists(ctx, song.Path)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		s.log.Infof("Song %s has the same content as already stored file %s", song.Name, song.Path)
+		return false, nil
+	}
+	err = s.storage.UploadWithMetadata(ctx, song.Path, song.Content, song.Size, ObjectMetadata{
+		ContentType: song.ContentType,
+		Checksum:    song.Hash,
+	})
+	if errors.Is(err, os.ErrExist) {
+		// Такой же файл параллельно загрузил другой запрос
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// removeStoredContent удаляет только что записанный файл, на который так и не сослалась песня.
+// Если удалить не удалось, файл останется брошенным, и его соберет GC
+func (s *Service) removeStoredContent(ctx context.Context, hash string) {
+	if err := s.deleteUnreferencedContent(ctx, hash); err != nil {
+		s.log.WithError(err).Errorf("failed to delete content %s of failed upload", hash)
+	}
+}
+
+func (s *Service) GetSongByID(ctx context.Context, id int64) (*Song, error) {
+	return s.repo.GetSongByID(ctx, id)
 }
 
-func (s *Service) GetSong(ctx context.Context, songName string) ([]byte, error) {
+// UpdateSong сохраняет описание песни song.ID. Возвращает ErrorInvalidParam, если не хватает
+// обязательного поля, и common.ErrNotFound, если песни нет
+func (s *Service) UpdateSong(ctx context.Context, song *Song) error {
+	if err := song.Validate(); err != nil {
+		return err
+	}
+	s.log.Infof("Updating song %d", song.ID)
+
+	return s.repo.UpdateSong(ctx, song)
+}
+
+// DeleteSong удаляет песню вместе с версиями. Аудиофайлы, на которые больше не ссылается ни одна песня,
+// удаляются из хранилища вместе со слинкованными с ними. Возвращает common.ErrNotFound, если песни нет
+func (s *Service) DeleteSong(ctx context.Context, id int64) error {
+	hashes, err := s.repo.DeleteSong(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.log.Infof("Deleted song %d", id)
+	for _, hash := range hashes {
+		if err = s.deleteUnreferencedContent(ctx, hash); err != nil {
+			// Файл останется брошенным, и его соберет GC
+			s.log.WithError(err).Errorf("failed to delete content %s of deleted song", hash)
+		}
+	}
+
+	return nil
+}
+
+// StatSong возвращает описание аудиофайла песни, не читая его
+func (s *Service) StatSong(ctx context.Context, song *Song) (*ObjectInfo, error) {
+	return s.storage.Stat(ctx, song.Path)
+}
+
+// GetSongRange читает фрагмент аудиофайла песни, см. Storage.GetRange
+func (s *Service) GetSongRange(ctx context.Context, song *Song, offset int64, length int64) (*ObjectRange, error) {
+	return s.storage.GetRange(ctx, song.Path, offset, length)
+}
+
+func (s *Service) GetSong(ctx context.Context, songName string) (io.ReadCloser, int64, error) {
 	s.log.Infof("Getting song %s", songName)
 	return s.storage.Get(ctx, songName)
 }
+
+// GetSongPlaybackURL возвращает временную ссылку на аудиофайл песни
+func (s *Service) GetSongPlaybackURL(ctx context.Context, song *Song) (*PresignedRequest, error) {
+	if s.presigner == nil {
+		return nil, ErrDirectAccessDisabled
+	}
+
+	return s.presigner.PresignGet(ctx, song.Path)
+}
+
+// PrepareDirectUpload подписывает загрузку аудиофайла напрямую в хранилище.
+// Если файл с таким содержимым уже загружен, ссылка не нужна и возвращается nil.
+func (s *Service) PrepareDirectUpload(ctx context.Context, hash string, size int64) (*PresignedRequest, error) {
+	if s.presigner == nil {
+		return nil, ErrDirectAccessDisabled
+	}
+	if !sha256HexRegexp.MatchString(hash) {
+		return nil, ErrorInvalidParam{"sha256"}
+	}
+	if size <= 0 {
+		return nil, ErrorInvalidParam{"size"}
+	}
+	exists, err := s.storage.Exists(ctx, ContentKey(hash))
+	if err != nil || exists {
+		return nil, err
+	}
+
+	return s.presigner.PresignPut(ctx, ContentKey(hash), size, hash)
+}
+
+// CompleteDirectUpload регистрирует песню, аудиофайл которой клиент загрузил по ссылке
+// из PrepareDirectUpload. Возвращает ErrorGetSong, если файл так и не появился в хранилище.
+func (s *Service) CompleteDirectUpload(ctx context.Context, song *Song) error {
+	if !sha256HexRegexp.MatchString(song.Hash) {
+		return ErrorInvalidParam{"sha256"}
+	}
+	s.log.Infof("Registering directly uploaded song %s", song.Name)
+	// Файл проверяется под блокировкой содержимого: иначе GC мог бы удалить его
+	// между проверкой и созданием песни
+	err := s.repo.InTransaction(ctx, func(repo Repo) error {
+		if err := repo.LockContent(ctx, song.Hash); err != nil {
+			return err
+		}
+		info, err := s.storage.Stat(ctx, ContentKey(song.Hash))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return ErrorGetSong{song.Name}
+			}
+			return err
+		}
+		song.Path = ContentKey(song.Hash)
+		song.Size = info.Size
+		if song.ContentType == "" {
+			song.ContentType = info.ContentType
+		}
+		return repo.CreateSong(ctx, song)
+	})
+	if err != nil {
+		song.ID = 0
+		return err
+	}
+
+	return nil
+}
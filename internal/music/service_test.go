@@ -0,0 +1,311 @@
+package music_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kroticw/freshman-server/infrastructure/storage"
+	"github.com/kroticw/freshman-server/internal/music"
+	log "github.com/sirupsen/logrus"
+)
+
+// fakeRepo хранит песни и версии в памяти. Методы, которые тестам не нужны, паникуют через
+// встроенный nil music.Repo
+type fakeRepo struct {
+	music.Repo
+	mu       sync.Mutex
+	songs    []*music.Song
+	versions []*music.SongVersion
+	// lateRefs - содержимое, на которое сослалась песня, созданная после ListSongs
+	lateRefs map[string]bool
+	// createErr возвращает CreateSong, commitErr - первая InTransaction, в которой fn не вернула ошибку
+	createErr error
+	commitErr error
+	lastID    int64
+	// restored - версии, которые вернул RestoreSongVersion
+	restored []int64
+	// onLock вызывается перед тем, как LockContent вернет управление: так тест изображает
+	// сборку мусора, успевшую раньше взять блокировку
+	onLock func(hash string)
+}
+
+// InTransaction откатывает изменения песен и версий, если fn вернула ошибку или не удалась фиксация
+func (r *fakeRepo) InTransaction(_ context.Context, fn func(repo music.Repo) error) error {
+	r.mu.Lock()
+	songs, versions := slices.Clone(r.songs), slices.Clone(r.versions)
+	r.mu.Unlock()
+	err := fn(r)
+	if err == nil {
+		// Фиксация не удается один раз
+		err, r.commitErr = r.commitErr, nil
+	}
+	if err != nil {
+		r.mu.Lock()
+		r.songs, r.versions = songs, versions
+		r.mu.Unlock()
+	}
+
+	return err
+}
+
+func (r *fakeRepo) LockContent(_ context.Context, hash string) error {
+	if r.onLock != nil {
+		r.onLock(hash)
+	}
+
+	return nil
+}
+
+func (r *fakeRepo) CreateSong(_ context.Context, song *music.Song) error {
+	if r.createErr != nil {
+		return r.createErr
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastID++
+	song.ID = r.lastID
+	r.songs = append(r.songs, song)
+
+	return nil
+}
+
+func (r *fakeRepo) ListSongs(context.Context) ([]*music.Song, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*music.Song(nil), r.songs...), nil
+}
+
+func (r *fakeRepo) ListVersionHashes(context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var hashes []string
+	for _, version := range r.versions {
+		hashes = append(hashes, version.Hash)
+	}
+
+	return hashes, nil
+}
+
+func (r *fakeRepo) SongExistsByHash(_ context.Context, hash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lateRefs[hash] {
+		return true, nil
+	}
+	for _, song := range r.songs {
+		if song.Hash == hash {
+			return true, nil
+		}
+	}
+	for _, version := range r.versions {
+		if version.Hash == hash {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ListSongVersions возвращает версии в порядке добавления, последняя - первой
+func (r *fakeRepo) ListSongVersions(_ context.Context, songID int64) ([]*music.SongVersion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var versions []*music.SongVersion
+	for i := len(r.versions) - 1; i >= 0; i-- {
+		if r.versions[i].SongID == songID {
+			versions = append(versions, r.versions[i])
+		}
+	}
+
+	return versions, nil
+}
+
+func (r *fakeRepo) DeleteSongVersions(ctx context.Context, songID int64, keep int) ([]*music.SongVersion, error) {
+	versions, err := r.ListSongVersions(ctx, songID)
+	if err != nil || len(versions) <= keep {
+		return nil, err
+	}
+	pruned := versions[keep:]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var left []*music.SongVersion
+	for _, version := range r.versions {
+		if version.SongID != songID || !containsVersion(pruned, version.ID) {
+			left = append(left, version)
+		}
+	}
+	r.versions = left
+
+	return pruned, nil
+}
+
+func (r *fakeRepo) RestoreSongVersion(_ context.Context, _ int64, versionID int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.restored = append(r.restored, versionID)
+
+	return nil
+}
+
+func containsVersion(versions []*music.SongVersion, id int64) bool {
+	for _, version := range versions {
+		if version.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newTestService(repo music.Repo) (*music.Service, *storage.MemoryDriver) {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	driver := storage.NewMemoryDriver()
+
+	return music.NewMusicService(driver, repo, logger), driver
+}
+
+// storeContent сохраняет content по хешу, как это делает загрузка песни, и возвращает хеш
+func storeContent(t *testing.T, driver music.Storage, content string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	err := driver.Upload(context.Background(), music.ContentKey(hash), strings.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+func exists(t *testing.T, driver music.Storage, key string) bool {
+	t.Helper()
+	ok, err := driver.Exists(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ok
+}
+
+func TestUploadSongFailure(t *testing.T) {
+	errDB := errors.New("database is down")
+	tests := []struct {
+		name string
+		repo *fakeRepo
+		// stored - такой же файл уже загружен другой песней
+		stored bool
+	}{
+		{"create fails", &fakeRepo{createErr: errDB}, false},
+		{"create fails with stored content", &fakeRepo{createErr: errDB}, true},
+		{"commit fails", &fakeRepo{commitErr: errDB}, false},
+		{"commit fails with stored content", &fakeRepo{commitErr: errDB}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, driver := newTestService(tt.repo)
+			content := "not really an mp3"
+			if tt.stored {
+				hash := storeContent(t, driver, content)
+				tt.repo.songs = []*music.Song{{ID: 1, Name: "first", Hash: hash}}
+			}
+			song := &music.Song{
+				Name:        "song",
+				Artists:     []string{"artist"},
+				Albums:      []string{"album"},
+				Content:     strings.NewReader(content),
+				Size:        int64(len(content)),
+				ContentType: "audio/mpeg",
+			}
+
+			err := service.UploadSong(context.Background(), song)
+			if !errors.Is(err, errDB) {
+				t.Fatalf("UploadSong() error = %v, want %v", err, errDB)
+			}
+			if song.ID != 0 {
+				t.Errorf("song.ID = %d after failed upload", song.ID)
+			}
+			if stored := exists(t, driver, music.ContentKey(song.Hash)); stored != tt.stored {
+				t.Errorf("content stored = %t after failed upload, want %t", stored, tt.stored)
+			}
+		})
+	}
+}
+
+func TestUploadSongStoresHash(t *testing.T) {
+	repo := &fakeRepo{}
+	service, driver := newTestService(repo)
+	content := "not really an mp3"
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	for _, name := range []string{"first", "duplicate"} {
+		song := &music.Song{
+			Name:    name,
+			Artists: []string{"artist"},
+			Albums:  []string{"album"},
+			Content: strings.NewReader(content),
+			Size:    int64(len(content)),
+		}
+		if err := service.UploadSong(context.Background(), song); err != nil {
+			t.Fatalf("UploadSong(%s): %v", name, err)
+		}
+	}
+
+	// Обе песни записаны в БД с хешем и ссылаются на один файл
+	if len(repo.songs) != 2 {
+		t.Fatalf("%d songs created, want 2", len(repo.songs))
+	}
+	for _, song := range repo.songs {
+		if song.ID == 0 || song.Hash != hash || song.Path != music.ContentKey(hash) {
+			t.Errorf("song %s stored with id %d, hash %q, path %q", song.Name, song.ID, song.Hash, song.Path)
+		}
+	}
+	objects := 0
+	err := driver.Walk(context.Background(), func(object music.ObjectInfo) error {
+		if !strings.Contains(object.Key, "/") {
+			objects++
+		}
+		return nil
+	})
+	if err != nil || objects != 1 || !exists(t, driver, music.ContentKey(hash)) {
+		t.Errorf("stored %d audio files, want 1 under the content hash: %v", objects, err)
+	}
+}
+
+func TestCompleteDirectUpload(t *testing.T) {
+	ctx := context.Background()
+	repo := &fakeRepo{}
+	service, driver := newTestService(repo)
+	hash := storeContent(t, driver, "direct")
+
+	// Сборка мусора удалила файл, пока загрузка ждала блокировку содержимого
+	repo.onLock = func(hash string) {
+		if err := driver.Delete(ctx, music.ContentKey(hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	song := &music.Song{Name: "song", Artists: []string{"artist"}, Albums: []string{"album"}, Hash: hash}
+	if err := service.CompleteDirectUpload(ctx, song); !errors.As(err, &music.ErrorGetSong{}) {
+		t.Fatalf("CompleteDirectUpload() of collected content error = %v, want ErrorGetSong", err)
+	}
+	if len(repo.songs) != 0 || song.ID != 0 {
+		t.Fatalf("song created without content: %d songs, id %d", len(repo.songs), song.ID)
+	}
+
+	repo.onLock = nil
+	storeContent(t, driver, "direct")
+	if err := service.CompleteDirectUpload(ctx, song); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.songs) != 1 || song.Size != int64(len("direct")) || song.Path != music.ContentKey(hash) {
+		t.Errorf("CompleteDirectUpload() created %d songs, size %d, path %q", len(repo.songs), song.Size, song.Path)
+	}
+}
@@ -0,0 +1,485 @@
+package tags
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	id3HeaderSize = 10
+	id3v1Size     = 128
+)
+
+// readID3 читает ID3v2 в начале файла. Поля, которых в нем нет, берутся из тегов после него:
+// из блоков FLAC, если это FLAC с ID3v2, или из ID3v1 в конце MP3
+func readID3(r io.ReadSeeker) (*Tags, error) {
+	var header [id3HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	version, flags := header[3], header[5]
+	size := int64(syncsafe(header[6:10]))
+	tags := &Tags{}
+	if version >= 2 && version <= 4 {
+		if err := readID3v2Frames(io.LimitReader(r, size), version, flags, tags); err != nil {
+			return nil, err
+		}
+	}
+
+	// После тега может идти подвал ID3v2.4, он нас не интересует
+	next := id3HeaderSize + size
+	if flags&0x10 != 0 && version == 4 {
+		next += id3HeaderSize
+	}
+	if _, err := r.Seek(next, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err == nil && string(magic[:]) == "fLaC" {
+		if _, err = r.Seek(next, io.SeekStart); err != nil {
+			return nil, err
+		}
+		flac, err := readFLACAt(r)
+		if err != nil {
+			return nil, err
+		}
+		tags.merge(flac)
+		return tags, nil
+	}
+	if err := mergeID3v1(r, tags); err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// readID3v2Frames читает кадры тега из r, ограниченного размером тега
+func readID3v2Frames(r io.Reader, version byte, flags byte, tags *Tags) error {
+	// Сжатые теги ID3v2.2 не поддерживаются
+	if version == 2 && flags&0x40 != 0 {
+		return nil
+	}
+	br := bufio.NewReader(r)
+	var tagReader io.Reader = br
+	// В ID3v2.2 и 2.3 рассинхронизация применяется ко всему тегу, в 2.4 - к отдельным кадрам
+	if flags&0x80 != 0 && version < 4 {
+		tagReader = &unsyncReader{r: br}
+	}
+	if flags&0x40 != 0 {
+		if err := skipExtendedHeader(tagReader, version); err != nil {
+			return nil
+		}
+	}
+
+	idSize, headerSize := 4, 10
+	if version == 2 {
+		idSize, headerSize = 3, 6
+	}
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(tagReader, header); err != nil {
+			// Тег закончился
+			return nil
+		}
+		if header[0] == 0 {
+			// Началось заполнение нулями
+			return nil
+		}
+		id := string(header[:idSize])
+		var size int64
+		var frameFlags uint16
+		switch version {
+		case 2:
+			size = int64(header[3])<<16 | int64(header[4])<<8 | int64(header[5])
+		case 3:
+			size = int64(binary.BigEndian.Uint32(header[4:8]))
+			frameFlags = binary.BigEndian.Uint16(header[8:10])
+		default:
+			size = int64(syncsafe(header[4:8]))
+			frameFlags = binary.BigEndian.Uint16(header[8:10])
+		}
+		limit := int64(maxFieldSize)
+		if isID3Picture(id) {
+			limit = maxPictureSize
+		}
+		if !isID3FrameWanted(id) || size > limit {
+			if _, err := io.CopyN(io.Discard, tagReader, size); err != nil {
+				return nil
+			}
+			continue
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(tagReader, data); err != nil {
+			return nil
+		}
+		data, ok := decodeFrameFlags(data, version, frameFlags)
+		if !ok || len(data) == 0 {
+			continue
+		}
+		if isID3Picture(id) {
+			if picture := parseID3Picture(data, version); picture != nil {
+				tags.setPicture(picture)
+			}
+			continue
+		}
+		applyID3Frame(tags, id, decodeID3Text(data[0], data[1:]))
+	}
+}
+
+func skipExtendedHeader(r io.Reader, version byte) error {
+	var sizeBytes [4]byte
+	if _, err := io.ReadFull(r, sizeBytes[:]); err != nil {
+		return err
+	}
+	// В ID3v2.3 размер не включает само поле размера, в 2.4 - включает и записан как syncsafe
+	size := int64(binary.BigEndian.Uint32(sizeBytes[:]))
+	if version == 4 {
+		size = int64(syncsafe(sizeBytes[:])) - 4
+	}
+	if size < 0 {
+		return errors.New("invalid extended header size")
+	}
+	_, err := io.CopyN(io.Discard, r, size)
+
+	return err
+}
+
+// decodeFrameFlags снимает с содержимого кадра флаги, которые меняют его формат.
+// ok = false для сжатых и зашифрованных кадров
+func decodeFrameFlags(data []byte, version byte, flags uint16) ([]byte, bool) {
+	switch version {
+	case 3:
+		if flags&0x00C0 != 0 {
+			return nil, false
+		}
+		if flags&0x0020 != 0 && len(data) > 0 {
+			// Байт группы
+			data = data[1:]
+		}
+	case 4:
+		if flags&0x000C != 0 {
+			return nil, false
+		}
+		if flags&0x0040 != 0 && len(data) > 0 {
+			data = data[1:]
+		}
+		if flags&0x0002 != 0 {
+			data = removeUnsync(data)
+		}
+		if flags&0x0001 != 0 {
+			// Длина данных до рассинхронизации
+			if len(data) < 4 {
+				return nil, false
+			}
+			data = data[4:]
+		}
+	}
+
+	return data, true
+}
+
+func isID3FrameWanted(id string) bool {
+	switch id {
+	case "TIT2", "TT2", "TPE1", "TP1", "TALB", "TAL", "TRCK", "TRK", "TPOS", "TPA",
+		"TYER", "TYE", "TDRC", "TCON", "TCO", "APIC", "PIC":
+		return true
+	default:
+		return false
+	}
+}
+
+func applyID3Frame(tags *Tags, id string, values []string) {
+	switch id {
+	case "TIT2", "TT2":
+		tags.Title = firstValue(values)
+	case "TPE1", "TP1":
+		tags.Artists = cleanValues(values)
+	case "TALB", "TAL":
+		tags.Album = firstValue(values)
+	case "TRCK", "TRK":
+		tags.TrackNumber = parseNumber(firstValue(values))
+	case "TPOS", "TPA":
+		tags.DiscNumber = parseNumber(firstValue(values))
+	case "TYER", "TYE", "TDRC":
+		if year := parseYear(firstValue(values)); year > 0 {
+			tags.Year = year
+		}
+	case "TCON", "TCO":
+		tags.Genre = id3Genre(firstValue(values))
+	}
+}
+
+func isID3Picture(id string) bool {
+	return id == "APIC" || id == "PIC"
+}
+
+// id3ImageFormats - MIME-типы по трехбуквенному формату изображения ID3v2.2
+var id3ImageFormats = map[string]string{
+	"JPG": "image/jpeg",
+	"PNG": "image/png",
+	"GIF": "image/gif",
+}
+
+// parseID3Picture разбирает кадр APIC: кодировка, MIME-тип, тип изображения, описание и данные.
+// В кадре PIC из ID3v2.2 вместо MIME-типа три буквы формата
+func parseID3Picture(data []byte, version byte) *Picture {
+	encoding, data := data[0], data[1:]
+	picture := &Picture{}
+	if version == 2 {
+		if len(data) < 4 {
+			return nil
+		}
+		picture.MIMEType = id3ImageFormats[strings.ToUpper(string(data[:3]))]
+		data = data[3:]
+	} else {
+		mime, rest, found := bytes.Cut(data, []byte{0})
+		if !found {
+			return nil
+		}
+		picture.MIMEType = strings.ToLower(string(mime))
+		data = rest
+	}
+	if len(data) < 1 {
+		return nil
+	}
+	picture.Type, data = data[0], data[1:]
+	// Описание заканчивается нулем в кодировке описания: в UTF-16 это два нулевых байта на четной позиции
+	if encoding == 1 || encoding == 2 {
+		end := -1
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil
+		}
+		data = data[end+2:]
+	} else {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return nil
+		}
+		data = data[end+1:]
+	}
+	picture.Data = data
+
+	return picture
+}
+
+// decodeID3Text декодирует текст кадра. В ID3v2.4 значения разделяются нулевым символом
+func decodeID3Text(encoding byte, data []byte) []string {
+	switch encoding {
+	case 1, 2:
+		var values []string
+		bigEndian := encoding == 2
+		for len(data) >= 2 {
+			end := len(data) - len(data)%2
+			for i := 0; i+1 < len(data); i += 2 {
+				if data[i] == 0 && data[i+1] == 0 {
+					end = i
+					break
+				}
+			}
+			values = append(values, decodeUTF16(data[:end], &bigEndian))
+			if end+2 > len(data) {
+				break
+			}
+			data = data[end+2:]
+		}
+		return values
+	case 3:
+		return strings.Split(string(data), "\x00")
+	default:
+		var values []string
+		for _, part := range bytes.Split(data, []byte{0}) {
+			values = append(values, decodeLatin1(part))
+		}
+		return values
+	}
+}
+
+// decodeUTF16 учитывает BOM в начале строки. Порядок байтов из BOM действует и для следующих строк кадра
+func decodeUTF16(data []byte, bigEndian *bool) string {
+	if len(data) >= 2 {
+		switch {
+		case data[0] == 0xFF && data[1] == 0xFE:
+			*bigEndian = false
+			data = data[2:]
+		case data[0] == 0xFE && data[1] == 0xFF:
+			*bigEndian = true
+			data = data[2:]
+		}
+	}
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if *bigEndian {
+			units = append(units, binary.BigEndian.Uint16(data[i:]))
+		} else {
+			units = append(units, binary.LittleEndian.Uint16(data[i:]))
+		}
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+
+	return string(runes)
+}
+
+// id3Genre разбирает жанр вида "Rock", "17", "(17)" или "(17)Rock"
+func id3Genre(value string) string {
+	if rest, ok := strings.CutPrefix(value, "("); ok {
+		ref, text, found := strings.Cut(rest, ")")
+		if !found {
+			return value
+		}
+		if text = strings.TrimSpace(text); text != "" {
+			return text
+		}
+		switch ref {
+		case "RX":
+			return "Remix"
+		case "CR":
+			return "Cover"
+		}
+		value = ref
+	}
+	if index, err := strconv.Atoi(value); err == nil {
+		return id3v1Genre(index)
+	}
+
+	return value
+}
+
+func id3v1Genre(index int) string {
+	if index < 0 || index >= len(id3v1Genres) {
+		return ""
+	}
+
+	return id3v1Genres[index]
+}
+
+// mergeID3v1 дополняет tags полями из ID3v1 в последних 128 байтах файла, если он там есть
+func mergeID3v1(r io.ReadSeeker, tags *Tags) error {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if end < id3v1Size {
+		return nil
+	}
+	if _, err = r.Seek(end-id3v1Size, io.SeekStart); err != nil {
+		return err
+	}
+	var tag [id3v1Size]byte
+	if _, err = io.ReadFull(r, tag[:]); err != nil {
+		return fmt.Errorf("read ID3v1: %w", err)
+	}
+	if string(tag[:3]) != "TAG" {
+		return nil
+	}
+
+	field := func(data []byte) string {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			data = data[:i]
+		}
+		return strings.TrimSpace(decodeLatin1(data))
+	}
+	v1 := &Tags{
+		Title: field(tag[3:33]),
+		Album: field(tag[63:93]),
+		Year:  parseYear(field(tag[93:97])),
+		Genre: id3v1Genre(int(tag[127])),
+	}
+	if artist := field(tag[33:63]); artist != "" {
+		v1.Artists = []string{artist}
+	}
+	// ID3v1.1 хранит номер трека в последнем байте комментария
+	if tag[125] == 0 && tag[126] != 0 {
+		v1.TrackNumber = int(tag[126])
+	}
+	tags.merge(v1)
+
+	return nil
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// removeUnsync убирает байты 0x00, вставленные после 0xFF при рассинхронизации
+func removeUnsync(data []byte) []byte {
+	result := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		result = append(result, data[i])
+		if data[i] == 0xFF && i+1 < len(data) && data[i+1] == 0x00 {
+			i++
+		}
+	}
+
+	return result
+}
+
+// unsyncReader убирает рассинхронизацию из потока
+type unsyncReader struct {
+	r      io.ByteReader
+	lastFF bool
+}
+
+func (u *unsyncReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		b, err := u.r.ReadByte()
+		if err != nil {
+			if n == 0 {
+				return 0, err
+			}
+			return n, nil
+		}
+		if u.lastFF && b == 0x00 {
+			u.lastFF = false
+			continue
+		}
+		u.lastFF = b == 0xFF
+		p[n] = b
+		n++
+	}
+
+	return n, nil
+}
+
+// id3v1Genres - жанры ID3v1 со стандартными расширениями Winamp
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal",
+	"Jazz+Funk", "Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip",
+	"Gospel", "Noise", "AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop",
+	"Instrumental Rock", "Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk",
+	"Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap",
+	"Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes",
+	"Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll",
+	"Hard Rock", "Folk", "Folk-Rock", "National Folk", "Swing", "Fast Fusion", "Bebob", "Latin", "Revival",
+	"Celtic", "Bluegrass", "Avantgarde", "Gothic Rock", "Progressive Rock", "Psychedelic Rock",
+	"Symphonic Rock", "Slow Rock", "Big Band", "Chorus", "Easy Listening", "Acoustic", "Humour", "Speech",
+	"Chanson", "Opera", "Chamber Music", "Sonata", "Symphony", "Booty Bass", "Primus", "Porn Groove",
+	"Satire", "Slow Jam", "Club", "Tango", "Samba", "Folklore", "Ballad", "Power Ballad", "Rhythmic Soul",
+	"Freestyle", "Duet", "Punk Rock", "Drum Solo", "A capella", "Euro-House", "Dance Hall", "Goa",
+	"Drum & Bass", "Club-House", "Hardcore", "Terror", "Indie", "BritPop", "Negerpunk", "Polsk Punk", "Beat",
+	"Christian Gangsta Rap", "Heavy Metal", "Black Metal", "Crossover", "Contemporary Christian",
+	"Christian Rock", "Merengue", "Salsa", "Thrash Metal", "Anime", "JPop", "Synthpop",
+}
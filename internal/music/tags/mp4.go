@@ -0,0 +1,225 @@
+package tags
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// mp4Atom - заголовок атома: size - размер содержимого без заголовка, -1 - до конца файла
+type mp4Atom struct {
+	kind string
+	size int64
+}
+
+// readMP4 ищет теги iTunes по пути moov/udta/meta/ilst, пропуская остальные атомы, включая mdat
+func readMP4(r io.ReadSeeker) (*Tags, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tags := &Tags{}
+	path := []string{"moov", "udta", "meta", "ilst"}
+	depth := 0
+	for {
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if pos >= end {
+			return tags, nil
+		}
+		atom, err := readMP4AtomHeader(r)
+		if err != nil {
+			// Оборванный файл: тегов в нем не нашлось
+			return tags, nil
+		}
+		if atom.size < 0 {
+			atom.size = end - pos
+		}
+		if atom.kind != path[depth] {
+			if _, err = r.Seek(atom.size, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if atom.kind == "ilst" {
+			return tags, readMP4Items(r, atom.size, tags)
+		}
+		// Поиск продолжается внутри атома до его конца
+		end = min(end, pos+atom.size)
+		if atom.kind == "meta" {
+			if err = skipMetaVersion(r); err != nil {
+				return tags, nil
+			}
+		}
+		depth++
+	}
+}
+
+func readMP4AtomHeader(r io.Reader) (mp4Atom, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return mp4Atom{}, err
+	}
+	atom := mp4Atom{kind: string(header[4:8])}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	switch size {
+	case 0:
+		atom.size = -1
+	case 1:
+		var large [8]byte
+		if _, err := io.ReadFull(r, large[:]); err != nil {
+			return mp4Atom{}, err
+		}
+		atom.size = int64(binary.BigEndian.Uint64(large[:])) - 16
+	default:
+		atom.size = size - 8
+	}
+	if atom.size < -1 {
+		return mp4Atom{}, errors.New("invalid mp4 atom size")
+	}
+
+	return atom, nil
+}
+
+// skipMetaVersion пропускает версию и флаги атома meta. В файлах QuickTime их нет,
+// и сразу за заголовком идет вложенный атом hdlr
+func skipMetaVersion(r io.ReadSeeker) error {
+	var next [8]byte
+	if _, err := io.ReadFull(r, next[:]); err != nil {
+		return err
+	}
+	offset := int64(-8)
+	if string(next[4:8]) != "hdlr" {
+		offset = -4
+	}
+	_, err := r.Seek(offset, io.SeekCurrent)
+
+	return err
+}
+
+// readMP4Items читает элементы ilst. Значение элемента лежит во вложенных атомах data
+func readMP4Items(r io.ReadSeeker, size int64, tags *Tags) error {
+	for size >= 8 {
+		item, err := readMP4AtomHeader(r)
+		if err != nil || item.size < 0 || item.size+8 > size {
+			return nil
+		}
+		size -= item.size + 8
+		limit := int64(maxFieldSize)
+		if item.kind == "covr" {
+			limit = maxPictureSize
+		}
+		if !isMP4ItemWanted(item.kind) || item.size > limit {
+			if _, err = r.Seek(item.size, io.SeekCurrent); err != nil {
+				return err
+			}
+			continue
+		}
+		data := make([]byte, item.size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil
+		}
+		if item.kind == "covr" {
+			if picture := mp4Picture(data); picture != nil {
+				tags.setPicture(picture)
+			}
+			continue
+		}
+		applyMP4Item(tags, item.kind, mp4DataValues(data))
+	}
+
+	return nil
+}
+
+// mp4DataValues возвращает содержимое атомов data элемента без типа и локали
+func mp4DataValues(data []byte) [][]byte {
+	var values [][]byte
+	for len(data) >= 16 {
+		size := int(binary.BigEndian.Uint32(data[:4]))
+		if size < 16 || size > len(data) {
+			break
+		}
+		if string(data[4:8]) == "data" {
+			values = append(values, data[16:size])
+		}
+		data = data[size:]
+	}
+
+	return values
+}
+
+// mp4PictureTypes - MIME-типы по типу данных атома data
+var mp4PictureTypes = map[uint32]string{
+	13: "image/jpeg",
+	14: "image/png",
+	27: "image/bmp",
+}
+
+// mp4Picture возвращает первое изображение элемента covr. Тип данных лежит в младших байтах
+// первого слова атома data, после него идет локаль
+func mp4Picture(data []byte) *Picture {
+	if len(data) < 16 || string(data[4:8]) != "data" {
+		return nil
+	}
+	size := int(binary.BigEndian.Uint32(data[:4]))
+	if size < 16 || size > len(data) {
+		return nil
+	}
+	dataType := binary.BigEndian.Uint32(data[8:12]) & 0xFFFFFF
+
+	return &Picture{MIMEType: mp4PictureTypes[dataType], Type: PictureTypeFrontCover, Data: data[16:size]}
+}
+
+func isMP4ItemWanted(kind string) bool {
+	switch kind {
+	case "\xa9nam", "\xa9ART", "\xa9alb", "trkn", "disk", "\xa9day", "\xa9gen", "gnre", "covr":
+		return true
+	default:
+		return false
+	}
+}
+
+func applyMP4Item(tags *Tags, kind string, values [][]byte) {
+	if len(values) == 0 {
+		return
+	}
+	texts := make([]string, len(values))
+	for i, value := range values {
+		texts[i] = string(value)
+	}
+	switch kind {
+	case "\xa9nam":
+		tags.Title = firstValue(texts)
+	case "\xa9ART":
+		tags.Artists = cleanValues(texts)
+	case "\xa9alb":
+		tags.Album = firstValue(texts)
+	case "trkn":
+		tags.TrackNumber = mp4Pair(values[0])
+	case "disk":
+		tags.DiscNumber = mp4Pair(values[0])
+	case "\xa9day":
+		tags.Year = parseYear(firstValue(texts))
+	case "\xa9gen":
+		tags.Genre = firstValue(texts)
+	case "gnre":
+		// Номер жанра ID3v1, увеличенный на 1
+		if tags.Genre == "" && len(values[0]) >= 2 {
+			tags.Genre = id3v1Genre(int(binary.BigEndian.Uint16(values[0])) - 1)
+		}
+	}
+}
+
+// mp4Pair читает номер из пары "номер из общего числа": 2 байта выравнивания, номер и общее число
+func mp4Pair(value []byte) int {
+	if len(value) < 4 {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint16(value[2:4]))
+}
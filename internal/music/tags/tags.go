@@ -0,0 +1,182 @@
+// Package tags читает теги аудиофайлов: ID3v2 и ID3v1 (MP3), Vorbis comment (FLAC, Ogg Vorbis, Opus)
+// и атомы iTunes (M4A). Читаются текстовые поля и встроенная обложка, прочие двоичные данные пропускаются.
+package tags
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrUnsupportedFormat возвращается, если формат файла не распознан
+var ErrUnsupportedFormat = errors.New("unsupported audio format")
+
+// maxFieldSize ограничивает размер поля тега, которое читается в память
+const maxFieldSize = 1 << 20
+
+// maxPacketSize ограничивает размер блока комментариев: в нем может лежать обложка в base64
+const maxPacketSize = 16 << 20
+
+// maxPictureSize ограничивает размер встроенной обложки
+const maxPictureSize = 16 << 20
+
+// PictureTypeFrontCover - тип изображения "лицевая сторона обложки" в ID3v2 и FLAC
+const PictureTypeFrontCover = 3
+
+// Picture - изображение, встроенное в аудиофайл
+type Picture struct {
+	// MIMEType пуст, если формат в тегах не указан
+	MIMEType string
+	// Type - тип изображения по таблице ID3v2 APIC. В MP4 тип не хранится, там это всегда обложка
+	Type byte
+	Data []byte
+}
+
+// Tags - поля тегов. Пустое значение означает, что поля в тегах нет
+type Tags struct {
+	Title       string
+	Artists     []string
+	Album       string
+	TrackNumber int
+	DiscNumber  int
+	Year        int
+	Genre       string
+	// Picture - лицевая сторона обложки, а если ее нет, первое встроенное изображение
+	Picture *Picture
+}
+
+// IsEmpty сообщает, что в файле не нашлось ни одного поля
+func (t *Tags) IsEmpty() bool {
+	return t.Title == "" && len(t.Artists) == 0 && t.Album == "" &&
+		t.TrackNumber == 0 && t.DiscNumber == 0 && t.Year == 0 && t.Genre == "" && t.Picture == nil
+}
+
+// merge заполняет пустые поля t значениями из other
+func (t *Tags) merge(other *Tags) {
+	if t.Title == "" {
+		t.Title = other.Title
+	}
+	if len(t.Artists) == 0 {
+		t.Artists = other.Artists
+	}
+	if t.Album == "" {
+		t.Album = other.Album
+	}
+	if t.TrackNumber == 0 {
+		t.TrackNumber = other.TrackNumber
+	}
+	if t.DiscNumber == 0 {
+		t.DiscNumber = other.DiscNumber
+	}
+	if t.Year == 0 {
+		t.Year = other.Year
+	}
+	if t.Genre == "" {
+		t.Genre = other.Genre
+	}
+	if other.Picture != nil {
+		t.setPicture(other.Picture)
+	}
+}
+
+// setPicture запоминает изображение, если у t еще нет обложки лучше
+func (t *Tags) setPicture(picture *Picture) {
+	if len(picture.Data) == 0 {
+		return
+	}
+	if t.Picture == nil || t.Picture.Type != PictureTypeFrontCover && picture.Type == PictureTypeFrontCover {
+		t.Picture = picture
+	}
+}
+
+// Read определяет формат файла по содержимому и читает его теги. Файл без тегов - не ошибка,
+// в этом случае возвращаются пустые Tags. Позиция r после чтения не определена
+func Read(r io.ReadSeeker) (*Tags, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var header [12]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrUnsupportedFormat
+		}
+		return nil, err
+	}
+	magic := header[:n]
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("ID3")):
+		return readID3(r)
+	case bytes.HasPrefix(magic, []byte("fLaC")):
+		return readFLAC(r)
+	case bytes.HasPrefix(magic, []byte("OggS")):
+		return readOgg(r)
+	case len(magic) >= 8 && string(magic[4:8]) == "ftyp":
+		return readMP4(r)
+	case len(magic) >= 2 && magic[0] == 0xFF && magic[1]&0xE0 == 0xE0:
+		// MPEG-кадр без ID3v2 в начале: теги могут быть только в ID3v1 в конце файла
+		tags := &Tags{}
+		if err = mergeID3v1(r, tags); err != nil {
+			return nil, err
+		}
+		return tags, nil
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// parseNumber читает номер вида "3" или "3/12"
+func parseNumber(s string) int {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "/")
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 0 {
+		return 0
+	}
+
+	return n
+}
+
+// parseYear читает год из даты вида "2001", "2001-05-01" или "2001-05-01T00:00:00Z"
+func parseYear(s string) int {
+	s = strings.TrimSpace(s)
+	if len(s) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(s[:4])
+	if err != nil || year <= 0 {
+		return 0
+	}
+
+	return year
+}
+
+// cleanValues обрезает пробелы и отбрасывает пустые значения
+func cleanValues(values []string) []string {
+	var result []string
+	for _, value := range values {
+		value = strings.TrimFunc(value, func(r rune) bool {
+			return unicode.IsSpace(r) || r == 0
+		})
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+
+	return result
+}
+
+func firstValue(values []string) string {
+	values = cleanValues(values)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
@@ -0,0 +1,261 @@
+package tags_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/kroticw/freshman-server/internal/music/tags"
+)
+
+// id3Frame собирает кадр ID3v2.3 (v2.4 при syncsafe) с текстом в кодировке encoding
+func id3Frame(id string, encoding byte, text []byte, syncsafe bool) []byte {
+	size := len(text) + 1
+	var header [10]byte
+	copy(header[:4], id)
+	if syncsafe {
+		binary.BigEndian.PutUint32(header[4:8], uint32(size&0x7F|(size>>7&0x7F)<<8|(size>>14&0x7F)<<16))
+	} else {
+		binary.BigEndian.PutUint32(header[4:8], uint32(size))
+	}
+
+	return append(append(header[:], encoding), text...)
+}
+
+func id3Tag(version byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	size := len(body)
+	header := []byte{'I', 'D', '3', version, 0, 0,
+		byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+
+	return append(header, body...)
+}
+
+func utf16WithBOM(s string) []byte {
+	data := []byte{0xFF, 0xFE}
+	for _, unit := range utf16.Encode([]rune(s)) {
+		data = binary.LittleEndian.AppendUint16(data, unit)
+	}
+
+	return append(data, 0, 0)
+}
+
+func id3v1(title, artist, album, year string, track, genre byte) []byte {
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+	copy(tag[3:33], title)
+	copy(tag[33:63], artist)
+	copy(tag[63:93], album)
+	copy(tag[93:97], year)
+	tag[126] = track
+	tag[127] = genre
+
+	return tag
+}
+
+func vorbisComment(fields ...string) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len("test")))
+	data = append(data, "test"...)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(fields)))
+	for _, field := range fields {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(field)))
+		data = append(data, field...)
+	}
+
+	return data
+}
+
+// flacFile собирает STREAMINFO, затем блоки PICTURE и VORBIS_COMMENT как последний блок
+func flacFile(comment []byte, pictures ...[]byte) []byte {
+	data := []byte("fLaC")
+	data = append(data, 0, 0, 0, 34)
+	data = append(data, make([]byte, 34)...)
+	for _, picture := range pictures {
+		data = append(data, 6, byte(len(picture)>>16), byte(len(picture)>>8), byte(len(picture)))
+		data = append(data, picture...)
+	}
+	data = append(data, 0x80|4, byte(len(comment)>>16), byte(len(comment)>>8), byte(len(comment)))
+
+	return append(data, comment...)
+}
+
+// oggPage собирает страницу Ogg с одним пакетом, разбитым на сегменты
+func oggPage(serial uint32, packet []byte) []byte {
+	var segments []byte
+	for n := len(packet); ; n -= 255 {
+		if n < 255 {
+			segments = append(segments, byte(n))
+			break
+		}
+		segments = append(segments, 255)
+	}
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	binary.LittleEndian.PutUint32(header[14:18], serial)
+	header[26] = byte(len(segments))
+
+	return append(append(header, segments...), packet...)
+}
+
+func mp4Atom(kind string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	atom := binary.BigEndian.AppendUint32(nil, uint32(len(body)+8))
+
+	return append(append(atom, kind...), body...)
+}
+
+func mp4Data(value []byte) []byte {
+	return mp4Atom("data", append(make([]byte, 8), value...))
+}
+
+func mp4TypedData(dataType byte, value []byte) []byte {
+	return mp4Atom("data", append([]byte{0, 0, 0, dataType, 0, 0, 0, 0}, value...))
+}
+
+// flacPicture собирает блок PICTURE без заголовка блока
+func flacPicture(pictureType uint32, mime string, data []byte) []byte {
+	block := binary.BigEndian.AppendUint32(nil, pictureType)
+	block = binary.BigEndian.AppendUint32(block, uint32(len(mime)))
+	block = append(block, mime...)
+	block = binary.BigEndian.AppendUint32(block, 4)
+	block = append(block, "desc"...)
+	block = append(block, make([]byte, 16)...)
+	block = binary.BigEndian.AppendUint32(block, uint32(len(data)))
+
+	return append(block, data...)
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want tags.Tags
+	}{
+		{
+			name: "ID3v2.3 with ID3v1 fallback",
+			data: bytes.Join([][]byte{
+				id3Tag(3,
+					id3Frame("TIT2", 0, []byte("Song"), false),
+					id3Frame("TPE1", 1, utf16WithBOM("Artist/Artiste"), false),
+					id3Frame("TRCK", 0, []byte("3/12"), false),
+					id3Frame("TCON", 0, []byte("(17)"), false),
+					id3Frame("APIC", 0, []byte("image/png\x00\x04back\x00PNGDATA"), false),
+					id3Frame("APIC", 1, append([]byte("image/jpeg\x00\x03"),
+						append(utf16WithBOM("Front"), "JPEGDATA"...)...), false),
+				),
+				{0xFF, 0xFB, 0x90, 0x00},
+				id3v1("", "", "Album", "1999", 0, 0),
+			}, nil),
+			want: tags.Tags{Title: "Song", Artists: []string{"Artist/Artiste"}, Album: "Album",
+				TrackNumber: 3, Year: 1999, Genre: "Rock",
+				Picture: &tags.Picture{MIMEType: "image/jpeg", Type: tags.PictureTypeFrontCover, Data: []byte("JPEGDATA")}},
+		},
+		{
+			name: "ID3v2.4",
+			data: id3Tag(4,
+				id3Frame("TIT2", 3, []byte("Песня"), true),
+				id3Frame("TPE1", 3, []byte("First\x00Second"), true),
+				id3Frame("TPOS", 3, []byte("2"), true),
+				id3Frame("TDRC", 3, []byte("2001-05-01"), true),
+			),
+			want: tags.Tags{Title: "Песня", Artists: []string{"First", "Second"}, DiscNumber: 2, Year: 2001},
+		},
+		{
+			name: "ID3v1",
+			data: append([]byte{0xFF, 0xFB, 0x90, 0x00}, id3v1("Title", "Artist", "Album", "1987", 7, 8)...),
+			want: tags.Tags{Title: "Title", Artists: []string{"Artist"}, Album: "Album",
+				TrackNumber: 7, Year: 1987, Genre: "Jazz"},
+		},
+		{
+			name: "FLAC",
+			data: flacFile(vorbisComment("TITLE=Song", "ARTIST=One", "artist=Two", "ALBUM=Album",
+				"TRACKNUMBER=4", "DISCNUMBER=1/2", "DATE=2010-01-02", "GENRE=Ambient"),
+				flacPicture(3, "image/PNG", []byte("PNGDATA"))),
+			want: tags.Tags{Title: "Song", Artists: []string{"One", "Two"}, Album: "Album",
+				TrackNumber: 4, DiscNumber: 1, Year: 2010, Genre: "Ambient",
+				Picture: &tags.Picture{MIMEType: "image/png", Type: 3, Data: []byte("PNGDATA")}},
+		},
+		{
+			name: "Ogg Vorbis",
+			data: bytes.Join([][]byte{
+				oggPage(1, []byte("\x01vorbis header")),
+				// Страница другого логического потока пропускается
+				oggPage(2, []byte("other stream")),
+				oggPage(1, append([]byte("\x03vorbis"),
+					vorbisComment("TITLE=Song", "ARTIST=Artist", "PADDING="+string(make([]byte, 600)))...)),
+			}, nil),
+			want: tags.Tags{Title: "Song", Artists: []string{"Artist"}},
+		},
+		{
+			name: "Opus",
+			data: bytes.Join([][]byte{
+				oggPage(1, []byte("OpusHead")),
+				oggPage(1, append([]byte("OpusTags"), vorbisComment("ALBUM=Album", "YEAR=2020",
+					"METADATA_BLOCK_PICTURE="+base64.StdEncoding.EncodeToString(
+						flacPicture(0, "image/jpeg", []byte("JPEGDATA"))))...)),
+			}, nil),
+			want: tags.Tags{Album: "Album", Year: 2020,
+				Picture: &tags.Picture{MIMEType: "image/jpeg", Data: []byte("JPEGDATA")}},
+		},
+		{
+			name: "MP4",
+			data: bytes.Join([][]byte{
+				mp4Atom("ftyp", []byte("M4A \x00\x00\x00\x00")),
+				mp4Atom("mdat", make([]byte, 64)),
+				mp4Atom("moov",
+					mp4Atom("mvhd", make([]byte, 16)),
+					mp4Atom("udta", mp4Atom("meta", make([]byte, 4),
+						mp4Atom("hdlr", make([]byte, 25)),
+						mp4Atom("ilst",
+							mp4Atom("\xa9nam", mp4Data([]byte("Song"))),
+							mp4Atom("\xa9ART", mp4Data([]byte("Artist"))),
+							mp4Atom("covr", mp4TypedData(14, []byte("PNGDATA")), mp4TypedData(13, []byte("JPEGDATA"))),
+							mp4Atom("trkn", mp4Data([]byte{0, 0, 0, 5, 0, 10, 0, 0})),
+							mp4Atom("disk", mp4Data([]byte{0, 0, 0, 1, 0, 1})),
+							mp4Atom("\xa9day", mp4Data([]byte("2015-03-04T00:00:00Z"))),
+							mp4Atom("gnre", mp4Data([]byte{0, 14})),
+						),
+					)),
+				),
+			}, nil),
+			want: tags.Tags{Title: "Song", Artists: []string{"Artist"}, TrackNumber: 5, DiscNumber: 1,
+				Year: 2015, Genre: "Pop",
+				Picture: &tags.Picture{MIMEType: "image/png", Type: tags.PictureTypeFrontCover, Data: []byte("PNGDATA")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tags.Read(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Read() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadUnsupported(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("RIFF....WAVE"), []byte("plain text file")} {
+		if _, err := tags.Read(bytes.NewReader(data)); !errors.Is(err, tags.ErrUnsupportedFormat) {
+			t.Errorf("Read(%q) error = %v, want ErrUnsupportedFormat", data, err)
+		}
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	// Оборванные теги не должны приводить к панике
+	full := flacFile(vorbisComment("TITLE=Song", "ARTIST=Artist"))
+	for n := 4; n < len(full); n++ {
+		_, _ = tags.Read(bytes.NewReader(full[:n]))
+	}
+	id3 := id3Tag(3, id3Frame("TIT2", 0, []byte("Song"), false))
+	for n := 3; n < len(id3); n++ {
+		_, _ = tags.Read(bytes.NewReader(id3[:n]))
+	}
+}
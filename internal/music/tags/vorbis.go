@@ -0,0 +1,284 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	flacBlockVorbisComment = 4
+	flacBlockPicture       = 6
+)
+
+var errInvalidVorbisComment = errors.New("invalid vorbis comment")
+
+func readFLAC(r io.ReadSeeker) (*Tags, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return readFLACAt(r)
+}
+
+// readFLACAt читает блоки метаданных FLAC, начиная с сигнатуры fLaC в текущей позиции r
+func readFLACAt(r io.ReadSeeker) (*Tags, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if string(magic[:]) != "fLaC" {
+		return nil, ErrUnsupportedFormat
+	}
+	tags := &Tags{}
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			// Метаданные оборваны, возвращаем то, что успели прочитать
+			return tags, nil
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		if blockType == flacBlockVorbisComment && size <= maxPacketSize {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return tags, nil
+			}
+			if err := parseVorbisComment(data, tags); err != nil {
+				return nil, err
+			}
+		} else if blockType == flacBlockPicture && size <= maxPictureSize {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return tags, nil
+			}
+			if picture := parseFLACPicture(data); picture != nil {
+				tags.setPicture(picture)
+			}
+		} else if _, err := r.Seek(size, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		if last {
+			return tags, nil
+		}
+	}
+}
+
+// readOgg читает комментарии первого логического потока Ogg: Vorbis, Opus или FLAC.
+// Комментарии лежат во втором пакете потока, который может занимать несколько страниц
+func readOgg(r io.Reader) (*Tags, error) {
+	packets := oggPacketReader{r: r}
+	first, err := packets.next()
+	if err != nil {
+		return nil, err
+	}
+	second, err := packets.next()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := &Tags{}
+	switch {
+	case bytes.HasPrefix(first, []byte("\x01vorbis")):
+		comment, ok := bytes.CutPrefix(second, []byte("\x03vorbis"))
+		if !ok {
+			return tags, nil
+		}
+		err = parseVorbisComment(comment, tags)
+	case bytes.HasPrefix(first, []byte("OpusHead")):
+		comment, ok := bytes.CutPrefix(second, []byte("OpusTags"))
+		if !ok {
+			return tags, nil
+		}
+		err = parseVorbisComment(comment, tags)
+	case bytes.HasPrefix(first, []byte("\x7fFLAC")):
+		// Второй пакет Ogg FLAC - блок метаданных FLAC с заголовком, обычно VORBIS_COMMENT
+		if len(second) < 4 || second[0]&0x7F != flacBlockVorbisComment {
+			return tags, nil
+		}
+		err = parseVorbisComment(second[4:], tags)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// oggPacketReader собирает пакеты из страниц Ogg. Страницы других логических потоков пропускаются
+type oggPacketReader struct {
+	r       io.Reader
+	serial  uint32
+	started bool
+	// segments - размеры еще не прочитанных сегментов текущей страницы
+	segments []byte
+}
+
+func (o *oggPacketReader) next() ([]byte, error) {
+	var packet []byte
+	for {
+		for len(o.segments) > 0 {
+			size := int(o.segments[0])
+			o.segments = o.segments[1:]
+			if len(packet)+size > maxPacketSize {
+				return nil, errors.New("ogg packet is too large")
+			}
+			segment := make([]byte, size)
+			if _, err := io.ReadFull(o.r, segment); err != nil {
+				return nil, err
+			}
+			packet = append(packet, segment...)
+			// Сегмент короче 255 байт завершает пакет
+			if size < 255 {
+				return packet, nil
+			}
+		}
+		if err := o.nextPage(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nextPage читает заголовок следующей страницы нужного потока
+func (o *oggPacketReader) nextPage() error {
+	var header [27]byte
+	for {
+		if _, err := io.ReadFull(o.r, header[:]); err != nil {
+			return err
+		}
+		if string(header[:4]) != "OggS" {
+			return errors.New("invalid ogg page")
+		}
+		serial := binary.LittleEndian.Uint32(header[14:18])
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(o.r, segments); err != nil {
+			return err
+		}
+		if !o.started {
+			o.serial, o.started = serial, true
+		}
+		if serial == o.serial {
+			o.segments = segments
+			return nil
+		}
+		var size int64
+		for _, segment := range segments {
+			size += int64(segment)
+		}
+		if _, err := io.CopyN(io.Discard, o.r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// parseVorbisComment разбирает блок Vorbis comment: строку производителя и список полей "ИМЯ=значение"
+func parseVorbisComment(data []byte, tags *Tags) error {
+	read := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		size := binary.LittleEndian.Uint32(data)
+		if uint64(size) > uint64(len(data)-4) {
+			return nil, false
+		}
+		value := data[4 : 4+size]
+		data = data[4+size:]
+		return value, true
+	}
+	if _, ok := read(); !ok {
+		return errInvalidVorbisComment
+	}
+	if len(data) < 4 {
+		return errInvalidVorbisComment
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+
+	fields := make(map[string][]string)
+	for range count {
+		comment, ok := read()
+		if !ok {
+			// Оборванный список: используем уже прочитанные поля
+			break
+		}
+		name, value, found := strings.Cut(string(comment), "=")
+		if !found {
+			continue
+		}
+		name = strings.ToUpper(name)
+		fields[name] = append(fields[name], value)
+	}
+
+	tags.Title = firstValue(fields["TITLE"])
+	tags.Artists = cleanValues(fields["ARTIST"])
+	tags.Album = firstValue(fields["ALBUM"])
+	tags.TrackNumber = parseNumber(firstValue(fields["TRACKNUMBER"]))
+	tags.DiscNumber = parseNumber(firstValue(fields["DISCNUMBER"]))
+	tags.Year = parseYear(firstValue(fields["DATE"]))
+	if tags.Year == 0 {
+		tags.Year = parseYear(firstValue(fields["YEAR"]))
+	}
+	tags.Genre = firstValue(fields["GENRE"])
+	// Обложка в комментариях - блок PICTURE из FLAC в base64
+	for _, value := range fields["METADATA_BLOCK_PICTURE"] {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		if picture := parseFLACPicture(data); picture != nil {
+			tags.setPicture(picture)
+		}
+	}
+
+	return nil
+}
+
+// parseFLACPicture разбирает блок PICTURE: тип, MIME-тип, описание, размеры изображения и данные
+func parseFLACPicture(data []byte) *Picture {
+	readUint32 := func() (uint32, bool) {
+		if len(data) < 4 {
+			return 0, false
+		}
+		value := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		return value, true
+	}
+	readBytes := func() ([]byte, bool) {
+		size, ok := readUint32()
+		if !ok || uint64(size) > uint64(len(data)) {
+			return nil, false
+		}
+		value := data[:size]
+		data = data[size:]
+		return value, true
+	}
+
+	pictureType, ok := readUint32()
+	if !ok || pictureType > 255 {
+		return nil
+	}
+	mime, ok := readBytes()
+	if !ok {
+		return nil
+	}
+	if _, ok = readBytes(); !ok {
+		return nil
+	}
+	// Ширина, высота, глубина цвета и размер палитры
+	if len(data) < 16 {
+		return nil
+	}
+	data = data[16:]
+	image, ok := readBytes()
+	if !ok {
+		return nil
+	}
+
+	return &Picture{MIMEType: strings.ToLower(string(mime)), Type: byte(pictureType), Data: image}
+}
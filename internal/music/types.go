@@ -1,6 +1,15 @@
 package music
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidRange возвращается хранилищем, если запрошенный диапазон выходит за пределы файла
+var ErrInvalidRange = errors.New("invalid range")
 
 type ErrorInvalidParam struct {
 	Param string `json:"param"`
@@ -18,33 +27,188 @@ func (err ErrorGetSong) Error() string {
 	return fmt.Sprintf("error getting song: %s", err.SongName)
 }
 
+// ObjectRange - фрагмент файла, прочитанный из хранилища
+type ObjectRange struct {
+	Body   io.ReadCloser
+	Offset int64
+	Length int64
+	// Size - полный размер файла, а не фрагмента
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// ErrChecksumMismatch возвращается при загрузке, если содержимое не совпало с ObjectMetadata.Checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ObjectMetadata сохраняется хранилищем вместе с файлом
+type ObjectMetadata struct {
+	ContentType string
+	// Checksum - SHA-256 содержимого в hex. Хранилище возвращает его, только если он был передан при загрузке
+	Checksum string
+	// Metadata - произвольные метаданные. Ключи в нижнем регистре: S3 не сохраняет регистр
+	Metadata map[string]string
+}
+
+// ObjectInfo описывает файл в хранилище. Key - имя файла, как его принимает Storage,
+// для слинкованных файлов это "<исходный файл без расширения>/<имя>".
+// Walk заполняет только Key, Size и ModTime
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+	ObjectMetadata
+}
+
+// PresignedRequest - подписанный запрос, который клиент выполняет напрямую к хранилищу.
+// Header содержит заголовки, которые клиент обязан передать вместе с запросом
+type PresignedRequest struct {
+	URL       string              `json:"url"`
+	Method    string              `json:"method"`
+	Header    map[string][]string `json:"header,omitempty"`
+	ExpiresAt time.Time           `json:"expiresAt"`
+}
+
 type Song struct {
+	ID      int64
 	Name    string
 	Artists []string
 	Albums  []string
-	Path    string
-	Content []byte
+	// Path - ключ аудиофайла в хранилище, см. ContentKey
+	Path string
+	// Hash - SHA-256 содержимого в hex. Песни с одинаковым содержимым ссылаются на один файл
+	Hash    string
+	Content io.Reader
+	Size    int64
+	// ContentType - MIME-тип аудиофайла, определенный при загрузке
+	ContentType string
+	// Available = false, если проверка хранилища не нашла аудиофайл песни или он поврежден
+	Available bool
+	// TrackNumber, DiscNumber и Year равны 0, если неизвестны
+	TrackNumber int
+	DiscNumber  int
+	Year        int
+	Genre       string
+	// MetadataSources - откуда взято каждое заполненное поле: MetadataSourceParams или MetadataSourceTags
+	MetadataSources map[string]string
+	// Audio определяется по заголовкам аудиофайла при загрузке
+	Audio AudioInfo
+}
+
+// AudioInfo - технические параметры аудиофайла. Нулевое значение поля означает, что оно неизвестно
+type AudioInfo struct {
+	Codec    string
+	Duration time.Duration
+	// Bitrate - средний битрейт в бит/с
+	Bitrate    int
+	SampleRate int
+	Channels   int
+}
+
+// Источники полей описания песни
+const (
+	MetadataSourceParams = "params"
+	MetadataSourceTags   = "tags"
+)
+
+// SongVersion - прежнее содержимое песни, замененное новым. Файл версии хранится по хешу, как и текущий
+type SongVersion struct {
+	ID     int64  `json:"id"`
+	SongID int64  `json:"songId"`
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	// ReplacedAt - время, когда версию заменило другое содержимое
+	ReplacedAt time.Time `json:"replacedAt"`
+}
+
+// Unmarshal заполняет песню из параметров запроса и аудиофайла. Обязательные поля могут
+// отсутствовать: их заполнят теги файла при загрузке, после чего песню проверяет Validate
+func (s *Song) Unmarshal(params map[string][]string, content io.Reader, size int64) error {
+	if err := s.unmarshalParams(params, false); err != nil {
+		return err
+	}
+	if content == nil || size <= 0 {
+		return ErrorGetSong{s.Name}
+	}
+	s.Content = content
+	s.Size = size
+	return nil
 }
 
-func (s *Song) Unmarshal(params map[string][]string, content []byte) error {
+// UnmarshalParams заполняет описание песни без аудиофайла
+func (s *Song) UnmarshalParams(params map[string][]string) error {
+	if err := s.unmarshalParams(params, true); err != nil {
+		return err
+	}
+	return s.Validate()
+}
+
+func (s *Song) unmarshalParams(params map[string][]string, strict bool) error {
 	if val, ok := params["name"]; ok && len(val) == 1 {
 		s.Name = val[0]
-	} else {
+	} else if ok || strict {
 		return ErrorInvalidParam{"name"}
 	}
 	if val, ok := params["artists"]; ok && len(val) > 0 {
 		s.Artists = val
-	} else {
+	} else if strict {
 		return ErrorInvalidParam{"artist"}
 	}
 	if val, ok := params["albums"]; ok && len(val) > 0 {
 		s.Albums = val
-	} else {
+	} else if strict {
 		return ErrorInvalidParam{"album"}
 	}
-	if len(content) == 0 {
-		return ErrorGetSong{s.Name}
+	numbers := []struct {
+		param string
+		value *int
+	}{
+		{"track", &s.TrackNumber},
+		{"disc", &s.DiscNumber},
+		{"year", &s.Year},
+	}
+	for _, number := range numbers {
+		val, ok := params[number.param]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(firstParam(val))
+		if err != nil || n <= 0 {
+			return ErrorInvalidParam{number.param}
+		}
+		*number.value = n
+	}
+	if val, ok := params["genre"]; ok {
+		s.Genre = firstParam(val)
+	}
+
+	s.MetadataSources = make(map[string]string)
+	for _, field := range s.metadataFields() {
+		if field.present() {
+			s.MetadataSources[field.name] = MetadataSourceParams
+		}
 	}
-	s.Content = content
 	return nil
 }
+
+// Validate проверяет, что у песни есть название, исполнители и альбомы
+func (s *Song) Validate() error {
+	if s.Name == "" {
+		return ErrorInvalidParam{"name"}
+	}
+	if len(s.Artists) == 0 {
+		return ErrorInvalidParam{"artist"}
+	}
+	if len(s.Albums) == 0 {
+		return ErrorInvalidParam{"album"}
+	}
+	return nil
+}
+
+func firstParam(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,108 @@
+package music
+
+import (
+	"context"
+	"sort"
+)
+
+// SpaceUsageReporter - хранилище, которое само ведет учет занятого места. Место по исходным файлам
+// возвращается по имени исходного файла без расширения, то есть для песен - по хешу содержимого
+type SpaceUsageReporter interface {
+	GetSpaceUsage(ctx context.Context) (int64, error)
+	GetSpaceUsageBySource(ctx context.Context) (map[string]int64, error)
+}
+
+// UsageReport - занятое место в хранилище. Место по пользователям не считается: у песен нет владельца
+type UsageReport struct {
+	Total int64 `json:"total"`
+	// Songs - место по песням: аудиофайл вместе со слинкованными с ним файлами. Песни с одинаковым
+	// содержимым пользуются одним файлом, и его размер указан у каждой из них
+	Songs []SongUsage `json:"songs"`
+	// Versions - место содержимого, на которое ссылаются только прошлые версии песен
+	Versions int64 `json:"versions"`
+	// Unreferenced - место файлов, на которые не ссылаются ни песни, ни версии,
+	// и файлов, хранящихся не по хешу содержимого
+	Unreferenced int64 `json:"unreferenced"`
+}
+
+type SongUsage struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	Bytes int64  `json:"bytes"`
+}
+
+// SpaceUsage считает место, занятое песнями, версиями и брошенными файлами. Если хранилище
+// не ведет учет места (SpaceUsageReporter), оно обходится целиком, для чего должно быть Walker
+func (s *Service) SpaceUsage(ctx context.Context) (*UsageReport, error) {
+	total, bySource, err := s.spaceUsageBySource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	songs, err := s.repo.ListSongs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := s.referencedContent(ctx, songs)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{Total: total, Songs: []SongUsage{}}
+	songContent := make(map[string]bool, len(songs))
+	for _, song := range songs {
+		report.Songs = append(report.Songs, SongUsage{ID: song.ID, Name: song.Name, Hash: song.Hash, Bytes: bySource[song.Hash]})
+		songContent[song.Hash] = true
+	}
+	sort.Slice(report.Songs, func(i, j int) bool { return report.Songs[i].ID < report.Songs[j].ID })
+	sourcesTotal := int64(0)
+	for source, size := range bySource {
+		sourcesTotal += size
+		if !songContent[source] && referenced[source] {
+			report.Versions += size
+		}
+	}
+	// Unreferenced - все, что не занято песнями и версиями, включая файлы не по хешу
+	report.Unreferenced = total - sourcesTotal
+	for source, size := range bySource {
+		if !referenced[source] {
+			report.Unreferenced += size
+		}
+	}
+
+	return report, nil
+}
+
+// spaceUsageBySource возвращает общее занятое место и место по хешу содержимого исходного файла
+func (s *Service) spaceUsageBySource(ctx context.Context) (int64, map[string]int64, error) {
+	if reporter, ok := s.storage.(SpaceUsageReporter); ok {
+		total, err := reporter.GetSpaceUsage(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		bySource, err := reporter.GetSpaceUsageBySource(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		return total, bySource, nil
+	}
+
+	walker, ok := s.storage.(Walker)
+	if !ok {
+		return 0, nil, ErrWalkNotSupported
+	}
+	total := int64(0)
+	bySource := make(map[string]int64)
+	err := walker.Walk(ctx, func(object ObjectInfo) error {
+		total += object.Size
+		if source, ok := contentSourceOfKey(object.Key); ok {
+			bySource[source] += object.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return total, bySource, nil
+}
@@ -0,0 +1,50 @@
+package music_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+func TestSpaceUsage(t *testing.T) {
+	ctx := context.Background()
+	repo := &fakeRepo{}
+	service, driver := newTestService(repo)
+	shared := storeContent(t, driver, "shared")
+	versioned := storeContent(t, driver, "old")
+	orphan := storeContent(t, driver, "orphan")
+	err := driver.UploadLinked(ctx, "cover-256.jpg", music.ContentKey(shared), strings.NewReader("jpeg"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = driver.Upload(ctx, "legacy.mp3", strings.NewReader("legacy"), 6); err != nil {
+		t.Fatal(err)
+	}
+	repo.songs = []*music.Song{{ID: 2, Name: "copy", Hash: shared}, {ID: 1, Name: "song", Hash: shared}}
+	repo.versions = []*music.SongVersion{{ID: 1, SongID: 1, Hash: versioned}}
+
+	report, err := service.SpaceUsage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shared и обложка, old, orphan, legacy.mp3
+	if report.Total != 6+4+3+6+6 {
+		t.Errorf("Total = %d, want %d", report.Total, 6+4+3+6+6)
+	}
+	if len(report.Songs) != 2 || report.Songs[0].ID != 1 || report.Songs[1].ID != 2 {
+		t.Fatalf("Songs = %+v, want songs 1 and 2", report.Songs)
+	}
+	for _, song := range report.Songs {
+		if song.Bytes != 10 {
+			t.Errorf("song %d uses %d bytes, want 10", song.ID, song.Bytes)
+		}
+	}
+	if report.Versions != 3 {
+		t.Errorf("Versions = %d, want 3", report.Versions)
+	}
+	if report.Unreferenced != 12 {
+		t.Errorf("Unreferenced = %d, want 12 (%s and legacy.mp3)", report.Unreferenced, orphan)
+	}
+}
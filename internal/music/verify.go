@@ -0,0 +1,284 @@
+package music
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Проблемы с аудиофайлом песни, которые находит Verify
+const (
+	ProblemMissing          = "missing"
+	ProblemSizeMismatch     = "size_mismatch"
+	ProblemChecksumMismatch = "checksum_mismatch"
+	// ProblemNoHash - песня загружена до перехода на хранение по хешу содержимого, ее файл не найти
+	ProblemNoHash = "no_hash"
+)
+
+// ErrWalkNotSupported возвращается Verify, если хранилище не умеет перечислять файлы
+var ErrWalkNotSupported = errors.New("storage does not support listing files")
+
+type VerifyOptions struct {
+	// Checksum включает перечитывание файлов и сверку SHA-256 с хешем песни
+	Checksum bool
+	// OrphanMinAge - файлы моложе этого срока не считаются брошенными:
+	// песню для них может еще регистрировать загрузка, идущая прямо сейчас
+	OrphanMinAge    time.Duration
+	DeleteOrphans   bool
+	MarkUnavailable bool
+}
+
+type VerifyReport struct {
+	Songs   int `json:"songs"`
+	Objects int `json:"objects"`
+	// Unrecognized - файлы, хранящиеся не по хешу содержимого. Их владельца не определить, поэтому они не трогаются
+	Unrecognized      int            `json:"unrecognized"`
+	Broken            []BrokenSong   `json:"broken"`
+	Orphans           []OrphanObject `json:"orphans"`
+	DeletedOrphans    int            `json:"deletedOrphans"`
+	MarkedUnavailable int            `json:"markedUnavailable"`
+	MarkedAvailable   int            `json:"markedAvailable"`
+}
+
+// BrokenSong - песня, аудиофайл которой отсутствует или не совпадает с записью в БД
+type BrokenSong struct {
+	ID           int64  `json:"id"`
+	Name         string `json:"name"`
+	Key          string `json:"key,omitempty"`
+	Problem      string `json:"problem"`
+	ExpectedSize int64  `json:"expectedSize,omitempty"`
+	ActualSize   int64  `json:"actualSize,omitempty"`
+	ActualHash   string `json:"actualHash,omitempty"`
+}
+
+// OrphanObject - файл в хранилище, на который не ссылается ни одна песня
+type OrphanObject struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Verify сверяет песни в БД с файлами в хранилище: находит песни без аудиофайла или с поврежденным
+// файлом и файлы, на которые не ссылается ни одна песня. С опциями DeleteOrphans и MarkUnavailable
+// брошенные файлы удаляются, а песни с поврежденными файлами помечаются недоступными
+// (и снова доступными, если файл восстановлен).
+func (s *Service) Verify(ctx context.Context, opts VerifyOptions) (*VerifyReport, error) {
+	index, err := s.indexStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	songs, err := s.repo.ListSongs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{
+		Songs:        len(songs),
+		Objects:      index.total,
+		Unrecognized: index.unrecognized,
+		Broken:       []BrokenSong{},
+		Orphans:      []OrphanObject{},
+	}
+
+	// checksums - результат сверки содержимого, одним файлом могут пользоваться несколько песен
+	checksums := make(map[string]string)
+	for _, song := range songs {
+		broken := s.verifySong(ctx, song, index.objects, checksums, opts)
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		if broken != nil {
+			report.Broken = append(report.Broken, *broken)
+		}
+		if !opts.MarkUnavailable || (broken == nil) == song.Available {
+			continue
+		}
+		if err = s.repo.SetSongAvailable(ctx, song.ID, broken == nil); err != nil {
+			return nil, err
+		}
+		if broken == nil {
+			report.MarkedAvailable++
+		} else {
+			report.MarkedUnavailable++
+		}
+	}
+
+	referenced, err := s.referencedContent(ctx, songs)
+	if err != nil {
+		return nil, err
+	}
+	for _, source := range index.orphans(referenced, time.Now().Add(-opts.OrphanMinAge)) {
+		sourceObjects := index.bySource[source]
+		for _, object := range sourceObjects {
+			report.Orphans = append(report.Orphans, newOrphanObject(object))
+		}
+		if !opts.DeleteOrphans {
+			continue
+		}
+		// Удаляем так же, как сборка мусора: под блокировкой содержимого с перепроверкой ссылок,
+		// поскольку за время обхода на файл могла сослаться новая песня
+		err = s.collectSource(ctx, source, sourceObjects, "")
+		if errors.Is(err, errContentReferenced) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.DeletedOrphans += len(sourceObjects)
+	}
+	sortOrphans(report.Orphans)
+
+	return report, nil
+}
+
+// storageIndex - файлы хранилища, сгруппированные по хешу содержимого исходного файла
+type storageIndex struct {
+	objects  map[string]ObjectInfo
+	bySource map[string][]ObjectInfo
+	// total - все файлы, unrecognized - файлы, хранящиеся не по хешу содержимого
+	total        int
+	unrecognized int
+}
+
+func (s *Service) indexStorage(ctx context.Context) (*storageIndex, error) {
+	walker, ok := s.storage.(Walker)
+	if !ok {
+		return nil, ErrWalkNotSupported
+	}
+	index := &storageIndex{
+		objects:  make(map[string]ObjectInfo),
+		bySource: make(map[string][]ObjectInfo),
+	}
+	err := walker.Walk(ctx, func(object ObjectInfo) error {
+		index.total++
+		source, ok := contentSourceOfKey(object.Key)
+		if !ok {
+			index.unrecognized++
+			return nil
+		}
+		index.objects[object.Key] = object
+		index.bySource[source] = append(index.bySource[source], object)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// orphans возвращает отсортированные хеши содержимого, которых нет в referenced
+// и все файлы которых изменены не позже minModTime
+func (index *storageIndex) orphans(referenced map[string]bool, minModTime time.Time) []string {
+	var sources []string
+	for source, objects := range index.bySource {
+		if !referenced[source] && olderThan(objects, minModTime) {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources)
+
+	return sources
+}
+
+// verifySong возвращает nil, если аудиофайл песни в порядке
+func (s *Service) verifySong(
+	ctx context.Context,
+	song *Song,
+	objects map[string]ObjectInfo,
+	checksums map[string]string,
+	opts VerifyOptions,
+) *BrokenSong {
+	if song.Hash == "" {
+		return &BrokenSong{ID: song.ID, Name: song.Name, Problem: ProblemNoHash}
+	}
+	key := ContentKey(song.Hash)
+	broken := &BrokenSong{ID: song.ID, Name: song.Name, Key: key}
+	object, ok := objects[key]
+	if !ok {
+		broken.Problem = ProblemMissing
+		return broken
+	}
+	if song.Size > 0 && song.Size != object.Size {
+		broken.Problem = ProblemSizeMismatch
+		broken.ExpectedSize = song.Size
+		broken.ActualSize = object.Size
+		return broken
+	}
+	if !opts.Checksum {
+		return nil
+	}
+	actual, ok := checksums[key]
+	if !ok {
+		var err error
+		actual, err = s.checksum(ctx, key)
+		if err != nil {
+			s.log.WithError(err).Errorf("failed to read %s for checksum verification", key)
+			if !errors.Is(err, os.ErrNotExist) {
+				// Ошибка чтения не означает, что файл поврежден
+				return nil
+			}
+			broken.Problem = ProblemMissing
+			return broken
+		}
+		checksums[key] = actual
+	}
+	if actual != song.Hash {
+		broken.Problem = ProblemChecksumMismatch
+		broken.ActualHash = actual
+		return broken
+	}
+
+	return nil
+}
+
+func (s *Service) checksum(ctx context.Context, key string) (string, error) {
+	body, _, err := s.storage.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, body); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// contentSourceOfKey возвращает хеш содержимого исходного файла, к которому относится ключ.
+// ok = false, если ключ не из ContentKey и не слинкован с таким файлом
+func contentSourceOfKey(key string) (source string, ok bool) {
+	if sourceDir, _, linked := strings.Cut(key, "/"); linked {
+		source = sourceDir
+	} else if source, ok = strings.CutSuffix(key, contentKeyExt); !ok {
+		return "", false
+	}
+
+	return source, sha256HexRegexp.MatchString(source)
+}
+
+func newOrphanObject(object ObjectInfo) OrphanObject {
+	return OrphanObject{Key: object.Key, Size: object.Size, ModTime: object.ModTime}
+}
+
+func sortOrphans(orphans []OrphanObject) {
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Key < orphans[j].Key
+	})
+}
+
+func olderThan(objects []ObjectInfo, minModTime time.Time) bool {
+	for _, object := range objects {
+		if object.ModTime.After(minModTime) {
+			return false
+		}
+	}
+
+	return true
+}
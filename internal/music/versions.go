@@ -0,0 +1,165 @@
+package music
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SetVersionRetention задает, сколько прежних версий хранить для каждой песни. 0 - без ограничения
+func (s *Service) SetVersionRetention(retention int) {
+	s.versionRetention = retention
+}
+
+// ReplaceSongContent заменяет аудиофайл песни song.ID содержимым song.Content. Прежнее содержимое
+// остается в хранилище и доступно как версия песни, пока его не вытеснит ограничение на число версий.
+// Возвращает common.ErrNotFound, если песни нет.
+func (s *Service) ReplaceSongContent(ctx context.Context, song *Song) error {
+	s.log.Infof("Replacing content of song %d", song.ID)
+	content, cleanup, err := s.openContent(song)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	s.fillAudioInfo(song, content)
+	picture := s.readTags(song, content).Picture
+	peaks := s.decodeWaveform(ctx, song, content)
+
+	var created bool
+	// Как и при загрузке, ссылка на содержимое появляется в транзакции до записи файла
+	err = s.repo.InTransaction(ctx, func(repo Repo) error {
+		if err := repo.ReplaceSongContent(ctx, song); err != nil {
+			return err
+		}
+		created, err = s.uploadContent(ctx, song)
+		return err
+	})
+	if err != nil {
+		if created {
+			s.removeStoredContent(ctx, song.Hash)
+		}
+		return err
+	}
+	s.storeCovers(ctx, song, picture)
+	if peaks != nil {
+		if err := s.storeWaveforms(ctx, song, peaks); err != nil {
+			s.log.WithError(err).Warnf("failed to store waveform of song %d", song.ID)
+		}
+	}
+	s.applyVersionRetention(ctx, song.ID)
+
+	return nil
+}
+
+func (s *Service) ListSongVersions(ctx context.Context, songID int64) ([]*SongVersion, error) {
+	return s.repo.ListSongVersions(ctx, songID)
+}
+
+// RestoreSongVersion возвращает песне содержимое версии versionID. Текущее содержимое становится версией.
+// Возвращает common.ErrNotFound, если нет песни или версии, и os.ErrNotExist, если файла версии нет в хранилище
+func (s *Service) RestoreSongVersion(ctx context.Context, songID int64, versionID int64) error {
+	versions, err := s.repo.ListSongVersions(ctx, songID)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.ID != versionID {
+			continue
+		}
+		exists, err := s.storage.Exists(ctx, ContentKey(version.Hash))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("content %s of song version %d: %w", version.Hash, versionID, os.ErrNotExist)
+		}
+		break
+	}
+	s.log.Infof("Restoring version %d of song %d", versionID, songID)
+	if err = s.repo.RestoreSongVersion(ctx, songID, versionID); err != nil {
+		return err
+	}
+	s.applyVersionRetention(ctx, songID)
+
+	return nil
+}
+
+// PruneSongVersions удаляет версии песни, кроме keep последних. Файлы удаленных версий удаляются
+// из хранилища, если на то же содержимое не ссылаются другие песни или версии
+func (s *Service) PruneSongVersions(ctx context.Context, songID int64, keep int) ([]*SongVersion, error) {
+	if keep < 0 {
+		return nil, ErrorInvalidParam{"keep"}
+	}
+	versions, err := s.repo.ListSongVersions(ctx, songID)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) <= keep {
+		return []*SongVersion{}, nil
+	}
+	pruned, err := s.repo.DeleteSongVersions(ctx, songID, keep)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range pruned {
+		if err = s.deleteUnreferencedContent(ctx, version.Hash); err != nil {
+			// Файл останется брошенным, и его соберет GC
+			s.log.WithError(err).Errorf("failed to delete content %s of pruned song version", version.Hash)
+		}
+	}
+	if len(pruned) > 0 {
+		s.log.Infof("Pruned %d versions of song %d", len(pruned), songID)
+	}
+
+	return pruned, nil
+}
+
+// applyVersionRetention вытесняет версии сверх versionRetention. Ошибка не влияет на операцию,
+// после которой вытеснение выполняется: лишние версии удалятся при следующей
+func (s *Service) applyVersionRetention(ctx context.Context, songID int64) {
+	if s.versionRetention <= 0 {
+		return
+	}
+	if _, err := s.PruneSongVersions(ctx, songID, s.versionRetention); err != nil {
+		s.log.WithError(err).Errorf("failed to prune versions of song %d", songID)
+	}
+}
+
+// deleteUnreferencedContent удаляет файл содержимого, если на него не ссылается ни одна песня или версия.
+// Проверка и удаление идут под блокировкой содержимого, чтобы новая песня не сослалась на него между ними
+func (s *Service) deleteUnreferencedContent(ctx context.Context, hash string) error {
+	return s.repo.InTransaction(ctx, func(repo Repo) error {
+		if err := repo.LockContent(ctx, hash); err != nil {
+			return err
+		}
+		referenced, err := repo.SongExistsByHash(ctx, hash)
+		if err != nil || referenced {
+			return err
+		}
+		err = s.storage.Delete(ctx, ContentKey(hash))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+// referencedContent возвращает хеши содержимого, на которые ссылаются songs или версии песен
+func (s *Service) referencedContent(ctx context.Context, songs []*Song) (map[string]bool, error) {
+	hashes, err := s.repo.ListVersionHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool, len(songs)+len(hashes))
+	for _, song := range songs {
+		if song.Hash != "" {
+			referenced[song.Hash] = true
+		}
+	}
+	for _, hash := range hashes {
+		referenced[hash] = true
+	}
+
+	return referenced, nil
+}
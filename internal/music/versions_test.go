@@ -0,0 +1,74 @@
+package music_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/kroticw/freshman-server/internal/music"
+)
+
+func TestPruneSongVersions(t *testing.T) {
+	repo := &fakeRepo{}
+	service, driver := newTestService(repo)
+	current := storeContent(t, driver, "current")
+	shared := storeContent(t, driver, "shared by song")
+	versioned := storeContent(t, driver, "shared by version")
+	unique := storeContent(t, driver, "unique")
+	repo.songs = []*music.Song{{ID: 1, Hash: current}, {ID: 2, Hash: shared}}
+	repo.versions = []*music.SongVersion{
+		{ID: 1, SongID: 1, Hash: shared},
+		{ID: 2, SongID: 1, Hash: versioned},
+		{ID: 3, SongID: 1, Hash: current},
+		{ID: 4, SongID: 1, Hash: unique},
+		{ID: 5, SongID: 2, Hash: versioned},
+	}
+
+	pruned, err := service.PruneSongVersions(context.Background(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 4 {
+		t.Fatalf("PruneSongVersions() pruned %d versions, want 4", len(pruned))
+	}
+	// Содержимое удаленных версий, на которое ссылаются песни или другие версии, остается
+	for name, hash := range map[string]string{"current": current, "shared": shared, "versioned": versioned} {
+		if !exists(t, driver, music.ContentKey(hash)) {
+			t.Errorf("PruneSongVersions() deleted %s content", name)
+		}
+	}
+	if exists(t, driver, music.ContentKey(unique)) {
+		t.Error("PruneSongVersions() left unreferenced content")
+	}
+
+	if _, err = service.PruneSongVersions(context.Background(), 1, -1); !errors.As(err, &music.ErrorInvalidParam{}) {
+		t.Errorf("PruneSongVersions(keep = -1) error = %v, want ErrorInvalidParam", err)
+	}
+}
+
+func TestRestoreSongVersion(t *testing.T) {
+	repo := &fakeRepo{}
+	service, driver := newTestService(repo)
+	stored := storeContent(t, driver, "stored")
+	repo.songs = []*music.Song{{ID: 1, Hash: storeContent(t, driver, "current")}}
+	repo.versions = []*music.SongVersion{
+		{ID: 1, SongID: 1, Hash: stored},
+		{ID: 2, SongID: 1, Hash: "8d5cb0ee3f2f4b0b1e2b3d9e4b3f8a7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a"},
+	}
+
+	err := service.RestoreSongVersion(context.Background(), 1, 2)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("RestoreSongVersion() of missing content error = %v, want os.ErrNotExist", err)
+	}
+	if len(repo.restored) != 0 {
+		t.Fatal("RestoreSongVersion() restored version without content")
+	}
+
+	if err = service.RestoreSongVersion(context.Background(), 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.restored) != 1 || repo.restored[0] != 1 {
+		t.Errorf("restored versions = %v, want [1]", repo.restored)
+	}
+}
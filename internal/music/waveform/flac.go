@@ -0,0 +1,47 @@
+package waveform
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mewkiz/flac"
+)
+
+func decodeFLAC(r io.Reader) (*Waveform, error) {
+	stream, err := flac.New(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	defer stream.Close()
+	bits := int(stream.Info.BitsPerSample)
+	p := newPeaks(int(stream.Info.SampleRate), int(stream.Info.NChannels))
+	for {
+		frame, err := stream.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode flac frame: %w", err)
+		}
+		if len(frame.Subframes) == 0 {
+			continue
+		}
+		for i := range frame.Subframes[0].Samples {
+			for _, subframe := range frame.Subframes {
+				p.add(flacSample(subframe.Samples[i], bits))
+			}
+		}
+	}
+
+	return p.waveform()
+}
+
+// flacSample приводит отсчет разрядности bits к 16 битам
+func flacSample(sample int32, bits int) int16 {
+	if bits > 16 {
+		return int16(sample >> (bits - 16))
+	}
+
+	return int16(sample << (16 - bits))
+}
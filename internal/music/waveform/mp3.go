@@ -0,0 +1,38 @@
+package waveform
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// mp3FrameBytes - go-mp3 всегда выдает 16-битное стерео
+const mp3FrameBytes = 4
+
+func decodeMP3(r io.Reader) (*Waveform, error) {
+	// Без Seek декодер не обходит весь файл заранее ради подсчета длины
+	decoder, err := mp3.NewDecoder(struct{ io.Reader }{r})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	p := newPeaks(decoder.SampleRate(), 2)
+	buf := make([]byte, mp3FrameBytes*4096)
+	for {
+		n, err := io.ReadFull(decoder, buf)
+		n -= n % mp3FrameBytes
+		for i := 0; i < n; i += 2 {
+			p.add(int16(binary.LittleEndian.Uint16(buf[i:])))
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode mp3: %w", err)
+		}
+	}
+
+	return p.waveform()
+}
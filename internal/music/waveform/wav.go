@@ -0,0 +1,148 @@
+package waveform
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// maxWAVFormatSize - наибольший размер чанка fmt: WAVE_FORMAT_EXTENSIBLE занимает 40 байт
+const maxWAVFormatSize = 64
+
+// wavFormat - содержимое чанка fmt
+type wavFormat struct {
+	format     uint16
+	channels   int
+	sampleRate int
+	blockAlign int
+	bits       int
+}
+
+// decodeWAV читает PCM 8/16/24/32 бит и float 32/64 бит из чанка data
+func decodeWAV(r io.Reader) (*Waveform, error) {
+	br := bufio.NewReader(r)
+	if _, err := br.Discard(12); err != nil {
+		return nil, err
+	}
+	var format *wavFormat
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return nil, fmt.Errorf("%w: wav data chunk not found", ErrUnsupportedFormat)
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:]))
+		switch string(header[:4]) {
+		case "fmt ":
+			// Размер берется из файла: без ограничения чанк заставил бы выделить до 4 ГБ
+			if size > maxWAVFormatSize {
+				return nil, fmt.Errorf("%w: wav fmt chunk of %d bytes", ErrUnsupportedFormat, size)
+			}
+			body := make([]byte, size)
+			if _, err := io.ReadFull(br, body); err != nil {
+				return nil, fmt.Errorf("%w: truncated wav fmt chunk", ErrUnsupportedFormat)
+			}
+			parsed, err := parseWAVFormat(body)
+			if err != nil {
+				return nil, err
+			}
+			format = parsed
+		case "data":
+			if format == nil {
+				return nil, fmt.Errorf("%w: wav fmt chunk is missing", ErrUnsupportedFormat)
+			}
+			if size == 0 || size == math.MaxUint32 {
+				// Размер не записан: данные идут до конца файла
+				size = math.MaxInt64
+			}
+			return decodeWAVData(io.LimitReader(br, size), format)
+		default:
+			if _, err := io.CopyN(io.Discard, br, size); err != nil {
+				return nil, fmt.Errorf("%w: truncated wav chunk %q", ErrUnsupportedFormat, header[:4])
+			}
+		}
+		if size%2 == 1 {
+			// Чанки выровнены по четной границе
+			if _, err := br.Discard(1); err != nil {
+				return nil, fmt.Errorf("%w: truncated wav chunk %q", ErrUnsupportedFormat, header[:4])
+			}
+		}
+	}
+}
+
+func parseWAVFormat(body []byte) (*wavFormat, error) {
+	if len(body) < 16 {
+		return nil, fmt.Errorf("%w: wav fmt chunk is too short", ErrUnsupportedFormat)
+	}
+	format := &wavFormat{
+		format:     binary.LittleEndian.Uint16(body[0:]),
+		channels:   int(binary.LittleEndian.Uint16(body[2:])),
+		sampleRate: int(binary.LittleEndian.Uint32(body[4:])),
+		blockAlign: int(binary.LittleEndian.Uint16(body[12:])),
+		bits:       int(binary.LittleEndian.Uint16(body[14:])),
+	}
+	if format.format == wavFormatExtensible && len(body) >= 26 {
+		// Настоящий формат - первые байты GUID подформата
+		format.format = binary.LittleEndian.Uint16(body[24:])
+	}
+	if format.channels == 0 || format.blockAlign%format.channels != 0 {
+		return nil, fmt.Errorf("%w: invalid wav block align %d", ErrUnsupportedFormat, format.blockAlign)
+	}
+	width := format.blockAlign / format.channels
+	switch {
+	case format.format == wavFormatPCM && width >= 1 && width <= 4:
+	case format.format == wavFormatFloat && (width == 4 || width == 8):
+	default:
+		return nil, fmt.Errorf("%w: wav format %d with %d bits", ErrUnsupportedFormat, format.format, format.bits)
+	}
+
+	return format, nil
+}
+
+func decodeWAVData(r io.Reader, format *wavFormat) (*Waveform, error) {
+	p := newPeaks(format.sampleRate, format.channels)
+	width := format.blockAlign / format.channels
+	buf := make([]byte, format.blockAlign*4096)
+	for {
+		n, err := io.ReadFull(r, buf)
+		// Неполный последний кадр отбрасывается
+		n -= n % format.blockAlign
+		for i := 0; i < n; i += width {
+			p.add(wavSample(buf[i:i+width], format.format))
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p.waveform()
+}
+
+// wavSample приводит отсчет к 16 битам. 8-битные отсчеты беззнаковые, остальные - со знаком
+func wavSample(b []byte, format uint16) int16 {
+	if format == wavFormatFloat {
+		var value float64
+		if len(b) == 4 {
+			value = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		} else {
+			value = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+		return int16(max(-1, min(1, value)) * math.MaxInt16)
+	}
+	if len(b) == 1 {
+		return int16(int(b[0])-128) << 8
+	}
+	// Старшие два байта
+	return int16(binary.LittleEndian.Uint16(b[len(b)-2:]))
+}
@@ -0,0 +1,247 @@
+// Package waveform декодирует аудио WAV, FLAC и MP3 в PCM и строит по нему пики для отрисовки
+// волны в плеере. Пики хранятся и кодируются в форматах audiowaveform: пары min/max по 8 бит
+package waveform
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrUnsupportedFormat возвращается, если формат аудио не удалось распознать или декодировать
+var ErrUnsupportedFormat = errors.New("unsupported audio format for waveform")
+
+// BaseSamplesPerPixel - число отсчетов на пару пиков при декодировании. Наборы с меньшим
+// числом пар собираются из нее
+const BaseSamplesPerPixel = 256
+
+// Waveform - пики волны: для каждого отрезка из SamplesPerPixel отсчетов минимум и максимум
+// по всем каналам
+type Waveform struct {
+	SampleRate      int
+	SamplesPerPixel int
+	// Data - пары min, max, приведенные к 8 битам
+	Data []int8
+}
+
+// Len возвращает число пар пиков
+func (w *Waveform) Len() int {
+	return len(w.Data) / 2
+}
+
+// Resample объединяет соседние пары так, чтобы их осталось не больше pixels.
+// Волна, в которой пар не больше pixels, возвращается как есть
+func (w *Waveform) Resample(pixels int) *Waveform {
+	if pixels <= 0 || w.Len() <= pixels {
+		return w
+	}
+	factor := (w.Len() + pixels - 1) / pixels
+	resampled := &Waveform{
+		SampleRate:      w.SampleRate,
+		SamplesPerPixel: w.SamplesPerPixel * factor,
+		Data:            make([]int8, 0, 2*((w.Len()+factor-1)/factor)),
+	}
+	for start := 0; start < w.Len(); start += factor {
+		low, high := int8(math.MaxInt8), int8(math.MinInt8)
+		for i := start; i < min(start+factor, w.Len()); i++ {
+			low = min(low, w.Data[2*i])
+			high = max(high, w.Data[2*i+1])
+		}
+		resampled.Data = append(resampled.Data, low, high)
+	}
+
+	return resampled
+}
+
+type Format string
+
+const (
+	// JSON - формат audiowaveform версии 2
+	JSON Format = "json"
+	// Binary - двоичный формат audiowaveform .dat версии 1
+	Binary Format = "dat"
+)
+
+// ParseFormat возвращает формат по имени. ok = false для неизвестного формата
+func ParseFormat(name string) (format Format, ok bool) {
+	switch Format(name) {
+	case JSON, Binary:
+		return Format(name), true
+	default:
+		return "", false
+	}
+}
+
+// Ext возвращает расширение файла без точки
+func (f Format) Ext() string {
+	return string(f)
+}
+
+func (f Format) ContentType() string {
+	if f == JSON {
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
+
+// audiowaveformJSON - волна в JSON-формате audiowaveform. Каналы сведены в один
+type audiowaveformJSON struct {
+	Version         int    `json:"version"`
+	Channels        int    `json:"channels"`
+	SampleRate      int    `json:"sample_rate"`
+	SamplesPerPixel int    `json:"samples_per_pixel"`
+	Bits            int    `json:"bits"`
+	Length          int    `json:"length"`
+	Data            []int8 `json:"data"`
+}
+
+// binaryFlag8Bit - флаг заголовка .dat: значения занимают 8 бит
+const binaryFlag8Bit = 1
+
+// Encode кодирует волну в формате format
+func (w *Waveform) Encode(format Format) ([]byte, error) {
+	switch format {
+	case JSON:
+		return json.Marshal(audiowaveformJSON{
+			Version:         2,
+			Channels:        1,
+			SampleRate:      w.SampleRate,
+			SamplesPerPixel: w.SamplesPerPixel,
+			Bits:            8,
+			Length:          w.Len(),
+			Data:            w.Data,
+		})
+	case Binary:
+		var buf bytes.Buffer
+		header := []uint32{1, binaryFlag8Bit, uint32(w.SampleRate), uint32(w.SamplesPerPixel), uint32(w.Len())}
+		if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(&buf, binary.LittleEndian, w.Data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown waveform format %q", format)
+	}
+}
+
+// Decode декодирует аудио WAV, FLAC или MP3 и строит пики по BaseSamplesPerPixel отсчетов на пару.
+// Для других форматов возвращает ErrUnsupportedFormat
+func Decode(r io.ReadSeeker) (*Waveform, error) {
+	header := make([]byte, 12)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrUnsupportedFormat
+		}
+		return nil, err
+	}
+	header = header[:n]
+	if bytes.HasPrefix(header, []byte("ID3")) {
+		// За ID3v2 может идти и FLAC
+		if header, err = afterID3v2(r, header); err != nil {
+			return nil, err
+		}
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return decodeWAV(r)
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return decodeFLAC(r)
+	case isMP3Frame(header):
+		return decodeMP3(r)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
+
+// afterID3v2 возвращает первые байты после тега ID3v2, размер которого записан в header
+func afterID3v2(r io.ReadSeeker, header []byte) ([]byte, error) {
+	if len(header) < 10 {
+		return nil, ErrUnsupportedFormat
+	}
+	size := int64(header[6]&0x7F)<<21 | int64(header[7]&0x7F)<<14 | int64(header[8]&0x7F)<<7 | int64(header[9]&0x7F)
+	size += 10
+	if header[5]&0x10 != 0 {
+		// Футер повторяет заголовок
+		size += 10
+	}
+	if _, err := r.Seek(size, io.SeekStart); err != nil {
+		return nil, err
+	}
+	next := make([]byte, 4)
+	n, err := io.ReadFull(r, next)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return next[:n], nil
+}
+
+// isMP3Frame проверяет синхрослово кадра MPEG Layer III. Другие слои декодер не поддерживает
+func isMP3Frame(header []byte) bool {
+	return len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0 && (header[1]>>1)&0x03 == 0x01
+}
+
+// peaks собирает пары min/max по BaseSamplesPerPixel отсчетов. Отсчеты каналов идут вперемешку
+type peaks struct {
+	sampleRate int
+	channels   int
+	channel    int
+	frames     int
+	low, high  int16
+	data       []int8
+}
+
+func newPeaks(sampleRate, channels int) *peaks {
+	p := &peaks{sampleRate: sampleRate, channels: max(1, channels)}
+	p.reset()
+
+	return p
+}
+
+func (p *peaks) reset() {
+	p.frames = 0
+	p.low, p.high = math.MaxInt16, math.MinInt16
+}
+
+// add добавляет отсчет, приведенный к 16 битам
+func (p *peaks) add(sample int16) {
+	p.low = min(p.low, sample)
+	p.high = max(p.high, sample)
+	p.channel++
+	if p.channel < p.channels {
+		return
+	}
+	p.channel = 0
+	p.frames++
+	if p.frames == BaseSamplesPerPixel {
+		p.flush()
+	}
+}
+
+func (p *peaks) flush() {
+	if p.frames == 0 && p.channel == 0 {
+		return
+	}
+	p.data = append(p.data, int8(p.low>>8), int8(p.high>>8))
+	p.channel = 0
+	p.reset()
+}
+
+func (p *peaks) waveform() (*Waveform, error) {
+	p.flush()
+	if p.sampleRate <= 0 {
+		return nil, fmt.Errorf("%w: invalid sample rate %d", ErrUnsupportedFormat, p.sampleRate)
+	}
+
+	return &Waveform{SampleRate: p.sampleRate, SamplesPerPixel: BaseSamplesPerPixel, Data: p.data}, nil
+}
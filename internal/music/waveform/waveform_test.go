@@ -0,0 +1,210 @@
+package waveform_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/kroticw/freshman-server/internal/music/waveform"
+	"github.com/mewkiz/flac"
+	"github.com/mewkiz/flac/frame"
+	"github.com/mewkiz/flac/meta"
+)
+
+// sine возвращает frames отсчетов синуса амплитуды amplitude от полной шкалы
+func sine(frames int, amplitude float64) []int16 {
+	samples := make([]int16, frames)
+	for i := range samples {
+		samples[i] = int16(amplitude * math.MaxInt16 * math.Sin(float64(i)/10))
+	}
+
+	return samples
+}
+
+// wavFile - стерео 16 бит, левый канал - samples, правый - тишина
+func wavFile(sampleRate int, samples []int16) []byte {
+	data := make([]byte, 0, len(samples)*4)
+	for _, sample := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(sample))
+		data = binary.LittleEndian.AppendUint16(data, 0)
+	}
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], 1)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 2)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], uint32(sampleRate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:], uint32(sampleRate*4))
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 4)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+	chunk := func(id string, body []byte) []byte {
+		return append(append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+	}
+	body := bytes.Join([][]byte{[]byte("WAVE"), chunk("fmt ", fmtChunk), chunk("data", data)}, nil)
+
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// flacFile кодирует моно 16 бит кадрами по 4096 отсчетов
+func flacFile(t *testing.T, sampleRate int, samples []int16) []byte {
+	var buf bytes.Buffer
+	info := &meta.StreamInfo{
+		BlockSizeMin:  16,
+		BlockSizeMax:  4096,
+		SampleRate:    uint32(sampleRate),
+		NChannels:     1,
+		BitsPerSample: 16,
+	}
+	encoder, err := flac.NewEncoder(&buf, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := 0; start < len(samples); start += 4096 {
+		block := samples[start:min(start+4096, len(samples))]
+		subframe := &frame.Subframe{
+			SubHeader: frame.SubHeader{Pred: frame.PredVerbatim},
+			Samples:   make([]int32, len(block)),
+			NSamples:  len(block),
+		}
+		for i, sample := range block {
+			subframe.Samples[i] = int32(sample)
+		}
+		err = encoder.WriteFrame(&frame.Frame{
+			Header: frame.Header{
+				HasFixedBlockSize: true,
+				BlockSize:         uint16(len(block)),
+				SampleRate:        uint32(sampleRate),
+				Channels:          frame.ChannelsMono,
+				BitsPerSample:     16,
+			},
+			Subframes: []*frame.Subframe{subframe},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// mp3Silence - кадры MPEG-1 Layer III 128 кбит/с, 44100 Гц без данных: каждый декодируется
+// в 1152 отсчета тишины
+func mp3Silence(frames int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+
+	return bytes.Repeat(frame, frames)
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		sampleRate int
+		// minLen - нижняя граница числа пар: декодер MP3 может отдать не все кадры
+		minLen, maxLen int
+		high           int8
+	}{
+		{"wav", wavFile(44100, sine(10000, 0.5)), 44100, 40, 40, 63},
+		{"flac", flacFile(t, 48000, sine(10000, 0.25)), 48000, 40, 40, 31},
+		{"mp3", mp3Silence(10), 44100, 40, 45, 0},
+		{"mp3 with id3", append([]byte("ID3\x03\x00\x00\x00\x00\x00\x04\x00\x00\x00\x00"), mp3Silence(10)...), 44100, 40, 45, 0},
+	}
+	for _, tt := range tests {
+		w, err := waveform.Decode(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("%s: Decode() error = %v", tt.name, err)
+		}
+		if w.SampleRate != tt.sampleRate || w.SamplesPerPixel != waveform.BaseSamplesPerPixel {
+			t.Errorf("%s: sample rate %d, %d samples per pixel", tt.name, w.SampleRate, w.SamplesPerPixel)
+		}
+		if w.Len() < tt.minLen || w.Len() > tt.maxLen {
+			t.Errorf("%s: Len() = %d, want %d..%d", tt.name, w.Len(), tt.minLen, tt.maxLen)
+		}
+		var high int8
+		for i := 1; i < len(w.Data); i += 2 {
+			high = max(high, w.Data[i])
+		}
+		if high != tt.high {
+			t.Errorf("%s: max peak = %d, want %d", tt.name, high, tt.high)
+		}
+		// Синус симметричен: минимум близок к минус максимуму
+		if w.Data[0] > -tt.high {
+			t.Errorf("%s: first min peak = %d, want <= %d", tt.name, w.Data[0], -tt.high)
+		}
+	}
+}
+
+func TestDecodeUnsupported(t *testing.T) {
+	// Чанк fmt с размером почти 4 ГБ не должен приводить к выделению памяти под него
+	hugeFormat := append([]byte("RIFF\x00\x00\x00\x00WAVEfmt \xb5\x00\xc9\xf6"), make([]byte, 400)...)
+	// Чанк, размер которого больше оставшегося файла
+	hugeChunk := append([]byte("RIFF\x00\x00\x00\x00WAVELIST\xb5\x00\xc9\xf6"), make([]byte, 400)...)
+	for _, data := range [][]byte{
+		nil,
+		[]byte("OggS not supported"),
+		[]byte("RIFF\x04\x00\x00\x00WAVE"),
+		hugeFormat,
+		hugeChunk,
+	} {
+		if _, err := waveform.Decode(bytes.NewReader(data)); !errors.Is(err, waveform.ErrUnsupportedFormat) {
+			t.Errorf("Decode(%q) error = %v, want ErrUnsupportedFormat", data, err)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	w := &waveform.Waveform{SampleRate: 8000, SamplesPerPixel: 256, Data: []int8{-1, 1, -5, 2, 0, 7, -3, 3, -2, 2}}
+	resampled := w.Resample(2)
+	want := []int8{-5, 7, -3, 3}
+	if resampled.SamplesPerPixel != 768 || !bytes.Equal(int8Bytes(resampled.Data), int8Bytes(want)) {
+		t.Errorf("Resample(2) = %d %v, want 768 %v", resampled.SamplesPerPixel, resampled.Data, want)
+	}
+	if w.Resample(10) != w {
+		t.Error("Resample() of a shorter waveform must return it as is")
+	}
+}
+
+func int8Bytes(values []int8) []byte {
+	b := make([]byte, len(values))
+	for i, v := range values {
+		b[i] = byte(v)
+	}
+
+	return b
+}
+
+func TestEncode(t *testing.T) {
+	w := &waveform.Waveform{SampleRate: 44100, SamplesPerPixel: 512, Data: []int8{-10, 12, -128, 127}}
+
+	data, err := w.Encode(waveform.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]any
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["version"] != 2.0 || decoded["samples_per_pixel"] != 512.0 || decoded["length"] != 2.0 ||
+		len(decoded["data"].([]any)) != 4 || decoded["data"].([]any)[2] != -128.0 {
+		t.Errorf("Encode(JSON) = %s", data)
+	}
+
+	data, err = w.Encode(waveform.Binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []uint32{1, 1, 44100, 512, 2}
+	for i, want := range header {
+		if got := binary.LittleEndian.Uint32(data[i*4:]); got != want {
+			t.Errorf("Encode(Binary) header[%d] = %d, want %d", i, got, want)
+		}
+	}
+	if !bytes.Equal(data[20:], int8Bytes(w.Data)) {
+		t.Errorf("Encode(Binary) data = %v", data[20:])
+	}
+}
@@ -0,0 +1,182 @@
+package music
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/kroticw/freshman-server/internal/music/waveform"
+)
+
+// WaveformResolutions - число пар пиков в наборах, которые строятся для каждой песни
+var WaveformResolutions = []int{256, 1024, 4096}
+
+// WaveformFormats - форматы, в которых сохраняется каждый набор пиков
+var WaveformFormats = []waveform.Format{waveform.JSON, waveform.Binary}
+
+// ErrNoWaveform возвращается, если пики песни не построены: формат ее аудио не поддерживается
+// или песня загружена до появления пиков и еще не обработана командой wave backfill
+var ErrNoWaveform = errors.New("song has no waveform")
+
+func waveformName(resolution int, format waveform.Format) string {
+	return fmt.Sprintf("waveform-%d.%s", resolution, format.Ext())
+}
+
+// WaveformBackfillReport - итог построения пиков для уже загруженных песен
+type WaveformBackfillReport struct {
+	Songs     int `json:"songs"`
+	Generated int `json:"generated"`
+	// Skipped - песни, пики которых уже построены, в том числе для другой песни с тем же содержимым
+	Skipped int `json:"skipped"`
+	// Unsupported - песни, формат аудио которых не декодируется, и песни без хеша содержимого
+	Unsupported int `json:"unsupported"`
+	// Failed - id песен, пики которых не удалось построить. Они будут обработаны при следующем запуске
+	Failed []int64 `json:"failed"`
+}
+
+// decodeWaveform строит пики по содержимому песни при загрузке, если их еще нет для этого содержимого.
+// Ошибки не прерывают загрузку: пики недекодируемой песни недоступны, остальные построит wave backfill
+func (s *Service) decodeWaveform(ctx context.Context, song *Song, content io.ReadSeeker) *waveform.Waveform {
+	if stored, err := s.waveformsStored(ctx, song); err != nil || stored {
+		if err != nil {
+			s.log.WithError(err).Warnf("failed to check waveform of song %s", song.Name)
+		}
+		return nil
+	}
+	peaks, err := readContent(content, song.Size, waveform.Decode)
+	if err != nil {
+		if errors.Is(err, waveform.ErrUnsupportedFormat) {
+			s.log.Debugf("No waveform for song %s: %v", song.Name, err)
+		} else {
+			s.log.WithError(err).Warnf("failed to decode audio of song %s for waveform", song.Name)
+		}
+		return nil
+	}
+
+	return peaks
+}
+
+// storeWaveforms сохраняет рядом с аудиофайлом все наборы пиков во всех форматах
+func (s *Service) storeWaveforms(ctx context.Context, song *Song, peaks *waveform.Waveform) error {
+	for _, resolution := range WaveformResolutions {
+		resampled := peaks.Resample(resolution)
+		for _, format := range WaveformFormats {
+			data, err := resampled.Encode(format)
+			if err != nil {
+				return err
+			}
+			if err = s.uploadLinked(ctx, song, waveformName(resolution, format), data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// waveformsStored сообщает, сохранены ли для аудиофайла песни все наборы пиков
+func (s *Service) waveformsStored(ctx context.Context, song *Song) (bool, error) {
+	linked, err := s.storage.ListLinked(ctx, song.Path)
+	if err != nil {
+		return false, err
+	}
+	for _, resolution := range WaveformResolutions {
+		for _, format := range WaveformFormats {
+			if !slices.Contains(linked, waveformName(resolution, format)) {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// GetWaveform возвращает набор пиков песни с resolution парами. Возвращает ErrorInvalidParam
+// для resolution не из WaveformResolutions и ErrNoWaveform, если пики не построены
+func (s *Service) GetWaveform(
+	ctx context.Context,
+	song *Song,
+	resolution int,
+	format waveform.Format,
+) (io.ReadCloser, int64, error) {
+	if !slices.Contains(WaveformResolutions, resolution) {
+		return nil, 0, ErrorInvalidParam{"resolution"}
+	}
+	name := waveformName(resolution, format)
+	exists, err := s.storage.IsLinkedExists(ctx, name, song.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !exists {
+		return nil, 0, ErrNoWaveform
+	}
+
+	return s.storage.Get(ctx, LinkedKey(song.Path, name))
+}
+
+// BackfillWaveforms строит пики для песен, загруженных до их появления или с ошибкой при построении.
+// Аудиофайл каждой такой песни читается из хранилища целиком, поэтому обход долгий
+func (s *Service) BackfillWaveforms(ctx context.Context) (*WaveformBackfillReport, error) {
+	songs, err := s.repo.ListSongs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &WaveformBackfillReport{Songs: len(songs), Failed: []int64{}}
+	// done - обработанное содержимое, одним файлом могут пользоваться несколько песен
+	done := make(map[string]bool)
+	for _, song := range songs {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		if song.Hash == "" {
+			report.Unsupported++
+			continue
+		}
+		if done[song.Hash] {
+			report.Skipped++
+			continue
+		}
+		done[song.Hash] = true
+		song.Path = ContentKey(song.Hash)
+		generated, err := s.backfillWaveform(ctx, song)
+		switch {
+		case errors.Is(err, waveform.ErrUnsupportedFormat):
+			report.Unsupported++
+		case err != nil:
+			s.log.WithError(err).Errorf("failed to build waveform of song %d", song.ID)
+			report.Failed = append(report.Failed, song.ID)
+		case generated:
+			report.Generated++
+		default:
+			report.Skipped++
+		}
+	}
+
+	return report, nil
+}
+
+// backfillWaveform строит недостающие пики песни по аудиофайлу в хранилище.
+// generated = false, если все пики уже были сохранены
+func (s *Service) backfillWaveform(ctx context.Context, song *Song) (generated bool, err error) {
+	stored, err := s.waveformsStored(ctx, song)
+	if err != nil || stored {
+		return false, err
+	}
+	spool, cleanup, err := s.spoolContent(ctx, song)
+	if err != nil {
+		return false, err
+	}
+	defer cleanup()
+	peaks, err := waveform.Decode(spool)
+	if err != nil {
+		return false, err
+	}
+	if err = s.storeWaveforms(ctx, song, peaks); err != nil {
+		return false, err
+	}
+	s.log.Infof("Built waveform of song %d", song.ID)
+
+	return true, nil
+}